@@ -1,15 +1,25 @@
 package pennybase
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
 	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestServerREST(t *testing.T) {
@@ -125,6 +135,19 @@ func TestServerREST(t *testing.T) {
 			auth:   [2]string{"admin", "admin123"},
 			status: http.StatusOK,
 		},
+		{
+			name:   "Delete deleted book",
+			method: http.MethodDelete,
+			path:   "/api/books/book2",
+			auth:   [2]string{"admin", "admin123"},
+			status: http.StatusNotFound,
+		},
+		{
+			name:   "Get deleted book",
+			method: http.MethodGet,
+			path:   "/api/books/book2",
+			status: http.StatusNotFound,
+		},
 
 		// Validation tests
 		{
@@ -133,7 +156,7 @@ func TestServerREST(t *testing.T) {
 			path:   "/api/books/",
 			body:   Resource{"title": "Book 123", "year": 3000},
 			auth:   [2]string{"user1", "user1pass"},
-			status: http.StatusInternalServerError,
+			status: http.StatusUnprocessableEntity,
 		},
 	}
 
@@ -193,3 +216,1206 @@ func TestServerStaticFiles(t *testing.T) {
 		t.Errorf("Static file serving failed: %v", gotBody)
 	}
 }
+
+func TestServerTemplatePreload(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "rest"))
+	s := must(NewServer(dir, filepath.Join(dir, "templates"), filepath.Join(dir, "static"))).T(t)
+	s.Preload = map[string][]string{"books.html": {"/static/app.css", "/static/app.js"}}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/books.html", nil))
+	want := []string{"</static/app.css>; rel=preload; as=style", "</static/app.js>; rel=preload; as=script"}
+	if got := w.Header().Values("Link"); !slices.Equal(got, want) {
+		t.Errorf("got Link headers %q, want %q", got, want)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/static/test.txt", nil))
+	if got := w.Header().Values("Link"); len(got) != 0 {
+		t.Errorf("got unexpected Link headers for static file: %q", got)
+	}
+}
+
+func TestServerSystemResources(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "rest"))
+	f := must(os.OpenFile(filepath.Join(dir, "_permissions.csv"), os.O_APPEND|os.O_WRONLY, 0)).T(t)
+	must(f.WriteString("p9,1,_permissions,*,,*,Misconfigured rule\np10,1,_users,*,,*,Misconfigured rule\n")).T(t)
+	must0(t, f.Close())
+	s := must(NewServer(dir, "", "")).T(t)
+	defer s.Store.Close()
+
+	do := func(method, path, body string, auth [2]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if auth[0] != "" {
+			req.SetBasicAuth(auth[0], auth[1])
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w
+	}
+	user1, admin := [2]string{"user1", "user1pass"}, [2]string{"admin", "admin123"}
+
+	grant := `{"resource":"books","action":"*","field":"","role":""}`
+	if w := do(http.MethodPost, "/api/_permissions/", grant, user1); w.Code != http.StatusUnauthorized {
+		t.Errorf("non-admin created a permission: %d %s", w.Code, w.Body)
+	}
+	if w := do(http.MethodPost, "/api/_users/", `{"username":"mallory","password":"x","roles":["admin"]}`, user1); w.Code != http.StatusUnauthorized {
+		t.Errorf("non-admin created a user: %d %s", w.Code, w.Body)
+	}
+	if w := do(http.MethodGet, "/api/_users/admin", "", user1); w.Code != http.StatusUnauthorized {
+		t.Errorf("non-admin read a user: %d %s", w.Code, w.Body)
+	}
+	if w := do(http.MethodPost, "/api/_permissions/", grant, admin); w.Code != http.StatusCreated {
+		t.Errorf("admin could not create a permission: %d %s", w.Code, w.Body)
+	}
+
+	// Users created through the API get a hashed password
+	if w := do(http.MethodPost, "/api/_users/", `{"username":"bob","password":"bobpass","roles":["editor"]}`, admin); w.Code != http.StatusCreated {
+		t.Fatalf("admin could not create a user: %d %s", w.Code, w.Body)
+	}
+	bob := must(s.Store.Get("_users", "bob")).T(t)
+	if bob["password"] == "bobpass" || !slices.Equal(bob["roles"].([]string), []string{"editor"}) {
+		t.Errorf("unexpected user record: %v", bob)
+	}
+	must(s.Store.AuthenticateBasic("bob", "bobpass")).T(t)
+
+	if w := do(http.MethodPut, "/api/_users/bob", `{"password":"newpass"}`, admin); w.Code != http.StatusOK {
+		t.Fatalf("admin could not update a user: %d %s", w.Code, w.Body)
+	}
+	must(s.Store.AuthenticateBasic("bob", "newpass")).T(t)
+}
+
+func TestServerUserView(t *testing.T) {
+	s := must(NewServer(testData(t, filepath.Join("testdata", "rest")), "", "")).T(t)
+	defer s.Store.Close()
+	must0(t, s.Store.insert(t.Context(), "_permissions", "p5", Resource{"resource": "_users", "action": "read", "role": "admin"}))
+	// A user signing in with another provider, written around the validation
+	must0(t, s.Store.Resources["_users"].Create(Record{"oauth1", "1", "", "", ""}))
+	get := func(path string) string {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.SetBasicAuth("admin", "admin123")
+		w := httptest.NewRecorder()
+		if s.ServeHTTP(w, req); w.Code != http.StatusOK {
+			t.Fatalf("%s: got status %d", path, w.Code)
+		}
+		return w.Body.String()
+	}
+	for _, hasPassword := range []bool{false, true} {
+		s.HasPassword = hasPassword
+		for _, body := range []string{get("/api/_users/admin"), get("/api/_users/oauth1"), get("/api/_users/"), get("/api/_users/stream")} {
+			if strings.Contains(body, `"password"`) || strings.Contains(body, "salt") || strings.Contains(body, "5V5R4SO4") {
+				t.Errorf("password leaked: %s", body)
+			}
+		}
+		var users []Resource
+		must0(t, json.Unmarshal([]byte(get("/api/_users/")), &users))
+		for _, u := range users {
+			want := any(nil)
+			if hasPassword {
+				want = u["_id"] != "oauth1"
+			}
+			if u["has_password"] != want {
+				t.Errorf("%v: got has_password %v, want %v", u["_id"], u["has_password"], want)
+			}
+		}
+	}
+	// The stored records are not changed
+	if u := must(s.Store.Get("_users", "admin")).T(t); u["password"] == "" || u["salt"] != "salt" {
+		t.Errorf("got %v", u)
+	}
+}
+
+func TestServerDefaultUser(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "authz"))
+	s := must(NewServer(dir, "", "")).T(t)
+	defer s.Store.Close()
+
+	for _, body := range []string{`{"title":"Mine"}`, `{"title":"Spoofed","owner":"bob"}`} {
+		req := httptest.NewRequest(http.MethodPost, "/api/books/", strings.NewReader(body))
+		req.SetBasicAuth("alice", "alicepass")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("got status %d: %s", w.Code, w.Body)
+		}
+		id := strings.TrimPrefix(w.Header().Get("Location"), "/api/books/")
+		if book := must(s.Store.Get("books", id)).T(t); book["owner"] != "alice" {
+			t.Errorf("%s: got owner %q, want alice", body, book["owner"])
+		}
+	}
+}
+
+func TestServerPartials(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "graphql"))
+	tmplDir := t.TempDir()
+	for name, body := range map[string]string{
+		"_books.html":      `<li>{{.Record.title}}</li>`,
+		"_books_list.html": `{{range .Records}}<li>{{.title}}</li>{{end}}`,
+		"_drafts.html":     `<p>{{.Record.title}}</p>`,
+	} {
+		must0(t, os.WriteFile(filepath.Join(tmplDir, name), []byte(body), 0644))
+	}
+	s := must(NewServer(dir, tmplDir, "")).T(t)
+	defer s.Store.Close()
+
+	tests := []struct {
+		path       string
+		auth       [2]string
+		wantStatus int
+		wantBody   string
+	}{
+		{"/partials/books/b3", [2]string{}, http.StatusOK, "<li>Solaris</li>"},
+		{"/partials/books/?sort_by=year", [2]string{}, http.StatusOK,
+			"<li>Solaris</li><li>A Wizard of Earthsea</li><li>The Left Hand of Darkness</li><li>The Dispossessed</li>"},
+		{"/partials/books/missing", [2]string{}, http.StatusNotFound, ""},
+		{"/partials/authors/a1", [2]string{}, http.StatusNotFound, ""},
+		{"/partials/drafts/d2", [2]string{}, http.StatusUnauthorized, ""},
+		{"/partials/drafts/d2", [2]string{"user1", "user1pass"}, http.StatusOK, "<p>User draft</p>"},
+		{"/partials/drafts/d1", [2]string{"user1", "user1pass"}, http.StatusUnauthorized, ""},
+		{"/_books.html", [2]string{}, http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		if tt.auth[0] != "" {
+			req.SetBasicAuth(tt.auth[0], tt.auth[1])
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s: got status %d, want %d", tt.path, w.Code, tt.wantStatus)
+		} else if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+			t.Errorf("%s: got body %q, want %q", tt.path, w.Body, tt.wantBody)
+		}
+	}
+}
+
+func TestServerStrictFields(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "authz"))
+	s := must(NewServer(dir, "", "")).T(t)
+	defer s.Store.Close()
+
+	tests := []struct {
+		strict     bool
+		method     string
+		path       string
+		body       string
+		wantStatus int
+		wantBody   string
+	}{
+		{false, http.MethodPost, "/api/books/", `{"title":"Lenient","titel":"typo"}`, http.StatusCreated, ""},
+		{true, http.MethodPost, "/api/books/", `{"title":"Strict","titel":"typo","pages":1}`, http.StatusBadRequest, "unknown fields: pages, titel"},
+		{true, http.MethodPost, "/api/books/", `{"_id":"b2","title":"Strict"}`, http.StatusCreated, ""},
+		{true, http.MethodPut, "/api/books/book123", `{"titel":"typo"}`, http.StatusBadRequest, "unknown fields: titel"},
+		{true, http.MethodPut, "/api/books/book123", `{"_v":1,"title":"Renamed","owner":"bob"}`, http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		s.Strict = tt.strict
+		req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		req.SetBasicAuth("alice", "alicepass")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s %s: got status %d, want %d: %s", tt.method, tt.body, w.Code, tt.wantStatus, w.Body)
+		} else if tt.wantBody != "" && strings.TrimSpace(w.Body.String()) != tt.wantBody {
+			t.Errorf("%s %s: got body %q, want %q", tt.method, tt.body, w.Body, tt.wantBody)
+		}
+	}
+}
+
+func TestServerMyResources(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "menu"))
+	s := must(NewServer(dir, "", "")).T(t)
+	defer s.Store.Close()
+	// Grant viewers read access to users, which still requires the admin role
+	must0(t, s.Store.insert(context.Background(), "_permissions", "p6", Resource{"resource": "_users", "action": "read", "role": "viewer"}))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/me/resources", nil)
+	req.SetBasicAuth("viewer", "viewerpass")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	var got []string
+	must0(t, json.NewDecoder(w.Body).Decode(&got))
+	if want := []string{"news", "reports"}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestServerSessionCookie(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "menu"))
+	s := must(NewServer(dir, "", "")).T(t)
+	defer s.Store.Close()
+	s.SessionCookie = "session_a"
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/api/login", strings.NewReader("username=viewer&password=viewerpass"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	s.ServeHTTP(w, req)
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "session_a" {
+		t.Fatalf("got cookies %v, want session_a", cookies)
+	}
+
+	for _, tt := range []struct {
+		cookie string
+		want   []string
+	}{
+		{"session_a", []string{"news", "reports"}},
+		{"session", []string{"news"}}, // another app's cookie is ignored
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/api/me/resources", nil)
+		req.AddCookie(&http.Cookie{Name: tt.cookie, Value: cookies[0].Value})
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		var got []string
+		must0(t, json.NewDecoder(w.Body).Decode(&got))
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.cookie, got, tt.want)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/logout", nil))
+	if cookies := w.Result().Cookies(); len(cookies) != 1 || cookies[0].Name != "session_a" || cookies[0].MaxAge >= 0 {
+		t.Errorf("logout: got cookies %v, want session_a removed", cookies)
+	}
+}
+
+func TestServerLoginRedirect(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "rest"))
+	s := must(NewServer(dir, "", "")).T(t)
+	defer s.Close()
+	for _, tt := range []struct {
+		form string
+		want string
+	}{
+		{"", "/"},
+		{"redirect=/books/book1", "/books/book1"},
+		{"next=%2Fbooks%3Fpage%3D2", "/books?page=2"},
+		{"redirect=/a&next=/b", "/a"},
+		{"redirect=books", "/"},
+		{"redirect=https://evil.example/", "/"},
+		{"redirect=//evil.example/", "/"},
+		{"redirect=/%5Cevil.example/", "/"},
+		{"redirect=/%09/evil.example/", "/"},
+		{"next=javascript:alert(1)", "/"},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/api/login", strings.NewReader("username=user1&password=user1pass&"+tt.form))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		if got := w.Header().Get("HX-Redirect"); w.Code != http.StatusOK || got != tt.want {
+			t.Errorf("%s: got status %d, redirect %q, want %q", tt.form, w.Code, got, tt.want)
+		}
+	}
+}
+
+func TestNewServerWithConfig(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "rest"))
+	cfg := DefaultConfig()
+	cfg.SessionCookie, cfg.SessionKey, cfg.SessionTTL = "app", "app-key", time.Hour
+	cfg.MaxBodySize = 64
+	s := must(NewServerWithConfig(cfg, dir, "", "")).T(t)
+	defer s.Store.Close()
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/api/login", strings.NewReader("username=user1&password=user1pass"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	s.ServeHTTP(w, req)
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "app" || cookies[0].MaxAge != 3600 {
+		t.Fatalf("got cookies %v", cookies)
+	}
+
+	for _, tt := range []struct {
+		name       string
+		session    string
+		body       string
+		wantStatus int
+	}{
+		{"configured key", cookies[0].Value, `{"title":"Short","author":"Me","year":2000}`, http.StatusCreated},
+		{"default key", SignSession("user1"), `{"title":"Short","author":"Me","year":2000}`, http.StatusUnauthorized},
+		{"body too large", cookies[0].Value, `{"title":"` + strings.Repeat("x", 64) + `","author":"Me"}`, http.StatusRequestEntityTooLarge},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/api/books/", strings.NewReader(tt.body))
+		req.AddCookie(&http.Cookie{Name: "app", Value: tt.session})
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s: got status %d, want %d: %s", tt.name, w.Code, tt.wantStatus, w.Body)
+		}
+	}
+}
+
+func TestServerMaxListItems(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "graphql"))
+	s := must(NewServer(dir, "", "")).T(t)
+	defer s.Store.Close()
+
+	for _, tt := range []struct {
+		max           int
+		wantLen       int
+		wantTruncated string
+	}{
+		{0, 4, ""},
+		{4, 4, ""},
+		{3, 3, "true"},
+	} {
+		s.MaxListItems = tt.max
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/books/?sort_by=year", nil))
+		var books []Resource
+		must0(t, json.NewDecoder(w.Body).Decode(&books))
+		if len(books) != tt.wantLen || w.Header().Get("X-Truncated") != tt.wantTruncated {
+			t.Errorf("max %d: got %d books, truncated %q", tt.max, len(books), w.Header().Get("X-Truncated"))
+		} else if books[0]["title"] != "Solaris" {
+			t.Errorf("max %d: got %v first", tt.max, books[0]["title"])
+		}
+	}
+}
+
+func TestServerListOrder(t *testing.T) {
+	s := must(NewServer(testData(t, filepath.Join("testdata", "graphql")), "", "")).T(t)
+	defer s.Store.Close()
+	for query, want := range map[string]string{
+		"?sort_by=year":             "b3,b2,b4,b1",
+		"?sort_by=-year":            "b1,b4,b2,b3",
+		"?sort_by=year&order=desc":  "b1,b4,b2,b3",
+		"?sort_by=-year&order=desc": "b1,b4,b2,b3",
+		"?sort_by=title&order=desc": "b4,b1,b3,b2",
+	} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/books/"+query, nil))
+		var books []Resource
+		must0(t, json.NewDecoder(w.Body).Decode(&books))
+		ids := []string{}
+		for _, b := range books {
+			ids = append(ids, b["_id"].(string))
+		}
+		if got := strings.Join(ids, ","); got != want {
+			t.Errorf("%s: got %s, want %s", query, got, want)
+		}
+	}
+}
+
+func TestServerListFilter(t *testing.T) {
+	s := must(NewServer(testData(t, filepath.Join("testdata", "rest")), "", "")).T(t)
+	defer s.Store.Close()
+	must0(t, s.Store.insert(t.Context(), "books", "book3", Resource{"title": "Animal Farm", "author": "George Orwell", "year": 1945.0, "tags": []string{"fiction"}}))
+	for _, tt := range []struct {
+		query      string
+		wantStatus int
+		want       string
+	}{
+		{"?author=George%20Orwell&sort_by=year", http.StatusOK, "book3,book2"},
+		{"?author=George%20Orwell&sort_by=year&order=desc", http.StatusOK, "book2,book3"},
+		{"?year=2015", http.StatusOK, "book1"},
+		{"?year=2015.0", http.StatusOK, "book1"},
+		{"?tags=fiction&sort_by=title", http.StatusOK, "book2,book3"},
+		{"?tags=fiction&year=1949", http.StatusOK, "book2"},
+		{"?author=Nobody", http.StatusOK, ""},
+		{"?sort_by=-title&limit=5&unknown=x", http.StatusOK, "book1,book3,book2"},
+		{"?year=recent", http.StatusBadRequest, ""},
+	} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/books/"+tt.query, nil))
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s: got status %d, want %d", tt.query, w.Code, tt.wantStatus)
+			continue
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		var books []Resource
+		must0(t, json.NewDecoder(w.Body).Decode(&books))
+		ids := []string{}
+		for _, b := range books {
+			ids = append(ids, b["_id"].(string))
+		}
+		if got := strings.Join(ids, ","); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.query, got, tt.want)
+		}
+	}
+	if _, err := s.Store.ListWhere("books", "", map[string]string{"publisher": "x"}); !errors.Is(err, ErrInvalidField) {
+		t.Errorf("got %v for an unknown field", err)
+	}
+}
+
+func TestServerListPaging(t *testing.T) {
+	s := must(NewServer(testData(t, filepath.Join("testdata", "graphql")), "", "")).T(t)
+	defer s.Store.Close()
+	for _, tt := range []struct {
+		query      string
+		wantStatus int
+		want       string
+	}{
+		{"?sort_by=year", http.StatusOK, "b3,b2,b4,b1"},
+		{"?sort_by=year&limit=0", http.StatusOK, "b3,b2,b4,b1"},
+		{"?sort_by=year&limit=2", http.StatusOK, "b3,b2"},
+		{"?sort_by=year&limit=2&offset=1", http.StatusOK, "b2,b4"},
+		{"?sort_by=-year&offset=3", http.StatusOK, "b3"},
+		{"?sort_by=year&offset=10", http.StatusOK, ""},
+		{"?offset=-1", http.StatusBadRequest, ""},
+		{"?limit=ten", http.StatusBadRequest, ""},
+	} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/books/"+tt.query, nil))
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s: got status %d, want %d", tt.query, w.Code, tt.wantStatus)
+			continue
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		var books []Resource
+		must0(t, json.NewDecoder(w.Body).Decode(&books))
+		ids := []string{}
+		for _, b := range books {
+			ids = append(ids, b["_id"].(string))
+		}
+		if got := strings.Join(ids, ","); got != tt.want || books == nil || w.Header().Get("X-Total-Count") != "4" {
+			t.Errorf("%s: got %q, total %q, want %q", tt.query, got, w.Header().Get("X-Total-Count"), tt.want)
+		}
+	}
+	books, total, err := s.Store.ListPage("books", "year", 1, 1)
+	if err != nil || total != 4 || len(books) != 1 || books[0]["_id"] != "b2" {
+		t.Errorf("got %v, total %d", books, total)
+	}
+}
+
+func TestServerListLinks(t *testing.T) {
+	s := must(NewServer(testData(t, filepath.Join("testdata", "graphql")), "", "")).T(t)
+	defer s.Store.Close()
+	for _, tt := range []struct {
+		query string
+		max   int
+		want  string
+	}{
+		{"?sort_by=year", 0, ""},
+		{"?sort_by=year&limit=1&offset=2", 0, `</api/books/?limit=1&offset=0&sort_by=year>; rel="first", ` +
+			`</api/books/?limit=1&offset=1&sort_by=year>; rel="prev", ` +
+			`</api/books/?limit=1&offset=3&sort_by=year>; rel="next", ` +
+			`</api/books/?limit=1&offset=3&sort_by=year>; rel="last"`},
+		{"?limit=3", 0, `</api/books/?limit=3&offset=0>; rel="first", ` +
+			`</api/books/?limit=3&offset=3>; rel="next", ` +
+			`</api/books/?limit=3&offset=3>; rel="last"`},
+		{"?limit=2&offset=3", 0, `</api/books/?limit=2&offset=0>; rel="first", ` +
+			`</api/books/?limit=2&offset=1>; rel="prev", ` +
+			`</api/books/?limit=2&offset=2>; rel="last"`},
+		{"?offset=1", 2, `</api/books/?limit=2&offset=0>; rel="first", ` +
+			`</api/books/?limit=2&offset=0>; rel="prev", ` +
+			`</api/books/?limit=2&offset=3>; rel="next", ` +
+			`</api/books/?limit=2&offset=2>; rel="last"`},
+	} {
+		s.MaxListItems = tt.max
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/books/"+tt.query, nil))
+		if got := w.Header().Get("Link"); w.Code != http.StatusOK || got != tt.want {
+			t.Errorf("%s: got status %d, links %s, want %s", tt.query, w.Code, got, tt.want)
+		}
+	}
+}
+
+func TestServerHandleAPI(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "authz"))
+	s := must(NewServer(dir, "", "")).T(t)
+	defer s.Store.Close()
+	must0(t, s.Store.insert(context.Background(), "_permissions", "p6", Resource{"resource": "books", "action": "archive", "field": "owner"}))
+	s.HandleAPI("POST /api/books/{id}/archive", "archive", func(w http.ResponseWriter, r *http.Request) {
+		book := Resource{"_id": r.PathValue("id"), "archived_by": CurrentUser(r)["_id"]}
+		s.Publish(w, "books", "archived", book)
+		WriteJSON(w, http.StatusOK, book)
+	})
+	events := make(chan Event, 10)
+	s.Broker.Subscribe("books", events)
+
+	for _, tt := range []struct {
+		user, password string
+		wantStatus     int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{"admin", "admin123", http.StatusUnauthorized}, // no matching permission row
+		{"bob", "bobpass", http.StatusOK},              // owner
+		{"alice", "alicepass", http.StatusOK},          // co-owner, allowed any action
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/api/books/book123/archive", nil)
+		if tt.user != "" {
+			req.SetBasicAuth(tt.user, tt.password)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		if w.Code != tt.wantStatus {
+			t.Errorf("%q: got status %d, want %d", tt.user, w.Code, tt.wantStatus)
+			continue
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		var got Resource
+		must0(t, json.NewDecoder(w.Body).Decode(&got))
+		if got["archived_by"] != tt.user || w.Header().Get("HX-Trigger") != "books-changed" {
+			t.Errorf("%q: got %v", tt.user, got)
+		}
+		if evt := <-events; evt.Action != "archived" || evt.ID != "book123" {
+			t.Errorf("%q: got event %+v", tt.user, evt)
+		}
+	}
+}
+
+func TestServerListCaching(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "graphql"))
+	s := must(NewServer(dir, "", "")).T(t)
+	defer s.Store.Close()
+
+	list := func(query string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/books/"+query, nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w
+	}
+	w := list("")
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" || w.Header().Get("Last-Modified") != "" {
+		t.Fatalf("got status %d, headers %v", w.Code, w.Header())
+	}
+	if w := list("", "If-None-Match", etag); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("got status %d, want 304", w.Code)
+	}
+	if w := list("?sort_by=year", "If-None-Match", etag); w.Code != http.StatusOK {
+		t.Errorf("got status %d for a different query, want 200", w.Code)
+	}
+
+	must(s.Store.Create("books", Resource{"title": "Fiasco", "author": "a2", "year": 1986.0})).T(t)
+	w = list("", "If-None-Match", etag)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Fatalf("got status %d, ETag %s after a change", w.Code, w.Header().Get("ETag"))
+	}
+	lastModified := w.Header().Get("Last-Modified")
+	if lastModified == "" {
+		t.Fatal("expected Last-Modified after a change")
+	}
+	if w := list("", "If-Modified-Since", lastModified); w.Code != http.StatusNotModified {
+		t.Errorf("got status %d, want 304", w.Code)
+	}
+}
+
+func TestBrokerFanOut(t *testing.T) {
+	b := &Broker{channels: map[string]map[chan Event]bool{}}
+	defer b.Close()
+	subs := make([]chan Event, 500)
+	for i := range subs {
+		subs[i] = make(chan Event, 3)
+		b.Subscribe("books", subs[i])
+	}
+	// A subscriber that is not ready yet still gets the events in time
+	slow := make(chan Event)
+	b.Subscribe("books", slow)
+
+	start := time.Now()
+	for i := range 3 {
+		b.Publish("books", Event{Action: "created", ID: strconv.Itoa(i)})
+	}
+	b.Publish("authors", Event{Action: "created"}) // no subscribers
+	if d := time.Since(start); d > slowSubscriber/2 {
+		t.Errorf("publishing took %v", d)
+	}
+	time.Sleep(10 * time.Millisecond)
+	for i := range 3 {
+		select {
+		case evt := <-slow:
+			if evt.ID != strconv.Itoa(i) {
+				t.Errorf("got event %+v, want %d", evt, i)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("event %d not delivered to the slow subscriber", i)
+		}
+	}
+	for _, ch := range subs {
+		for i := range 3 {
+			if evt := <-ch; evt.ID != strconv.Itoa(i) {
+				t.Fatalf("got event %+v, want %d", evt, i)
+			}
+		}
+	}
+}
+
+func TestServerEventsReplay(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "graphql"))
+	s := must(NewServer(dir, "", "")).T(t)
+	defer s.Store.Close()
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	seq := s.Store.ChangeSeq("books") // 4 records in the fixture
+	id := must(s.Store.Create("books", Resource{"title": "Fiasco", "author": "a2"})).T(t)
+	must0(t, s.Store.Update("books", Resource{"_id": id, "_v": 1.0, "title": "Fiasco (1986)", "author": "a2"}))
+	must0(t, s.Store.Delete("books", "b1"))
+
+	// events reads n events as "id event data" lines after connecting with the Last-Event-ID
+	events := func(lastID string, n int, publish func()) []string {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		req := must(http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/api/events/books", nil)).T(t)
+		req.Header.Set("Last-Event-ID", lastID)
+		req.SetBasicAuth("user1", "user1pass")
+		resp := must(http.DefaultClient.Do(req)).T(t)
+		defer resp.Body.Close()
+		if publish != nil {
+			publish()
+		}
+		got, evt := []string{}, []string{}
+		for sc := bufio.NewScanner(resp.Body); len(got) < n && sc.Scan(); {
+			if line := sc.Text(); line == "" {
+				got, evt = append(got, strings.Join(evt, " ")), nil
+			} else {
+				_, v, _ := strings.Cut(line, ": ")
+				evt = append(evt, v)
+			}
+		}
+		return got
+	}
+
+	want := []string{
+		fmt.Sprintf(`%d updated {"_id":"%s","_v":2,"author":"a2","title":"Fiasco (1986)","year":0}`, seq+2, id),
+		fmt.Sprintf(`%d deleted {"_id":"b1"}`, seq+3),
+		fmt.Sprintf(`%d created {"_id":"b9","_v":1,"title":"Fiasco"}`, seq+4),
+	}
+	got := events(fmt.Sprint(seq+1), 3, func() {
+		must(s.Store.Create("books", Resource{"_id": "b9", "title": "Fiasco", "author": "a2"})).T(t)
+		s.Publish(httptest.NewRecorder(), "books", "created", Resource{"_id": "b9", "_v": 1.0, "title": "Fiasco"})
+	})
+	if !slices.Equal(got, want) {
+		t.Errorf("got events:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// Changes that are no longer retained can't be replayed
+	s.Store.MaxChanges = 1
+	must0(t, s.Store.Delete("books", "b2"))
+	if got := events(fmt.Sprint(seq), 1, nil); len(got) != 1 || got[0] != fmt.Sprintf("%d reset {}", seq+5) {
+		t.Errorf("got %v, want a reset event", got)
+	}
+}
+
+func TestServerEventsReplayUsers(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "rest"))
+	f := must(os.OpenFile(filepath.Join(dir, "_permissions.csv"), os.O_APPEND|os.O_WRONLY, 0644)).T(t)
+	must(f.WriteString("p5,1,_users,read,,admin\n")).T(t)
+	must0(t, f.Close())
+	s := must(NewServer(dir, "", "")).T(t)
+	defer s.Store.Close()
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	seq := s.Store.ChangeSeq("_users")
+	must0(t, s.Store.CreateUser("alice", "alicepass", nil))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req := must(http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/api/events/_users", nil)).T(t)
+	req.Header.Set("Last-Event-ID", fmt.Sprint(seq))
+	req.SetBasicAuth("admin", "admin123")
+	resp := must(http.DefaultClient.Do(req)).T(t)
+	defer resp.Body.Close()
+	for sc := bufio.NewScanner(resp.Body); sc.Scan(); {
+		data, ok := strings.CutPrefix(sc.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var res Resource
+		must0(t, json.Unmarshal([]byte(data), &res))
+		if res["_id"] != "alice" {
+			t.Fatalf("got %v, want alice", res)
+		}
+		if _, ok := res["password"]; ok {
+			t.Errorf("password replayed: %v", res)
+		}
+		if _, ok := res["salt"]; ok {
+			t.Errorf("salt replayed: %v", res)
+		}
+		break
+	}
+}
+
+func TestServerEventsAdminOnly(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "rest"))
+	f := must(os.OpenFile(filepath.Join(dir, "_permissions.csv"), os.O_APPEND|os.O_WRONLY, 0644)).T(t)
+	must(f.WriteString("p5,1,_users,read,,*\n")).T(t)
+	must0(t, f.Close())
+	s := must(NewServer(dir, "", "")).T(t)
+	defer s.Store.Close()
+	seq := s.Store.ChangeSeq("_users")
+	must0(t, s.Store.CreateUser("alice", "alicepass", nil))
+	must0(t, s.Store.Delete("_users", "alice"))
+
+	for _, tt := range []struct {
+		user, password string
+		want           int
+	}{
+		{"user1", "user1pass", 0},
+		{"admin", "admin123", 2},
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		req := httptest.NewRequestWithContext(ctx, http.MethodGet, "/api/events/_users", nil)
+		req.Header.Set("Last-Event-ID", fmt.Sprint(seq))
+		req.SetBasicAuth(tt.user, tt.password)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		cancel()
+		if n := strings.Count(w.Body.String(), "data: "); n != tt.want {
+			t.Errorf("%s: got %d events, want %d: %s", tt.user, n, tt.want, w.Body)
+		}
+		user := must(s.Store.Get("_users", tt.user)).T(t)
+		authorize := s.templateData(req, user)["Authorize"].(func(string, string, string) bool)
+		if got := authorize("_users", "", "read"); got != (tt.want > 0) {
+			t.Errorf("%s: template Authorize got %v", tt.user, got)
+		}
+	}
+}
+
+func TestServerPathValidation(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "rest"))
+	s := must(NewServer(dir, "", "")).T(t)
+	defer s.Store.Close()
+
+	for _, tt := range []struct {
+		method, path string
+		wantStatus   int
+		wantParam    string
+	}{
+		{http.MethodGet, "/api/..%2f_users/", http.StatusBadRequest, "resource"},
+		{http.MethodGet, "/api/bo%20oks/book1", http.StatusBadRequest, "resource"},
+		{http.MethodGet, "/api/books/book%0A1", http.StatusBadRequest, "id"},
+		{http.MethodDelete, "/api/books/..%2fbook1", http.StatusBadRequest, "id"},
+		{http.MethodGet, "/api/books/book1", http.StatusOK, ""},
+		{http.MethodGet, "/api/books/no.such-book", http.StatusNotFound, ""}, // reaches the store
+	} {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		req.SetBasicAuth("admin", "admin123")
+		req.Header.Set("Accept", "application/json")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s %s: got %d, want %d", tt.method, tt.path, w.Code, tt.wantStatus)
+			continue
+		}
+		if tt.wantParam == "" {
+			continue
+		}
+		var resp errorResponse
+		must0(t, json.NewDecoder(w.Body).Decode(&resp))
+		if resp.Error.Code != "invalid_path" || resp.Error.Params["param"] != tt.wantParam {
+			t.Errorf("%s %s: got %+v", tt.method, tt.path, resp.Error)
+		}
+	}
+
+	// Any id is accepted without a pattern
+	s.IDPattern = nil
+	req := httptest.NewRequest(http.MethodGet, "/api/books/book%201", nil)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	if w.Code == http.StatusBadRequest {
+		t.Error("id rejected without an id pattern")
+	}
+}
+
+func TestServerGetBy(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "rest"))
+	f := must(os.OpenFile(filepath.Join(dir, "_schemas.csv"), os.O_APPEND|os.O_WRONLY, 0o644)).T(t)
+	must(f.WriteString("m1,1,members,_id,text,,,^.+$\nm2,1,members,_v,number,1,,\nm3,1,members,username,text,,,^[a-z]+$,\"trim,lower\"\nm4,1,members,team,text,,,\n")).T(t)
+	must0(t, f.Close())
+	must0(t, os.WriteFile(filepath.Join(dir, "members.csv"), []byte("u1,1,alice,red\nu2,1,bob,red\nu3,1,carol,blue\nu4,1,carol,blue\n"), 0o644))
+	f = must(os.OpenFile(filepath.Join(dir, "_permissions.csv"), os.O_APPEND|os.O_WRONLY, 0o644)).T(t)
+	must(f.WriteString("p9,1,members,read,,*,\n")).T(t)
+	must0(t, f.Close())
+	s := must(NewServer(dir, "", "")).T(t)
+	defer s.Store.Close()
+
+	if m := must(s.Store.GetBy("members", "username", " Alice")).T(t); m["_id"] != "u1" {
+		t.Errorf("got %v", m)
+	}
+	for _, tt := range []struct {
+		path, user string
+		wantStatus int
+		wantID     string
+	}{
+		{"/api/members/by/username/bob", "user1", http.StatusOK, "u2"},
+		{"/api/members/by/username/Bob", "user1", http.StatusOK, "u2"},
+		{"/api/members/by/username/dave", "user1", http.StatusNotFound, ""},
+		{"/api/members/by/username/bob", "", http.StatusUnauthorized, ""},
+		{"/api/members/by/username/dave", "", http.StatusUnauthorized, ""}, // no probing
+		{"/api/members/by/username/carol", "user1", http.StatusInternalServerError, ""},
+		{"/api/members/by/team/red", "user1", http.StatusInternalServerError, ""},
+		{"/api/members/by/nickname/bob", "user1", http.StatusInternalServerError, ""},
+	} {
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		if tt.user != "" {
+			req.SetBasicAuth(tt.user, tt.user+"pass")
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s: got status %d, want %d", tt.path, w.Code, tt.wantStatus)
+			continue
+		}
+		if tt.wantID != "" {
+			var m Resource
+			must0(t, json.NewDecoder(w.Body).Decode(&m))
+			if m["_id"] != tt.wantID {
+				t.Errorf("%s: got %v", tt.path, m)
+			}
+		}
+	}
+}
+
+func TestServerNoTrailingSlash(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "rest"))
+	s := must(NewServer(dir, "", "")).T(t)
+	defer s.Store.Close()
+
+	for _, tt := range []struct {
+		method, path, body string
+		wantStatus         int
+	}{
+		{http.MethodGet, "/api/books", "", http.StatusOK},
+		{http.MethodGet, "/api/books/", "", http.StatusOK},
+		{http.MethodPost, "/api/books", `{"title":"Book","author":"Me","year":2000}`, http.StatusCreated},
+		{http.MethodGet, "/api/books/book1", "", http.StatusOK},
+		{http.MethodGet, "/api/me/resources", "", http.StatusOK},
+	} {
+		req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		req.SetBasicAuth("user1", "user1pass")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s %s: got status %d, want %d", tt.method, tt.path, w.Code, tt.wantStatus)
+			continue
+		}
+		if tt.path == "/api/books" && tt.method == http.MethodGet {
+			var books []Resource
+			must0(t, json.NewDecoder(w.Body).Decode(&books))
+			if len(books) == 0 {
+				t.Error("got an empty list")
+			}
+		}
+	}
+}
+
+func TestServerTmpID(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "rest"))
+	s := must(NewServer(dir, "", "")).T(t)
+	defer s.Close()
+	s.Strict = true
+	events := make(chan Event, 1)
+	s.Broker.Subscribe("books", events)
+	defer s.Broker.Unsubscribe("books", events)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/books", strings.NewReader(`{"_tmp_id":"local-1","title":"Dune","author":"Frank Herbert","year":1965}`))
+	req.SetBasicAuth("user1", "user1pass")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	var resp map[string]string
+	must0(t, json.NewDecoder(w.Body).Decode(&resp))
+	if w.Code != http.StatusCreated || resp["_tmp_id"] != "local-1" || resp["_id"] == "" || w.Header().Get("Location") != "/api/books/"+resp["_id"] {
+		t.Fatalf("got status %d, body %v", w.Code, resp)
+	}
+	evt := <-events
+	if evt.ID != resp["_id"] || evt.Data["_id"] != resp["_id"] || evt.Data["_tmp_id"] != "local-1" {
+		t.Errorf("got event %+v", evt)
+	}
+	if book := must(s.Store.Get("books", resp["_id"])).T(t); book["_tmp_id"] != nil {
+		t.Errorf("temporary id stored: %v", book)
+	}
+
+	// Without a temporary id the response has no body
+	req = httptest.NewRequest(http.MethodPost, "/api/books", strings.NewReader(`{"title":"Emma","author":"Jane Austen","year":1915}`))
+	req.SetBasicAuth("user1", "user1pass")
+	w = httptest.NewRecorder()
+	if s.ServeHTTP(w, req); w.Code != http.StatusCreated || w.Body.Len() != 0 {
+		t.Errorf("got status %d, body %q", w.Code, w.Body.String())
+	}
+	if evt := <-events; evt.Data["_tmp_id"] != nil {
+		t.Errorf("got event %+v", evt)
+	}
+}
+
+func TestServerReloadSchemas(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "rest"))
+	s := must(NewServer(dir, "", "")).T(t)
+	defer s.Close()
+	f := must(os.OpenFile(filepath.Join(dir, "_schemas.csv"), os.O_APPEND|os.O_WRONLY, 0644)).T(t)
+	must(f.WriteString("s90,1,magazines,_id,text,,,^.+$\ns91,1,magazines,_v,number,1,,\ns92,1,magazines,name,text,,,\n")).T(t)
+	must0(t, f.Close())
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 20 {
+				req := httptest.NewRequest(http.MethodGet, "/api/books/?sort_by=title", nil)
+				w := httptest.NewRecorder()
+				s.ServeHTTP(w, req)
+				if w.Code != http.StatusOK {
+					t.Errorf("got status %d: %s", w.Code, w.Body)
+				}
+			}
+		}()
+	}
+	for range 5 {
+		must0(t, s.Store.ReloadSchemas())
+	}
+	wg.Wait()
+	if _, ok := s.Store.Resources["magazines"]; !ok {
+		t.Fatal("expected the new resource to be opened")
+	}
+	must(s.Store.Create("magazines", Resource{"name": "Wired"})).T(t)
+}
+
+func TestServerUpdateConflict(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "rest"))
+	f := must(os.OpenFile(filepath.Join(dir, "_permissions.csv"), os.O_APPEND|os.O_WRONLY, 0644)).T(t)
+	must(f.WriteString("p5,1,books,update,,admin\n")).T(t)
+	must0(t, f.Close())
+	s := must(NewServer(dir, "", "")).T(t)
+	defer s.Close()
+	put := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, "/api/books/book1", strings.NewReader(body))
+		req.SetBasicAuth("admin", "admin123")
+		req.Header.Set("Accept", "application/json")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w
+	}
+	// Two clients read version 1, the second update loses
+	if w := put(`{"_v":1,"title":"First"}`); w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	w := put(`{"_v":1,"title":"Second"}`)
+	var resp errorResponse
+	if must0(t, json.NewDecoder(w.Body).Decode(&resp)); w.Code != http.StatusConflict || resp.Error.Code != "version_conflict" || resp.Error.Params["version"] != "2" {
+		t.Errorf("got status %d, %+v", w.Code, resp)
+	}
+	if resp.Current["title"] != "First" || resp.Current["_v"] != 2.0 {
+		t.Errorf("got current %v", resp.Current)
+	}
+	if b := must(s.Store.Get("books", "book1")).T(t); b["title"] != "First" || b["_v"] != 2.0 {
+		t.Errorf("got %v", b)
+	}
+	// Without a version the update always applies
+	if w := put(`{"title":"Third"}`); w.Code != http.StatusOK {
+		t.Errorf("got status %d", w.Code)
+	}
+	err := s.Store.Update("books", Resource{"_id": "book1", "_v": 1.0, "title": "Stale"})
+	if !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("got %v", err)
+	}
+	// Racing updates of the same version, exactly one wins
+	for v := 3; v < 23; v++ {
+		codes := make([]int, 2)
+		var wg sync.WaitGroup
+		for i := range codes {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				codes[i] = put(fmt.Sprintf(`{"_v":%d,"title":"Racer %d"}`, v, i)).Code
+			}()
+		}
+		wg.Wait()
+		slices.Sort(codes)
+		if codes[0] != http.StatusOK || codes[1] != http.StatusConflict {
+			t.Fatalf("version %d: got statuses %v", v, codes)
+		}
+	}
+}
+
+func TestServerKnownOnly(t *testing.T) {
+	s := must(NewServer(testData(t, filepath.Join("testdata", "rest")), "", "")).T(t)
+	defer s.Close()
+	handled := false
+	s.HandleAPI("PATCH /api/{resource}/{id}/poke", "poke", func(w http.ResponseWriter, r *http.Request) { handled = true })
+
+	for _, known := range []bool{false, true} {
+		s.KnownOnly = known
+		for _, tt := range []struct{ method, path string }{
+			{http.MethodGet, "/api/boks/"},
+			{http.MethodPost, "/api/boks"},
+			{http.MethodPut, "/api/boks/book1"},
+			{http.MethodPatch, "/api/boks/book1/poke"},
+			{http.MethodGet, "/api/boks/by/title/1984"},
+		} {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader("{}"))
+			req.Header.Set("Accept", "application/json")
+			s.ServeHTTP(w, req)
+			// Without KnownOnly, anonymous users are refused by the
+			// authorization, which runs first
+			want := http.StatusUnauthorized
+			if known {
+				want = http.StatusNotFound
+			}
+			if w.Code != want {
+				t.Errorf("%v %s %s: got status %d, want %d: %s", known, tt.method, tt.path, w.Code, want, w.Body)
+			}
+			var resp errorResponse
+			if known && (json.Unmarshal(w.Body.Bytes(), &resp) != nil || resp.Error.Code != "resource_not_found") {
+				t.Errorf("%s %s: got %s", tt.method, tt.path, w.Body)
+			}
+		}
+	}
+	if handled {
+		t.Error("handler ran for an unknown resource")
+	}
+
+	// Known resources are authorized as usual
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/books/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("got status %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestServerListFlatten(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "rest"))
+	for file, rows := range map[string]string{
+		"_schemas.csv":     "d1,1,docs,_id,text,,,^.+$\nd2,1,docs,_v,number,1,,\nd3,1,docs,metadata,text,,,,flatten=title|author.name|missing\n",
+		"_permissions.csv": "p9,1,docs,read,,,\n",
+	} {
+		f := must(os.OpenFile(filepath.Join(dir, file), os.O_APPEND|os.O_WRONLY, 0644)).T(t)
+		must(f.WriteString(rows)).T(t)
+		must0(t, f.Close())
+	}
+	s := must(NewServer(dir, "", "")).T(t)
+	defer s.Close()
+	metadata := `{"title":"Report","author":{"name":"Ann","email":"ann@example.com"},"pages":[1,2,3]}`
+	id := must(s.Store.Create("docs", Resource{"metadata": metadata})).T(t)
+	must(s.Store.Create("docs", Resource{})).T(t)
+	if _, err := s.Store.Create("docs", Resource{"metadata": "{not json"}); !errors.Is(err, ErrInvalidField) {
+		t.Errorf("got %v for invalid JSON", err)
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/docs/", nil))
+	var list []Resource
+	must0(t, json.NewDecoder(w.Body).Decode(&list))
+	want := []Resource{
+		{"_id": id, "_v": 1.0, "metadata.title": "Report", "metadata.author.name": "Ann"},
+		{"_v": 1.0},
+	}
+	if len(list) != 2 {
+		t.Fatalf("got %v", list)
+	}
+	if list[0]["_id"] != id {
+		list[0], list[1] = list[1], list[0]
+	}
+	want[1]["_id"] = list[1]["_id"]
+	if !reflect.DeepEqual(list, want) {
+		t.Errorf("got %v, want %v", list, want)
+	}
+
+	// Single records have the whole value
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/docs/"+id, nil))
+	var doc Resource
+	must0(t, json.NewDecoder(w.Body).Decode(&doc))
+	if doc["metadata"] != metadata {
+		t.Errorf("got %v", doc)
+	}
+
+	field := FieldSchema{Resource: "docs", Field: "tags", Type: List}
+	if err := field.parseOptions("flatten=a"); err == nil {
+		t.Error("expected flatten option to require text")
+	}
+}
+
+func TestServerAfterHook(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "rest"))
+	f := must(os.OpenFile(filepath.Join(dir, "_permissions.csv"), os.O_APPEND|os.O_WRONLY, 0644)).T(t)
+	must(f.WriteString("p5,1,books,update,,admin\n")).T(t)
+	must0(t, f.Close())
+	s := must(NewServer(dir, "", "")).T(t)
+	defer s.Close()
+	var calls []string
+	s.Hook = func(trigger, resource string, user, r Resource) error {
+		if r["title"] == "Rejected" {
+			return errors.New("rejected")
+		}
+		return nil
+	}
+	s.AfterHook = func(trigger, resource string, user, r Resource) error {
+		calls = append(calls, fmt.Sprintf("%s %s/%v v%v %v by %v", trigger, resource, r["_id"], r["_v"], r["title"], user["_id"]))
+		return errors.New("ignored")
+	}
+	defer func(id func() string) { ID = id }(ID)
+	ID = func() string { return "book3" }
+	do := func(method, path, body string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.SetBasicAuth("admin", "admin123")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w.Code
+	}
+	for _, tt := range []struct {
+		method, path, body string
+		want               int
+	}{
+		{"POST", "/api/books/", `{"title":"Rejected","author":"Nobody","year":2000}`, http.StatusInternalServerError},
+		{"POST", "/api/books/", `{"title":"Dune","author":"Frank Herbert","year":1965}`, http.StatusCreated},
+		{"PUT", "/api/books/book3", `{"title":"Dune Messiah"}`, http.StatusOK},
+		{"PUT", "/api/books/book3", `{"year":1800}`, http.StatusUnprocessableEntity},
+		{"DELETE", "/api/books/book3", "", http.StatusOK},
+	} {
+		if code := do(tt.method, tt.path, tt.body); code != tt.want {
+			t.Errorf("%s %s: got status %d, want %d", tt.method, tt.path, code, tt.want)
+		}
+	}
+	want := []string{
+		"create books/book3 v1 Dune by admin",
+		"update books/book3 v2 Dune Messiah by admin",
+		"delete books/book3 v2 Dune Messiah by admin",
+	}
+	if !slices.Equal(calls, want) {
+		t.Errorf("got calls %q, want %q", calls, want)
+	}
+}
+
+func TestServerBool(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "rest"))
+	f := must(os.OpenFile(filepath.Join(dir, "_schemas.csv"), os.O_APPEND|os.O_WRONLY, 0644)).T(t)
+	must(f.WriteString("s19,1,books,available,bool,,,\n")).T(t)
+	must0(t, f.Close())
+	// Rows written before the field was added have it empty
+	books := must(os.ReadFile(filepath.Join(dir, "books.csv"))).T(t)
+	must0(t, os.WriteFile(filepath.Join(dir, "books.csv"), bytes.ReplaceAll(books, []byte("\n"), []byte(",\n")), 0644))
+	s := must(NewServer(dir, "", "")).T(t)
+	defer s.Close()
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.SetBasicAuth("user1", "user1pass")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w
+	}
+	get := func(id string) map[string]any {
+		w := do(http.MethodGet, "/api/books/"+id, "")
+		var res map[string]any
+		must0(t, json.NewDecoder(w.Body).Decode(&res))
+		return res
+	}
+	if v, ok := get("book1")["available"]; v != false || !ok {
+		t.Errorf("old row: got %#v", v)
+	}
+	defer func(id func() string) { ID = id }(ID)
+	ID = func() string { return "book3" }
+	if w := do(http.MethodPost, "/api/books/", `{"title":"Dune","author":"Frank Herbert","year":1965,"available":true}`); w.Code != http.StatusCreated {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	if v := get("book3")["available"]; v != true {
+		t.Errorf("created: got %#v", v)
+	}
+	if w := do(http.MethodPost, "/api/books/", `{"title":"Dune","author":"Frank Herbert","year":1965,"available":"yes"}`); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("string for a bool: got status %d", w.Code)
+	}
+	if raw := must(os.ReadFile(filepath.Join(dir, "books.csv"))).T(t); !bytes.Contains(raw, []byte("book3,1,Dune,Frank Herbert,1965,,true\n")) {
+		t.Errorf("stored %s", raw)
+	}
+}
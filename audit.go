@@ -0,0 +1,140 @@
+package pennybase
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"maps"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Severity of an audit finding.
+const (
+	SeverityHigh   = "high"
+	SeverityMedium = "medium"
+	SeverityLow    = "low"
+)
+
+// Finding is a risky setting reported by Audit.
+type Finding struct {
+	Check    string `json:"check"`
+	Severity string `json:"severity"`
+	Resource string `json:"resource,omitempty"`
+	Message  string `json:"message"`
+}
+
+// initialSessionKey is the random SessionKey of the process, which changes on
+// every restart.
+var initialSessionKey = SessionKey
+
+// Audit checks the schemas and permissions for risky settings: invalid
+// regexes, weak _id patterns, writes open to anonymous users, system
+// resources readable by non-admins and resources without permission rows.
+// Findings are sorted by severity.
+func (s *Store) Audit() []Finding {
+	return sortFindings(s.audit(context.Background()))
+}
+
+func (s *Store) audit(ctx context.Context) []Finding {
+	findings := []Finding{}
+	for _, resource := range slices.Sorted(maps.Keys(s.Schemas)) {
+		for _, field := range s.Schemas[resource] {
+			if _, err := regexp.Compile(field.Regex); err != nil {
+				findings = append(findings, Finding{"invalid_regex", SeverityHigh, resource,
+					fmt.Sprintf("regex of field %s does not compile: %v", field.Field, err)})
+			} else if field.Field == "_id" {
+				findings = append(findings, auditID(resource, field.Regex)...)
+			}
+		}
+	}
+	permissions, err := s.list(ctx, "_permissions", "")
+	if err != nil {
+		return append(findings, Finding{"permissions", SeverityHigh, "_permissions", err.Error()})
+	}
+	protected := map[string]bool{}
+	for _, p := range permissions {
+		resource, _ := p["resource"].(string)
+		action, _ := p["action"].(string)
+		field, _ := p["field"].(string)
+		role, _ := p["role"].(string)
+		protected[resource] = true
+		public := field == "" && role == ""
+		switch {
+		case public && action != "read":
+			findings = append(findings, Finding{"anonymous_write", SeverityHigh, resource,
+				fmt.Sprintf("permission %s lets anonymous users %s records", p["_id"], action)})
+		case strings.HasPrefix(resource, "_") && (public || role == "*"):
+			findings = append(findings, Finding{"system_resource", SeverityHigh, resource,
+				fmt.Sprintf("permission %s grants %s to non-admin users, Store.Authorize honors it", p["_id"], action)})
+		}
+	}
+	for _, resource := range slices.Sorted(maps.Keys(s.Schemas)) {
+		if !strings.HasPrefix(resource, "_") && !protected[resource] {
+			findings = append(findings, Finding{"no_permissions", SeverityLow, resource,
+				"no permission rows, the resource is not accessible via the API"})
+		}
+	}
+	return findings
+}
+
+// auditID reports _id regexes accepting empty ids, slashes or control
+// characters.
+func auditID(resource, regex string) []Finding {
+	re := regexp.MustCompile(regex)
+	if regex == "" || re.MatchString("") {
+		return []Finding{{"weak_id", SeverityMedium, resource, "the _id regex accepts empty ids"}}
+	}
+	for _, id := range []string{"a/b", "a\tb", "a\x00b"} {
+		if re.MatchString(id) {
+			return []Finding{{"weak_id", SeverityLow, resource,
+				fmt.Sprintf("the _id regex %q accepts slashes or control characters", regex)}}
+		}
+	}
+	return nil
+}
+
+// Audit is Store.Audit plus checks of the server configuration: a session key
+// that changes on every restart and session cookies without the Secure flag.
+func (s *Server) Audit() []Finding {
+	return sortFindings(s.audit(context.Background(), false))
+}
+
+// audit reports missing Secure cookies as high severity if the server is
+// known to be reached over https.
+func (s *Server) audit(ctx context.Context, https bool) []Finding {
+	findings := s.Store.audit(ctx)
+	if cmp.Or(s.SessionKey, SessionKey) == initialSessionKey {
+		findings = append(findings, Finding{"session_key", SeverityMedium, "",
+			"SessionKey is random, sessions end on restart and can't be shared between servers"})
+	}
+	if !s.SecureCookie {
+		severity := SeverityMedium
+		if https {
+			severity = SeverityHigh
+		}
+		findings = append(findings, Finding{"insecure_cookie", severity, "",
+			"session cookies lack the Secure flag, set SecureCookie when serving over https"})
+	}
+	return findings
+}
+
+func sortFindings(findings []Finding) []Finding {
+	rank := map[string]int{SeverityHigh: 0, SeverityMedium: 1, SeverityLow: 2}
+	slices.SortStableFunc(findings, func(a, b Finding) int { return cmp.Compare(rank[a.Severity], rank[b.Severity]) })
+	return findings
+}
+
+// handleAudit reports the findings of Server.Audit to admins. Requests
+// received over TLS or forwarded from https make missing Secure cookies a
+// high severity finding.
+func (s *Server) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if !hasRole(CurrentUser(r), s.AdminRole) {
+		s.WriteError(w, r, http.StatusUnauthorized, newError("admin_required"))
+		return
+	}
+	https := r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+	WriteJSON(w, http.StatusOK, sortFindings(s.audit(r.Context(), https)))
+}
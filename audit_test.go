@@ -0,0 +1,128 @@
+package pennybase
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+const auditSchemas = `s1,1,_permissions,_id,text,,,^[a-z0-9]+$
+s2,1,_permissions,_v,number,1,,
+s3,1,_permissions,resource,text,,,^.+$
+s4,1,_permissions,action,text,,,^.+$
+s5,1,_permissions,field,text,,,
+s6,1,_permissions,role,text,,,
+s7,1,notes,_v,number,1,,
+s8,1,notes,owner,text,,,
+`
+
+const auditPermissions = `p1,1,notes,read,,,
+p2,1,notes,*,owner,,
+`
+
+func auditStore(t *testing.T, schemas, permissions string) *Store {
+	t.Helper()
+	mem := NewMemStorage()
+	for name, data := range map[string]string{"_schemas.csv": schemas, "_permissions.csv": permissions} {
+		f := must(mem.Open(name)).T(t)
+		must(f.Write([]byte(data))).T(t)
+		must0(t, f.Close())
+	}
+	return must(NewStore("", WithStorage(mem))).T(t)
+}
+
+func TestStoreAudit(t *testing.T) {
+	const id = "s0,1,notes,_id,text,,,"
+	for _, tt := range []struct {
+		name, schemas, permissions string
+		wantCheck, wantSeverity    string
+	}{
+		{"clean", auditSchemas + id + "^[a-z0-9-]+$\n", auditPermissions, "", ""},
+		{"empty id", auditSchemas + id + "^.*$\n", auditPermissions, "weak_id", SeverityMedium},
+		{"slashes in id", auditSchemas + id + "^.+$\n", auditPermissions, "weak_id", SeverityLow},
+		{"anonymous write", auditSchemas + id + "^[a-z0-9-]+$\n", auditPermissions + "p3,1,notes,*,,,\n", "anonymous_write", SeverityHigh},
+		{"system resource", auditSchemas + id + "^[a-z0-9-]+$\n", auditPermissions + "p3,1,_permissions,read,,*\n", "system_resource", SeverityHigh},
+		{"no permissions", auditSchemas + id + "^[a-z0-9-]+$\n", "", "no_permissions", SeverityLow},
+	} {
+		s := auditStore(t, tt.schemas, tt.permissions)
+		findings := s.Audit()
+		if tt.wantCheck == "" {
+			if len(findings) != 0 {
+				t.Errorf("%s: got %+v", tt.name, findings)
+			}
+		} else if len(findings) != 1 || findings[0].Check != tt.wantCheck || findings[0].Severity != tt.wantSeverity {
+			t.Errorf("%s: got %+v, want %s %s", tt.name, findings, tt.wantSeverity, tt.wantCheck)
+		}
+		must0(t, s.Close())
+	}
+
+	// Invalid regexes fail to load, schemas changed in Go are still checked
+	invalid := auditSchemas + id + "^[a-z0-9-]+$\ns9,1,notes,title,text,,,^(.+$\n"
+	mem := NewMemStorage()
+	f := must(mem.Open("_schemas.csv")).T(t)
+	must(f.Write([]byte(invalid))).T(t)
+	if _, err := NewStore("", WithStorage(mem)); err == nil {
+		t.Error("expected an invalid regex to fail")
+	}
+	s := auditStore(t, auditSchemas+id+"^[a-z0-9-]+$\n", auditPermissions)
+	defer s.Close()
+	s.Schemas["notes"] = append(s.Schemas["notes"], FieldSchema{Resource: "notes", Field: "title", Type: Text, Regex: "^(.+$"})
+	if findings := s.Audit(); len(findings) != 1 || findings[0].Check != "invalid_regex" || findings[0].Severity != SeverityHigh {
+		t.Errorf("got %+v", findings)
+	}
+}
+
+func TestServerAudit(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "rest"))
+	s := must(NewServer(dir, "", "")).T(t)
+	defer s.Close()
+
+	checks := func(findings []Finding) []string {
+		names := []string{}
+		for _, f := range findings {
+			if f.Resource == "" {
+				names = append(names, f.Check+":"+f.Severity)
+			}
+		}
+		return names
+	}
+	if got := checks(s.Audit()); !slices.Equal(got, []string{"session_key:medium", "insecure_cookie:medium"}) {
+		t.Errorf("got %v", got)
+	}
+
+	for _, tt := range []struct {
+		user, password, proto string
+		wantStatus            int
+		want                  []string
+	}{
+		{"user1", "user1pass", "", http.StatusUnauthorized, nil},
+		{"admin", "admin123", "", http.StatusOK, []string{"session_key:medium", "insecure_cookie:medium"}},
+		{"admin", "admin123", "https", http.StatusOK, []string{"insecure_cookie:high", "session_key:medium"}},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/api/_audit", nil)
+		req.SetBasicAuth(tt.user, tt.password)
+		req.Header.Set("X-Forwarded-Proto", tt.proto)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s %s: got status %d, want %d", tt.user, tt.proto, w.Code, tt.wantStatus)
+			continue
+		}
+		if tt.want == nil {
+			continue
+		}
+		var findings []Finding
+		must0(t, json.NewDecoder(w.Body).Decode(&findings))
+		if got := checks(findings); !slices.Equal(got, tt.want) {
+			t.Errorf("%s %s: got %v, want %v", tt.user, tt.proto, got, tt.want)
+		}
+	}
+
+	s.SessionKey, s.SecureCookie = "configured", true
+	if got := checks(s.Audit()); len(got) != 0 {
+		t.Errorf("got %v with a session key and secure cookies", got)
+	}
+}
@@ -3,6 +3,7 @@ package pennybase
 import (
 	"errors"
 	"path/filepath"
+	"slices"
 	"testing"
 )
 
@@ -107,3 +108,78 @@ func TestAuthorization(t *testing.T) {
 		})
 	}
 }
+
+func TestAccessibleResources(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "menu"))
+	store := must(NewStore(dir)).T(t)
+	defer store.Close()
+
+	tests := []struct {
+		username, password string
+		want               []string
+	}{
+		{"", "", []string{"news"}},
+		{"bob", "bobpass", []string{"news"}},
+		{"viewer", "viewerpass", []string{"news", "reports"}},
+		{"admin", "admin123", []string{"_users", "audits", "news"}},
+	}
+	for _, tt := range tests {
+		u, _ := store.AuthenticateBasic(tt.username, tt.password)
+		if got := store.AccessibleResources(u); !slices.Equal(got, tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.username, got, tt.want)
+		}
+	}
+}
+
+func TestAddPermission(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "authz"))
+	store := must(NewStore(dir)).T(t)
+	defer store.Close()
+
+	bob := must(store.AuthenticateBasic("bob", "bobpass")).T(t)
+	if err := store.Authorize("books", "", "create", bob); err == nil {
+		t.Fatal("expected bob not to be able to create books")
+	}
+	must0(t, store.AddPermission("books", "create", "", "*"))
+	if err := store.Authorize("books", "", "create", bob); err != nil {
+		t.Errorf("expected bob to be able to create books: %v", err)
+	}
+	must0(t, store.AddPermission("books", "delete", "owner", ""))
+	if err := store.Authorize("books", "book123", "delete", bob); err != nil {
+		t.Errorf("expected owner bob to be able to delete book123: %v", err)
+	}
+
+	for _, tt := range []struct{ resource, action, field string }{
+		{"movies", "read", ""},
+		{"books", "publish", ""},
+		{"books", "read", "author"},
+	} {
+		if err := store.AddPermission(tt.resource, tt.action, tt.field, ""); err == nil {
+			t.Errorf("%v: expected an error", tt)
+		}
+	}
+}
+
+func TestAuthorizeOwnerRole(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "authz"))
+	store := must(NewStore(dir)).T(t)
+	defer store.Close()
+	must0(t, store.CreateUser("carol", "carolpass", nil))
+	// A single row lets owners (by the "user" option field) delete their books
+	must0(t, store.AddPermission("books", "delete", "", "@owner"))
+
+	bob := must(store.AuthenticateBasic("bob", "bobpass")).T(t)
+	carol := must(store.AuthenticateBasic("carol", "carolpass")).T(t)
+	if err := store.Authorize("books", "book123", "delete", bob); err != nil {
+		t.Errorf("expected owner to be authorized: %v", err)
+	}
+	if err := store.Authorize("books", "book123", "delete", carol); err == nil {
+		t.Error("expected a stranger not to be authorized")
+	}
+	if err := store.Authorize("books", "", "delete", bob); err == nil {
+		t.Error("expected @owner not to apply without a record")
+	}
+	if err := store.AddPermission("_users", "read", "", "@owner"); err == nil {
+		t.Error("expected an error for a resource without owner fields")
+	}
+}
@@ -0,0 +1,122 @@
+package pennybase
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// CreateBatch creates records in a resource as a single operation (see Batch)
+// and returns their ids in the same order. Either all of them are created or
+// none is.
+func (s *Store) CreateBatch(resource string, rs []Resource) ([]string, error) {
+	return s.createBatch(context.Background(), resource, rs, nil)
+}
+
+func (s *Store) createBatch(ctx context.Context, resource string, rs []Resource, user Resource) ([]string, error) {
+	if _, ok := s.Schemas[resource]; !ok {
+		return nil, newError("resource_not_found", "resource", resource)
+	}
+	ids, writes := make([]string, len(rs)), make([]Write, len(rs))
+	for i, r := range rs {
+		s.preset(resource, r, user)
+		ids[i] = s.normalizeID(resource, ID())
+		r["_id"], r["_v"] = ids[i], 1.0
+		if err := s.checkRefs(ctx, resource, r, nil); err != nil {
+			return nil, err
+		}
+		writes[i] = Write{Resource: resource, Action: "create", Data: r}
+	}
+	s.slugMu.Lock()
+	defer s.slugMu.Unlock()
+	if err := s.batch(ctx, "create", writes); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// BatchResult is the outcome of creating one record of a best-effort batch:
+// its index in the request and either its id or the error.
+type BatchResult struct {
+	Index int    `json:"index"`
+	ID    string `json:"id,omitempty"`
+	Code  string `json:"code,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// handleBatch creates the records of a JSON array. By default the batch is
+// atomic and responds with the ids of the records. With ?mode=besteffort
+// every record is created on its own and the response is 207 Multi-Status
+// with a BatchResult per record.
+func (s *Server) handleBatch(w http.ResponseWriter, r *http.Request) {
+	var items []Resource
+	if err := json.NewDecoder(r.Body).Decode(&items); err != nil {
+		s.WriteError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	for i := range items {
+		if items[i] == nil {
+			items[i] = Resource{}
+		}
+	}
+	resource := r.PathValue("resource")
+	if resource == "_users" {
+		s.WriteError(w, r, http.StatusBadRequest, newError("batch_unsupported", "resource", resource))
+		return
+	}
+	switch r.URL.Query().Get("mode") {
+	case "", "atomic":
+	case "besteffort":
+		s.createEach(w, r, resource, items)
+		return
+	default:
+		s.WriteError(w, r, http.StatusBadRequest, newError("invalid_batch_mode"))
+		return
+	}
+	for _, res := range items {
+		if !s.checkFields(w, r, resource, res) {
+			return
+		}
+	}
+	for _, res := range items {
+		if err := s.hook(r.Context(), "create", resource, res); err != nil {
+			s.WriteError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	ids, err := s.Store.createBatch(r.Context(), resource, items, CurrentUser(r))
+	if err != nil {
+		s.WriteError(w, r, errorStatus(err), err)
+		return
+	}
+	for _, res := range items {
+		s.Publish(w, resource, "created", res)
+		s.afterHook(r.Context(), "create", resource, res)
+	}
+	WriteJSON(w, http.StatusCreated, ids)
+}
+
+func (s *Server) createEach(w http.ResponseWriter, r *http.Request, resource string, items []Resource) {
+	results := make([]BatchResult, len(items))
+	for i, res := range items {
+		results[i].Index = i
+		err := s.unknownFields(resource, res)
+		if err == nil {
+			err = s.hook(r.Context(), "create", resource, res)
+		}
+		if err == nil {
+			results[i].ID, err = s.Store.create(r.Context(), resource, res, CurrentUser(r))
+		}
+		if err != nil {
+			results[i].Error = err.Error()
+			if e := (*Error)(nil); errors.As(err, &e) {
+				results[i].Code, results[i].Error = e.Code, s.catalog(r).Format(e)
+			}
+			continue
+		}
+		s.Publish(w, resource, "created", res)
+		s.afterHook(r.Context(), "create", resource, res)
+	}
+	WriteJSON(w, http.StatusMultiStatus, results)
+}
@@ -0,0 +1,62 @@
+package pennybase
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestServerBatchCreate(t *testing.T) {
+	s := must(NewServer(testData(t, filepath.Join("testdata", "rest")), "", "")).T(t)
+	defer s.Store.Close()
+	batch := func(query, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/api/books/_batch"+query, strings.NewReader(body))
+		req.SetBasicAuth("user1", "user1pass")
+		s.ServeHTTP(w, req)
+		return w
+	}
+	const items = `[{"title":"Dune","author":"Frank Herbert","year":1965},{"title":"","author":"Nobody","year":2000},{"title":"Emma","author":"Jane Austen","year":1900}]`
+	count := func() int { return len(must(s.Store.List("books", "")).T(t)) }
+	before := count()
+
+	// Atomic by default: nothing is created if a record is invalid
+	if w := batch("", items); w.Code != http.StatusUnprocessableEntity || count() != before {
+		t.Errorf("atomic: got status %d and %d books, want %d books", w.Code, count(), before)
+	}
+
+	w := batch("?mode=besteffort", items)
+	if w.Code != http.StatusMultiStatus {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	var results []BatchResult
+	must0(t, json.NewDecoder(w.Body).Decode(&results))
+	if len(results) != 3 || count() != before+2 {
+		t.Fatalf("got %+v and %d books", results, count())
+	}
+	for i, r := range results {
+		if failed := i == 1; r.Index != i || (r.ID == "") != failed || (r.Error != "") != failed {
+			t.Errorf("got %+v for item %d", r, i)
+		}
+	}
+	if results[1].Code != "invalid_field" {
+		t.Errorf("got code %q", results[1].Code)
+	}
+	if b := must(s.Store.Get("books", results[2].ID)).T(t); b["title"] != "Emma" {
+		t.Errorf("got %v", b)
+	}
+
+	w = batch("?mode=atomic", `[{"title":"A","author":"B","year":1950},{"title":"C","author":"D","year":1960}]`)
+	var ids []string
+	if w.Code != http.StatusCreated || json.NewDecoder(w.Body).Decode(&ids) != nil || len(ids) != 2 || count() != before+4 {
+		t.Errorf("got status %d, ids %v and %d books", w.Code, ids, count())
+	}
+	for _, query := range []string{"?mode=sometimes", "?mode=besteffort&x"} {
+		if w := batch(query, `{}`); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d", query, w.Code)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package pennybase
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Blobs are large payloads of a record kept outside of the CSV files, one file
+// per record, field and payload. The field (a text field with the "blob"
+// option) holds only a reference: the size and the SHA-256 of the payload,
+// e.g. "1048576:9f86d0...". Blob fields can't be set by creates and updates.
+
+// blobPrefix returns the prefix of the names of the files holding the blobs
+// of a record field. It is derived from a hash, so that ids can't escape the
+// storage namespace.
+func blobPrefix(resource, id, field string) string {
+	sum := sha256.Sum256([]byte(resource + "\x00" + id + "\x00" + field))
+	return "_blob_" + hex.EncodeToString(sum[:16]) + "_"
+}
+
+// blobFile returns the name of the file holding the blob with the given
+// checksum. Every payload has its own file, so that a reference never points
+// to the bytes of another one.
+func blobFile(resource, id, field, sum string) string {
+	return blobPrefix(resource, id, field) + sum
+}
+
+// parseBlobRef returns the size and the checksum of a blob reference.
+func parseBlobRef(ref string) (int64, string, bool) {
+	size, sum, ok := strings.Cut(ref, ":")
+	n, err := strconv.ParseInt(size, 10, 64)
+	return n, sum, ok && err == nil
+}
+
+// checkBlobField checks that the resource has a blob field with this name.
+func (s *Store) checkBlobField(resource, field string) error {
+	if _, ok := s.Schemas[resource]; !ok {
+		return newError("resource_not_found", "resource", resource)
+	}
+	for _, f := range s.Schemas[resource] {
+		if f.Field == field && f.Blob {
+			return nil
+		}
+	}
+	return newError("invalid_field", "field", field)
+}
+
+// PutBlob streams the payload of a blob field of an existing record to the
+// storage, replacing the previous one, and stores its reference in the record
+// as a new version. The previous payload is removed once the record is
+// written, and the new one if it can't be. It returns the number of bytes
+// written.
+func (s *Store) PutBlob(resource, id, field string, r io.Reader) (int64, error) {
+	return s.putBlob(context.Background(), resource, id, field, r)
+}
+
+func (s *Store) putBlob(ctx context.Context, resource, id, field string, r io.Reader) (n int64, err error) {
+	ctx, end := s.span(ctx, "store.put_blob", Attr{"resource", resource}, Attr{"id", id}, Attr{"field", field})
+	defer func() { end(err) }()
+	done, err := s.enter()
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+	if err := s.checkBlobField(resource, field); err != nil {
+		return 0, err
+	}
+	orig, err := s.get(ctx, resource, id)
+	if err != nil {
+		return 0, err
+	} else if orig == nil {
+		return 0, newError("record_not_found")
+	}
+	id = orig["_id"].(string)
+	// Write to a temporary file first, so that readers never see a partial blob
+	tmp := blobPrefix(resource, id, field) + rand.Text() + ".tmp"
+	f, err := s.Storage.Open(tmp)
+	if err != nil {
+		return 0, err
+	}
+	h := sha256.New()
+	n, err = io.Copy(io.MultiWriter(f, h), r)
+	if err == nil {
+		if f, ok := f.(interface{ Sync() error }); ok {
+			err = f.Sync()
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	name := blobFile(resource, id, field, sum)
+	if err == nil {
+		err = s.Storage.Rename(tmp, name)
+	}
+	if err != nil {
+		_ = s.Storage.Remove(tmp)
+		return 0, err
+	}
+	// Puts are serialized from here, and readers wait until the reference and
+	// the files agree again
+	s.blobMu.Lock()
+	defer s.blobMu.Unlock()
+	old, rec, err := s.swapBlobRef(ctx, resource, id, field, fmt.Sprintf("%d:%s", n, sum))
+	if err != nil {
+		if old != name {
+			_ = s.Storage.Remove(name) // the record still refers to the old payload
+		}
+		return 0, err
+	}
+	if old != "" && old != name {
+		_ = s.Storage.Remove(old)
+	}
+	return n, s.committed(resource, rec)
+}
+
+// swapBlobRef writes a new version of a record with a new blob reference. It
+// returns the file of the previous blob, if any, and the written record.
+func (s *Store) swapBlobRef(ctx context.Context, resource, id, field, ref string) (string, Record, error) {
+	res, err := s.get(ctx, resource, id)
+	if err != nil {
+		return "", nil, err
+	} else if res == nil {
+		return "", nil, newError("record_not_found")
+	}
+	var old string
+	if _, sum, ok := parseBlobRef(fmt.Sprint(res[field])); ok {
+		old = blobFile(resource, id, field, sum)
+	}
+	res[field], res["_v"] = ref, res["_v"].(float64)+1
+	rec, err := s.record(resource, res, res)
+	if err == nil {
+		err = s.Resources[resource].Update(rec)
+	}
+	return old, rec, err
+}
+
+// GetBlob streams the payload of a blob field to w and returns its size. It
+// fails with a record_not_found error if no blob was put.
+func (s *Store) GetBlob(resource, id, field string, w io.Writer) (int64, error) {
+	return s.getBlob(context.Background(), resource, id, field, w)
+}
+
+func (s *Store) getBlob(ctx context.Context, resource, id, field string, w io.Writer) (n int64, err error) {
+	ctx, end := s.span(ctx, "store.get_blob", Attr{"resource", resource}, Attr{"id", id}, Attr{"field", field})
+	defer func() { end(err) }()
+	done, err := s.enter()
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+	// The file is opened before a put can replace it, see putBlob
+	s.blobMu.RLock()
+	size, sum, err := s.blobRef(ctx, resource, id, field)
+	var f File
+	if err == nil {
+		f, err = s.Storage.Open(blobFile(resource, s.normalizeID(resource, id), field, sum))
+	}
+	s.blobMu.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if n, err = io.Copy(w, io.NewSectionReader(f, 0, size)); err == nil && n != size {
+		err = fmt.Errorf("blob %s/%s/%s has %d of %d bytes", resource, id, field, n, size)
+	}
+	return n, err
+}
+
+// blobRef returns the size and the checksum of a blob from the reference in
+// its record.
+func (s *Store) blobRef(ctx context.Context, resource, id, field string) (int64, string, error) {
+	if err := s.checkBlobField(resource, field); err != nil {
+		return 0, "", err
+	}
+	res, err := s.get(ctx, resource, id)
+	if err != nil {
+		return 0, "", err
+	}
+	ref, _ := res[field].(string)
+	size, sum, ok := parseBlobRef(ref)
+	if res == nil || !ok {
+		return 0, "", newError("record_not_found")
+	}
+	return size, sum, nil
+}
+
+// removeBlobs removes the blobs of a deleted record.
+func (s *Store) removeBlobs(resource, id string) {
+	var prefixes []string
+	for _, f := range s.Schemas[resource] {
+		if f.Blob {
+			prefixes = append(prefixes, blobPrefix(resource, id, f.Field))
+		}
+	}
+	if len(prefixes) == 0 {
+		return
+	}
+	names, _ := s.Storage.List()
+	for _, name := range names {
+		if slices.ContainsFunc(prefixes, func(p string) bool { return strings.HasPrefix(name, p) }) {
+			_ = s.Storage.Remove(name)
+		}
+	}
+}
+
+// handleBlob streams blobs in and out: GET /blobs/{resource}/{id}/{field}
+// requires "read" permission on the record, PUT requires "update".
+func (s *Server) handleBlob(w http.ResponseWriter, r *http.Request) {
+	resource, id, field := r.PathValue("resource"), r.PathValue("id"), r.PathValue("field")
+	if r.Method == http.MethodPut {
+		n, err := s.Store.putBlob(r.Context(), resource, id, field, r.Body)
+		if err != nil {
+			s.WriteError(w, r, errorStatus(err), err)
+			return
+		}
+		WriteJSON(w, http.StatusOK, map[string]int64{"size": n})
+		return
+	}
+	size, _, err := s.Store.blobRef(r.Context(), resource, id, field)
+	if err != nil {
+		s.WriteError(w, r, errorStatus(err), err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	_, _ = s.Store.getBlob(r.Context(), resource, id, field, w)
+}
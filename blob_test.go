@@ -0,0 +1,208 @@
+package pennybase
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const blobSchemas = `s19,1,docs,_id,text,,,^.+$
+s20,1,docs,_v,number,1,,
+s21,1,docs,owner,text,,,
+s22,1,docs,content,text,,,,blob
+`
+
+const blobPermissions = `p5,1,docs,read,owner,
+p6,1,docs,update,owner,
+`
+
+func blobData(t *testing.T) string {
+	t.Helper()
+	dir := testData(t, filepath.Join("testdata", "rest"))
+	for name, data := range map[string]string{"_schemas.csv": blobSchemas, "_permissions.csv": blobPermissions} {
+		f := must(os.OpenFile(filepath.Join(dir, name), os.O_APPEND|os.O_WRONLY, 0644)).T(t)
+		must(f.WriteString(data)).T(t)
+		must0(t, f.Close())
+	}
+	return dir
+}
+
+func TestStoreBlob(t *testing.T) {
+	s := must(NewStore(blobData(t))).T(t)
+	defer s.Close()
+
+	id := must(s.Create("docs", Resource{"owner": "user1", "content": "ignored"})).T(t)
+	if _, err := s.GetBlob("docs", id, "content", io.Discard); err == nil {
+		t.Error("expected an error before the blob is put")
+	}
+
+	// Stream 5MB in and out without holding them in memory
+	const size = 5 << 20
+	in := sha256.New()
+	n := must(s.PutBlob("docs", id, "content", io.TeeReader(io.LimitReader(rand.Reader, size), in))).T(t)
+	out := sha256.New()
+	if m := must(s.GetBlob("docs", id, "content", out)).T(t); n != size || m != size {
+		t.Errorf("put %d bytes, got %d, want %d", n, m, size)
+	}
+	if !bytes.Equal(in.Sum(nil), out.Sum(nil)) {
+		t.Error("checksums differ")
+	}
+	want := fmt.Sprintf("%d:%x", size, in.Sum(nil))
+	if doc := must(s.Get("docs", id)).T(t); doc["content"] != want || doc["_v"] != 2.0 {
+		t.Errorf("got %v, want content %s", doc, want)
+	}
+
+	// Blob references can't be changed by updates
+	must0(t, s.Update("docs", Resource{"_id": id, "content": "forged"}))
+	if doc := must(s.Get("docs", id)).T(t); doc["content"] != want {
+		t.Errorf("got content %v after update", doc["content"])
+	}
+
+	// A smaller blob replaces the previous one
+	must(s.PutBlob("docs", id, "content", bytes.NewBufferString("hello"))).T(t)
+	var buf bytes.Buffer
+	if must(s.GetBlob("docs", id, "content", &buf)).T(t); buf.String() != "hello" {
+		t.Errorf("got %q", buf.String())
+	}
+
+	for _, tt := range []struct{ resource, id, field string }{
+		{"docs", "missing", "content"},
+		{"docs", id, "owner"},
+		{"movies", id, "content"},
+	} {
+		if _, err := s.PutBlob(tt.resource, tt.id, tt.field, bytes.NewBufferString("x")); err == nil {
+			t.Errorf("%s/%s/%s: expected an error", tt.resource, tt.id, tt.field)
+		}
+	}
+
+	if files := blobFiles(t, s, id); len(files) != 1 {
+		t.Errorf("got blob files %v, want only the last one", files)
+	}
+	must0(t, s.Delete("docs", id))
+	if files := blobFiles(t, s, id); len(files) != 0 {
+		t.Errorf("blob files %v were not removed", files)
+	}
+}
+
+// blobFiles returns the files of the content blobs of a document.
+func blobFiles(t *testing.T, s *Store, id string) []string {
+	t.Helper()
+	names := must(s.Storage.List()).T(t)
+	return slices.DeleteFunc(names, func(name string) bool { return !strings.HasPrefix(name, blobPrefix("docs", id, "content")) })
+}
+
+func TestStoreBlobConcurrentPuts(t *testing.T) {
+	s := must(NewStore(blobData(t))).T(t)
+	defer s.Close()
+	id := must(s.Create("docs", Resource{"owner": "user1"})).T(t)
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = s.PutBlob("docs", id, "content", strings.NewReader(strings.Repeat(strconv.Itoa(i), 1000*(i+1))))
+		}()
+	}
+	wg.Wait()
+	var buf bytes.Buffer
+	must(s.GetBlob("docs", id, "content", &buf)).T(t)
+	doc := must(s.Get("docs", id)).T(t)
+	if want := fmt.Sprintf("%d:%x", buf.Len(), sha256.Sum256(buf.Bytes())); doc["content"] != want {
+		t.Errorf("got reference %v for payload %s", doc["content"], want)
+	}
+	if files := blobFiles(t, s, id); len(files) != 1 {
+		t.Errorf("got blob files %v, want one", files)
+	}
+
+	// A put that can't update the record keeps the previous payload
+	db := s.Resources["docs"]
+	s.Resources["docs"] = conflictDB{db}
+	if _, err := s.PutBlob("docs", id, "content", strings.NewReader("lost")); !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("got %v, want a version conflict", err)
+	}
+	s.Resources["docs"] = db
+	var after bytes.Buffer
+	if must(s.GetBlob("docs", id, "content", &after)).T(t); after.String() != buf.String() {
+		t.Errorf("got %d bytes after a failed put, want %d", after.Len(), buf.Len())
+	}
+	if files := blobFiles(t, s, id); len(files) != 1 {
+		t.Errorf("got blob files %v after a failed put, want one", files)
+	}
+}
+
+// conflictDB fails all updates with a version conflict.
+type conflictDB struct{ DB }
+
+func (conflictDB) Update(Record) error { return newError("version_conflict") }
+
+func TestServerBlob(t *testing.T) {
+	dir := blobData(t)
+	f := must(os.OpenFile(filepath.Join(dir, "_permissions.csv"), os.O_APPEND|os.O_WRONLY, 0644)).T(t)
+	must(f.WriteString("p7,1,docs,read,,admin\np8,1,docs,update,,admin\n")).T(t)
+	must0(t, f.Close())
+	s := must(NewServer(dir, "", "")).T(t)
+	defer s.Close()
+	id := must(s.Store.Create("docs", Resource{"owner": "user1"})).T(t)
+	path := "/blobs/docs/" + id + "/content"
+
+	const size = 3 << 20
+	data := make([]byte, size)
+	must(rand.Read(data)).T(t)
+	for _, tt := range []struct {
+		method, user, password string
+		wantStatus             int
+	}{
+		{http.MethodPut, "", "", http.StatusUnauthorized},
+		{http.MethodPut, "user1", "user1pass", http.StatusOK},
+		{http.MethodGet, "", "", http.StatusUnauthorized},
+		{http.MethodGet, "user1", "user1pass", http.StatusOK},
+	} {
+		req := httptest.NewRequest(tt.method, path, bytes.NewReader(data))
+		if tt.user != "" {
+			req.SetBasicAuth(tt.user, tt.password)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s %q: got status %d, want %d", tt.method, tt.user, w.Code, tt.wantStatus)
+			continue
+		}
+		if tt.method == http.MethodGet && w.Code == http.StatusOK {
+			if got := w.Header().Get("Content-Length"); got != strconv.Itoa(size) {
+				t.Errorf("got Content-Length %s", got)
+			}
+			if sha256.Sum256(w.Body.Bytes()) != sha256.Sum256(data) {
+				t.Error("checksums differ")
+			}
+		}
+	}
+
+	for _, tt := range []struct {
+		method, path string
+		want         int
+	}{
+		{http.MethodGet, "/blobs/docs/" + id + "/owner", http.StatusUnprocessableEntity},
+		{http.MethodPut, "/blobs/docs/" + id + "/owner", http.StatusUnprocessableEntity},
+		{http.MethodGet, "/blobs/docs/missing/content", http.StatusNotFound},
+		{http.MethodPut, "/blobs/docs/missing/content", http.StatusNotFound},
+	} {
+		req := httptest.NewRequest(tt.method, tt.path, strings.NewReader("x"))
+		req.SetBasicAuth("admin", "admin123")
+		w := httptest.NewRecorder()
+		if s.ServeHTTP(w, req); w.Code != tt.want {
+			t.Errorf("%s %s: got status %d, want %d", tt.method, tt.path, w.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package pennybase
+
+import (
+	"context"
+	"maps"
+	"slices"
+)
+
+// cascade returns the writes that deleting a record cascades to through ref
+// fields: the deletes of the records referring to it with a "cascade" field,
+// recursively, and the updates clearing the "setnull" fields of the remaining
+// ones. It fails if a "restrict" field of a remaining record refers to a
+// deleted one. Deletes carry the deleted record.
+func (s *Store) cascade(ctx context.Context, resource, id string) ([]Write, error) {
+	type referrer struct {
+		field FieldSchema
+		rec   Resource
+	}
+	writes, referrers := []Write{}, []referrer{}
+	deleted := map[string]bool{resource + "/" + id: true}
+	for queue := []Write{{Resource: resource, Data: Resource{"_id": id}}}; len(queue) > 0; queue = queue[1:] {
+		target, targetID := queue[0].Resource, queue[0].Data["_id"].(string)
+		for _, dep := range slices.Sorted(maps.Keys(s.Schemas)) {
+			for _, field := range s.Schemas[dep] {
+				if field.Type != Reference || field.Target != target || field.OnDelete == "" {
+					continue
+				}
+				recs, err := s.listWhere(ctx, dep, "", map[string]string{field.Field: targetID})
+				if err != nil {
+					return nil, err
+				}
+				for _, rec := range recs {
+					key := dep + "/" + rec["_id"].(string)
+					if field.OnDelete != "cascade" {
+						referrers = append(referrers, referrer{field, rec})
+					} else if !deleted[key] {
+						deleted[key] = true
+						writes = append(writes, Write{Resource: dep, Action: "delete", Data: rec})
+						queue = append(queue, writes[len(writes)-1])
+					}
+				}
+			}
+		}
+	}
+	updates := map[string]Resource{}
+	for _, r := range referrers {
+		refID := r.rec["_id"].(string)
+		key := r.field.Resource + "/" + refID
+		if deleted[key] {
+			continue
+		}
+		if r.field.OnDelete == "restrict" {
+			return nil, newError("record_referenced", "resource", r.field.Resource, "id", refID)
+		}
+		if updates[key] == nil {
+			updates[key] = Resource{"_id": refID}
+			writes = append(writes, Write{Resource: r.field.Resource, Action: "update", Data: updates[key]})
+		}
+		updates[key][r.field.Field] = ""
+	}
+	return writes, nil
+}
+
+// deleteCascaded deletes a record and applies the writes its deletion
+// cascades to as a single operation. The data of the updates is replaced with
+// the updated records.
+func (s *Store) deleteCascaded(ctx context.Context, resource, id string, cascaded []Write) error {
+	writes := append([]Write{{Resource: resource, Action: "delete", Data: Resource{"_id": id}}}, cascaded...)
+	if err := s.batch(ctx, "delete", writes); err != nil {
+		return err
+	}
+	s.removeBlobs(resource, id)
+	for i, w := range cascaded {
+		if w.Action == "delete" {
+			s.removeBlobs(w.Resource, w.Data["_id"].(string))
+		} else if rec, err := s.get(ctx, w.Resource, w.Data["_id"].(string)); err == nil {
+			cascaded[i].Data = rec
+		}
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package pennybase
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeleteCascade(t *testing.T) {
+	for _, tt := range []struct {
+		option     string
+		wantStatus int
+		wantAuthor any      // of the book referring to the deleted author, nil if deleted
+		wantEvents []string // sorted, resources are published independently
+	}{
+		{"cascade", http.StatusOK, nil, []string{"authors deleted a2", "books deleted b3"}},
+		{"restrict", http.StatusConflict, "a2", nil},
+		{"setnull", http.StatusOK, "", []string{"authors deleted a2", "books updated b3"}},
+	} {
+		t.Run(tt.option, func(t *testing.T) {
+			dir := testData(t, filepath.Join("testdata", "graphql"))
+			schemas := filepath.Join(dir, "_schemas.csv")
+			data := strings.Replace(string(must(os.ReadFile(schemas)).T(t)), "books,author,text,,,", "books,author,ref,,,authors,"+tt.option, 1)
+			must0(t, os.WriteFile(schemas, []byte(data), 0644))
+			s := must(NewServer(dir, "", "")).T(t)
+			defer s.Close()
+			must0(t, s.Store.insert(context.Background(), "_permissions", "p4", Resource{"resource": "authors", "action": "delete", "role": "admin"}))
+			events := make(chan Event, 10)
+			s.Broker.Subscribe("books", events)
+			s.Broker.Subscribe("authors", events)
+
+			req := httptest.NewRequest(http.MethodDelete, "/api/authors/a2", nil)
+			req.SetBasicAuth("admin", "admin123")
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, req)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d: %s", w.Code, w.Body)
+			}
+			book, err := s.Store.Get("books", "b3")
+			if tt.wantAuthor == nil && !errors.Is(err, ErrRecordNotFound) {
+				t.Errorf("got %v, %v for a cascaded delete", book, err)
+			} else if tt.wantAuthor != nil && (err != nil || book["author"] != tt.wantAuthor) {
+				t.Errorf("got %v, %v, want author %q", book, err, tt.wantAuthor)
+			}
+			if n := must(s.Store.Count("books")).T(t); n != 4 && tt.option != "cascade" || n != 3 && tt.option == "cascade" {
+				t.Errorf("got %d books", n)
+			}
+
+			got := []string{}
+			for range tt.wantEvents {
+				select {
+				case evt := <-events:
+					got = append(got, strings.Join([]string{map[byte]string{'a': "authors", 'b': "books"}[evt.ID[0]], evt.Action, evt.ID}, " "))
+				case <-time.After(time.Second):
+					t.Fatalf("got events %v, want %v", got, tt.wantEvents)
+				}
+			}
+			if slices.Sort(got); !slices.Equal(got, tt.wantEvents) {
+				t.Errorf("got events %v, want %v", got, tt.wantEvents)
+			}
+		})
+	}
+}
+
+func TestDeleteCascadeRecursive(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "graphql"))
+	schemas := filepath.Join(dir, "_schemas.csv")
+	data := strings.Replace(string(must(os.ReadFile(schemas)).T(t)), "books,author,text,,,", "books,author,ref,,,authors,cascade", 1)
+	data += "s24,1,reviews,_id,text,,,^.+$\ns25,1,reviews,_v,number,1,,\ns26,1,reviews,book,ref,,,books,cascade\ns27,1,reviews,pick,ref,,,books,setnull\n"
+	must0(t, os.WriteFile(schemas, []byte(data), 0644))
+	s := must(NewStore(dir)).T(t)
+	defer s.Close()
+	r1 := must(s.Create("reviews", Resource{"book": "b3"})).T(t)
+	r2 := must(s.Create("reviews", Resource{"book": "b1", "pick": "b3"})).T(t)
+
+	must0(t, s.Delete("authors", "a2"))
+	if _, err := s.Get("reviews", r1); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("got %v for the review of a deleted book", err)
+	}
+	if r := must(s.Get("reviews", r2)).T(t); r["book"] != "b1" || r["pick"] != "" || r["_v"] != 2.0 {
+		t.Errorf("got %v", r)
+	}
+	if err := s.Delete("authors", "a9"); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("got %v for a missing author", err)
+	}
+}
+
+func TestDeleteCascadeCycles(t *testing.T) {
+	open := func(schemas string) *Store {
+		mem := NewMemStorage()
+		f := must(mem.Open("_schemas.csv")).T(t)
+		must(f.Write([]byte(schemas))).T(t)
+		must0(t, f.Close())
+		return must(NewStore("", WithStorage(mem))).T(t)
+	}
+	create := func(s *Store, resource, id string, rec Resource) {
+		must0(t, s.insert(context.Background(), resource, id, rec))
+	}
+	// deleteOnce deletes the record and checks that the deletion cascades to
+	// each of the wanted records exactly once, and that nothing else is left.
+	deleteOnce := func(s *Store, resource, id string, want []string, left map[string]int) {
+		t.Helper()
+		var writes []Write
+		done := make(chan error)
+		go func() {
+			var err error
+			if writes, err = s.cascade(context.Background(), resource, id); err != nil {
+				done <- err
+				return
+			}
+			done <- s.Delete(resource, id)
+		}()
+		select {
+		case err := <-done:
+			must0(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("deleting %s/%s did not terminate", resource, id)
+		}
+		got := []string{}
+		for _, w := range writes {
+			got = append(got, w.Action+" "+w.Resource+"/"+w.Data["_id"].(string))
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("deleting %s/%s cascades to %v, want %v", resource, id, got, want)
+		}
+		for resource, n := range left {
+			if got := must(s.Count(resource)).T(t); got != n {
+				t.Errorf("got %d %s left, want %d", got, resource, n)
+			}
+		}
+	}
+
+	t.Run("mutual", func(t *testing.T) {
+		// a and b refer to each other with cascade fields
+		s := open("a1,1,a,_id,text,,,^.+$\na2,1,a,_v,number,1,,\na3,1,a,b,ref,,,b,cascade\n" +
+			"b1,1,b,_id,text,,,^.+$\nb2,1,b,_v,number,1,,\nb3,1,b,a,ref,,,a,cascade\n")
+		defer s.Close()
+		create(s, "a", "a1", Resource{"b": ""})
+		create(s, "b", "b1", Resource{"a": "a1"})
+		must0(t, s.Update("a", Resource{"_id": "a1", "b": "b1"}))
+		create(s, "a", "a2", Resource{"b": "b1"})
+		create(s, "b", "b2", Resource{"a": "a2"})
+		create(s, "a", "a3", Resource{"b": ""})
+		deleteOnce(s, "a", "a1", []string{"delete b/b1", "delete a/a2", "delete b/b2"}, map[string]int{"a": 1, "b": 0})
+	})
+
+	t.Run("self", func(t *testing.T) {
+		// nodes refer to their parent node, a node can be its own parent
+		s := open("n1,1,nodes,_id,text,,,^.+$\nn2,1,nodes,_v,number,1,,\nn3,1,nodes,parent,ref,,,nodes,cascade\n")
+		defer s.Close()
+		create(s, "nodes", "root", Resource{"parent": ""})
+		must0(t, s.Update("nodes", Resource{"_id": "root", "parent": "root"}))
+		create(s, "nodes", "n1", Resource{"parent": "root"})
+		create(s, "nodes", "n2", Resource{"parent": "n1"})
+		create(s, "nodes", "n3", Resource{"parent": "root"})
+		create(s, "nodes", "other", Resource{"parent": ""})
+		deleteOnce(s, "nodes", "root", []string{"delete nodes/n1", "delete nodes/n3", "delete nodes/n2"}, map[string]int{"nodes": 1})
+	})
+}
+
+func TestSchemaOnDeleteOption(t *testing.T) {
+	field := FieldSchema{Resource: "books", Field: "title", Type: Text}
+	if err := field.parseOptions("cascade"); err == nil {
+		t.Error("expected an error for a cascade text field")
+	}
+	field.Type = Reference
+	must0(t, field.parseOptions("setnull"))
+	if field.OnDelete != "setnull" {
+		t.Errorf("got %q", field.OnDelete)
+	}
+}
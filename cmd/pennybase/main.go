@@ -1,32 +1,112 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/zserge/pennybase"
 )
 
+// config reads the server settings from the environment.
+func config() pennybase.Config {
+	cfg := pennybase.DefaultConfig()
+	if salt := os.Getenv("SALT"); salt != "" {
+		cfg.SessionKey = salt
+	}
+	cfg.SecureCookie = os.Getenv("SECURE_COOKIE") != ""
+	return cfg
+}
+
+// audit prints the findings of Server.Audit for the data directory and
+// returns 1 if any of them is of high severity.
+func audit(dataDir string) int {
+	server, err := pennybase.NewServerWithConfig(config(), dataDir, "", "")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer server.Close()
+	code := 0
+	for _, f := range server.Audit() {
+		fmt.Printf("%-6s %-16s %-12s %s\n", f.Severity, f.Check, f.Resource, f.Message)
+		if f.Severity == pennybase.SeverityHigh {
+			code = 1
+		}
+	}
+	return code
+}
+
 func main() {
-	server, err := pennybase.NewServer("data", "templates", "static")
+	dataDir := "data"
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		if len(os.Args) > 2 {
+			dataDir = os.Args[2]
+		}
+		os.Exit(audit(dataDir))
+	}
+	var follower *pennybase.Follower
+	if len(os.Args) > 1 && os.Args[1] == "follow" {
+		fs := flag.NewFlagSet("follow", flag.ExitOnError)
+		source := fs.String("source", "", "primary server URL, e.g. http://primary:8080")
+		fs.StringVar(&dataDir, "data", "replica", "replica data directory")
+		interval := fs.Duration("interval", time.Second, "polling interval")
+		_ = fs.Parse(os.Args[2:])
+		if *source == "" {
+			log.Fatal("follow: -source is required")
+		}
+		if err := os.MkdirAll(dataDir, 0755); err != nil {
+			log.Fatal(err)
+		}
+		follower = &pennybase.Follower{
+			Source:   *source,
+			User:     os.Getenv("SOURCE_USER"),
+			Password: os.Getenv("SOURCE_PASSWORD"),
+			Interval: *interval,
+		}
+		if err := follower.InitDir(dataDir); err != nil {
+			log.Fatal(err)
+		}
+	}
+	server, err := pennybase.NewServerWithConfig(config(), dataDir, "templates", "static")
 	if err != nil {
 		log.Fatal(err)
 	}
+	if follower != nil {
+		server.ReadOnly = true
+		follower.Store = server.Store
+		go follower.Run(context.Background())
+	}
 	logger := func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			log.Printf("%s %s", r.Method, r.URL.String())
 			next.ServeHTTP(w, r)
 		})
 	}
-	if salt := os.Getenv("SALT"); salt != "" {
-		pennybase.SessionKey = salt
-	}
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
 	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	srv := &http.Server{Addr: ":" + port, Handler: logger(server)}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
 	log.Printf("Starting server on port %s...\n", port)
-	log.Fatal(http.ListenAndServe(":"+port, logger(server)))
-
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	// Wait for the scheduled jobs to finish
+	if err := server.Close(); err != nil {
+		log.Fatal(err)
+	}
 }
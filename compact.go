@@ -0,0 +1,260 @@
+package pennybase
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"slices"
+	"strconv"
+)
+
+// Compactor is implemented by databases that can drop outdated versions and
+// deleted records from their storage, see Store.Compact.
+type Compactor interface {
+	Compact() error
+}
+
+// compactedRows returns the number of rows dropped by compactions. It is kept
+// in a marker row with an empty id at the start of a compacted file, so that
+// Seq doesn't go back.
+func compactedRows(rec Record) (int64, bool) {
+	if len(rec) < 2 || rec[0] != "" {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(rec[1], 10, 64)
+	return n, err == nil
+}
+
+// Compact rewrites the file keeping only the latest version of every live
+// record, in the same order, so that Iter yields the same records. The copy is
+// written to a temporary file without holding the lock. Records appended in
+// the meantime are copied over while the files are swapped. Reads in progress
+// go on with the old file, which is closed once they are done.
+//
+// Holding db.mu only for the swap is safe because the file is append-only:
+// writers never change the first size bytes read for the copy, and every
+// row they append after them is copied verbatim under the lock, after the
+// live records. Like in the old file, such a row wins over the copied version
+// of its record when the index is rebuilt, be it an update or a deletion.
+// Compactions are serialized by db.compact, so writers are only blocked for
+// the copy of the appended rows rather than for the whole rewrite.
+func (db *csvDB) Compact() error {
+	db.compact.Lock()
+	defer db.compact.Unlock()
+	db.mu.RLock()
+	f, size, rows := db.f, db.size, db.rows
+	db.refs.acquire(f)
+	db.mu.RUnlock()
+	defer db.refs.release(f)
+
+	type live struct {
+		pos int64
+		rec Record
+	}
+	latest, compacted := map[string]live{}, int64(0)
+	r := db.format.reader(io.NewSectionReader(f, 0, size))
+	for {
+		pos := r.InputOffset()
+		rec, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		n, marker := compactedRows(rec)
+		switch {
+		case marker:
+			compacted += n
+		case len(rec) < 2:
+		case rec[1] == "0":
+			delete(latest, rec[0])
+		default:
+			latest[rec[0]] = live{pos, rec}
+		}
+	}
+	dropped := rows - int64(len(latest))
+	if dropped == compacted {
+		return nil // no outdated rows
+	}
+
+	tmp := db.name + ".compact"
+	_ = db.st.Remove(tmp) // left by a failed compaction
+	out, err := db.st.Open(tmp)
+	if err != nil {
+		return err
+	}
+	fail := func(err error) error {
+		out.Close()
+		_ = db.st.Remove(tmp)
+		return err
+	}
+	w := db.format.writer(out)
+	_ = w.Write(Record{"", strconv.FormatInt(dropped, 10)})
+	for _, l := range slices.SortedFunc(maps.Values(latest), func(a, b live) int { return cmp.Compare(a.pos, b.pos) }) {
+		_ = w.Write(l.rec)
+	}
+	if w.Flush(); w.Error() != nil {
+		return fail(w.Error())
+	}
+
+	// Rows appended since the scan are copied as they are, see above
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, err := io.Copy(out, io.NewSectionReader(f, size, db.size-size)); err != nil {
+		return fail(err)
+	}
+	if out, ok := out.(interface{ Sync() error }); ok {
+		if err := out.Sync(); err != nil {
+			return fail(err)
+		}
+	}
+	if err := out.Close(); err != nil {
+		_ = db.st.Remove(tmp)
+		return err
+	}
+	if err := db.st.Rename(tmp, db.name); err != nil {
+		_ = db.st.Remove(tmp)
+		return err
+	}
+	nf, err := db.st.Open(db.name)
+	if err != nil {
+		return err
+	}
+	if db.size, err = nf.Size(); err != nil {
+		return err
+	}
+	db.refs.retire(f)
+	db.f = nf
+	if err := db.reindex(); err != nil {
+		return err
+	}
+	if db.persist > 0 {
+		return db.saveIndex()
+	}
+	return nil
+}
+
+// AutoCompact sets when a database is compacted in the background: once the
+// dead rows (outdated versions and deleted records) are at least Ratio of the
+// rows of the file and at least MinDead. The zero value disables it.
+type AutoCompact struct {
+	Ratio   float64
+	MinDead int64
+}
+
+// DefaultAutoCompact is the automatic compaction of the resources of a store
+// unless set otherwise with WithCompaction.
+var DefaultAutoCompact = AutoCompact{Ratio: 0.5, MinDead: 10000}
+
+// WithAutoCompact compacts the database in the background when it reaches the
+// share of dead rows of ac, see AutoCompact.
+func WithAutoCompact(ac AutoCompact) DBOption { return func(db *csvDB) { db.auto = ac } }
+
+// autoCompact starts a background compaction if the dead rows reached the
+// threshold and none is running or being started. The caller must hold db.mu.
+func (db *csvDB) autoCompact() {
+	if db.auto.Ratio <= 0 || db.closing || db.busy {
+		return
+	}
+	st := db.stats()
+	if st.Dead < db.auto.MinDead || st.DeadRatio < db.auto.Ratio {
+		return
+	}
+	db.busy = true
+	db.bg.Add(1)
+	go func() {
+		defer db.bg.Done()
+		if err := db.Compact(); err != nil {
+			log.Printf("csvdb: %s: compaction: %v", db.name, err)
+		}
+		db.mu.Lock()
+		db.busy = false
+		db.mu.Unlock()
+	}()
+}
+
+// readDropped returns the number of rows dropped by compactions from the
+// marker row at the start of the file, if any.
+func (db *csvDB) readDropped() int64 {
+	rec, err := db.format.reader(io.NewSectionReader(db.f, 0, db.size)).Read()
+	if n, ok := compactedRows(rec); err == nil && ok {
+		return n
+	}
+	return 0
+}
+
+// DBStats describes the fragmentation of a database file.
+type DBStats struct {
+	Rows      int64   // rows in the file, not counting the compaction marker
+	Live      int64   // live records
+	Dead      int64   // outdated versions and deleted records
+	DeadRatio float64 // Dead / Rows, 0 for an empty file
+	Size      int64   // file size in bytes
+}
+
+// Stats returns the number of live and dead rows of the file, without reading
+// it.
+func (db *csvDB) Stats() DBStats {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.stats()
+}
+
+func (db *csvDB) stats() DBStats {
+	st := DBStats{Rows: db.rows - db.dropped, Live: db.live, Size: db.size}
+	if st.Dead = st.Rows - st.Live; st.Rows > 0 {
+		st.DeadRatio = float64(st.Dead) / float64(st.Rows)
+	}
+	return st
+}
+
+// Stats returns the fragmentation of the storage of a resource, if its
+// database reports it.
+func (s *Store) Stats(resource string) (DBStats, error) {
+	done, err := s.enter()
+	if err != nil {
+		return DBStats{}, err
+	}
+	defer done()
+	db, ok := s.Resources[resource]
+	if !ok {
+		return DBStats{}, newError("resource_not_found", "resource", resource)
+	}
+	st, ok := db.(interface{ Stats() DBStats })
+	if !ok {
+		return DBStats{}, fmt.Errorf("resource %s does not report stats", resource)
+	}
+	return st.Stats(), nil
+}
+
+// Compact drops outdated versions and deleted records from the storage of a
+// resource, if its database supports it (see Compactor). Change sequences are
+// preserved, but deleted records are no longer listed as tombstones by
+// ?since requests.
+func (s *Store) Compact(resource string) error {
+	return s.compact(context.Background(), resource)
+}
+
+func (s *Store) compact(ctx context.Context, resource string) (err error) {
+	_, end := s.span(ctx, "store.compact", Attr{"resource", resource})
+	defer func() { end(err) }()
+	done, err := s.enter()
+	if err != nil {
+		return err
+	}
+	defer done()
+	db, ok := s.Resources[resource]
+	if !ok {
+		return newError("resource_not_found", "resource", resource)
+	}
+	c, ok := db.(Compactor)
+	if !ok {
+		return fmt.Errorf("resource %s does not support compaction", resource)
+	}
+	return c.Compact()
+}
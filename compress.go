@@ -0,0 +1,49 @@
+package pennybase
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"io"
+	"strings"
+)
+
+// compressedPrefix marks a text cell holding gzipped, base64-encoded text, so
+// that compressed cells and cells written before the "compress" option was
+// set can be told apart.
+const compressedPrefix = "gz:"
+
+// compressText encodes text for a compressed field. Short text that doesn't
+// get smaller is stored as it is, unless it could be mistaken for a
+// compressed cell.
+func compressText(s string) string {
+	var buf bytes.Buffer
+	buf.WriteString(compressedPrefix)
+	enc := base64.NewEncoder(base64.StdEncoding, &buf)
+	zw := gzip.NewWriter(enc)
+	_, _ = zw.Write([]byte(s))
+	_ = zw.Close()
+	_ = enc.Close()
+	if buf.Len() >= len(s) && !strings.HasPrefix(s, compressedPrefix) {
+		return s
+	}
+	return buf.String()
+}
+
+// decompressText decodes a cell of a compressed field. Cells that aren't
+// compressed are returned as they are.
+func decompressText(s string) (string, error) {
+	data, ok := strings.CutPrefix(s, compressedPrefix)
+	if !ok {
+		return s, nil
+	}
+	zr, err := gzip.NewReader(base64.NewDecoder(base64.StdEncoding, strings.NewReader(data)))
+	if err != nil {
+		return "", err
+	}
+	text, err := io.ReadAll(zr)
+	if err != nil {
+		return "", err
+	}
+	return string(text), nil
+}
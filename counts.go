@@ -0,0 +1,226 @@
+package pennybase
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// refIndex counts the records of a resource whose text field refers to each
+// id, e.g. the books of every author. It is built with one scan on first use
+// and then kept up to date by every committed write.
+type refIndex struct {
+	pos    int               // field position in the records
+	refs   map[string]string // record id -> referenced id
+	counts map[string]int    // referenced id -> number of records
+}
+
+func (idx *refIndex) set(id, ref string) {
+	if old, ok := idx.refs[id]; ok {
+		if idx.counts[old]--; idx.counts[old] == 0 {
+			delete(idx.counts, old)
+		}
+		delete(idx.refs, id)
+	}
+	if ref != "" {
+		idx.refs[id] = ref
+		idx.counts[ref]++
+	}
+}
+
+// RelatedCount returns the number of records of the resource whose field
+// holds the given id, without reading the resource files except for the
+// first call for each resource and field.
+func (s *Store) RelatedCount(resource, field, id string) (int, error) {
+	done, err := s.enter()
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+	s.refsMu.Lock()
+	defer s.refsMu.Unlock()
+	idx, err := s.refIndex(resource, field)
+	if err != nil {
+		return 0, err
+	}
+	return idx.counts[id], nil
+}
+
+// refIndex returns the index of the resource field, building it if needed.
+// The caller must hold refsMu.
+func (s *Store) refIndex(resource, field string) (*refIndex, error) {
+	key := resource + "." + field
+	if idx, ok := s.refs[key]; ok {
+		return idx, nil
+	}
+	db, ok := s.Resources[resource]
+	if !ok {
+		return nil, newError("resource_not_found", "resource", resource)
+	}
+	idx := &refIndex{pos: -1, refs: map[string]string{}, counts: map[string]int{}}
+	for i, f := range s.Schemas[resource] {
+		if f.Field == field && (f.Type == Text || f.Type == Reference) && i > 1 {
+			idx.pos = i
+		}
+	}
+	if idx.pos < 0 {
+		return nil, newError("invalid_field", "field", key)
+	}
+	for rec, err := range db.Iter() {
+		if err != nil {
+			return nil, err
+		}
+		if idx.pos < len(rec) {
+			idx.set(rec[0], rec[idx.pos])
+		}
+	}
+	if s.refs == nil {
+		s.refs = map[string]*refIndex{}
+	}
+	s.refs[key] = idx
+	return idx, nil
+}
+
+// indexRefs applies a committed record to the indexes of its resource.
+func (s *Store) indexRefs(resource string, rec Record) {
+	s.refsMu.Lock()
+	defer s.refsMu.Unlock()
+	for key, idx := range s.refs {
+		if !strings.HasPrefix(key, resource+".") {
+			continue
+		}
+		ref := ""
+		if rec[1] != "0" && idx.pos < len(rec) {
+			ref = rec[idx.pos]
+		}
+		idx.set(rec[0], ref)
+	}
+}
+
+// expandCounts adds the "_counts" object requested with the expand_counts
+// query parameter, e.g. ?expand_counts=books.author, to each record: the
+// number of books whose author field holds the record id. The user must be
+// allowed to read the counted resources. On failure it writes the error
+// response.
+func (s *Server) expandCounts(w http.ResponseWriter, r *http.Request, res ...Resource) bool {
+	specs := countSpecs(r)
+	if len(specs) == 0 {
+		return true
+	}
+	for _, spec := range specs {
+		resource, field, _ := strings.Cut(spec, ".")
+		if err := s.authorize(r.Context(), resource, "", "read", CurrentUser(r)); err != nil {
+			s.WriteError(w, r, http.StatusUnauthorized, err)
+			return false
+		}
+		if _, err := s.Store.RelatedCount(resource, field, ""); err != nil {
+			s.WriteError(w, r, http.StatusBadRequest, err)
+			return false
+		}
+	}
+	for _, rec := range res {
+		counts := map[string]int{}
+		id, _ := rec["_id"].(string)
+		for _, spec := range specs {
+			resource, field, _ := strings.Cut(spec, ".")
+			counts[spec], _ = s.Store.RelatedCount(resource, field, id)
+		}
+		rec["_counts"] = counts
+	}
+	return true
+}
+
+func countSpecs(r *http.Request) []string {
+	specs := []string{}
+	for spec := range strings.SplitSeq(r.FormValue("expand_counts"), ",") {
+		if spec = strings.TrimSpace(spec); spec != "" {
+			specs = append(specs, spec)
+		}
+	}
+	return specs
+}
+
+// Counter is implemented by databases that know their live records without
+// reading them, see Store.Count and Store.Exists.
+type Counter interface {
+	Count() int
+	Exists(id string) bool
+}
+
+// Count returns the number of live records of a resource. Databases that
+// implement Counter answer from memory, the records of others are counted
+// without being converted to resources.
+func (s *Store) Count(resource string) (int, error) {
+	return s.countWhere(context.Background(), resource, nil)
+}
+
+// Exists reports whether a resource has a live record with the id, without
+// reading it if the database implements Counter and records can't expire.
+func (s *Store) Exists(resource, id string) (bool, error) {
+	done, err := s.enter()
+	if err != nil {
+		return false, err
+	}
+	defer done()
+	db, ok := s.Resources[resource]
+	if !ok {
+		return false, newError("resource_not_found", "resource", resource)
+	}
+	id = s.normalizeID(resource, id)
+	if c, ok := db.(Counter); ok && !expiring(s.Schemas[resource]) {
+		return c.Exists(id), nil
+	}
+	_, err = s.get(context.Background(), resource, id)
+	if errors.Is(err, ErrRecordNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// CountWhere returns the number of records matching a filter, see ListWhere.
+func (s *Store) CountWhere(resource string, filter map[string]string) (int, error) {
+	return s.countWhere(context.Background(), resource, filter)
+}
+
+func (s *Store) countWhere(ctx context.Context, resource string, filter map[string]string) (n int, err error) {
+	if len(filter) > 0 || expiring(s.Schemas[resource]) {
+		res, err := s.listWhere(ctx, resource, "", filter)
+		return len(res), err
+	}
+	_, end := s.span(ctx, "store.count", Attr{"resource", resource})
+	defer func() { end(err) }()
+	done, err := s.enter()
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+	db, ok := s.Resources[resource]
+	if !ok {
+		return 0, newError("resource_not_found", "resource", resource)
+	}
+	if c, ok := db.(Counter); ok {
+		return c.Count(), nil
+	}
+	for _, err := range db.Iter() {
+		if err != nil {
+			return 0, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// handleCount responds with the number of records matching the filter
+// parameters of the request, e.g. {"count": 42}.
+func (s *Server) handleCount(w http.ResponseWriter, r *http.Request) {
+	n, err := s.Store.countWhere(r.Context(), r.PathValue("resource"), s.filter(r))
+	if errors.Is(err, ErrInvalidField) {
+		s.WriteError(w, r, http.StatusBadRequest, err)
+		return
+	} else if err != nil {
+		s.WriteError(w, r, errorStatus(err), err)
+		return
+	}
+	WriteJSON(w, http.StatusOK, map[string]int{"count": n})
+}
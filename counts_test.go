@@ -0,0 +1,186 @@
+package pennybase
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestStoreRelatedCount(t *testing.T) {
+	originalID := ID
+	defer func() { ID = originalID }()
+	dir := testData(t, filepath.Join("testdata", "graphql"))
+	s := must(NewStore(dir)).T(t)
+	defer s.Close()
+
+	check := func(step string, want map[string]int) {
+		t.Helper()
+		for author, n := range want {
+			if got := must(s.RelatedCount("books", "author", author)).T(t); got != n {
+				t.Errorf("%s: %s has %d books, want %d", step, author, got, n)
+			}
+		}
+	}
+	check("initial", map[string]int{"a1": 3, "a2": 1, "a3": 0})
+	ID = func() string { return "b5" }
+	must(s.Create("books", Resource{"title": "Fiasco", "author": "a2"})).T(t)
+	check("create", map[string]int{"a1": 3, "a2": 2})
+	must0(t, s.Update("books", Resource{"_id": "b1", "author": "a3"}))
+	check("update", map[string]int{"a1": 2, "a2": 2, "a3": 1})
+	must0(t, s.Update("books", Resource{"_id": "b1", "title": "The Dispossessed"}))
+	check("update other field", map[string]int{"a1": 2, "a3": 1})
+	must0(t, s.Update("books", Resource{"_id": "b5", "author": ""}))
+	check("clear", map[string]int{"a2": 1})
+	must0(t, s.Delete("books", "b3"))
+	check("delete", map[string]int{"a1": 2, "a2": 0, "a3": 1})
+
+	for _, tt := range []struct{ resource, field string }{
+		{"movies", "author"},
+		{"books", "year"},
+		{"books", "_id"},
+		{"books", "publisher"},
+	} {
+		if _, err := s.RelatedCount(tt.resource, tt.field, "a1"); err == nil {
+			t.Errorf("expected an error for %s.%s", tt.resource, tt.field)
+		}
+	}
+}
+
+func TestStoreCountExists(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		backend func(dir string) Backend
+	}{
+		{"csv", func(dir string) Backend { return CSVBackend{Storage: DirStorage(dir)} }},
+		{"mem", func(string) Backend { return MemBackend{} }},
+		{"scan", func(dir string) Backend {
+			return BackendFunc(func(resource string) (DB, error) {
+				db, err := CSVBackend{Storage: DirStorage(dir)}.Open(resource)
+				return countingDB{db, &atomic.Int32{}}, err // hides Counter
+			})
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := testData(t, filepath.Join("testdata", "graphql"))
+			s := &Server{Store: must(NewStore(dir, WithBackend(tt.backend(dir)))).T(t)}
+			defer s.Store.Close()
+			if tt.name == "mem" {
+				for _, id := range []string{"b1", "b2", "b3", "b4"} {
+					must0(t, s.Store.Batch(Write{Resource: "books", Action: "create", Data: Resource{"_id": id, "title": id, "author": "a1"}}))
+				}
+			}
+			must0(t, s.Store.Delete("books", "b2"))
+			must0(t, s.Store.Update("books", Resource{"_id": "b3", "title": "Updated"}))
+			if n := must(s.Store.Count("books")).T(t); n != 3 {
+				t.Errorf("got %d books", n)
+			}
+			for id, want := range map[string]bool{"b1": true, "b2": false, "b3": true, "b9": false} {
+				if got := must(s.Store.Exists("books", id)).T(t); got != want {
+					t.Errorf("%s exists: got %v", id, got)
+				}
+			}
+			if _, err := s.Store.Exists("movies", "m1"); !errors.Is(err, ErrResourceNotFound) {
+				t.Errorf("got %v for a missing resource", err)
+			}
+			tmpl := template.Must(template.New("t").Parse(`{{.Store.Count "books"}} {{.Store.Exists "books" "b1"}}`))
+			var buf strings.Builder
+			must0(t, tmpl.Execute(&buf, s.templateData(httptest.NewRequest(http.MethodGet, "/", nil), nil)))
+			if buf.String() != "3 true" {
+				t.Errorf("got %q from the template", buf.String())
+			}
+		})
+	}
+}
+
+func TestServerExpandCounts(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "graphql"))
+	s := must(NewServer(dir, "", "")).T(t)
+	defer s.Store.Close()
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Accept", "application/json")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w
+	}
+	w := get("/api/authors/?expand_counts=books.author")
+	var authors []struct {
+		ID     string         `json:"_id"`
+		Counts map[string]int `json:"_counts"`
+	}
+	must0(t, json.NewDecoder(w.Body).Decode(&authors))
+	if len(authors) != 2 || authors[0].Counts["books.author"] != 3 || authors[1].Counts["books.author"] != 1 {
+		t.Errorf("got %+v", authors)
+	}
+	etag := w.Header().Get("ETag")
+
+	// Counts are kept fresh in cached lists
+	must0(t, s.Store.Delete("books", "b3"))
+	req := httptest.NewRequest(http.MethodGet, "/api/authors/?expand_counts=books.author", nil)
+	req.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("got status %d after a counted record was deleted", w.Code)
+	}
+
+	var author map[string]any
+	must0(t, json.NewDecoder(get("/api/authors/a2?expand_counts=books.author").Body).Decode(&author))
+	if counts, _ := author["_counts"].(map[string]any); counts["books.author"] != 0.0 {
+		t.Errorf("got %v", author)
+	}
+
+	for _, tt := range []struct {
+		path       string
+		wantStatus int
+	}{
+		{"/api/authors/?expand_counts=drafts.owner", http.StatusUnauthorized},   // drafts are not public
+		{"/api/authors/a1?expand_counts=drafts.owner", http.StatusUnauthorized}, // drafts are not public
+		{"/api/authors/?expand_counts=movies.author", http.StatusUnauthorized},  // no such resource
+		{"/api/authors/?expand_counts=books.year", http.StatusBadRequest},
+		{"/api/authors/?expand_counts=books", http.StatusBadRequest},
+	} {
+		if w := get(tt.path); w.Code != tt.wantStatus {
+			t.Errorf("%s: got status %d, want %d", tt.path, w.Code, tt.wantStatus)
+		}
+	}
+}
+
+func TestServerCount(t *testing.T) {
+	s := must(NewServer(testData(t, filepath.Join("testdata", "rest")), "", "")).T(t)
+	defer s.Store.Close()
+	must(s.Store.Create("books", Resource{"title": "Animal Farm", "author": "George Orwell", "year": 1945.0})).T(t)
+	must0(t, s.Store.Delete("books", "book1"))
+	if n := must(s.Store.Count("books")).T(t); n != 2 {
+		t.Errorf("got %d books", n)
+	}
+	for _, tt := range []struct {
+		path       string
+		wantStatus int
+		want       int
+	}{
+		{"/api/books/count", http.StatusOK, 2},
+		{"/api/books/count?author=George%20Orwell", http.StatusOK, 2},
+		{"/api/books/count?author=George%20Orwell&year=1945", http.StatusOK, 1},
+		{"/api/books/count?year=recent", http.StatusBadRequest, 0},
+		{"/api/_users/count", http.StatusUnauthorized, 0},
+	} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s: got status %d, want %d", tt.path, w.Code, tt.wantStatus)
+			continue
+		}
+		var got struct{ Count int }
+		if w.Code == http.StatusOK && (json.NewDecoder(w.Body).Decode(&got) != nil || got.Count != tt.want) {
+			t.Errorf("%s: got %+v, want %d", tt.path, got, tt.want)
+		}
+	}
+}
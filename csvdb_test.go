@@ -1,18 +1,57 @@
 package pennybase
 
 import (
+	"bytes"
 	"crypto/rand"
+	"errors"
+	"io"
+	"iter"
+	"maps"
+	mathrand "math/rand/v2"
+	"os"
 	"path/filepath"
 	"slices"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 var _ DB = (*csvDB)(nil)
 
-func TestDBBasicOperations(t *testing.T) {
-	db := must(NewCSVDB(filepath.Join(t.TempDir(), "test.csv"))).T(t)
+type dbOpener = func(st Storage, name string, opts ...DBOption) (*csvDB, error)
+
+// The tests taking any DB also run against memDB, see TestMemDB.
+
+// TestDBConformance runs the database tests below against every file format.
+func TestDBConformance(t *testing.T) {
+	for _, engine := range []struct {
+		name string
+		open dbOpener
+	}{{"csv", OpenCSVDB}, {"jsonl", OpenJSONLDB}} {
+		for _, tt := range []struct {
+			name string
+			test func(*testing.T, dbOpener)
+		}{
+			{"BasicOperations", testDBBasicOperations},
+			{"IndexRebuild", testIndexRebuild},
+			{"EmptyIterator", testEmptyIterator},
+			{"IteratorWithDeletes", testIteratorWithDeletes},
+			{"Concurrent", testConcurrent},
+			{"Compact", testCompact},
+			{"CompactLiveSet", testCompactLiveSet},
+			{"InterleavedGetCreate", testInterleavedGetCreate},
+			{"IterFrom", testIterFrom},
+		} {
+			t.Run(engine.name+"/"+tt.name, func(t *testing.T) { tt.test(t, engine.open) })
+		}
+	}
+}
+
+func testDBBasicOperations[D DB](t *testing.T, open func(Storage, string, ...DBOption) (D, error)) {
+	db := must(open(DirStorage(t.TempDir()), "test.db")).T(t)
 	defer db.Close()
 
 	id := rand.Text()
@@ -22,6 +61,14 @@ func TestDBBasicOperations(t *testing.T) {
 
 	initialRec := Record{id, "1", "foo"}
 	must0(t, db.Create(initialRec))
+	if err := db.Create(initialRec); !errors.Is(err, ErrVersionConflict) {
+		t.Fatalf("got %v for creating an existing record", err)
+	}
+	for _, rec := range []Record{{"", "1"}, {"x", "2"}, {"x"}} {
+		if err := db.Create(rec); !errors.Is(err, ErrInvalidRecord) {
+			t.Fatalf("got %v for creating %q", err, rec)
+		}
+	}
 
 	if rec := must(db.Get(id)).T(t); !slices.Equal(rec, initialRec) {
 		t.Fatalf("get after create got %v, want %v", rec, initialRec)
@@ -44,13 +91,37 @@ func TestDBBasicOperations(t *testing.T) {
 		t.Fatalf("got unexpected record after delete: %v", rec)
 	}
 
-	if err := db.Update(Record{id, "3", "qux"}); err == nil {
-		t.Fatal("want error on update after delete")
+	if err := db.Update(Record{id, "3", "qux"}); !errors.Is(err, ErrRecordNotFound) {
+		t.Fatalf("got %v for an update after delete", err)
+	}
+	if err := db.Delete(id); !errors.Is(err, ErrRecordNotFound) {
+		t.Fatalf("got %v for deleting twice", err)
 	}
 }
 
-func TestEmptyIterator(t *testing.T) {
-	db, _ := NewCSVDB(filepath.Join(t.TempDir(), "test.csv"))
+func testIndexRebuild(t *testing.T, open dbOpener) {
+	db := must(open(NewMemStorage(), "test.db")).T(t)
+	defer db.Close()
+	must0(t, db.Create(Record{"a", "1", "foo"}))
+	must0(t, db.Create(Record{"b", "1", "bar"}))
+	must0(t, db.Update(Record{"a", "2", "baz"}))
+
+	for _, offset := range []int64{db.index["b"], 3, db.size + 10} {
+		db.index["a"] = offset
+		if rec := must(db.Get("a")).T(t); !slices.Equal(rec, Record{"a", "2", "baz"}) {
+			t.Errorf("offset %d: got %v", offset, rec)
+		}
+		if rec := must(db.Get("b")).T(t); !slices.Equal(rec, Record{"b", "1", "bar"}) {
+			t.Errorf("offset %d: got %v for another id", offset, rec)
+		}
+	}
+	if db.rows != 3 {
+		t.Errorf("got %d rows after the rebuild", db.rows)
+	}
+}
+
+func testEmptyIterator[D DB](t *testing.T, open func(Storage, string, ...DBOption) (D, error)) {
+	db := must(open(DirStorage(t.TempDir()), "test.db")).T(t)
 	defer db.Close()
 	count := 0
 	for range db.Iter() {
@@ -61,8 +132,8 @@ func TestEmptyIterator(t *testing.T) {
 	}
 }
 
-func TestIteratorWithDeletes(t *testing.T) {
-	db := must(NewCSVDB(filepath.Join(t.TempDir(), "test.csv"))).T(t)
+func testIteratorWithDeletes[D DB](t *testing.T, open func(Storage, string, ...DBOption) (D, error)) {
+	db := must(open(DirStorage(t.TempDir()), "test.db")).T(t)
 	defer db.Close()
 
 	for i := range 10 {
@@ -84,8 +155,8 @@ func TestIteratorWithDeletes(t *testing.T) {
 	}
 }
 
-func TestConcurrent(t *testing.T) {
-	db := must(NewCSVDB(filepath.Join(t.TempDir(), "test.csv"))).T(t)
+func testConcurrent[D DB](t *testing.T, open func(Storage, string, ...DBOption) (D, error)) {
+	db := must(open(DirStorage(t.TempDir()), "test.db")).T(t)
 	defer db.Close()
 	var wg sync.WaitGroup
 	for i := range 1000 {
@@ -105,12 +176,23 @@ func TestConcurrent(t *testing.T) {
 }
 
 func BenchmarkWrite(b *testing.B) {
-	db, _ := NewCSVDB(filepath.Join(b.TempDir(), "test.csv"))
-	defer db.Close()
-	b.ResetTimer()
-	for i := range b.N {
-		id := strconv.Itoa(i)
-		_ = db.Create(Record{id, "1", "data"})
+	for _, bb := range []struct {
+		name string
+		mode Durability
+	}{
+		{"NoSync", NoSync},
+		{"SyncAlways", SyncAlways},
+		{"Sync10ms", Durability(10 * time.Millisecond)},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			db, _ := NewCSVDB(filepath.Join(b.TempDir(), "test.csv"), WithSync(bb.mode))
+			defer db.Close()
+			b.ResetTimer()
+			for i := range b.N {
+				id := strconv.Itoa(i)
+				_ = db.Create(Record{id, "1", "data"})
+			}
+		})
 	}
 }
 
@@ -127,3 +209,584 @@ func BenchmarkRead(b *testing.B) {
 		_, _ = db.Get(id)
 	}
 }
+
+// BenchmarkMixed measures reads and writes while other goroutines read.
+func BenchmarkMixed(b *testing.B) {
+	open := func(b *testing.B, n int) *csvDB {
+		db, _ := NewCSVDB(filepath.Join(b.TempDir(), "test.csv"))
+		for i := range n {
+			_ = db.Create(Record{strconv.Itoa(i), "1", "data"})
+		}
+		return db
+	}
+	b.Run("GetCreate", func(b *testing.B) {
+		db := open(b, 1000)
+		defer db.Close()
+		var next atomic.Int64
+		next.Store(1000)
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				if i%10 == 0 {
+					_ = db.Create(Record{strconv.FormatInt(next.Add(1), 10), "1", "data"})
+				} else {
+					_, _ = db.Get(strconv.Itoa(i % 1000))
+				}
+			}
+		})
+	})
+	b.Run("GetDuringIter", func(b *testing.B) {
+		db := open(b, 10000)
+		defer db.Close()
+		done := make(chan struct{})
+		var wg sync.WaitGroup
+		for range 4 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-done:
+						return
+					default:
+					}
+					for range db.Iter() {
+					}
+				}
+			}()
+		}
+		b.ResetTimer()
+		for i := range b.N {
+			_, _ = db.Get(strconv.Itoa(i % 10000))
+		}
+		b.StopTimer()
+		close(done)
+		wg.Wait()
+	})
+}
+
+func testCompact(t *testing.T, open dbOpener) {
+	dir := DirStorage(t.TempDir())
+	db := must(open(dir, "test.db")).T(t)
+	defer func() { db.Close() }()
+	must0(t, db.indexColumn(2))
+	for i := range 100 {
+		id := strconv.Itoa(i)
+		must0(t, db.Create(Record{id, "1", "v1"}))
+		must0(t, db.Update(Record{id, "2", "v2"}))
+		if i%2 == 0 {
+			must0(t, db.Delete(id))
+		}
+	}
+	records := func() (recs []Record) {
+		for rec, err := range db.Iter() {
+			must0(t, err)
+			recs = append(recs, rec)
+		}
+		return recs
+	}
+	want, seq, size := records(), db.Seq(), db.size
+
+	// Iterations in progress don't block writers and finish against the old
+	// file, yielding the records as of their start
+	next, stop := iter.Pull2(db.Iter())
+	first, _, _ := next()
+	must0(t, db.Create(Record{"new", "1", "v1"}))
+	must0(t, db.Delete("new"))
+	seq, size = db.Seq(), db.size
+	done := make(chan error)
+	go func() { done <- db.Compact() }()
+	got := []Record{first}
+	for rec, _, ok := next(); ok; rec, _, ok = next() {
+		got = append(got, rec)
+	}
+	stop()
+	must0(t, <-done)
+	if !slices.EqualFunc(got, want, slices.Equal) {
+		t.Errorf("iteration during compaction got %v", got)
+	}
+
+	if got := records(); !slices.EqualFunc(got, want, slices.Equal) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if db.Seq() != seq || db.size >= size/2 {
+		t.Errorf("got seq %d, size %d, want seq %d and less than half of %d bytes", db.Seq(), db.size, seq, size)
+	}
+	if ids, _ := db.lookup(2, "v2"); len(ids) != 50 {
+		t.Errorf("got %d indexed records", len(ids))
+	}
+	must0(t, db.Update(Record{"1", "3", "v3"}))
+	must0(t, db.Create(Record{"0", "1", "again"}))
+	if rec := must(db.Get("1")).T(t); !slices.Equal(rec, Record{"1", "3", "v3"}) {
+		t.Errorf("got %v after update", rec)
+	}
+
+	// Compacting twice and reopening keep the change sequence
+	must0(t, db.Compact())
+	must0(t, db.Compact())
+	seq = db.Seq()
+	must0(t, db.Close())
+	db = must(open(dir, "test.db")).T(t)
+	if db.Seq() != seq || len(records()) != 51 {
+		t.Errorf("got seq %d and %d records after reopening, want %d and 51", db.Seq(), len(records()), seq)
+	}
+	if rec := must(db.Get("0")).T(t); !slices.Equal(rec, Record{"0", "1", "again"}) {
+		t.Errorf("got %v after reopening", rec)
+	}
+}
+
+func testCompactLiveSet(t *testing.T, open dbOpener) {
+	dir := t.TempDir()
+	db := must(open(DirStorage(dir), "test.db")).T(t)
+	defer db.Close()
+	r := mathrand.New(mathrand.NewPCG(1, 2))
+	live := map[string]Record{}
+	for i := range 2000 {
+		id := strconv.Itoa(r.IntN(300))
+		switch rec, ok := live[id]; {
+		case !ok:
+			live[id] = Record{id, "1", "created " + strconv.Itoa(i)}
+			must0(t, db.Create(live[id]))
+		case r.IntN(4) == 0:
+			delete(live, id)
+			must0(t, db.Delete(id))
+		default:
+			v, _ := strconv.Atoi(rec[1])
+			live[id] = Record{id, strconv.Itoa(v + 1), "updated " + strconv.Itoa(i)}
+			must0(t, db.Update(live[id]))
+		}
+	}
+	must0(t, db.Compact())
+
+	// The file holds the marker row, then exactly the live records
+	fr := db.format.reader(bytes.NewReader(must(os.ReadFile(filepath.Join(dir, "test.db"))).T(t)))
+	if _, ok := compactedRows(must(fr.Read()).T(t)); !ok {
+		t.Fatal("no marker row")
+	}
+	rows := map[string]Record{}
+	for rec, err := fr.Read(); !errors.Is(err, io.EOF); rec, err = fr.Read() {
+		if _, dup := rows[must(rec, err).T(t)[0]]; dup {
+			t.Errorf("duplicate row %v", rec)
+		}
+		rows[rec[0]] = rec
+	}
+	if !maps.EqualFunc(rows, live, slices.Equal) {
+		t.Errorf("got %d rows, want %d live records", len(rows), len(live))
+	}
+	got := map[string]Record{}
+	for rec, err := range db.Iter() {
+		got[must(rec, err).T(t)[0]] = rec
+	}
+	if !maps.EqualFunc(got, live, slices.Equal) {
+		t.Errorf("got %d records, want %d", len(got), len(live))
+	}
+}
+
+func testInterleavedGetCreate(t *testing.T, open dbOpener) {
+	dir := t.TempDir()
+	db := must(open(DirStorage(dir), "test.db")).T(t)
+	const n = 5000
+	for i := range n {
+		id := strconv.Itoa(i)
+		must0(t, db.Create(Record{id, "1", "data " + id}))
+		if rec := must(db.Get(strconv.Itoa(i / 2))).T(t); rec[2] != "data "+strconv.Itoa(i/2) {
+			t.Fatalf("get %d: got %v", i/2, rec)
+		}
+	}
+	must0(t, db.Close())
+
+	// Reads must not move the write position, the file parses cleanly
+	r := db.format.reader(bytes.NewReader(must(os.ReadFile(filepath.Join(dir, "test.db"))).T(t)))
+	recs := []Record{}
+	for {
+		rec, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		recs = append(recs, must(rec, err).T(t))
+	}
+	if len(recs) != n {
+		t.Fatalf("got %d records, want %d", len(recs), n)
+	}
+	for i, rec := range recs {
+		if want := (Record{strconv.Itoa(i), "1", "data " + strconv.Itoa(i)}); !slices.Equal(rec, want) {
+			t.Fatalf("record %d: got %v, want %v", i, rec, want)
+		}
+	}
+}
+
+func testIterFrom(t *testing.T, open dbOpener) {
+	db := must(open(DirStorage(t.TempDir()), "test.db")).T(t)
+	defer db.Close()
+	for i := range 10 {
+		must0(t, db.Create(Record{"r" + strconv.Itoa(i), "1", "v1"}))
+	}
+	must0(t, db.Update(Record{"r2", "2", "v2"}))
+	must0(t, db.Delete("r3"))
+	ids := func(offset int64, n int) (ids []string, next int64) {
+		t.Helper()
+		for row, err := range db.IterFrom(offset) {
+			must0(t, err)
+			if len(ids) == n {
+				break
+			}
+			ids, next = append(ids, row.Record[0]+"/"+row.Record[1]), row.Next
+		}
+		return ids, next
+	}
+	first, next := ids(0, 4)
+	if want := []string{"r0/1", "r1/1", "r4/1", "r5/1"}; !slices.Equal(first, want) {
+		t.Fatalf("got %v, want %v", first, want)
+	}
+	// Records updated after the scan began come again with the new version
+	must0(t, db.Update(Record{"r1", "2", "v2"}))
+	must0(t, db.Update(Record{"r7", "2", "v2"}))
+	rest, _ := ids(next, 100)
+	if want := []string{"r6/1", "r8/1", "r9/1", "r2/2", "r1/2", "r7/2"}; !slices.Equal(rest, want) {
+		t.Errorf("got %v, want %v", rest, want)
+	}
+	if rest, _ := ids(db.size, 100); len(rest) != 0 {
+		t.Errorf("got %v at the end", rest)
+	}
+	for _, err := range db.IterFrom(db.size + 1) {
+		if err == nil {
+			t.Error("expected an error past the end")
+		}
+	}
+	gen := db.Generation()
+	if must0(t, db.Compact()); db.Generation() == gen {
+		t.Error("expected compaction to change the generation")
+	}
+}
+
+func TestIndexFile(t *testing.T) {
+	st := NewMemStorage()
+	db := must(openDB(st, "test.csv", csvFormat, 10)).T(t)
+	for i := range 25 {
+		must0(t, db.Create(Record{strconv.Itoa(i), "1", "a,\"b\"\nc"}))
+	}
+	// Saved periodically
+	if !slices.Contains(must(st.List()).T(t), "test.csv.idx") {
+		t.Error("index file not saved after 10 writes")
+	}
+	must0(t, db.Update(Record{"3", "2", "updated"}))
+	must0(t, db.Delete("4"))
+	must0(t, db.Close())
+	index, version, rows := db.index, db.version, db.rows
+
+	// Rows appended since the index was saved are scanned
+	f := must(st.Open("test.csv")).T(t)
+	must(f.Write([]byte("5,2,appended\n"))).T(t)
+	must0(t, f.Close())
+	version["5"], rows = 2, rows+1
+	db = must(openDB(st, "test.csv", csvFormat, 10)).T(t)
+	must0(t, db.loadIndex())
+	if !maps.Equal(db.version, version) || db.rows != rows || len(db.index) != len(index) {
+		t.Errorf("got versions %v and %d rows, want %v and %d", db.version, db.rows, version, rows)
+	}
+	for id, want := range map[string]Record{"3": {"3", "2", "updated"}, "5": {"5", "2", "appended"}, "6": {"6", "1", "a,\"b\"\nc"}} {
+		if rec := must(db.Get(id)).T(t); !slices.Equal(rec, want) {
+			t.Errorf("got %v, want %v", rec, want)
+		}
+	}
+	must0(t, db.Close())
+
+	write := func(name, data string) {
+		_ = st.Remove(name)
+		f := must(st.Open(name)).T(t)
+		must(f.Write([]byte(data))).T(t)
+		must0(t, f.Close())
+	}
+	idx := must(st.Open("test.csv.idx")).T(t)
+	data := make([]byte, must(idx.Size()).T(t))
+	must(idx.ReadAt(data, 0)).T(t)
+	must0(t, idx.Close())
+	for _, tt := range []struct {
+		name    string
+		corrupt func()
+	}{
+		{"truncated", func() { write("test.csv.idx", string(data[:len(data)/2])) }},
+		{"corrupted", func() { write("test.csv.idx", strings.Replace(string(data), "\n3,", "\n9,", 1)) }},
+		{"stale", func() {
+			write("test.csv.idx", string(data))
+			write("test.csv", "a,1,rewritten\n"+strings.Repeat("b,1,x\n", 100))
+		}},
+	} {
+		tt.corrupt()
+		db := must(openDB(st, "test.csv", csvFormat, 10)).T(t)
+		if err := db.loadIndex(); !errors.Is(err, errStaleIndex) {
+			t.Errorf("%s: got %v", tt.name, err)
+		}
+		if _, err := db.Get("0"); tt.name == "stale" && err == nil {
+			t.Errorf("%s: got a record of the old file", tt.name)
+		}
+		if rec, err := db.Get("0"); tt.name != "stale" && (err != nil || rec[0] != "0") {
+			t.Errorf("%s: got %v, %v", tt.name, rec, err)
+		}
+		must0(t, db.Close())
+	}
+}
+
+// syncStorage counts the syncs of its files.
+type syncStorage struct {
+	*MemStorage
+	syncs atomic.Int64
+}
+
+type syncFile struct {
+	File
+	st *syncStorage
+}
+
+func (f syncFile) Sync() error {
+	f.st.syncs.Add(1)
+	return nil
+}
+
+func (st *syncStorage) Open(name string) (File, error) {
+	f, err := st.MemStorage.Open(name)
+	return syncFile{f, st}, err
+}
+
+// hookStorage calls onOpen before opening a file.
+type hookStorage struct {
+	*MemStorage
+	onOpen func(name string)
+}
+
+func (st hookStorage) Open(name string) (File, error) {
+	st.onOpen(name)
+	return st.MemStorage.Open(name)
+}
+
+func TestCompactConcurrentWrites(t *testing.T) {
+	var db *csvDB
+	writes := false
+	st := hookStorage{NewMemStorage(), func(name string) {
+		// Writers are not blocked while the live records are copied
+		if writes && strings.HasSuffix(name, ".compact") {
+			writes = false
+			must0(t, db.Update(Record{"1", "3", "v3"}))
+			must0(t, db.Delete("2"))
+			must0(t, db.Create(Record{"4", "1", "v1"}))
+		}
+	}}
+	db = must(OpenCSVDB(st, "test.db")).T(t)
+	defer func() { db.Close() }()
+	for _, id := range []string{"1", "2", "3"} {
+		must0(t, db.Create(Record{id, "1", "v1"}))
+		must0(t, db.Update(Record{id, "2", "v2"}))
+	}
+	writes = true
+	must0(t, db.Compact())
+	if writes {
+		t.Fatal("no writes during compaction")
+	}
+	want := []Record{{"3", "2", "v2"}, {"1", "3", "v3"}, {"4", "1", "v1"}}
+	seq := db.Seq()
+	for _, step := range []string{"compacted", "reopened"} {
+		var got []Record
+		for rec, err := range db.Iter() {
+			got = append(got, must(rec, err).T(t))
+		}
+		if !slices.EqualFunc(got, want, slices.Equal) || db.Seq() != seq {
+			t.Errorf("%s: got %v, seq %d, want %v, seq %d", step, got, db.Seq(), want, seq)
+		}
+		if _, err := db.Get("2"); !errors.Is(err, ErrRecordNotFound) {
+			t.Errorf("%s: got %v for a deleted record", step, err)
+		}
+		must0(t, db.Close())
+		db = must(OpenCSVDB(st, "test.db")).T(t)
+	}
+}
+
+func TestDurability(t *testing.T) {
+	for _, tt := range []struct {
+		mode      Durability
+		min, max  int64
+		wantAfter int64 // syncs after closing
+	}{
+		{NoSync, 0, 0, 0},
+		{SyncAlways, 100, 100, 100},
+		{Durability(time.Hour), 0, 0, 1},
+		{Durability(time.Millisecond), 1, 99, -1},
+	} {
+		st := &syncStorage{MemStorage: NewMemStorage()}
+		db := must(OpenCSVDB(st, "test.csv", WithSync(tt.mode))).T(t)
+		for i := range 100 {
+			must0(t, db.Create(Record{strconv.Itoa(i), "1", "data"}))
+		}
+		if tt.mode > 0 && tt.mode < Durability(time.Second) {
+			time.Sleep(20 * time.Millisecond)
+		}
+		if n := st.syncs.Load(); n < tt.min || n > tt.max {
+			t.Errorf("mode %d: got %d syncs, want %d to %d", tt.mode, n, tt.min, tt.max)
+		}
+		must0(t, db.Close())
+		// Closing syncs pending writes and stops the syncing goroutine
+		n := st.syncs.Load()
+		if tt.wantAfter >= 0 && n != tt.wantAfter {
+			t.Errorf("mode %d: got %d syncs after closing, want %d", tt.mode, n, tt.wantAfter)
+		}
+		if time.Sleep(10 * time.Millisecond); st.syncs.Load() != n {
+			t.Errorf("mode %d: synced after closing", tt.mode)
+		}
+	}
+
+	st := &syncStorage{MemStorage: NewMemStorage()}
+	f := must(st.Open("_schemas.csv")).T(t)
+	must(f.Write([]byte("s1,1,notes,_id,text,,,^.+$\ns2,1,notes,_v,number,1,,\n"))).T(t)
+	s := must(NewStore("", WithStorage(st), WithDurability(SyncAlways))).T(t)
+	defer s.Close()
+	must(s.Create("notes", Resource{})).T(t)
+	if n := st.syncs.Load(); n != 1 {
+		t.Errorf("got %d syncs of the store", n)
+	}
+}
+
+func TestTailRepair(t *testing.T) {
+	const valid = "1,1,a\n2,1,b\n"
+	for _, tt := range []struct {
+		name, data string
+		want       []string // ids, nil if opening fails
+		repaired   bool
+	}{
+		{"empty", "", []string{}, false},
+		{"valid", valid, []string{"1", "2"}, false},
+		{"truncated last row", valid + `3,1,"unterminated`, []string{"1", "2"}, true},
+		{"garbage last row", valid + "3,1,a\"b\n", []string{"1", "2"}, true},
+		{"garbage in the middle", "1,1,a\n2,1,b\"\n3,1,c\n", nil, false},
+	} {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "test.db")
+		must0(t, os.WriteFile(path, []byte(tt.data), 0644))
+		if tt.want == nil || tt.repaired {
+			if db, err := NewCSVDB(path); err == nil {
+				db.Close()
+				t.Errorf("%s: opened without repairing", tt.name)
+			}
+		}
+		db, err := NewCSVDB(path, WithTailRepair())
+		if tt.want == nil {
+			if err == nil {
+				db.Close()
+				t.Errorf("%s: expected an error", tt.name)
+			}
+			if _, err := os.Stat(path + ".bak"); err == nil {
+				t.Errorf("%s: backup of an unrepaired file", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		ids := []string{}
+		for rec, err := range db.Iter() {
+			ids = append(ids, must(rec, err).T(t)[0])
+		}
+		must0(t, db.Create(Record{"4", "1", "d"}))
+		must0(t, db.Close())
+		if !slices.Equal(ids, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, ids, tt.want)
+		}
+		if bak, err := os.ReadFile(path + ".bak"); tt.repaired && string(bak) != tt.data || !tt.repaired && err == nil {
+			t.Errorf("%s: got backup %q, %v", tt.name, bak, err)
+		}
+		if got := string(must(os.ReadFile(path)).T(t)); tt.repaired && got != valid+"4,1,d\n" {
+			t.Errorf("%s: got file %q", tt.name, got)
+		}
+	}
+}
+
+func TestLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := must(NewCSVDB(path)).T(t)
+	if _, err := NewCSVDB(path); !errors.Is(err, ErrLocked) {
+		t.Fatalf("got %v, want ErrLocked", err)
+	}
+	start := time.Now()
+	if _, err := NewCSVDB(path, WithLockTimeout(100*time.Millisecond)); !errors.Is(err, ErrLocked) {
+		t.Fatalf("got %v after waiting, want ErrLocked", err)
+	}
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Errorf("gave up after %v", d)
+	}
+	// Compacting replaces the file, the lock stays
+	must0(t, db.Create(Record{"1", "1", "a"}))
+	must0(t, db.Compact())
+	if _, err := NewCSVDB(path); !errors.Is(err, ErrLocked) {
+		t.Fatalf("got %v after compacting, want ErrLocked", err)
+	}
+
+	time.AfterFunc(50*time.Millisecond, func() { db.Close() })
+	next := must(NewCSVDB(path, WithLockTimeout(5*time.Second))).T(t)
+	if rec := must(next.Get("1")).T(t); rec[2] != "a" {
+		t.Errorf("got %v", rec)
+	}
+	must0(t, next.Close())
+
+	// Stores lock every file, and release them if they fail to open
+	dir := testData(t, filepath.Join("testdata", "rest"))
+	s := must(NewStore(dir)).T(t)
+	if _, err := NewStore(dir); !errors.Is(err, ErrLocked) {
+		t.Fatalf("got %v for a second store", err)
+	}
+	must0(t, s.Close())
+	books := must(NewCSVDB(filepath.Join(dir, "books.csv"))).T(t)
+	if _, err := NewStore(dir); !errors.Is(err, ErrLocked) {
+		t.Fatalf("got %v with books locked", err)
+	}
+	must0(t, books.Close())
+	must0(t, must(NewStore(dir)).T(t).Close())
+}
+
+func TestAutoCompact(t *testing.T) {
+	dir := DirStorage(t.TempDir())
+	db := must(openDB(dir, "test.db", csvFormat, 1, WithAutoCompact(AutoCompact{Ratio: 0.5, MinDead: 100}))).T(t)
+	defer func() { db.Close() }()
+	var wg sync.WaitGroup
+	for w := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 50 {
+				id := strconv.Itoa(w*50 + i)
+				must0(t, db.Create(Record{id, "1", "v1"}))
+				for v := 2; v <= 4; v++ {
+					must0(t, db.Update(Record{id, strconv.Itoa(v), "v" + strconv.Itoa(v)}))
+				}
+				if i%2 == 0 {
+					must0(t, db.Delete(id))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	seq := db.Seq()
+	if seq != 200*4+100 {
+		t.Fatalf("got seq %d", seq)
+	}
+	// Closing waits for the compaction in progress, if any. Writes made
+	// during a compaction don't start another one, so the file may be above
+	// the threshold again, but it was compacted.
+	must0(t, db.Close())
+	db = must(openDB(dir, "test.db", csvFormat, 1)).T(t)
+	st := db.Stats()
+	if st.Live != 100 || st.Rows >= seq || st.Size != db.size {
+		t.Errorf("got %+v after automatic compactions", st)
+	}
+	must0(t, db.Close())
+
+	// Stats survive reopening without the index file
+	db = must(openDB(dir, "test.db", csvFormat, 0)).T(t)
+	if got := db.Stats(); got != st || db.Seq() != seq {
+		t.Errorf("got %+v and seq %d after reopening, want %+v and %d", got, db.Seq(), st, seq)
+	}
+	must0(t, db.Close())
+	db = must(openDB(dir, "test.db", csvFormat, 0)).T(t)
+	must0(t, db.Compact())
+	if got := db.Stats(); got.Rows != 100 || got.Dead != 0 || got.DeadRatio != 0 {
+		t.Errorf("got %+v after compacting", got)
+	}
+}
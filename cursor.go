@@ -0,0 +1,97 @@
+package pennybase
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Row is a record yielded by IterFrom, with the offset of the next row,
+// where a resumed scan starts.
+type Row struct {
+	Record Record
+	Next   int64
+}
+
+// Resumable is implemented by databases whose scans can be resumed, see
+// Store.ListFrom.
+type Resumable interface {
+	IterFrom(offset int64) func(yield func(Row, error) bool)
+	Generation() int64
+}
+
+// ListFrom returns at most limit live records of a resource (all of them if
+// limit is 0) in the order they were written, starting at a cursor returned
+// by a previous call, or at the beginning if the cursor is empty. It also
+// returns the cursor of the next records, which is empty once they are all
+// read. Unlike List it holds only one page of records in memory. Records
+// updated during the scan are returned again with their new version.
+// Compacting the resource file expires the cursors, and resuming a scan then
+// fails with an "invalid_cursor" error.
+func (s *Store) ListFrom(resource, cursor string, limit int) ([]Resource, string, error) {
+	return s.listFrom(context.Background(), resource, cursor, limit)
+}
+
+func (s *Store) listFrom(ctx context.Context, resource, cursor string, limit int) (res []Resource, next string, err error) {
+	ctx, end := s.span(ctx, "store.list_from", Attr{"resource", resource})
+	defer func() { end(err) }()
+	done, err := s.enter()
+	if err != nil {
+		return nil, "", err
+	}
+	defer done()
+	db, ok := s.Resources[resource]
+	if !ok {
+		return nil, "", newError("resource_not_found", "resource", resource)
+	}
+	r, ok := db.(Resumable)
+	if !ok {
+		return nil, "", fmt.Errorf("resource %s does not support cursors", resource)
+	}
+	gen, offset := r.Generation(), int64(0)
+	if cursor != "" {
+		g, o, ok := parseCursor(cursor)
+		if !ok || g != gen {
+			return nil, "", newError("invalid_cursor")
+		}
+		offset = o
+	}
+	_, endDB := s.span(ctx, "db.iter", Attr{"resource", resource})
+	defer func() { endDB(err) }()
+	res, now := []Resource{}, time.Now()
+	for row, err := range r.IterFrom(offset) {
+		if err != nil {
+			return nil, "", err
+		}
+		if limit > 0 && len(res) == limit {
+			next = formatCursor(gen, offset)
+			break
+		}
+		rec, err := s.resource(resource, row.Record)
+		if err != nil {
+			return nil, "", err
+		}
+		if offset = row.Next; !s.expired(resource, rec, now) {
+			res = append(res, rec)
+		}
+	}
+	if r.Generation() != gen {
+		// Compacted while reading, the offsets may be off
+		return nil, "", newError("invalid_cursor")
+	}
+	return res, next, nil
+}
+
+// formatCursor encodes the generation of a file and an offset in it.
+func formatCursor(gen, offset int64) string {
+	return strconv.FormatInt(gen, 36) + "." + strconv.FormatInt(offset, 36)
+}
+
+func parseCursor(cursor string) (gen, offset int64, ok bool) {
+	g, o, ok := strings.Cut(cursor, ".")
+	gen, err1 := strconv.ParseInt(g, 36, 64)
+	offset, err2 := strconv.ParseInt(o, 36, 64)
+	return gen, offset, ok && err1 == nil && err2 == nil && gen >= 0 && offset >= 0
+}
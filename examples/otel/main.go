@@ -0,0 +1,47 @@
+//go:build ignore
+
+// This example shows how to export pennybase spans to OpenTelemetry. It lives
+// outside of the main module build so that pennybase itself keeps zero
+// dependencies. Copy it into your own module and run `go get go.opentelemetry.io/otel`.
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+
+	"github.com/zserge/pennybase"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type otelTracer struct{ t trace.Tracer }
+
+func (o otelTracer) StartSpan(ctx context.Context, name string, attrs ...pennybase.Attr) (context.Context, func(error)) {
+	kv := make([]attribute.KeyValue, 0, len(attrs))
+	for _, a := range attrs {
+		if a.Value != "" {
+			kv = append(kv, attribute.String("pennybase."+a.Key, a.Value))
+		}
+	}
+	ctx, span := o.t.Start(ctx, name, trace.WithAttributes(kv...))
+	return ctx, func(err error) {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
+
+func main() {
+	server, err := pennybase.NewServer("data", "templates", "static")
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Configure an exporter and tracer provider with otel.SetTracerProvider first.
+	server.Store.Tracer = otelTracer{t: otel.Tracer("pennybase")}
+	log.Fatal(http.ListenAndServe(":8080", server))
+}
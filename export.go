@@ -0,0 +1,323 @@
+package pennybase
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Canonical converts a record read from an external source into the canonical
+// form produced by Record. Besides canonical records it accepts missing
+// trailing fields, numbers with surrounding whitespace or in any format
+// understood by strconv.ParseFloat ("" is zero), datetimes with surrounding
+// whitespace or in any time zone, bools in any form understood by
+// strconv.ParseBool ("" is false), "\r\n" line endings in text and empty list
+// items.
+func (s Schema) Canonical(rec Record) (Record, error) {
+	if len(rec) > len(s) {
+		return nil, fmt.Errorf("record length %d is greater than schema length %d", len(rec), len(s))
+	}
+	rec = append(slices.Clone(rec), make(Record, len(s)-len(rec))...)
+	for i, field := range s {
+		if field.Type == Number {
+			if rec[i] = strings.TrimSpace(rec[i]); rec[i] == "" {
+				rec[i] = "0"
+			}
+		} else if field.Type == DateTime || field.Type == Bool {
+			rec[i] = strings.TrimSpace(rec[i])
+		}
+	}
+	res, err := s.Resource(rec)
+	if err != nil {
+		return nil, err
+	}
+	return s.Record(res)
+}
+
+// ExportCSV writes all live records of the resource as CSV in canonical form.
+// The first row holds the field names.
+func (s *Store) ExportCSV(resource string, w io.Writer) error {
+	done, err := s.enter()
+	if err != nil {
+		return err
+	}
+	defer done()
+	schema, ok := s.Schemas[resource]
+	if !ok {
+		return newError("resource_not_found", "resource", resource)
+	}
+	cw := csv.NewWriter(w)
+	header := Record{}
+	for _, field := range schema {
+		header = append(header, field.Field)
+	}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for rec, err := range s.Resources[resource].Iter() {
+		if err != nil {
+			return err
+		}
+		if rec, err = schema.Canonical(rec); err != nil {
+			return err
+		}
+		if err := cw.Write(rec); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// Stream writes all live records of the resource to w as newline-delimited
+// JSON, one object per line, while iterating over the file, so that the
+// records are never held in memory at once. Writes to the resource wait until
+// it returns.
+func (s *Store) Stream(resource string, w io.Writer) error {
+	return s.stream(context.Background(), resource, w, nil)
+}
+
+// Export writes all live records of the resource to w as JSON lines, like
+// Stream, in a form that Import reads back.
+func (s *Store) Export(resource string, w io.Writer) error {
+	return s.stream(context.Background(), resource, w, nil)
+}
+
+// stream is like Stream, and converts the records with view if it's not nil.
+func (s *Store) stream(ctx context.Context, resource string, w io.Writer, view func(Resource) Resource) (err error) {
+	ctx, end := s.span(ctx, "store.stream", Attr{"resource", resource})
+	defer func() { end(err) }()
+	done, err := s.enter()
+	if err != nil {
+		return err
+	}
+	defer done()
+	db, ok := s.Resources[resource]
+	if !ok {
+		return newError("resource_not_found", "resource", resource)
+	}
+	_, endDB := s.span(ctx, "db.iter", Attr{"resource", resource})
+	defer func() { endDB(err) }()
+	enc := json.NewEncoder(w)
+	for rec, err := range db.Iter() {
+		if err != nil {
+			return err
+		}
+		if len(rec) < 2 {
+			continue
+		}
+		r, err := s.resource(resource, rec)
+		if err != nil {
+			return err
+		}
+		if view != nil {
+			r = view(r)
+		}
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportCSV reads records written by ExportCSV and applies them like replicated
+// records, keeping their IDs and versions. Columns are matched by the header
+// row, so they may come in any order and missing columns are empty. Every
+// record is converted with Schema.Canonical before it is stored.
+func (s *Store) ImportCSV(resource string, r io.Reader) error {
+	done, err := s.enter()
+	if err != nil {
+		return err
+	}
+	defer done()
+	schema, ok := s.Schemas[resource]
+	if !ok {
+		return newError("resource_not_found", "resource", resource)
+	}
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return fmt.Errorf("reading header: %w", err)
+	}
+	columns := make([]int, len(header))
+	for i, name := range header {
+		if columns[i] = slices.IndexFunc(schema, func(f FieldSchema) bool { return f.Field == name }); columns[i] < 0 {
+			return fmt.Errorf("unknown field %q", name)
+		}
+		if slices.Index(header[:i], name) >= 0 {
+			return fmt.Errorf("duplicate field %q", name)
+		}
+	}
+	for {
+		row, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line, _ := cr.FieldPos(0)
+		if len(row) > len(header) {
+			return fmt.Errorf("line %d: too many fields", line)
+		}
+		rec := make(Record, len(schema))
+		for i, v := range row {
+			rec[columns[i]] = v
+		}
+		if rec, err = schema.Canonical(rec); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if err := s.Apply(resource, rec); err != nil {
+			return err
+		}
+	}
+}
+
+// Import reads records written by Export, one JSON object per line, and
+// writes them to the resource as a single operation (see Batch). A record
+// with the "_id" of an existing record updates it if merge is true and is an
+// error otherwise, other records are created, with a new id if they have
+// none. Versions are not kept, see ImportCSV for that. Every record is validated
+// before anything is written, and the error of the first invalid one has its
+// line number.
+func (s *Store) Import(resource string, r io.Reader, merge bool) error {
+	return s.importJSON(context.Background(), resource, r, merge)
+}
+
+func (s *Store) importJSON(ctx context.Context, resource string, r io.Reader, merge bool) (err error) {
+	ctx, end := s.span(ctx, "store.import_json", Attr{"resource", resource})
+	defer func() { end(err) }()
+	done, err := s.enter()
+	if err != nil {
+		return err
+	}
+	defer done()
+	if _, ok := s.Schemas[resource]; !ok {
+		return newError("resource_not_found", "resource", resource)
+	}
+	s.slugMu.Lock()
+	defer s.slugMu.Unlock()
+	writes, ids, seen := []Write{}, map[string]bool{}, map[string]string{}
+	br := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		data, err := br.ReadBytes('\n')
+		if len(bytes.TrimSpace(data)) > 0 {
+			w, err := s.importWrite(ctx, resource, data, merge, ids, seen)
+			if err != nil {
+				return atLine(line, err)
+			}
+			writes = append(writes, w)
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	if len(writes) == 0 {
+		return nil
+	}
+	return s.batch(ctx, "import", writes)
+}
+
+// importWrite validates a line of Import and returns its write. ids and
+// seen track the records and the unique values of the previous lines.
+func (s *Store) importWrite(ctx context.Context, resource string, data []byte, merge bool, ids map[string]bool, seen map[string]string) (Write, error) {
+	var res Resource
+	if err := json.Unmarshal(data, &res); err != nil {
+		return Write{}, err
+	}
+	for _, field := range s.Schemas[resource] {
+		items, ok := res[field.Field].([]any)
+		if !ok || field.Type != List {
+			continue
+		}
+		list := make([]string, len(items))
+		for i, item := range items {
+			if list[i], ok = item.(string); !ok {
+				return Write{}, newError("invalid_field", "field", field.Field)
+			}
+		}
+		res[field.Field] = list
+	}
+	w := Write{Resource: resource, Action: "create", Data: res}
+	if id, _ := res["_id"].(string); id != "" && merge {
+		if _, err := s.get(ctx, resource, id); err == nil {
+			w.Action = "update"
+		}
+	}
+	rec, err := s.prepare(ctx, w)
+	if err != nil {
+		return Write{}, err
+	}
+	if ids[rec[0]] {
+		return Write{}, fmt.Errorf("record %s/%s is written more than once", resource, rec[0])
+	}
+	if err := s.checkUnique(resource, rec, seen); err != nil {
+		return Write{}, err
+	}
+	ids[rec[0]], res["_id"] = true, rec[0] // new ids are kept for the batch
+	return w, nil
+}
+
+// lineError is an error of a line of an import.
+type lineError struct {
+	line int
+	err  error
+}
+
+func (e *lineError) Error() string { return fmt.Sprintf("line %d: %v", e.line, e.err) }
+func (e *lineError) Unwrap() error { return e.err }
+
+// atLine adds the line number to an import error. Coded errors get it as the
+// "line" param too, so that clients see it.
+func atLine(line int, err error) error {
+	if e := (*Error)(nil); errors.As(err, &e) {
+		params := maps.Clone(e.Params)
+		if params == nil {
+			params = map[string]string{}
+		}
+		params["line"] = strconv.Itoa(line)
+		err = &Error{Code: e.Code, Params: params}
+	}
+	return &lineError{line, err}
+}
+
+// handleExport sends the records of a resource as a JSON lines file, see
+// Store.Export.
+func (s *Server) handleExport(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", r.PathValue("resource")+".jsonl"))
+	s.handleStream(w, r)
+}
+
+// handleImport writes the records of a JSON lines body, see Store.Import,
+// merging them into existing records with ?merge=1. Errors of invalid lines
+// are 400 Bad Request unless their code says otherwise.
+func (s *Server) handleImport(w http.ResponseWriter, r *http.Request) {
+	resource := r.PathValue("resource")
+	if resource == "_users" {
+		s.WriteError(w, r, http.StatusBadRequest, newError("batch_unsupported", "resource", resource))
+		return
+	}
+	err := s.Store.importJSON(r.Context(), resource, r.Body, r.FormValue("merge") == "1")
+	if err != nil {
+		status := errorStatus(err)
+		if le := (*lineError)(nil); errors.As(err, &le) && status == http.StatusInternalServerError {
+			status = http.StatusBadRequest
+		}
+		s.WriteError(w, r, status, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
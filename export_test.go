@@ -0,0 +1,343 @@
+package pennybase
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const exportSchemas = `s1,1,items,_id,text,,,^.+$
+s2,1,items,_v,number,1,,
+s3,1,items,n,number,,,
+s4,1,items,title,text,,,
+s5,1,items,tags,list,,,
+s6,1,items,code,text,,,,"trim,lower"
+`
+
+func exportStore(t *testing.T) *Store {
+	t.Helper()
+	dir := t.TempDir()
+	must0(t, os.WriteFile(filepath.Join(dir, "_schemas.csv"), []byte(exportSchemas), 0644))
+	s := must(NewStore(dir)).T(t)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestFormatNumber(t *testing.T) {
+	for n, want := range map[float64]string{
+		0:                           "0",
+		math.Copysign(0, -1):        "0",
+		1:                           "1",
+		-2.5:                        "-2.5",
+		1e6:                         "1000000",
+		123456789:                   "123456789",
+		0.30000000000000004:         "0.30000000000000004",
+		1e-6:                        "0.000001",
+		1e-7:                        "1e-7",
+		1e20:                        "100000000000000000000",
+		1e21:                        "1e+21",
+		math.MaxFloat64:             "1.7976931348623157e+308",
+		math.SmallestNonzeroFloat64: "5e-324",
+	} {
+		if got := formatNumber(n); got != want {
+			t.Errorf("formatNumber(%v) = %q, want %q", n, got, want)
+		}
+	}
+}
+
+func TestSchemaCanonical(t *testing.T) {
+	schema := exportStore(t).Schemas["items"]
+	tests := []struct {
+		name string
+		rec  Record
+		want Record
+	}{
+		{"canonical", Record{"a", "1", "1.5", "x", "p,q", "c"}, Record{"a", "1", "1.5", "x", "p,q", "c"}},
+		{"missing fields", Record{"a", "1"}, Record{"a", "1", "0", "", "", ""}},
+		{"empty number", Record{"a", "1", "", "", "", ""}, Record{"a", "1", "0", "", "", ""}},
+		{"number variants", Record{"a", " 2.0 ", "1e3", "", "", ""}, Record{"a", "2", "1000", "", "", ""}},
+		{"negative zero", Record{"a", "1", "-0", "", "", ""}, Record{"a", "1", "0", "", "", ""}},
+		{"line endings", Record{"a", "1", "0", "x\r\ny\rz", "", ""}, Record{"a", "1", "0", "x\ny\nz", "", ""}},
+		{"empty list items", Record{"a", "1", "0", "", ",p,,q,", ""}, Record{"a", "1", "0", "", "p,q", ""}},
+		{"list items with commas", Record{"a", "1", "0", "", `["p,q","r"]`, ""}, Record{"a", "1", "0", "", `["p,q","r"]`, ""}},
+		{"json list without commas", Record{"a", "1", "0", "", `["p","","q"]`, ""}, Record{"a", "1", "0", "", "p,q", ""}},
+		{"list like json", Record{"a", "1", "0", "", "[p,q]", ""}, Record{"a", "1", "0", "", `["[p","q]"]`, ""}},
+		{"normalized field", Record{"a", "1", "0", "", "", " ABC "}, Record{"a", "1", "0", "", "", "abc"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := must(schema.Canonical(tt.rec)).T(t); !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+	for _, rec := range []Record{
+		{"a", "1", "NaN", "", "", ""},
+		{"a", "1", "Inf", "", "", ""},
+		{"a", "1", "one", "", "", ""},
+		{"a", "0", "1", "", "", ""},
+		{"a", "1", "0", "", "", "", "extra"},
+	} {
+		if _, err := schema.Canonical(rec); err == nil {
+			t.Errorf("expected error for %q", rec)
+		}
+	}
+}
+
+// randomText returns short strings biased towards characters that are special
+// in CSV, in lists or in normalization.
+func randomText(r *rand.Rand) string {
+	chars := []string{"a", "Z", "0", " ", ",", "\"", "'", "\n", "\r", "\r\n", "\t", "\\", "e\u0301", "\u00e9", "\u65e5", "\u200b", "\U0001F600"}
+	var sb strings.Builder
+	for range r.IntN(8) {
+		sb.WriteString(chars[r.IntN(len(chars))])
+	}
+	return sb.String()
+}
+
+func randomNumber(r *rand.Rand) float64 {
+	switch r.IntN(6) {
+	case 0:
+		return float64(r.IntN(2000) - 1000)
+	case 1:
+		return r.NormFloat64() * math.Pow(10, float64(r.IntN(60)-30))
+	case 2:
+		return math.Copysign(0, -1)
+	case 3:
+		return float64(r.Int64())
+	case 4:
+		return math.Float64frombits(r.Uint64N(1 << 52)) // subnormal
+	default:
+		if n := math.Float64frombits(r.Uint64()); !math.IsNaN(n) && !math.IsInf(n, 0) {
+			return n
+		}
+		return 0
+	}
+}
+
+func randomResource(r *rand.Rand) Resource {
+	res := Resource{}
+	if r.IntN(4) > 0 {
+		res["n"] = randomNumber(r)
+	}
+	if r.IntN(4) > 0 {
+		res["title"] = randomText(r)
+	}
+	if r.IntN(4) > 0 {
+		tags := []string{}
+		for range r.IntN(4) {
+			tags = append(tags, randomText(r))
+		}
+		res["tags"] = tags
+	}
+	if r.IntN(4) > 0 {
+		res["code"] = randomText(r)
+	}
+	return res
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewPCG(1, 2))
+	src := exportStore(t)
+	for range 500 {
+		res := randomResource(r)
+		id := must(src.Create("items", res)).T(t)
+		if r.IntN(3) == 0 {
+			res = randomResource(r)
+			res["_id"], res["_v"] = id, 1.0
+			must0(t, src.Update("items", res))
+		}
+		if r.IntN(10) == 0 {
+			must0(t, src.Delete("items", id))
+		}
+	}
+	// Every stored record is already canonical
+	schema := src.Schemas["items"]
+	for rec, err := range src.Resources["items"].Iter() {
+		must0(t, err)
+		if got := must(schema.Canonical(rec)).T(t); !slices.Equal(got, rec) {
+			t.Fatalf("record %q is not canonical, want %q", rec, got)
+		}
+	}
+
+	var first, second bytes.Buffer
+	must0(t, src.ExportCSV("items", &first))
+	dst := exportStore(t)
+	must0(t, dst.ImportCSV("items", bytes.NewReader(first.Bytes())))
+	must0(t, dst.ExportCSV("items", &second))
+	if !bytes.Equal(first.Bytes(), second.Bytes()) {
+		t.Fatalf("export changed after import:\n%s\n---\n%s", first.String(), second.String())
+	}
+	want := must(src.List("items", "")).T(t)
+	got := must(dst.List("items", "")).T(t)
+	if len(got) != len(want) {
+		t.Fatalf("imported %d records, want %d", len(got), len(want))
+	}
+	// Importing the same export again changes nothing
+	must0(t, dst.ImportCSV("items", bytes.NewReader(first.Bytes())))
+	if seq := dst.ChangeSeq("items"); seq != int64(len(want)) {
+		t.Errorf("reimport wrote records, change counter is %d", seq)
+	}
+}
+
+func TestImportVariants(t *testing.T) {
+	s := exportStore(t)
+	data := "title,_v,_id,n\r\n" +
+		"\"Hello\r\nworld\",1,a, 1.50\r\n" +
+		",1,b\r\n"
+	must0(t, s.ImportCSV("items", strings.NewReader(data)))
+	var out bytes.Buffer
+	must0(t, s.ExportCSV("items", &out))
+	want := "_id,_v,n,title,tags,code\n" +
+		"a,1,1.5,\"Hello\nworld\",,\n" +
+		"b,1,0,,,\n"
+	if out.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", out.String(), want)
+	}
+	for _, data := range []string{
+		"_id,_v,color\na,1,red\n",
+		"_id,_v,_v\na,1,1\n",
+		"_id,_v\na,1,extra\n",
+		"_id,_v,n\na,1,many\n",
+	} {
+		if err := s.ImportCSV("items", strings.NewReader(data)); err == nil {
+			t.Errorf("expected error importing %q", data)
+		}
+	}
+	if err := s.ImportCSV("unknown", strings.NewReader("_id\n")); err == nil {
+		t.Error("expected error for an unknown resource")
+	}
+}
+
+func TestServerStream(t *testing.T) {
+	s := must(NewServer(testData(t, filepath.Join("testdata", "graphql")), "", "")).T(t)
+	defer s.Store.Close()
+	must0(t, s.Store.Update("books", Resource{"_id": "b1", "title": "The Dispossessed: An Ambiguous Utopia"}))
+	must0(t, s.Store.Delete("books", "b2"))
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/books/stream", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("got status %d, content type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	got := map[string]Resource{}
+	dec := json.NewDecoder(w.Body)
+	for lines := strings.Count(w.Body.String(), "\n"); dec.More(); {
+		var r Resource
+		must0(t, dec.Decode(&r))
+		got[r["_id"].(string)] = r
+		if len(got) > lines {
+			t.Fatal("records are not on separate lines")
+		}
+	}
+	want := map[string]Resource{}
+	for _, r := range must(s.Store.List("books", "")).T(t) {
+		want[r["_id"].(string)] = r
+	}
+	if !reflect.DeepEqual(got, want) || len(got) != 3 {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	w = httptest.NewRecorder()
+	if s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/movies/stream", nil)); w.Code == http.StatusOK {
+		t.Error("got status 200 for a missing resource")
+	}
+}
+
+func TestExportImportJSON(t *testing.T) {
+	s := exportStore(t)
+	id := must(s.Create("items", Resource{"n": 1.0, "title": "one", "tags": []string{"a"}})).T(t)
+	var buf bytes.Buffer
+	must0(t, s.Export("items", &buf))
+
+	t2 := exportStore(t)
+	must0(t, t2.Import("items", bytes.NewReader(buf.Bytes()), false))
+	if got := must(t2.Get("items", id)).T(t); got["title"] != "one" || !reflect.DeepEqual(got["tags"], []string{"a"}) {
+		t.Errorf("got %v after import", got)
+	}
+	if err := t2.Import("items", bytes.NewReader(buf.Bytes()), false); err == nil {
+		t.Error("imported an existing record without merge")
+	}
+
+	lines := `{"_id":"` + id + `","n":2,"title":"two"}` + "\n\n" + `{"title":"new","tags":["b","c"]}` + "\n"
+	must0(t, t2.Import("items", strings.NewReader(lines), true))
+	if got := must(t2.Get("items", id)).T(t); got["title"] != "two" || got["_v"] != 2.0 {
+		t.Errorf("got %v after merge", got)
+	}
+	if n := len(must(t2.List("items", "")).T(t)); n != 2 {
+		t.Errorf("got %d records, want 2", n)
+	}
+
+	for _, bad := range []string{
+		`{"title":"ok"}` + "\n" + `{"n":"x"}`,
+		`{"title":"ok"}` + "\n" + `{"tags":[1]}`,
+		`{"title":"ok"}` + "\n" + `not json`,
+		`{"_id":"x"}` + "\n" + `{"_id":"x"}`,
+	} {
+		err := t2.Import("items", strings.NewReader(bad), true)
+		if err == nil || !strings.Contains(err.Error(), "line 2") {
+			t.Errorf("%q: got %v, want an error at line 2", bad, err)
+		}
+		if e := (*Error)(nil); errors.As(err, &e) && e.Params["line"] != "2" {
+			t.Errorf("%q: got params %v", bad, e.Params)
+		}
+	}
+	if n := len(must(t2.List("items", "")).T(t)); n != 2 {
+		t.Errorf("got %d records after failed imports, want 2", n)
+	}
+}
+
+func TestServerExportImport(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "rest"))
+	f := must(os.OpenFile(filepath.Join(dir, "_permissions.csv"), os.O_APPEND|os.O_WRONLY, 0)).T(t)
+	must(f.WriteString("p8,1,books,export,,admin,,\np9,1,books,import,,admin,,\n")).T(t)
+	must0(t, f.Close())
+	s := must(NewServer(dir, "", "")).T(t)
+	defer s.Store.Close()
+
+	do := func(method, path, body, user, pass string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if user != "" {
+			req.SetBasicAuth(user, pass)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w
+	}
+	if w := do(http.MethodGet, "/api/books/_export", "", "user1", "user1pass"); w.Code != http.StatusForbidden && w.Code != http.StatusUnauthorized {
+		t.Errorf("export by a user: got status %d", w.Code)
+	}
+	w := do(http.MethodGet, "/api/books/_export", "", "admin", "admin123")
+	if w.Code != http.StatusOK || !strings.Contains(w.Header().Get("Content-Disposition"), "books.jsonl") {
+		t.Fatalf("got status %d, headers %v", w.Code, w.Header())
+	}
+	if n := strings.Count(w.Body.String(), "\n"); n != 2 {
+		t.Errorf("got %d lines, want 2", n)
+	}
+	lines := `{"_id":"book1","title":"The Go Programming Language, 2nd ed."}` + "\n" + `{"title":"Dune","author":"Frank Herbert","year":1965}`
+	if w := do(http.MethodPost, "/api/books/_import", lines, "user1", "user1pass"); w.Code == http.StatusNoContent {
+		t.Error("import by a user succeeded")
+	}
+	if w := do(http.MethodPost, "/api/books/_import", lines, "admin", "admin123"); w.Code != http.StatusBadRequest && w.Code != http.StatusConflict {
+		t.Errorf("import of an existing record without merge: got status %d", w.Code)
+	}
+	if w := do(http.MethodPost, "/api/books/_import?merge=1", lines, "admin", "admin123"); w.Code != http.StatusNoContent {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	if got := must(s.Store.Get("books", "book1")).T(t); got["title"] != "The Go Programming Language, 2nd ed." {
+		t.Errorf("got %v", got)
+	}
+	if n := len(must(s.Store.List("books", "")).T(t)); n != 3 {
+		t.Errorf("got %d books, want 3", n)
+	}
+}
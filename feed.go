@@ -0,0 +1,149 @@
+package pennybase
+
+import (
+	"cmp"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// FeedConfig maps resource fields to Atom feed entries. Each field can be
+// overridden with a query parameter of the same name, e.g.
+// /api/posts/_feed.atom?title=headline&limit=10.
+type FeedConfig struct {
+	Title   string // feed title, defaults to the resource name
+	Author  string // feed author, defaults to "pennybase"
+	Updated string // datetime field (RFC3339 text or unix seconds), defaults to "updated"
+	Entry   string // entry title field, defaults to "title"
+	Summary string // entry summary field, optional
+	Content string // entry content field, optional
+	Limit   int    // number of most recent entries, defaults to 20
+}
+
+type atomText struct {
+	Type string `xml:"type,attr,omitempty"`
+	Body string `xml:",chardata"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	ID      string    `xml:"id"`
+	Title   atomText  `xml:"title"`
+	Updated string    `xml:"updated"`
+	Link    atomLink  `xml:"link"`
+	Summary *atomText `xml:"summary,omitempty"`
+	Content *atomText `xml:"content,omitempty"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string   `xml:"id"`
+	Title   atomText `xml:"title"`
+	Updated string   `xml:"updated"`
+	Author  struct {
+		Name string `xml:"name"`
+	} `xml:"author"`
+	Link    atomLink    `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+func feedTime(v any) (time.Time, bool) {
+	switch v := v.(type) {
+	case time.Time:
+		return v, !v.IsZero()
+	case float64:
+		return time.Unix(int64(v), 0).UTC(), v != 0
+	case string:
+		t, err := time.Parse(time.RFC3339, v)
+		return t.UTC(), err == nil
+	}
+	return time.Time{}, false
+}
+
+// handleFeed serves an Atom feed of the records the user is allowed to read.
+// Feed readers are mostly anonymous, so unlike the list API it doesn't
+// require read access to the whole resource.
+func (s *Server) handleFeed(w http.ResponseWriter, r *http.Request) {
+	resource := r.PathValue("resource")
+	cfg := s.Feeds[resource]
+	for name, p := range map[string]*string{"updated": &cfg.Updated, "title": &cfg.Entry, "summary": &cfg.Summary, "content": &cfg.Content} {
+		if v := r.FormValue(name); v != "" {
+			*p = v
+		}
+	}
+	if n, err := strconv.Atoi(r.FormValue("limit")); err == nil && n > 0 {
+		cfg.Limit = n
+	}
+	cfg.Title = cmp.Or(cfg.Title, resource)
+	cfg.Author = cmp.Or(cfg.Author, "pennybase")
+	cfg.Updated = cmp.Or(cfg.Updated, "updated")
+	cfg.Entry = cmp.Or(cfg.Entry, "title")
+	cfg.Limit = cmp.Or(cfg.Limit, 20)
+
+	user, _ := s.Authenticate(r)
+	all, err := s.Store.list(r.Context(), resource, "")
+	if err != nil {
+		s.WriteError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	type item struct {
+		res     Resource
+		updated time.Time
+	}
+	items := []item{}
+	for _, res := range all {
+		updated, ok := feedTime(res[cfg.Updated])
+		if !ok || s.authorize(r.Context(), resource, res["_id"].(string), "read", user) != nil {
+			continue
+		}
+		items = append(items, item{res, updated})
+	}
+	sort.SliceStable(items, func(i, j int) bool { return items[i].updated.After(items[j].updated) })
+	if len(items) > cfg.Limit {
+		items = items[:cfg.Limit]
+	}
+
+	lastModified := time.Unix(0, 0).UTC()
+	if len(items) > 0 {
+		lastModified = items[0].updated
+	}
+	if t, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !lastModified.Truncate(time.Second).After(t) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	base := fmt.Sprintf("%s://%s/api/%s/", scheme, r.Host, resource)
+	feed := atomFeed{ID: base + "_feed.atom", Title: atomText{Body: cfg.Title}, Updated: lastModified.Format(time.RFC3339), Link: atomLink{Rel: "self", Href: base + "_feed.atom"}}
+	feed.Author.Name = cfg.Author
+	for _, it := range items {
+		id := it.res["_id"].(string)
+		e := atomEntry{
+			ID:      fmt.Sprintf("urn:pennybase:%s:%s", resource, id),
+			Title:   atomText{Type: "text", Body: fmt.Sprint(cmp.Or(it.res[cfg.Entry], any(id)))},
+			Updated: it.updated.Format(time.RFC3339),
+			Link:    atomLink{Rel: "alternate", Href: base + id},
+		}
+		if v, ok := it.res[cfg.Summary]; ok && cfg.Summary != "" {
+			e.Summary = &atomText{Type: "text", Body: fmt.Sprint(v)}
+		}
+		if v, ok := it.res[cfg.Content]; ok && cfg.Content != "" {
+			e.Content = &atomText{Type: "text", Body: fmt.Sprint(v)}
+		}
+		feed.Entries = append(feed.Entries, e)
+	}
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+	_, _ = w.Write([]byte(xml.Header))
+	_ = xml.NewEncoder(w).Encode(feed)
+}
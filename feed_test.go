@@ -0,0 +1,98 @@
+package pennybase
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// parseAtom decodes a feed, checking the elements required by RFC 4287.
+func parseAtom(t *testing.T, body []byte) atomFeed {
+	t.Helper()
+	var feed atomFeed
+	must0(t, xml.Unmarshal(body, &feed))
+	if feed.XMLName.Space != "http://www.w3.org/2005/Atom" || feed.XMLName.Local != "feed" {
+		t.Errorf("not an Atom feed: %v", feed.XMLName)
+	}
+	if feed.ID == "" || feed.Title.Body == "" || feed.Author.Name == "" {
+		t.Errorf("feed is missing id, title or author: %+v", feed)
+	}
+	if _, err := time.Parse(time.RFC3339, feed.Updated); err != nil {
+		t.Errorf("invalid feed updated: %v", err)
+	}
+	ids := map[string]bool{}
+	for _, e := range feed.Entries {
+		if e.ID == "" || e.Title.Body == "" || ids[e.ID] {
+			t.Errorf("entry is missing title or has no unique id: %+v", e)
+		}
+		ids[e.ID] = true
+		if _, err := time.Parse(time.RFC3339, e.Updated); err != nil {
+			t.Errorf("invalid entry updated: %v", err)
+		}
+	}
+	return feed
+}
+
+func TestFeed(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "feed"))
+	s := must(NewServer(dir, "", "")).T(t)
+	defer s.Store.Close()
+	s.Feeds = map[string]FeedConfig{"posts": {Title: "My blog", Updated: "published", Summary: "summary", Content: "body"}}
+
+	get := func(path string, auth [2]string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if auth[0] != "" {
+			req.SetBasicAuth(auth[0], auth[1])
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("/api/posts/_feed.atom", [2]string{}, nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/atom+xml; charset=utf-8" {
+		t.Fatalf("got %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	feed := parseAtom(t, w.Body.Bytes())
+	if feed.Title.Body != "My blog" || feed.Updated != "2024-03-01T10:00:00Z" || len(feed.Entries) != 3 {
+		t.Fatalf("unexpected feed: %+v", feed)
+	}
+	e := feed.Entries[2]
+	if e.ID != "urn:pennybase:posts:hello" || e.Title.Body != "Hello world" || e.Summary.Body != "First post" ||
+		e.Content.Body != "Hello <b>world</b> & everyone" || e.Link.Href != "http://example.com/api/posts/hello" {
+		t.Errorf("unexpected entry: %+v", e)
+	}
+	if feed.Entries[1].Updated != "2024-02-01T08:00:00Z" {
+		t.Errorf("entries are not sorted by date: %+v", feed.Entries)
+	}
+
+	// Query parameters override the configuration
+	feed = parseAtom(t, get("/api/posts/_feed.atom?title=summary&limit=1", [2]string{}, nil).Body.Bytes())
+	if len(feed.Entries) != 1 || feed.Entries[0].Title.Body != "Even more news" {
+		t.Errorf("unexpected entries: %+v", feed.Entries)
+	}
+
+	// Conditional GET
+	lastModified := w.Header().Get("Last-Modified")
+	if w := get("/api/posts/_feed.atom", [2]string{}, http.Header{"If-Modified-Since": {lastModified}}); w.Code != http.StatusNotModified {
+		t.Errorf("got status %d for an unmodified feed", w.Code)
+	}
+	if w := get("/api/posts/_feed.atom", [2]string{}, http.Header{"If-Modified-Since": {"Mon, 01 Jan 2024 00:00:00 GMT"}}); w.Code != http.StatusOK {
+		t.Errorf("got status %d for a modified feed", w.Code)
+	}
+
+	// Private records only show up for users allowed to read them
+	if feed := parseAtom(t, get("/api/notes/_feed.atom", [2]string{}, nil).Body.Bytes()); len(feed.Entries) != 0 {
+		t.Errorf("got private entries in anonymous feed: %+v", feed.Entries)
+	}
+	feed = parseAtom(t, get("/api/notes/_feed.atom", [2]string{"user1", "user1pass"}, nil).Body.Bytes())
+	if len(feed.Entries) != 1 || feed.Entries[0].ID != "urn:pennybase:notes:n2" || feed.Entries[0].Updated != "2023-11-14T22:15:00Z" {
+		t.Errorf("unexpected private feed entries: %+v", feed.Entries)
+	}
+}
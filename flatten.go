@@ -0,0 +1,52 @@
+package pennybase
+
+import (
+	"encoding/json"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// flatten replaces the text fields holding JSON that have the "flatten"
+// option with the configured keys of their values, e.g. "metadata.title" for
+// the key "title" of the field "metadata". Nested keys are separated by dots.
+// Keys missing from the value are left out, and so are values that aren't
+// JSON objects. Records without such fields are returned as they are.
+func (s Schema) flatten(res Resource) Resource {
+	if !slices.ContainsFunc(s, func(f FieldSchema) bool { return f.Flatten != "" }) {
+		return res
+	}
+	out := maps.Clone(res)
+	for _, field := range s {
+		if field.Flatten == "" {
+			continue
+		}
+		text, _ := out[field.Field].(string)
+		delete(out, field.Field)
+		var obj map[string]any
+		if json.Unmarshal([]byte(text), &obj) != nil {
+			continue
+		}
+		for key := range strings.SplitSeq(field.Flatten, "|") {
+			if v, ok := lookupJSON(obj, key); ok {
+				out[field.Field+"."+key] = v
+			}
+		}
+	}
+	return out
+}
+
+// lookupJSON returns the value at a dotted path of keys in a JSON object.
+func lookupJSON(obj map[string]any, path string) (any, bool) {
+	var v any = obj
+	for key := range strings.SplitSeq(path, ".") {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if v, ok = m[key]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
@@ -0,0 +1,507 @@
+package pennybase
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// A minimal read-only GraphQL endpoint. Every resource is a root field
+// returning a list of objects:
+//
+//	{ books(filter: {author: "alice"}, sort: "title", limit: 10) { _id title } }
+//
+// Text fields holding an id of another resource can be resolved with a
+// "resource" argument, and records of another resource pointing back to the
+// current object can be listed with an "on" argument naming the referring
+// field:
+//
+//	{ books { title author(resource: "authors") { name books(on: "author") { title } } } }
+//
+// Only queries are supported: no mutations, variables, fragments or directives.
+// Objects the user is not allowed to read are left out of lists.
+
+type gqlField struct {
+	Alias, Name string
+	Args        map[string]any
+	Sel         []*gqlField
+	Line, Col   int
+}
+
+func (f *gqlField) key() string {
+	if f.Alias != "" {
+		return f.Alias
+	}
+	return f.Name
+}
+
+type gqlLocation struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+type gqlError struct {
+	Message   string        `json:"message"`
+	Locations []gqlLocation `json:"locations,omitempty"`
+	Path      []any         `json:"path,omitempty"`
+}
+
+func (e *gqlError) Error() string { return e.Message }
+
+type gqlParser struct {
+	src       string
+	pos       int
+	line, col int
+	depth     int // current nesting of selection sets, lists and objects
+	maxDepth  int
+}
+
+func (p *gqlParser) errorf(format string, args ...any) error {
+	return &gqlError{Message: "syntax error: " + fmt.Sprintf(format, args...), Locations: []gqlLocation{{p.line, p.col}}}
+}
+
+func (p *gqlParser) skip() {
+	for p.pos < len(p.src) {
+		switch c := p.src[p.pos]; {
+		case c == '#':
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		case c == '\n':
+			p.pos, p.line, p.col = p.pos+1, p.line+1, 1
+		case c == ' ' || c == '\t' || c == '\r' || c == ',':
+			p.pos, p.col = p.pos+1, p.col+1
+		default:
+			return
+		}
+	}
+}
+
+// enter opens a nested selection set or value, which must be left with
+// p.depth-- once parsed. Nesting is limited, so that queries following
+// references back and forth between resources can't grow without bound.
+func (p *gqlParser) enter() error {
+	if p.depth++; p.maxDepth > 0 && p.depth > p.maxDepth {
+		return &gqlError{Message: fmt.Sprintf("query is nested deeper than %d levels", p.maxDepth), Locations: []gqlLocation{{p.line, p.col}}}
+	}
+	return nil
+}
+
+func (p *gqlParser) peek() byte {
+	if p.skip(); p.pos < len(p.src) {
+		return p.src[p.pos]
+	}
+	return 0
+}
+
+func (p *gqlParser) advance(n int) {
+	p.pos, p.col = p.pos+n, p.col+n
+}
+
+func (p *gqlParser) expect(c byte) error {
+	if p.peek() != c {
+		return p.errorf("expected %q", c)
+	}
+	p.advance(1)
+	return nil
+}
+
+func isNameChar(c byte, first bool) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (!first && c >= '0' && c <= '9')
+}
+
+func (p *gqlParser) name() (string, error) {
+	p.skip()
+	start := p.pos
+	for p.pos < len(p.src) && isNameChar(p.src[p.pos], p.pos == start) {
+		p.pos++
+	}
+	if p.pos == start {
+		return "", p.errorf("expected name")
+	}
+	p.col += p.pos - start
+	return p.src[start:p.pos], nil
+}
+
+func parseGraphQL(src string, maxDepth int) ([]*gqlField, error) {
+	p := &gqlParser{src: src, line: 1, col: 1, maxDepth: maxDepth}
+	if c := p.peek(); isNameChar(c, true) {
+		op, _ := p.name()
+		if op != "query" {
+			return nil, &gqlError{Message: fmt.Sprintf("unsupported operation %q, only queries are supported", op)}
+		}
+		if isNameChar(p.peek(), true) {
+			_, _ = p.name() // operation name
+		}
+		if p.peek() == '(' {
+			return nil, p.errorf("variables are not supported")
+		}
+	}
+	sel, err := p.selectionSet()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek() != 0 {
+		return nil, p.errorf("unexpected %q after query, only one operation is supported", p.src[p.pos])
+	}
+	return sel, nil
+}
+
+func (p *gqlParser) selectionSet() ([]*gqlField, error) {
+	if err := p.expect('{'); err != nil {
+		return nil, err
+	}
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer func() { p.depth-- }()
+	sel := []*gqlField{}
+	for p.peek() != '}' {
+		if p.peek() == '.' || p.peek() == '@' {
+			return nil, p.errorf("fragments and directives are not supported")
+		}
+		f := &gqlField{Line: p.line, Col: p.col}
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() == ':' {
+			p.advance(1)
+			f.Alias = name
+			if name, err = p.name(); err != nil {
+				return nil, err
+			}
+		}
+		f.Name = name
+		if p.peek() == '(' {
+			p.advance(1)
+			f.Args = map[string]any{}
+			for p.peek() != ')' {
+				arg, err := p.name()
+				if err != nil {
+					return nil, err
+				}
+				if err := p.expect(':'); err != nil {
+					return nil, err
+				}
+				if f.Args[arg], err = p.value(); err != nil {
+					return nil, err
+				}
+			}
+			p.advance(1)
+		}
+		if p.peek() == '{' {
+			if f.Sel, err = p.selectionSet(); err != nil {
+				return nil, err
+			}
+		}
+		sel = append(sel, f)
+	}
+	p.advance(1)
+	if len(sel) == 0 {
+		return nil, p.errorf("empty selection set")
+	}
+	return sel, nil
+}
+
+func (p *gqlParser) value() (any, error) {
+	switch c := p.peek(); {
+	case c == '$':
+		return nil, p.errorf("variables are not supported")
+	case c == '"':
+		start := p.pos
+		for p.advance(1); p.pos < len(p.src) && p.src[p.pos] != '"'; p.advance(1) {
+			if p.src[p.pos] == '\\' {
+				p.advance(1)
+			} else if p.src[p.pos] == '\n' {
+				break
+			}
+		}
+		if p.pos >= len(p.src) || p.src[p.pos] != '"' {
+			return nil, p.errorf("unterminated string")
+		}
+		p.advance(1)
+		var s string
+		if err := json.Unmarshal([]byte(p.src[start:p.pos]), &s); err != nil {
+			return nil, p.errorf("invalid string: %v", err)
+		}
+		return s, nil
+	case c == '-' || (c >= '0' && c <= '9'):
+		start := p.pos
+		for p.advance(1); p.pos < len(p.src) && strings.IndexByte("0123456789.eE+-", p.src[p.pos]) >= 0; p.advance(1) {
+		}
+		n, err := strconv.ParseFloat(p.src[start:p.pos], 64)
+		if err != nil {
+			return nil, p.errorf("invalid number %q", p.src[start:p.pos])
+		}
+		return n, nil
+	case c == '[':
+		p.advance(1)
+		if err := p.enter(); err != nil {
+			return nil, err
+		}
+		defer func() { p.depth-- }()
+		list := []any{}
+		for p.peek() != ']' {
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		p.advance(1)
+		return list, nil
+	case c == '{':
+		p.advance(1)
+		if err := p.enter(); err != nil {
+			return nil, err
+		}
+		defer func() { p.depth-- }()
+		obj := map[string]any{}
+		for p.peek() != '}' {
+			k, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(':'); err != nil {
+				return nil, err
+			}
+			if obj[k], err = p.value(); err != nil {
+				return nil, err
+			}
+		}
+		p.advance(1)
+		return obj, nil
+	case isNameChar(c, true):
+		name, _ := p.name()
+		switch name {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+		return name, nil // enum value
+	}
+	return nil, p.errorf("expected value")
+}
+
+type gqlExec struct {
+	srv   *Server
+	store *Store
+	ctx   context.Context
+	user  Resource
+	errs  []*gqlError
+	// nested holds the records of each nested list field by the parent id
+	// they refer to, so that a resource is read once per field rather than
+	// once per parent object.
+	nested map[*gqlField]map[string][]Resource
+}
+
+func (e *gqlExec) fail(f *gqlField, path []any, format string, args ...any) any {
+	e.errs = append(e.errs, &gqlError{
+		Message:   fmt.Sprintf(format, args...),
+		Locations: []gqlLocation{{f.Line, f.Col}},
+		Path:      slices.Clone(path),
+	})
+	return nil
+}
+
+// list resolves a list of records of the resource matching the field arguments,
+// and optionally referring to the parent object with the id via the "on" field.
+func (e *gqlExec) list(resource string, f *gqlField, path []any, parentID string) any {
+	schema, ok := e.store.Schemas[resource]
+	if !ok {
+		return e.fail(f, path, "unknown resource %q", resource)
+	}
+	if f.Sel == nil {
+		return e.fail(f, path, "field %q must have a selection of subfields", f.Name)
+	}
+	filter := map[string]any{}
+	if m, ok := f.Args["filter"].(map[string]any); ok {
+		maps.Copy(filter, m)
+	} else if f.Args["filter"] != nil {
+		return e.fail(f, path, "filter must be an object")
+	}
+	if id, ok := f.Args["id"]; ok {
+		filter["_id"] = id
+	}
+	on, _ := f.Args["on"].(string)
+	sortBy, _ := f.Args["sort"].(string)
+	limit := -1
+	if n, ok := f.Args["limit"].(float64); ok {
+		limit = int(n)
+	}
+	for name, want := range filter {
+		i := slices.IndexFunc(schema, func(fs FieldSchema) bool { return fs.Field == name })
+		if i < 0 {
+			return e.fail(f, path, "unknown field %q in filter for %s", name, resource)
+		}
+		if s, ok := want.(string); ok {
+			filter[name] = schema[i].Normalize(s) // match the stored form
+		}
+		if t, ok := parseDateTime(filter[name]); ok && schema[i].Type == DateTime {
+			filter[name] = t
+		}
+	}
+	if on != "" && !slices.ContainsFunc(schema, func(fs FieldSchema) bool { return fs.Field == on }) {
+		return e.fail(f, path, "unknown field %q in %s", on, resource)
+	}
+	all, err := e.records(resource, f, on, sortBy, parentID)
+	if err != nil {
+		return e.fail(f, path, "%s", err)
+	}
+	res := []any{}
+	for _, r := range all {
+		if limit >= 0 && len(res) >= limit {
+			break
+		}
+		if !gqlMatches(r, filter) {
+			continue
+		}
+		if e.srv.authorize(e.ctx, resource, r["_id"].(string), "read", e.user) != nil {
+			continue
+		}
+		res = append(res, e.object(resource, r, f.Sel, append(path, len(res))))
+	}
+	return res
+}
+
+// records returns the records of the resource in the order of sortBy, only
+// those whose on field refers to the parent id if on is set. The nested lists
+// are read once for all the parents and grouped by parent id.
+func (e *gqlExec) records(resource string, f *gqlField, on, sortBy, parentID string) ([]Resource, error) {
+	if on == "" {
+		return e.store.list(e.ctx, resource, sortBy)
+	}
+	if groups, ok := e.nested[f]; ok {
+		return groups[parentID], nil
+	}
+	all, err := e.store.list(e.ctx, resource, sortBy)
+	if err != nil {
+		return nil, err
+	}
+	groups := map[string][]Resource{}
+	for _, r := range all {
+		ids := []string{}
+		switch v := r[on].(type) {
+		case string:
+			ids = append(ids, v)
+		case []string:
+			ids = append(ids, v...)
+		}
+		for _, id := range ids {
+			if g := groups[id]; len(g) == 0 || g[len(g)-1]["_id"] != r["_id"] {
+				groups[id] = append(g, r)
+			}
+		}
+	}
+	if e.nested == nil {
+		e.nested = map[*gqlField]map[string][]Resource{}
+	}
+	e.nested[f] = groups
+	return groups[parentID], nil
+}
+
+func gqlMatches(r Resource, filter map[string]any) bool {
+	for k, want := range filter {
+		if !gqlMatch(r[k], want) {
+			return false
+		}
+	}
+	return true
+}
+
+func gqlMatch(v, want any) bool {
+	if list, ok := v.([]string); ok {
+		return slices.Contains(list, fmt.Sprint(want))
+	}
+	return v == want
+}
+
+func (e *gqlExec) object(resource string, r Resource, sel []*gqlField, path []any) OrderedResource {
+	obj, r := OrderedResource{}, e.srv.view(resource, r)
+	for _, f := range sel {
+		path := append(path, f.key())
+		var field *FieldSchema
+		if i := slices.IndexFunc(e.store.Schemas[resource], func(fs FieldSchema) bool { return fs.Field == f.Name }); i >= 0 {
+			field = &e.store.Schemas[resource][i]
+		}
+		switch {
+		case f.Name == "__typename":
+			obj = append(obj, FieldValue{f.key(), resource})
+		case field == nil && f.Args["on"] != nil:
+			obj = append(obj, FieldValue{f.key(), e.list(f.Name, f, path, r["_id"].(string))})
+		case field == nil:
+			obj = append(obj, FieldValue{f.key(), e.fail(f, path, "unknown field %q on %s", f.Name, resource)})
+		case f.Sel == nil:
+			obj = append(obj, FieldValue{f.key(), r[f.Name]})
+		case field.Type == Reference:
+			obj = append(obj, FieldValue{f.key(), e.ref(field.Target, r[f.Name].(string), f, path)})
+		case field.Type == Text && f.Args["resource"] != nil:
+			obj = append(obj, FieldValue{f.key(), e.ref(fmt.Sprint(f.Args["resource"]), r[f.Name].(string), f, path)})
+		default:
+			obj = append(obj, FieldValue{f.key(), e.fail(f, path, "field %q of %s has no subfields", f.Name, resource)})
+		}
+	}
+	return obj
+}
+
+func (e *gqlExec) ref(resource, id string, f *gqlField, path []any) any {
+	if _, ok := e.store.Schemas[resource]; !ok {
+		return e.fail(f, path, "unknown resource %q", resource)
+	}
+	if id == "" {
+		return nil
+	}
+	if err := e.srv.authorize(e.ctx, resource, id, "read", e.user); err != nil {
+		return e.fail(f, path, "%s", err)
+	}
+	r, err := e.store.get(e.ctx, resource, id)
+	if err != nil || r == nil {
+		return e.fail(f, path, "%s/%s not found", resource, id)
+	}
+	return e.object(resource, r, f.Sel, path)
+}
+
+func (s *Server) handleGraphQL(w http.ResponseWriter, r *http.Request) {
+	if !s.GraphQL {
+		http.NotFound(w, r)
+		return
+	}
+	var req struct {
+		Query     string         `json:"query"`
+		Variables map[string]any `json:"variables"`
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]any{"errors": []*gqlError{{Message: err.Error()}}})
+		return
+	}
+	sel, err := parseGraphQL(req.Query, s.GraphQLDepth)
+	if err == nil && len(req.Variables) > 0 {
+		err = &gqlError{Message: "variables are not supported"}
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]any{"errors": []error{err}})
+		return
+	}
+	e := &gqlExec{srv: s, store: s.Store, ctx: r.Context(), user: CurrentUser(r)}
+	data := OrderedResource{}
+	for _, f := range sel {
+		data = append(data, FieldValue{f.key(), e.list(f.Name, f, []any{f.key()}, "")})
+	}
+	resp := map[string]any{"data": data}
+	if len(e.errs) > 0 {
+		resp["errors"] = e.errs
+	}
+	_ = json.NewEncoder(w).Encode(resp)
+}
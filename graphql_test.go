@@ -0,0 +1,216 @@
+package pennybase
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func graphQL(t *testing.T, s *Server, query string, auth [2]string) (int, string) {
+	t.Helper()
+	body := must(json.Marshal(map[string]string{"query": query})).T(t)
+	req := httptest.NewRequest(http.MethodPost, "/api/graphql", strings.NewReader(string(body)))
+	if auth[0] != "" {
+		req.SetBasicAuth(auth[0], auth[1])
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	return w.Code, strings.TrimSpace(w.Body.String())
+}
+
+func TestGraphQL(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "graphql"))
+	s := must(NewServer(dir, "", "")).T(t)
+	defer s.Store.Close()
+
+	if code, _ := graphQL(t, s, `{ books { title } }`, [2]string{}); code != http.StatusNotFound {
+		t.Errorf("expected GraphQL to be disabled by default, got status %d", code)
+	}
+	s.GraphQL = true
+
+	tests := []struct {
+		name   string
+		query  string
+		auth   [2]string
+		status int
+		want   string
+	}{
+		{
+			name:   "nested resolution",
+			query:  `query Books { books(id: "b3") { title year author(resource: "authors") { __typename name } } }`,
+			status: http.StatusOK,
+			want:   `{"data":{"books":[{"title":"Solaris","year":1961,"author":{"__typename":"authors","name":"Stanislaw Lem"}}]}}`,
+		},
+		{
+			name: "book to author to other books",
+			query: `{
+				first: books(filter: {year: 1974}) {
+					author(resource: "authors") {
+						name
+						books(on: "author", sort: "year", limit: 2) { title }
+					}
+				}
+			}`,
+			status: http.StatusOK,
+			want:   `{"data":{"first":[{"author":{"name":"Ursula K. Le Guin","books":[{"title":"A Wizard of Earthsea"},{"title":"The Left Hand of Darkness"}]}}]}}`,
+		},
+		{
+			name:   "permission-filtered objects anonymous",
+			query:  `{ drafts { title } }`,
+			status: http.StatusOK,
+			want:   `{"data":{"drafts":[]}}`,
+		},
+		{
+			name:   "permission-filtered objects as owner",
+			query:  `{ drafts { _id title } }`,
+			auth:   [2]string{"user1", "user1pass"},
+			status: http.StatusOK,
+			want:   `{"data":{"drafts":[{"_id":"d2","title":"User draft"}]}}`,
+		},
+		{
+			name:   "unauthorized reference",
+			query:  `{ drafts(id: "d2") { owner } books(id: "b1") { title author(resource: "drafts") { title } } }`,
+			status: http.StatusOK,
+			want:   `{"data":{"drafts":[],"books":[{"title":"The Dispossessed","author":null}]},"errors":[{"message":"unauthenticated","locations":[{"line":1,"column":54}],"path":["books",0,"author"]}]}`,
+		},
+		{
+			name:   "unknown field",
+			query:  `{ books(id: "b1") { isbn } }`,
+			status: http.StatusOK,
+			want:   `{"data":{"books":[{"isbn":null}]},"errors":[{"message":"unknown field \"isbn\" on books","locations":[{"line":1,"column":21}],"path":["books",0,"isbn"]}]}`,
+		},
+		{
+			name:   "unknown resource",
+			query:  `{ movies { title } }`,
+			status: http.StatusOK,
+			want:   `{"data":{"movies":null},"errors":[{"message":"unknown resource \"movies\"","locations":[{"line":1,"column":3}],"path":["movies"]}]}`,
+		},
+		{
+			name:   "unterminated selection",
+			query:  `{ books { title }`,
+			status: http.StatusBadRequest,
+			want:   `{"errors":[{"message":"syntax error: expected name","locations":[{"line":1,"column":18}]}]}`,
+		},
+		{
+			name:   "mutation",
+			query:  `mutation { books { title } }`,
+			status: http.StatusBadRequest,
+			want:   `{"errors":[{"message":"unsupported operation \"mutation\", only queries are supported"}]}`,
+		},
+		{
+			name:   "variables",
+			query:  `{ books(id: $id) { title } }`,
+			status: http.StatusBadRequest,
+			want:   `{"errors":[{"message":"syntax error: variables are not supported","locations":[{"line":1,"column":13}]}]}`,
+		},
+		{
+			name:   "unterminated string",
+			query:  `{ books(id: "b1) { title } }`,
+			status: http.StatusBadRequest,
+			want:   `{"errors":[{"message":"syntax error: unterminated string","locations":[{"line":1,"column":29}]}]}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, body := graphQL(t, s, tt.query, tt.auth)
+			if code != tt.status {
+				t.Errorf("got status %d, want %d", code, tt.status)
+			}
+			if body != tt.want {
+				t.Errorf("got  %s\nwant %s", body, tt.want)
+			}
+		})
+	}
+}
+
+func TestGraphQLDepth(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "graphql"))
+	s := must(NewServer(dir, "", "")).T(t)
+	defer s.Store.Close()
+	s.GraphQL = true
+
+	// books and authors refer to each other, so a query can go back and forth
+	cycle := func(n int) string {
+		q := "title"
+		for range n {
+			q = `author(resource: "authors") { books(on: "author", id: "b3") { ` + q + ` } }`
+		}
+		return `{ books(id: "b3") { ` + q + ` } }`
+	}
+	code, body := graphQL(t, s, cycle(4), [2]string{})
+	want := `{"data":{"books":[{"author":{"books":[{"author":{"books":[{"author":{"books":[{"author":{"books":[{"title":"Solaris"}]}}]}}]}}]}}]}}`
+	if code != http.StatusOK || body != want {
+		t.Errorf("got %d %s", code, body)
+	}
+	code, body = graphQL(t, s, cycle(5), [2]string{})
+	want = `{"errors":[{"message":"query is nested deeper than 10 levels","locations":[{"line":1,"column":298}]}]}`
+	if code != http.StatusBadRequest || body != want {
+		t.Errorf("got %d %s", code, body)
+	}
+	code, body = graphQL(t, s, `{ books(filter: `+strings.Repeat("[", 20)+`) { title } }`, [2]string{})
+	if code != http.StatusBadRequest || !strings.Contains(body, "nested deeper than 10 levels") {
+		t.Errorf("got %d %s", code, body)
+	}
+}
+
+func TestGraphQLNestedListsReadOnce(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "graphql"))
+	s := must(NewServer(dir, "", "")).T(t)
+	defer s.Store.Close()
+	s.GraphQL = true
+	tr := &recordingTracer{}
+	s.Store.Tracer = tr
+
+	code, body := graphQL(t, s, `{ authors(sort: "name") { name books(on: "author", sort: "year") { title } } }`, [2]string{})
+	want := `{"data":{"authors":[{"name":"Stanislaw Lem","books":[{"title":"Solaris"}]},{"name":"Ursula K. Le Guin","books":[{"title":"A Wizard of Earthsea"},{"title":"The Left Hand of Darkness"},{"title":"The Dispossessed"}]}]}}`
+	if code != http.StatusOK || body != want {
+		t.Errorf("got %d %s", code, body)
+	}
+	// One list of authors and one of books for both authors
+	lists := map[string]int{}
+	for _, sp := range tr.spans {
+		if sp.Name == "store.list" {
+			lists[sp.Attrs[0].Value]++
+		}
+	}
+	if lists["authors"] != 1 || lists["books"] != 1 {
+		t.Errorf("got lists %v, want authors and books once", lists)
+	}
+}
+
+func TestStoreReferences(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "graphql"))
+	schemas := filepath.Join(dir, "_schemas.csv")
+	data := strings.Replace(string(must(os.ReadFile(schemas)).T(t)), "books,author,text,,,", "books,author,ref,,,authors", 1)
+	must0(t, os.WriteFile(schemas, []byte(data), 0644))
+	s := must(NewServer(dir, "", "")).T(t)
+	defer s.Close()
+	s.GraphQL = true
+
+	id := must(s.Store.Create("books", Resource{"title": "Fiasco", "author": "a2"})).T(t)
+	must(s.Store.Create("books", Resource{"title": "Anonymous"})).T(t)
+	_, err := s.Store.Create("books", Resource{"title": "Hyperion", "author": "a9"})
+	if !errors.Is(err, ErrReferenceNotFound) || err.Error() != "referenced authors/a9 not found" {
+		t.Errorf("got %v for a missing author", err)
+	}
+	if err := s.Store.Update("books", Resource{"_id": id, "author": "a9"}); !errors.Is(err, ErrReferenceNotFound) {
+		t.Errorf("got %v for an update to a missing author", err)
+	}
+	// Records referring to deleted records can still be updated
+	must0(t, s.Store.Delete("authors", "a2"))
+	must0(t, s.Store.Update("books", Resource{"_id": id, "year": 1986.0}))
+
+	if code, body := graphQL(t, s, `{ books(id: "b1") { author { name } } }`, [2]string{}); code != http.StatusOK || body != `{"data":{"books":[{"author":{"name":"Ursula K. Le Guin"}}]}}` {
+		t.Errorf("got %d %s", code, body)
+	}
+
+	must0(t, os.WriteFile(schemas, []byte(strings.Replace(data, ",authors\n", ",movies\n", 1)), 0644))
+	if _, err := NewStore(dir); err == nil {
+		t.Error("expected an error for a reference to an unknown resource")
+	}
+}
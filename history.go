@@ -0,0 +1,100 @@
+package pennybase
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Historian is implemented by databases that keep the previous versions of
+// records, see Store.History.
+type Historian interface {
+	History(id string) ([]Record, error)
+}
+
+// History returns every version of a record still in the file, oldest first,
+// including the tombstone ({id, "0"}) if the record was deleted. Compaction
+// drops the outdated versions.
+func (db *csvDB) History(id string) ([]Record, error) {
+	db.mu.RLock()
+	f, size := db.f, db.size
+	db.refs.acquire(f)
+	db.mu.RUnlock()
+	defer db.refs.release(f)
+	var versions []Record
+	r := db.format.reader(io.NewSectionReader(f, 0, size))
+	for {
+		rec, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(rec) >= 2 && rec[0] == id {
+			versions = append(versions, rec)
+		}
+	}
+	if len(versions) == 0 {
+		return nil, newError("record_not_found")
+	}
+	return versions, nil
+}
+
+// History returns the versions of a record, oldest first. If the record was
+// deleted, the last one is a tombstone ({"_id": id, "_v": 0, "_deleted":
+// true}).
+func (s *Store) History(resource, id string) ([]Resource, error) {
+	return s.history(context.Background(), resource, id)
+}
+
+func (s *Store) history(ctx context.Context, resource, id string) (res []Resource, err error) {
+	id = s.normalizeID(resource, id)
+	_, end := s.span(ctx, "store.history", Attr{"resource", resource}, Attr{"id", id})
+	defer func() { end(err) }()
+	done, err := s.enter()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	db, ok := s.Resources[resource]
+	if !ok {
+		return nil, newError("resource_not_found", "resource", resource)
+	}
+	h, ok := db.(Historian)
+	if !ok {
+		return nil, fmt.Errorf("resource %s does not keep history", resource)
+	}
+	versions, err := h.History(id)
+	if err != nil {
+		return nil, err
+	}
+	for _, rec := range versions {
+		if rec[1] == "0" {
+			res = append(res, Resource{"_id": id, "_v": 0.0, "_deleted": true})
+			continue
+		}
+		r, err := s.resource(resource, rec)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, r)
+	}
+	return res, nil
+}
+
+func (s *Server) handleHistory(w http.ResponseWriter, r *http.Request) {
+	resource := r.PathValue("resource")
+	versions, err := s.Store.history(r.Context(), resource, r.PathValue("id"))
+	if err != nil {
+		s.WriteError(w, r, errorStatus(err), err)
+		return
+	}
+	for i, v := range versions {
+		versions[i] = s.view(resource, v)
+	}
+	_ = json.NewEncoder(w).Encode(versions)
+}
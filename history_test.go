@@ -0,0 +1,50 @@
+package pennybase
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestStoreHistory(t *testing.T) {
+	s := must(NewServer(testData(t, filepath.Join("testdata", "rest")), "", "")).T(t)
+	defer s.Store.Close()
+	id := must(s.Store.Create("books", Resource{"title": "Draft", "author": "Anon", "year": 2000.0})).T(t)
+	must0(t, s.Store.Update("books", Resource{"_id": id, "title": "Second draft"}))
+	must0(t, s.Store.Update("books", Resource{"_id": id, "title": "Final"}))
+
+	versions := must(s.Store.History("books", id)).T(t)
+	if len(versions) != 3 || versions[0]["title"] != "Draft" || versions[2]["title"] != "Final" || versions[2]["_v"] != 3.0 {
+		t.Errorf("got %v", versions)
+	}
+
+	// Deleted records keep their history, followed by the tombstone
+	must0(t, s.Store.Delete("books", id))
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/books/"+id+"/_history", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	must0(t, json.NewDecoder(w.Body).Decode(&versions))
+	if len(versions) != 4 || versions[1]["title"] != "Second draft" || versions[3]["_deleted"] != true || versions[3]["_v"] != 0.0 {
+		t.Errorf("got %v", versions)
+	}
+
+	if _, err := s.Store.History("books", "nope"); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("got %v", err)
+	}
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/books/nope/_history", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("got status %d", w.Code)
+	}
+	// The history of users is read like users are
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/_users/admin/_history", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d for anonymous users history", w.Code)
+	}
+}
@@ -0,0 +1,179 @@
+package pennybase
+
+import (
+	"cmp"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Error is a user-facing error with a stable code, so that clients can handle
+// it and servers can translate it. Params are substituted into the message
+// templates of a Catalog, e.g. {field}.
+type Error struct {
+	Code   string
+	Params map[string]string
+}
+
+func (e *Error) Error() string { return English.Format(e) }
+
+// Is reports whether target is an *Error with the same code, so that errors
+// can be matched against the sentinels with errors.Is regardless of params.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// Sentinels for errors.Is, e.g. to tell a missing resource from a failed
+// validation when creating a record. ErrReferenceNotFound is returned for ref
+// fields pointing to missing records, ErrReferenced for deletes refused by a
+// "restrict" ref field, and ErrDuplicate for values of "unique" fields that
+// are taken. ErrLocked is returned when opening a file that another process
+// (or another open database) has locked, and ErrClosed by the operations of a
+// closed Store. ErrRecordNotFound, ErrVersionConflict (also for creating a
+// record that exists) and ErrInvalidRecord (e.g. a missing id) are also
+// returned by the CSV databases, and custom DB implementations should return
+// them too.
+var (
+	ErrResourceNotFound  = &Error{Code: "resource_not_found"}
+	ErrRecordNotFound    = &Error{Code: "record_not_found"}
+	ErrVersionConflict   = &Error{Code: "version_conflict"}
+	ErrInvalidField      = &Error{Code: "invalid_field"}
+	ErrRequiredField     = &Error{Code: "required_field"}
+	ErrReferenceNotFound = &Error{Code: "reference_not_found"}
+	ErrReferenced        = &Error{Code: "record_referenced"}
+	ErrDuplicate         = &Error{Code: "duplicate_value"}
+	ErrInvalidRecord     = &Error{Code: "invalid_record"}
+	ErrLocked            = &Error{Code: "database_locked"}
+	ErrClosed            = &Error{Code: "store_closed"}
+)
+
+// newError returns an *Error with the given code and key-value parameters.
+func newError(code string, kv ...string) *Error {
+	e := &Error{Code: code, Params: map[string]string{}}
+	for i := 0; i+1 < len(kv); i += 2 {
+		e.Params[kv[i]] = kv[i+1]
+	}
+	return e
+}
+
+// Catalog maps error codes to message templates in one language.
+type Catalog map[string]string
+
+// English is the default catalog. Other catalogs may translate any subset of
+// its codes, the missing ones fall back to English.
+var English = Catalog{
+	"invalid_field":       `invalid field "{field}"`,
+	"required_field":      `field "{field}" is required`,
+	"resource_not_found":  "resource {resource} not found",
+	"record_not_found":    "record not found",
+	"invalid_record":      "invalid record",
+	"version_conflict":    "record was modified concurrently, the current version is {version}",
+	"database_locked":     "{name} is locked by another process",
+	"store_closed":        "the store is closed",
+	"duplicate_value":     `field "{field}" must be unique, "{value}" is taken`,
+	"unauthenticated":     "unauthenticated",
+	"unauthorized":        "unauthorized",
+	"admin_required":      "admin role required",
+	"read_only":           "read-only server",
+	"invalid_credentials": "Invalid credentials",
+	"unknown_fields":      "unknown fields: {fields}",
+	"invalid_since":       "invalid since version",
+	"invalid_page":        "limit and offset must be non-negative integers",
+	"invalid_cursor":      "the cursor is invalid or expired, start from the beginning",
+	"body_too_large":      "request body is larger than {limit} bytes",
+	"quota_exceeded":      "quota {quota} exceeded, try again after {reset}",
+	"invalid_path":        "invalid {param} in the URL",
+	"reference_not_found": "referenced {resource}/{id} not found",
+	"support_required":    "{role} role required to impersonate users",
+	"not_impersonating":   "not impersonating a user",
+	"invalid_batch_mode":  "mode must be atomic or besteffort",
+	"batch_unsupported":   "{resource} records can't be created in batches",
+	"record_referenced":   "record is referenced by {resource}/{id}",
+	"unknown_role":        "unknown role {role}, known roles are {roles}",
+	"admin_lockout":       "you can't remove the {role} role from yourself",
+}
+
+// Format renders the message of e, or its code if no catalog knows it.
+func (c Catalog) Format(e *Error) string {
+	tmpl, ok := c[e.Code]
+	if !ok {
+		if tmpl, ok = English[e.Code]; !ok {
+			return e.Code
+		}
+	}
+	args := []string{}
+	for k, v := range e.Params {
+		args = append(args, "{"+k+"}", v)
+	}
+	return strings.NewReplacer(args...).Replace(tmpl)
+}
+
+// catalog picks the catalog of the most preferred language in the
+// Accept-Language header, trying "pt" for "pt-BR" as well.
+func (s *Server) catalog(r *http.Request) Catalog {
+	type lang struct {
+		tag string
+		q   float64
+	}
+	langs := []lang{}
+	for part := range strings.SplitSeq(r.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		l := lang{tag: strings.ToLower(strings.TrimSpace(tag)), q: 1}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			l.q, _ = strconv.ParseFloat(q, 64)
+		}
+		if l.tag != "" && l.q > 0 {
+			langs = append(langs, l)
+		}
+	}
+	slices.SortStableFunc(langs, func(a, b lang) int { return cmp.Compare(b.q, a.q) })
+	for _, l := range langs {
+		primary, _, _ := strings.Cut(l.tag, "-")
+		for _, tag := range []string{l.tag, primary} {
+			if c, ok := s.Catalogs[tag]; ok {
+				return c
+			}
+		}
+	}
+	return English
+}
+
+type errorResponse struct {
+	Error struct {
+		Code    string            `json:"code,omitempty"`
+		Message string            `json:"message"`
+		Params  map[string]string `json:"params,omitempty"`
+	} `json:"error"`
+	Current Resource `json:"current,omitempty"` // the stored record on a version conflict
+}
+
+// WriteError writes an error response, translating errors with a code
+// (*Error) to the language preferred by the client. Clients accepting JSON
+// get {"error":{"code":...,"message":...,"params":{...}}}, others get the message as plain
+// text. Bodies exceeding MaxBodySize are reported as 413 Content Too Large.
+func (s *Server) WriteError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	s.writeError(w, r, status, err, nil)
+}
+
+// writeError is WriteError also sending the current version of a record to
+// JSON clients, so that they can merge their changes on a conflict.
+func (s *Server) writeError(w http.ResponseWriter, r *http.Request, status int, err error, current Resource) {
+	if tooLarge := (*http.MaxBytesError)(nil); errors.As(err, &tooLarge) {
+		status, err = http.StatusRequestEntityTooLarge, newError("body_too_large", "limit", strconv.FormatInt(tooLarge.Limit, 10))
+	}
+	resp := errorResponse{Current: current}
+	resp.Error.Message = err.Error()
+	var e *Error
+	if errors.As(err, &e) {
+		resp.Error.Code, resp.Error.Message, resp.Error.Params = e.Code, s.catalog(r).Format(e), e.Params
+	}
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		WriteJSON(w, status, resp)
+		return
+	}
+	http.Error(w, resp.Error.Message, status)
+}
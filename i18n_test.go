@@ -0,0 +1,75 @@
+package pennybase
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestServerLocalizedErrors(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "rest"))
+	s := must(NewServer(dir, "", "")).T(t)
+	defer s.Store.Close()
+	s.Catalogs["de"] = Catalog{
+		"invalid_field": `Feld "{field}" ist ungueltig`,
+		"unauthorized":  "nicht erlaubt",
+	}
+
+	for _, tt := range []struct {
+		name, method, path, body string
+		user, lang, accept       string
+		wantStatus               int
+		wantCode, wantMessage    string
+	}{
+		{"validation", "POST", "/api/books/", `{"title":"Book","author":"Me","year":3000}`, "user1", "de-DE,de;q=0.9,en;q=0.5", "application/json",
+			http.StatusUnprocessableEntity, "invalid_field", `Feld "year" ist ungueltig`},
+		{"authorization", "PUT", "/api/books/book1", `{"title":"Mine"}`, "user1", "en;q=0.5, de", "application/json",
+			http.StatusUnauthorized, "unauthorized", "nicht erlaubt"},
+		{"missing translation", "POST", "/api/books/", `{"title":"Book"}`, "", "de", "application/json",
+			http.StatusUnauthorized, "unauthenticated", "unauthenticated"},
+		{"unknown language", "POST", "/api/books/", `{"title":"Book","author":"Me","year":3000}`, "user1", "fr-CA, fr", "application/json",
+			http.StatusUnprocessableEntity, "invalid_field", `invalid field "year"`},
+		{"excluded language", "PUT", "/api/books/book1", `{"title":"Mine"}`, "user1", "de;q=0, en", "application/json",
+			http.StatusUnauthorized, "unauthorized", "unauthorized"},
+		{"plain text", "PUT", "/api/books/book1", `{"title":"Mine"}`, "user1", "de", "",
+			http.StatusUnauthorized, "", "nicht erlaubt"},
+	} {
+		req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		if tt.user != "" {
+			req.SetBasicAuth(tt.user, tt.user+"pass")
+		}
+		req.Header.Set("Accept-Language", tt.lang)
+		req.Header.Set("Accept", tt.accept)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s: got status %d, want %d", tt.name, w.Code, tt.wantStatus)
+			continue
+		}
+		if tt.accept == "" {
+			if got := strings.TrimSpace(w.Body.String()); got != tt.wantMessage {
+				t.Errorf("%s: got %q, want %q", tt.name, got, tt.wantMessage)
+			}
+			continue
+		}
+		var resp errorResponse
+		must0(t, json.NewDecoder(w.Body).Decode(&resp))
+		if resp.Error.Code != tt.wantCode || resp.Error.Message != tt.wantMessage {
+			t.Errorf("%s: got %+v, want %s %q", tt.name, resp.Error, tt.wantCode, tt.wantMessage)
+		}
+	}
+}
+
+func TestErrorMessages(t *testing.T) {
+	// Coded errors keep their English messages for Go callers
+	schema := Schema{{Field: "n", Type: Number, Min: 1, Max: 2}}
+	if _, err := schema.Record(Resource{"n": 5.0}); err == nil || err.Error() != `invalid field "n"` {
+		t.Errorf("got %v", err)
+	}
+	if got := (Catalog{}).Format(newError("no_such_code")); got != "no_such_code" {
+		t.Errorf("got %q for an unknown code", got)
+	}
+}
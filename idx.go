@@ -0,0 +1,143 @@
+package pennybase
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"io"
+	"slices"
+	"strconv"
+)
+
+// Index files keep the index of a database file, so that it doesn't have to
+// be scanned when opened. An index file is named after the database file with
+// an ".idx" suffix and holds CSV rows: a header with the size of the database
+// file it was saved at, the number of rows and a checksum of the last bytes of
+// the file, then an "id,offset,version" row per record, and finally the
+// SHA-256 of everything before it. The version of a deleted record is minus
+// the version of its deletion, see csvDB.Deleted.
+
+var errStaleIndex = errors.New("stale index file")
+
+// tailSum returns the checksum of the bytes of the database file just before
+// size, which tells apart a file rewritten since the index was saved.
+func (db *csvDB) tailSum(size int64) (string, error) {
+	start := max(0, size-256)
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(db.f, start, size-start)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// saveIndex writes the index to a temporary file and renames it over the index
+// file.
+func (db *csvDB) saveIndex() error {
+	tail, err := db.tailSum(db.size)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	_ = w.Write([]string{strconv.FormatInt(db.size, 10), strconv.FormatInt(db.rows, 10), tail})
+	for id, pos := range db.index {
+		v := db.version[id]
+		if v == 0 {
+			v = -db.deleted[id]
+		}
+		_ = w.Write([]string{id, strconv.FormatInt(pos, 10), strconv.FormatInt(v, 10)})
+	}
+	if w.Flush(); w.Error() != nil {
+		return w.Error()
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	buf.WriteString(hex.EncodeToString(sum[:]) + "\n")
+
+	name := db.name + ".idx"
+	tmp := name + ".tmp"
+	_ = db.st.Remove(tmp)
+	f, err := db.st.Open(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := db.st.Rename(tmp, name); err != nil {
+		return err
+	}
+	db.unsaved = 0
+	return nil
+}
+
+// loadIndex loads the index file and scans only the rows appended after it
+// was saved. It fails if there is no index file, or if it is truncated,
+// corrupted or doesn't match the database file.
+func (db *csvDB) loadIndex() error {
+	name := db.name + ".idx"
+	if names, err := db.st.List(); err != nil || !slices.Contains(names, name) {
+		return errStaleIndex
+	}
+	f, err := db.st.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	size, err := f.Size()
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(io.NewSectionReader(f, 0, size))
+	if err != nil {
+		return err
+	}
+	i := bytes.LastIndexByte(bytes.TrimSuffix(data, []byte("\n")), '\n')
+	if i < 0 {
+		return errStaleIndex
+	}
+	body, sum := data[:i+1], sha256.Sum256(data[:i+1])
+	if string(bytes.TrimSpace(data[i+1:])) != hex.EncodeToString(sum[:]) {
+		return errStaleIndex
+	}
+	r := csv.NewReader(bytes.NewReader(body))
+	r.FieldsPerRecord = 3
+	header, err := r.Read()
+	if err != nil {
+		return err
+	}
+	end, err1 := strconv.ParseInt(header[0], 10, 64)
+	rows, err2 := strconv.ParseInt(header[1], 10, 64)
+	if err1 != nil || err2 != nil || end > db.size {
+		return errStaleIndex
+	}
+	if tail, err := db.tailSum(end); err != nil || tail != header[2] {
+		return errStaleIndex
+	}
+	index, version, deleted := map[string]int64{}, map[string]int64{}, map[string]int64{}
+	for {
+		rec, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		pos, err1 := strconv.ParseInt(rec[1], 10, 64)
+		v, err2 := strconv.ParseInt(rec[2], 10, 64)
+		if err1 != nil || err2 != nil || pos >= end || v == 0 {
+			return errStaleIndex // v is 0 for deletions in older index files
+		}
+		index[rec[0]], version[rec[0]] = pos, max(v, 0)
+		if v < 0 {
+			deleted[rec[0]] = -v
+		}
+	}
+	db.dropped = db.readDropped()
+	return db.scan(end, index, version, deleted, rows)
+}
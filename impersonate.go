@@ -0,0 +1,142 @@
+package pennybase
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// handleImpersonate lets an admin with the SupportRole act as another user:
+// the response sets a session cookie of that user, which also names the
+// admin. Requests made with it are authenticated as the user, with the admin
+// in the "_impersonator" field of the user record passed to hooks, and are
+// recorded in the audit trail, see Server.Impersonations.
+func (s *Server) handleImpersonate(w http.ResponseWriter, r *http.Request) {
+	admin := CurrentUser(r)
+	// Impersonated users can't impersonate others, even admins
+	if _, nested := admin["_impersonator"]; nested || !hasRole(admin, s.AdminRole) || !hasRole(admin, s.SupportRole) {
+		s.WriteError(w, r, http.StatusForbidden, newError("support_required", "role", s.SupportRole))
+		return
+	}
+	username := r.PathValue("username")
+	if user, err := s.Store.get(r.Context(), "_users", username); err != nil || user == nil {
+		s.WriteError(w, r, http.StatusNotFound, newError("record_not_found"))
+		return
+	}
+	if err := s.recordImpersonation(r, admin["_id"].(string), username, "start"); err != nil {
+		s.WriteError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	s.setSession(w, signImpersonation(s.session().key, username, admin["_id"].(string)))
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleEndImpersonation replaces an impersonation session with a session of
+// the admin who opened it.
+func (s *Server) handleEndImpersonation(w http.ResponseWriter, r *http.Request) {
+	sess := s.session()
+	var username, admin string
+	if cookie, err := r.Cookie(sess.cookie); err == nil {
+		username, admin, _ = parseSession(sess.key, cookie.Value, sess.ttl)
+	}
+	if admin == "" {
+		s.WriteError(w, r, http.StatusBadRequest, newError("not_impersonating"))
+		return
+	}
+	if err := s.recordImpersonation(r, admin, username, "end"); err != nil {
+		s.WriteError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	s.setSession(w, signSession(sess.key, admin))
+	w.WriteHeader(http.StatusOK)
+}
+
+// logImpersonation records every request, reads included, made by an admin
+// impersonating a user.
+func (s *Server) logImpersonation(r *http.Request, user Resource) error {
+	admin, ok := user["_impersonator"].(string)
+	if !ok {
+		return nil
+	}
+	return s.recordImpersonation(r, admin, user["_id"].(string), "request")
+}
+
+// Impersonation is an entry of the audit trail of impersonation.
+type Impersonation struct {
+	Time   time.Time `json:"time"`
+	Admin  string    `json:"admin"`
+	User   string    `json:"user"`
+	Action string    `json:"action"` // "start", "end" or "request"
+	Method string    `json:"method"`
+	Path   string    `json:"path"`
+}
+
+// impersonationLog keeps the audit trail in _impersonations.csv, which is
+// opened by the first entry or query.
+type impersonationLog struct {
+	once sync.Once
+	db   *csvDB
+	err  error
+}
+
+func (s *Server) impersonationDB() (*csvDB, error) {
+	l := &s.impersonations
+	l.once.Do(func() { l.db, l.err = OpenCSVDB(s.Store.Storage, "_impersonations.csv") })
+	return l.db, l.err
+}
+
+// recordImpersonation appends an entry to the audit trail and logs it.
+// Requests are refused if the entry can't be written.
+func (s *Server) recordImpersonation(r *http.Request, admin, user, action string) error {
+	log.Printf("impersonation: %s as %s: %s %s %s", admin, user, action, r.Method, r.URL.Path)
+	db, err := s.impersonationDB()
+	if err != nil {
+		return err
+	}
+	return db.Create(Record{ID(), "1", time.Now().UTC().Format(time.RFC3339Nano), admin, user, action, r.Method, r.URL.Path})
+}
+
+// Impersonations returns the audit trail of impersonation, oldest first:
+// when admins started and ended impersonating users, and every request they
+// made meanwhile.
+func (s *Server) Impersonations() ([]Impersonation, error) {
+	db, err := s.impersonationDB()
+	if err != nil {
+		return nil, err
+	}
+	trail := []Impersonation{}
+	for rec, err := range db.Iter() {
+		if err != nil {
+			return nil, err
+		}
+		if len(rec) < 8 {
+			continue
+		}
+		t, _ := time.Parse(time.RFC3339Nano, rec[2])
+		trail = append(trail, Impersonation{Time: t, Admin: rec[3], User: rec[4], Action: rec[5], Method: rec[6], Path: rec[7]})
+	}
+	return trail, nil
+}
+
+// handleImpersonations returns the audit trail to admins, optionally only the
+// entries of the admin and user given as query parameters.
+func (s *Server) handleImpersonations(w http.ResponseWriter, r *http.Request) {
+	if !hasRole(CurrentUser(r), s.AdminRole) {
+		s.WriteError(w, r, http.StatusUnauthorized, newError("admin_required"))
+		return
+	}
+	trail, err := s.Impersonations()
+	if err != nil {
+		s.WriteError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	admin, user := r.FormValue("admin"), r.FormValue("user")
+	res := []Impersonation{}
+	for _, e := range trail {
+		if (admin == "" || e.Admin == admin) && (user == "" || e.User == user) {
+			res = append(res, e)
+		}
+	}
+	WriteJSON(w, http.StatusOK, res)
+}
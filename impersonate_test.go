@@ -0,0 +1,174 @@
+package pennybase
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerImpersonate(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "rest"))
+	s := must(NewServer(dir, "", "")).T(t)
+	defer func() { s.Close() }()
+	must0(t, s.Store.CreateUser("helpdesk", "helpdeskpass", []string{"admin", "support"}))
+	var hookUser Resource
+	s.Hook = func(trigger, resource string, user, r Resource) error {
+		hookUser = user
+		return nil
+	}
+
+	do := func(method, path, body string, auth func(*http.Request)) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		auth(req)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w
+	}
+	basic := func(user, password string) func(*http.Request) {
+		return func(r *http.Request) { r.SetBasicAuth(user, password) }
+	}
+	cookie := func(c *http.Cookie) func(*http.Request) {
+		return func(r *http.Request) { r.AddCookie(c) }
+	}
+
+	for _, tt := range []struct {
+		user, password, target string
+		wantStatus             int
+	}{
+		{"user1", "user1pass", "admin", http.StatusForbidden},
+		{"admin", "admin123", "user1", http.StatusForbidden}, // no support role
+		{"helpdesk", "helpdeskpass", "nobody", http.StatusNotFound},
+	} {
+		if w := do(http.MethodPost, "/api/admin/impersonate/"+tt.target, "", basic(tt.user, tt.password)); w.Code != tt.wantStatus {
+			t.Errorf("%s as %s: got status %d, want %d", tt.user, tt.target, w.Code, tt.wantStatus)
+		}
+	}
+
+	w := do(http.MethodPost, "/api/admin/impersonate/user1", "", basic("helpdesk", "helpdeskpass"))
+	if w.Code != http.StatusOK || len(w.Result().Cookies()) != 1 {
+		t.Fatalf("got status %d, cookies %v", w.Code, w.Result().Cookies())
+	}
+	session := w.Result().Cookies()[0]
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(session)
+	if user := must(s.Authenticate(req)).T(t); user["_id"] != "user1" || user["_impersonator"] != "helpdesk" {
+		t.Errorf("authenticated as %v", user)
+	}
+
+	if w := do(http.MethodGet, "/api/books/", "", cookie(session)); w.Code != http.StatusOK {
+		t.Errorf("read: got status %d", w.Code)
+	}
+	// Writes are made as the user, and hooks know the admin behind them
+	w = do(http.MethodPost, "/api/books/", `{"title":"Dune","author":"Frank Herbert","year":1965}`, cookie(session))
+	if w.Code != http.StatusCreated || hookUser["_id"] != "user1" || hookUser["_impersonator"] != "helpdesk" {
+		t.Errorf("got status %d, hook user %v", w.Code, hookUser)
+	}
+	if w := do(http.MethodPost, "/api/admin/impersonate/admin", "", cookie(session)); w.Code != http.StatusForbidden {
+		t.Errorf("nested impersonation: got status %d", w.Code)
+	}
+
+	w = do(http.MethodDelete, "/api/admin/impersonate", "", cookie(session))
+	if w.Code != http.StatusOK || len(w.Result().Cookies()) != 1 {
+		t.Fatalf("end: got status %d, cookies %v", w.Code, w.Result().Cookies())
+	}
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(w.Result().Cookies()[0])
+	if user := must(s.Authenticate(req)).T(t); user["_id"] != "helpdesk" || user["_impersonator"] != nil {
+		t.Errorf("authenticated as %v after the end of impersonation", user)
+	}
+	if w := do(http.MethodDelete, "/api/admin/impersonate", "", cookie(w.Result().Cookies()[0])); w.Code != http.StatusBadRequest {
+		t.Errorf("end without impersonation: got status %d", w.Code)
+	}
+
+	// The audit trail has both ids for the start, every request, reads
+	// included, and the end
+	want := []string{
+		"helpdesk user1 start POST /api/admin/impersonate/user1",
+		"helpdesk user1 request GET /api/books/",
+		"helpdesk user1 request POST /api/books/",
+		"helpdesk user1 request POST /api/admin/impersonate/admin",
+		"helpdesk user1 end DELETE /api/admin/impersonate",
+	}
+	trail := func(entries []Impersonation) []string {
+		got := []string{}
+		for _, e := range entries {
+			if e.Time.IsZero() {
+				t.Errorf("no time in %v", e)
+			}
+			got = append(got, strings.Join([]string{e.Admin, e.User, e.Action, e.Method, e.Path}, " "))
+		}
+		return got
+	}
+	if got := trail(must(s.Impersonations()).T(t)); !slices.Equal(got, want) {
+		t.Errorf("got trail\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if w := do(http.MethodGet, "/api/admin/impersonations", "", basic("user1", "user1pass")); w.Code != http.StatusUnauthorized {
+		t.Errorf("trail as a user: got status %d", w.Code)
+	}
+	w = do(http.MethodGet, "/api/admin/impersonations?admin=helpdesk&user=user1", "", basic("admin", "admin123"))
+	var entries []Impersonation
+	if must0(t, json.NewDecoder(w.Body).Decode(&entries)); w.Code != http.StatusOK || !slices.Equal(trail(entries), want) {
+		t.Errorf("got status %d, trail %v", w.Code, trail(entries))
+	}
+	// The trail is kept across restarts
+	must0(t, s.Close())
+	s = must(NewServer(dir, "", "")).T(t)
+	if got := trail(must(s.Impersonations()).T(t)); !slices.Equal(got, want) {
+		t.Errorf("after restart got trail %v", got)
+	}
+}
+
+func TestSessionUsernames(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "rest"))
+	s := must(NewServer(dir, "", "")).T(t)
+	defer s.Close()
+	for _, name := range []string{"admin:99999999999", "bad\nname"} {
+		if err := s.Store.CreateUser(name, "pass", nil); !errors.Is(err, ErrInvalidField) {
+			t.Errorf("%q: got %v, want an invalid username", name, err)
+		}
+	}
+
+	// A user created before colons were rejected logs in as itself, not as
+	// the admin with an impersonation session that never expires
+	name, salt := "admin:99999999999", Salt()
+	must0(t, s.Store.insert(t.Context(), "_users", name, Resource{"salt": salt, "password": HashPasswd("pass", salt), "roles": []string{}}))
+	req := httptest.NewRequest(http.MethodPost, "/api/login", strings.NewReader("username=admin%3A99999999999&password=pass"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || len(w.Result().Cookies()) != 1 {
+		t.Fatalf("login: got status %d", w.Code)
+	}
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(w.Result().Cookies()[0])
+	if user := must(s.Authenticate(req)).T(t); user["_id"] != name || user["_impersonator"] != nil {
+		t.Errorf("authenticated as %v", user)
+	}
+
+	key, now := s.session().key, time.Now().Unix()
+	for _, tt := range []struct {
+		session, username, impersonator string
+		ok                              bool
+	}{
+		{signSession(key, "user1"), "user1", "", true},
+		{signSession(key, "a.b:c"), "a.b:c", "", true},
+		{signImpersonation(key, "user1", "a:b.c"), "user1", "a:b.c", true},
+		{signData(key, fmt.Sprintf("user1:%d", now+3600)), "", "", false}, // from the future
+		{signData(key, fmt.Sprintf("user1:%d", now-25*3600)), "", "", false},
+		{signData(key, fmt.Sprintf("user1:%d.", now)), "", "", false},
+		{signData(key, fmt.Sprintf("user1:%d:admin", now)), "", "", false},
+		{signSession("other key", "user1"), "", "", false},
+	} {
+		username, impersonator, ok := parseSession(key, tt.session, 24*time.Hour)
+		if username != tt.username || impersonator != tt.impersonator || ok != tt.ok {
+			t.Errorf("%s: got %q %q %v", tt.session, username, impersonator, ok)
+		}
+	}
+}
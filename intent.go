@@ -0,0 +1,326 @@
+package pennybase
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// Write is one step of a Store.Batch.
+type Write struct {
+	Resource string
+	Action   string   // "create", "update" or "delete"
+	Data     Resource // record fields, only "_id" is used for deletes
+}
+
+// IntentWarning reports a multi-step operation that was interrupted by a
+// crash and could not be completed when the store was opened, or whose step
+// failed to be written. The steps applied before are kept and the operation
+// stays pending, see Store.RepairIntent.
+type IntentWarning struct {
+	ID  string
+	Op  string
+	Err error
+}
+
+func (w *IntentWarning) Error() string {
+	return fmt.Sprintf("incomplete %s operation %s: %v", w.Op, w.ID, w.Err)
+}
+
+func (w *IntentWarning) Unwrap() error { return w.Err }
+
+// intentStep is a versioned record to be written to a resource. Writing it
+// again is a no-op, which makes rolling an operation forward idempotent.
+type intentStep struct {
+	Resource string `json:"resource"`
+	Record   Record `json:"record"`
+}
+
+// Batch applies writes to one or more resources as a single operation. All
+// records are validated before anything is written. Unless it's a single
+// write, the operation is first recorded in the intent log (_intents.csv), so
+// that if the process crashes halfway, the remaining writes are applied when
+// the store is opened again. Batches are not isolated from concurrent writes
+// to the same records: the writes to records modified since they were
+// validated are skipped, the others are applied, and the batch fails with an
+// error naming the skipped ones.
+func (s *Store) Batch(writes ...Write) error {
+	if slices.ContainsFunc(writes, func(w Write) bool {
+		return slices.ContainsFunc(s.Schemas[w.Resource], func(f FieldSchema) bool { return f.Unique })
+	}) {
+		s.slugMu.Lock()
+		defer s.slugMu.Unlock()
+	}
+	return s.batch(context.Background(), "batch", writes)
+}
+
+func (s *Store) batch(ctx context.Context, op string, writes []Write) (err error) {
+	ctx, end := s.span(ctx, "store.batch", Attr{"op", op})
+	defer func() { end(err) }()
+	done, err := s.enter()
+	if err != nil {
+		return err
+	}
+	defer done()
+	steps, seen := []intentStep{}, map[string]string{}
+	for _, w := range writes {
+		rec, err := s.prepare(ctx, w)
+		if err != nil {
+			return err
+		}
+		if rec[1] != "0" {
+			if err := s.checkUnique(w.Resource, rec, seen); err != nil {
+				return err
+			}
+		}
+		if slices.ContainsFunc(steps, func(st intentStep) bool { return st.Resource == w.Resource && st.Record[0] == rec[0] }) {
+			return fmt.Errorf("record %s/%s is written more than once", w.Resource, rec[0])
+		}
+		steps = append(steps, intentStep{Resource: w.Resource, Record: rec})
+	}
+	return s.logIntent(op, steps)
+}
+
+// Move promotes a record to another resource, e.g. a draft to an article,
+// and returns its id there. Fields of the same name and type are copied,
+// the others are dropped. The record is created and the original deleted as
+// a single operation (see Batch), so a record that is invalid in the
+// destination schema stays where it was.
+func (s *Store) Move(srcResource, id, dstResource string) (string, error) {
+	ctx := context.Background()
+	if _, ok := s.Schemas[dstResource]; !ok {
+		return "", newError("resource_not_found", "resource", dstResource)
+	}
+	src, err := s.get(ctx, srcResource, id)
+	if err != nil {
+		return "", err
+	} else if src == nil {
+		return "", newError("record_not_found")
+	}
+	types := map[string]FieldType{}
+	for _, field := range s.Schemas[srcResource] {
+		types[field.Field] = field.Type
+	}
+	newID := s.normalizeID(dstResource, ID())
+	data := Resource{"_id": newID}
+	for _, field := range s.Schemas[dstResource] {
+		if v, ok := src[field.Field]; ok && types[field.Field] == field.Type && !strings.HasPrefix(field.Field, "_") {
+			data[field.Field] = v
+		}
+	}
+	s.slugMu.Lock()
+	defer s.slugMu.Unlock()
+	err = s.batch(ctx, "move", []Write{
+		{Resource: dstResource, Action: "create", Data: data},
+		{Resource: srcResource, Action: "delete", Data: Resource{"_id": src["_id"]}},
+	})
+	if err != nil {
+		return "", err
+	}
+	return newID, nil
+}
+
+// prepare turns a write into the record to be stored, the same way as
+// create, update and delete do.
+func (s *Store) prepare(ctx context.Context, w Write) (Record, error) {
+	schema, ok := s.Schemas[w.Resource]
+	if !ok {
+		return nil, newError("resource_not_found", "resource", w.Resource)
+	}
+	r := maps.Clone(w.Data)
+	if r == nil {
+		r = Resource{}
+	}
+	id, _ := r["_id"].(string)
+	if id == "" && w.Action == "create" {
+		id = ID()
+	}
+	id = s.normalizeID(w.Resource, id)
+	orig, err := s.get(ctx, w.Resource, id)
+	switch w.Action {
+	case "create":
+		if err == nil {
+			return nil, fmt.Errorf("record %s/%s already exists", w.Resource, id)
+		}
+		if err := s.setSlugs(w.Resource, id, r); err != nil {
+			return nil, err
+		}
+		r["_id"], r["_v"] = id, 1.0
+	case "update":
+		if err != nil {
+			return nil, fmt.Errorf("record not found: %w", err)
+		}
+		for _, field := range schema {
+			if _, ok := r[field.Field]; !ok {
+				r[field.Field] = orig[field.Field]
+			}
+		}
+		r["_id"], r["_v"] = id, orig["_v"].(float64)+1
+		return s.record(w.Resource, r, orig)
+	case "delete":
+		if err != nil {
+			return nil, fmt.Errorf("record not found: %w", err)
+		}
+		return Record{id, "0"}, nil
+	default:
+		return nil, fmt.Errorf("invalid action %q", w.Action)
+	}
+	return schema.Record(r)
+}
+
+// logIntent writes the steps of an operation, surrounded by an intent record
+// and its completion. The intent is synced to disk before the first step.
+// Steps conflicting with concurrent writes are skipped and the operation is
+// rolled forward right away, like on restart, so that it is complete when the
+// conflicts are reported. If a step can't be written, the intent stays pending
+// and an IntentWarning is returned.
+func (s *Store) logIntent(op string, steps []intentStep) error {
+	if len(steps) == 1 {
+		return s.applyStep(steps[0])
+	}
+	data, err := json.Marshal(steps)
+	if err != nil {
+		return err
+	}
+	s.intentsOnce.Do(func() { s.intents, s.intentsErr = OpenCSVDB(s.Storage, "_intents.csv") })
+	if s.intentsErr != nil {
+		return s.intentsErr
+	}
+	id := ID()
+	if err := s.intents.Create(Record{id, "1", op, string(data)}); err != nil {
+		return err
+	}
+	if err := s.intents.sync(); err != nil {
+		return err
+	}
+	var conflicts []error
+	for _, st := range steps {
+		if err := s.applyStep(st); errors.Is(err, errConcurrentWrite) {
+			conflicts = append(conflicts, err)
+		} else if err != nil {
+			return &IntentWarning{ID: id, Op: op, Err: err}
+		}
+	}
+	for _, st := range steps {
+		if db, ok := s.Resources[st.Resource].(interface{ sync() error }); ok {
+			if err := db.sync(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := s.intents.Delete(id); err != nil {
+		return err
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("%s was applied without the conflicting writes: %w", op, errors.Join(conflicts...))
+	}
+	return nil
+}
+
+var errConcurrentWrite = errors.New("modified concurrently")
+
+func (s *Store) applyStep(st intentStep) error {
+	applied, err := s.replicate(st.Resource, st.Record)
+	if err == nil && !applied {
+		err = fmt.Errorf("record %s/%s was %w", st.Resource, st.Record[0], errConcurrentWrite)
+	}
+	return err
+}
+
+// rollForward applies the steps of an interrupted operation, skipping the
+// ones that were written before the crash.
+func (s *Store) rollForward(rec Record) error {
+	if len(rec) < 4 {
+		return errors.New("invalid intent record")
+	}
+	var steps []intentStep
+	if err := json.Unmarshal([]byte(rec[3]), &steps); err != nil {
+		return err
+	}
+	for _, st := range steps {
+		if len(st.Record) < 2 {
+			return errors.New("invalid intent step")
+		}
+		if _, err := s.replicate(st.Resource, st.Record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recoverIntents rolls forward the operations left pending in the intent log
+// by a crash. Those that can't be completed are reported in Warnings. If
+// nothing is pending, the log is removed; it is created again by the next
+// batch that needs it.
+func (s *Store) recoverIntents() error {
+	names, err := s.Storage.List()
+	if err != nil || !slices.Contains(names, "_intents.csv") {
+		return err
+	}
+	db, err := OpenCSVDB(s.Storage, "_intents.csv")
+	if err != nil {
+		return err
+	}
+	pending := []Record{}
+	for rec, err := range db.Iter() {
+		if err != nil {
+			db.Close()
+			return err
+		}
+		pending = append(pending, rec)
+	}
+	for _, rec := range pending {
+		if err := s.rollForward(rec); err != nil {
+			w := &IntentWarning{ID: rec[0], Op: rec[2], Err: err}
+			log.Println(w)
+			s.Warnings = append(s.Warnings, w)
+		} else if err := db.Delete(rec[0]); err != nil {
+			db.Close()
+			return err
+		}
+	}
+	if len(s.Warnings) > 0 {
+		s.intentsOnce.Do(func() { s.intents = db })
+		return nil
+	}
+	if err := db.Close(); err != nil {
+		return err
+	}
+	return s.Storage.Remove("_intents.csv")
+}
+
+// RepairIntent resolves an operation reported by an IntentWarning, either by
+// trying to complete it again (e.g. after restoring a missing resource), or,
+// if discard is set, by dropping its remaining steps.
+func (s *Store) RepairIntent(id string, discard bool) error {
+	done, err := s.enter()
+	if err != nil {
+		return err
+	}
+	defer done()
+	if s.intents == nil {
+		return errors.New("record not found")
+	}
+	rec, err := s.intents.Get(id)
+	if err != nil {
+		return err
+	}
+	if !discard {
+		if err := s.rollForward(rec); err != nil {
+			return err
+		}
+	}
+	if err := s.intents.Delete(id); err != nil {
+		return err
+	}
+	s.Warnings = slices.DeleteFunc(s.Warnings, func(err error) bool {
+		var w *IntentWarning
+		return errors.As(err, &w) && w.ID == id
+	})
+	return nil
+}
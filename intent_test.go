@@ -0,0 +1,270 @@
+package pennybase
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync/atomic"
+	"testing"
+)
+
+const intentSchemas = `s1,1,authors,_id,text,,,^.+$
+s2,1,authors,_v,number,1,,
+s3,1,authors,name,text,,,^.+$
+s4,1,authors,books,number,,,
+s5,1,books,_id,text,,,^.+$
+s6,1,books,_v,number,1,,
+s7,1,books,title,text,,,^.+$
+s8,1,books,author,text,,,
+`
+
+// faultStorage simulates a crash: once its budget of writes is used up,
+// every write fails. A negative budget means unlimited writes.
+type faultStorage struct {
+	*MemStorage
+	budget atomic.Int64
+}
+
+type faultFile struct {
+	File
+	fs *faultStorage
+}
+
+func (fs *faultStorage) Open(name string) (File, error) {
+	f, err := fs.MemStorage.Open(name)
+	return faultFile{f, fs}, err
+}
+
+func (f faultFile) Write(p []byte) (int, error) {
+	if f.fs.budget.Add(-1) == -1 {
+		f.fs.budget.Store(0)
+		return 0, errors.New("simulated crash")
+	}
+	return f.File.Write(p)
+}
+
+func intentStorage(t *testing.T) *MemStorage {
+	t.Helper()
+	mem := NewMemStorage()
+	f := must(mem.Open("_schemas.csv")).T(t)
+	must(f.Write([]byte(intentSchemas))).T(t)
+	s := must(NewStore("", WithStorage(mem))).T(t)
+	must0(t, s.insert(t.Context(), "authors", "a1", Resource{"name": "Lem", "books": 1.0}))
+	must0(t, s.insert(t.Context(), "authors", "a2", Resource{"name": "Nobody"}))
+	must0(t, s.Close())
+	return mem
+}
+
+func hasIntentLog(t *testing.T, mem *MemStorage) bool {
+	t.Helper()
+	return slices.Contains(must(mem.List()).T(t), "_intents.csv")
+}
+
+func TestBatchCrashRecovery(t *testing.T) {
+	writes := []Write{
+		{Resource: "books", Action: "create", Data: Resource{"_id": "b1", "title": "Solaris", "author": "a1"}},
+		{Resource: "authors", Action: "update", Data: Resource{"_id": "a1", "books": 2.0}},
+		{Resource: "authors", Action: "delete", Data: Resource{"_id": "a2"}},
+	}
+	// An intent, three steps and the completion
+	for budget := range 6 {
+		t.Run(fmt.Sprint(budget), func(t *testing.T) {
+			mem := intentStorage(t)
+			fs := &faultStorage{MemStorage: mem}
+			fs.budget.Store(-1)
+			s := must(NewStore("", WithStorage(fs))).T(t)
+			fs.budget.Store(int64(budget))
+			err := s.Batch(writes...)
+			if (err == nil) != (budget == 5) {
+				t.Fatalf("batch returned %v", err)
+			}
+			// A failed step leaves the operation pending
+			var w *IntentWarning
+			if failedStep := budget >= 1 && budget <= 3; errors.As(err, &w) != failedStep {
+				t.Errorf("got %v", err)
+			}
+
+			s = must(NewStore("", WithStorage(mem))).T(t)
+			defer s.Close()
+			if len(s.Warnings) != 0 {
+				t.Fatalf("unexpected warnings: %v", s.Warnings)
+			}
+			book, bookErr := s.Get("books", "b1")
+			author := must(s.Get("authors", "a1")).T(t)
+			_, deletedErr := s.Get("authors", "a2")
+			if budget == 0 {
+				// Crashed before the intent was written, nothing happened
+				if bookErr == nil || author["books"] != 1.0 || deletedErr != nil {
+					t.Errorf("got partial state: %v %v %v", book, author, deletedErr)
+				}
+			} else if bookErr != nil || book["title"] != "Solaris" || author["books"] != 2.0 || author["_v"] != 2.0 || deletedErr == nil {
+				t.Errorf("operation was not completed: %v %v %v %v", book, bookErr, author, deletedErr)
+			}
+			if hasIntentLog(t, mem) {
+				t.Error("intent log was not removed after recovery")
+			}
+		})
+	}
+}
+
+// racyDB writes a concurrent update before the first replicated record.
+type racyDB struct {
+	*csvDB
+	race func(db *csvDB)
+}
+
+func (db *racyDB) Replicate(r Record) (bool, error) {
+	if db.race != nil {
+		db.race(db.csvDB)
+		db.race = nil
+	}
+	return db.csvDB.Replicate(r)
+}
+
+func TestBatchConflict(t *testing.T) {
+	mem := intentStorage(t)
+	s := must(NewStore("", WithStorage(mem))).T(t)
+	authors := s.Resources["authors"].(*csvDB)
+	s.Resources["authors"] = &racyDB{authors, func(db *csvDB) {
+		must0(t, db.Update(Record{"a1", "2", "Stanislaw Lem", "1"}))
+	}}
+	err := s.Batch(
+		Write{Resource: "books", Action: "create", Data: Resource{"_id": "b1", "title": "Solaris", "author": "a1"}},
+		Write{Resource: "authors", Action: "update", Data: Resource{"_id": "a1", "books": 2.0}},
+		Write{Resource: "authors", Action: "delete", Data: Resource{"_id": "a2"}},
+	)
+	if !errors.Is(err, errConcurrentWrite) {
+		t.Fatalf("got %v, want a conflict", err)
+	}
+	s.Resources["authors"] = authors
+	// The other steps are applied right away, and nothing is left for a
+	// restart to apply
+	check := func(step string) {
+		t.Helper()
+		if a := must(s.Get("authors", "a1")).T(t); a["name"] != "Stanislaw Lem" || a["books"] != 1.0 {
+			t.Errorf("%s: got %v, want the concurrent update", step, a)
+		}
+		if _, err := s.Get("books", "b1"); err != nil {
+			t.Errorf("%s: got %v for the created book", step, err)
+		}
+		if _, err := s.Get("authors", "a2"); !errors.Is(err, ErrRecordNotFound) {
+			t.Errorf("%s: got %v for the deleted author", step, err)
+		}
+	}
+	check("batch")
+	must0(t, s.Close())
+	s = must(NewStore("", WithStorage(mem))).T(t)
+	defer s.Close()
+	if len(s.Warnings) != 0 {
+		t.Errorf("unexpected warnings: %v", s.Warnings)
+	}
+	check("restart")
+	if hasIntentLog(t, mem) {
+		t.Error("intent log was not removed")
+	}
+}
+
+func TestBatch(t *testing.T) {
+	mem := intentStorage(t)
+	s := must(NewStore("", WithStorage(mem))).T(t)
+	defer s.Close()
+	for _, writes := range [][]Write{
+		{{Resource: "books", Action: "create", Data: Resource{"_id": "b1", "title": "Solaris"}}, {Resource: "books", Action: "create", Data: Resource{"title": ""}}},
+		{{Resource: "authors", Action: "create", Data: Resource{"_id": "a1", "name": "Lem"}}},
+		{{Resource: "authors", Action: "update", Data: Resource{"_id": "a3", "name": "Lem"}}},
+		{{Resource: "authors", Action: "delete", Data: Resource{"_id": "a1"}}, {Resource: "authors", Action: "update", Data: Resource{"_id": "a1"}}},
+		{{Resource: "authors", Action: "rename", Data: Resource{"_id": "a1"}}},
+		{{Resource: "movies", Action: "create", Data: Resource{"title": "Solaris"}}},
+	} {
+		if err := s.Batch(writes...); err == nil {
+			t.Errorf("expected error for %v", writes)
+		}
+	}
+	if _, err := s.Get("books", "b1"); err == nil {
+		t.Error("invalid batch was partially applied")
+	}
+	// A single write skips the intent log
+	must0(t, s.Batch(Write{Resource: "authors", Action: "update", Data: Resource{"_id": "a2", "name": "Somebody"}}))
+	if hasIntentLog(t, mem) {
+		t.Error("single write used the intent log")
+	}
+	if a := must(s.Get("authors", "a2")).T(t); a["name"] != "Somebody" {
+		t.Errorf("got %v", a)
+	}
+}
+
+func TestRepairIntent(t *testing.T) {
+	mem := intentStorage(t)
+	f := must(mem.Open("_intents.csv")).T(t)
+	must(f.Write([]byte(`i1,1,batch,"[{""resource"":""books"",""record"":[""b1"",""1"",""Solaris"",""a1""]},{""resource"":""movies"",""record"":[""m1"",""1""]}]"` + "\n"))).T(t)
+
+	s := must(NewStore("", WithStorage(mem))).T(t)
+	var w *IntentWarning
+	if len(s.Warnings) != 1 || !errors.As(s.Warnings[0], &w) || w.ID != "i1" || w.Op != "batch" {
+		t.Fatalf("got warnings %v", s.Warnings)
+	}
+	// The steps before the failing one are applied
+	must(s.Get("books", "b1")).T(t)
+	if err := s.RepairIntent("i1", false); err == nil {
+		t.Error("expected repair to fail again")
+	}
+	must0(t, s.RepairIntent("i1", true))
+	if len(s.Warnings) != 0 {
+		t.Errorf("got warnings %v after repair", s.Warnings)
+	}
+	must0(t, s.Close())
+
+	s = must(NewStore("", WithStorage(mem))).T(t)
+	defer s.Close()
+	if len(s.Warnings) != 0 || hasIntentLog(t, mem) {
+		t.Errorf("got warnings %v after reopening", s.Warnings)
+	}
+}
+
+func TestStoreMove(t *testing.T) {
+	mem := NewMemStorage()
+	f := must(mem.Open("_schemas.csv")).T(t)
+	must(f.Write([]byte(`s1,1,drafts,_id,text,,,^.+$
+s2,1,drafts,_v,number,1,,
+s3,1,drafts,title,text,,,
+s4,1,drafts,body,text,,,
+s5,1,drafts,notes,text,,,
+s6,1,drafts,words,number,,,
+s7,1,articles,_id,text,,,^.+$
+s8,1,articles,_v,number,1,,
+s9,1,articles,title,text,,,^.+$
+s10,1,articles,body,text,,,
+s11,1,articles,words,text,,,
+`))).T(t)
+	s := must(NewStore("", WithStorage(mem))).T(t)
+	defer s.Close()
+	must0(t, s.insert(t.Context(), "drafts", "d1", Resource{"title": "Hello", "body": "World", "notes": "todo", "words": 1.0}))
+	must0(t, s.insert(t.Context(), "drafts", "d2", Resource{"body": "Untitled"}))
+
+	// Articles require a title
+	if _, err := s.Move("drafts", "d2", "articles"); err == nil {
+		t.Error("expected an error for an invalid article")
+	}
+	if list := must(s.List("articles", "")).T(t); len(list) != 0 {
+		t.Errorf("got articles %v", list)
+	}
+	must(s.Get("drafts", "d2")).T(t)
+
+	id := must(s.Move("drafts", "d1", "articles")).T(t)
+	article := must(s.Get("articles", id)).T(t)
+	if article["title"] != "Hello" || article["body"] != "World" || article["words"] != "" || article["_v"] != 1.0 {
+		t.Errorf("got %v", article)
+	}
+	if d, err := s.Get("drafts", "d1"); err == nil && d != nil {
+		t.Errorf("draft was not deleted: %v", d)
+	}
+	for _, tt := range []struct{ src, id, dst string }{
+		{"drafts", "d1", "articles"},
+		{"drafts", "d2", "pages"},
+		{"pages", "p1", "articles"},
+	} {
+		if _, err := s.Move(tt.src, tt.id, tt.dst); err == nil {
+			t.Errorf("expected an error moving %s/%s to %s", tt.src, tt.id, tt.dst)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package pennybase
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"path/filepath"
+)
+
+// NewJSONLDB opens (or creates) a JSONL database at the given path.
+func NewJSONLDB(path string, opts ...DBOption) (*csvDB, error) {
+	return OpenJSONLDB(DirStorage(filepath.Dir(path)), filepath.Base(path), opts...)
+}
+
+// OpenJSONLDB opens (or creates) a database named name in the given storage,
+// which keeps every record as a JSON array of strings on its own line, e.g.
+// ["b1","2","Dune","Frank Herbert","1965"]. Newlines and other control
+// characters in text are escaped, so every row is a single line. It has the
+// same semantics as a CSV database.
+func OpenJSONLDB(st Storage, name string, opts ...DBOption) (*csvDB, error) {
+	return openDB(st, name, jsonlFormat, 0, opts...)
+}
+
+var jsonlFormat = rowFormat{
+	reader: func(r io.Reader) rowReader { return &jsonlReader{r: bufio.NewReader(r)} },
+	writer: func(w io.Writer) rowWriter {
+		bw := bufio.NewWriter(w)
+		enc := json.NewEncoder(bw)
+		enc.SetEscapeHTML(false)
+		return &jsonlWriter{w: bw, enc: enc}
+	},
+}
+
+type jsonlReader struct {
+	r   *bufio.Reader
+	off int64
+}
+
+func (jr *jsonlReader) InputOffset() int64 { return jr.off }
+
+// Read returns the next row, skipping blank lines.
+func (jr *jsonlReader) Read() ([]string, error) {
+	for {
+		line, err := jr.r.ReadBytes('\n')
+		jr.off += int64(len(line))
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		var row []string
+		if err := json.Unmarshal(line, &row); err != nil {
+			return nil, err
+		}
+		return row, nil
+	}
+}
+
+type jsonlWriter struct {
+	w   *bufio.Writer
+	enc *json.Encoder
+	err error
+}
+
+// Write encodes a row followed by a newline.
+func (jw *jsonlWriter) Write(row []string) error {
+	if jw.err == nil {
+		jw.err = jw.enc.Encode(row)
+	}
+	return jw.err
+}
+
+func (jw *jsonlWriter) Flush() {
+	if jw.err == nil {
+		jw.err = jw.w.Flush()
+	}
+}
+
+func (jw *jsonlWriter) Error() error { return jw.err }
@@ -0,0 +1,88 @@
+package pennybase
+
+import (
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// WithListCache makes the store keep the last result of List (and of
+// ListWhere, ListPage and the list endpoint, which use it) for every resource
+// and sort order, until the next write to the resource. Writes made to
+// Store.Resources directly, bypassing the store, are not noticed.
+func WithListCache() StoreOption {
+	return func(s *Store) { s.listCache = &listCache{entries: map[listKey]listEntry{}} }
+}
+
+type listKey struct{ resource, sortBy string }
+
+type listEntry struct {
+	seq int64 // ChangeSeq of the resource before the records were read
+	res []Resource
+}
+
+// listCache holds sorted records by resource and sort order. A nil cache
+// keeps nothing.
+type listCache struct {
+	mu      sync.Mutex
+	entries map[listKey]listEntry
+}
+
+// get returns a copy of the records cached for the resource and sort order if
+// the resource hasn't changed since they were read.
+func (c *listCache) get(resource, sortBy string, seq int64) ([]Resource, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	e, ok := c.entries[listKey{resource, sortBy}]
+	c.mu.Unlock()
+	if !ok || e.seq != seq {
+		return nil, false
+	}
+	return cloneResources(e.res), true
+}
+
+// put caches a copy of the records read at the given ChangeSeq. Results of
+// sorting by fields the schema doesn't have are not kept, so that clients
+// can't grow the cache.
+func (c *listCache) put(schema Schema, resource, sortBy string, seq int64, res []Resource) {
+	if c == nil {
+		return
+	}
+	if field := strings.TrimPrefix(sortBy, "-"); field != "" && !slices.ContainsFunc(schema, func(f FieldSchema) bool { return f.Field == field }) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[listKey{resource, sortBy}]; ok && e.seq > seq {
+		return
+	}
+	c.entries[listKey{resource, sortBy}] = listEntry{seq, cloneResources(res)}
+}
+
+// drop removes the records cached for a resource.
+func (c *listCache) drop(resource string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.entries {
+		if key.resource == resource {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// cloneResources copies the slice and the records, so that callers can change
+// them without changing the cache. Field values are shared, they are never
+// modified in place.
+func cloneResources(res []Resource) []Resource {
+	clone := make([]Resource, len(res))
+	for i, r := range res {
+		clone[i] = maps.Clone(r)
+	}
+	return clone
+}
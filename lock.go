@@ -0,0 +1,74 @@
+package pennybase
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Locker is implemented by storages that can lock files against other
+// processes. Lock takes an exclusive lock on a file, or fails with ErrLocked
+// if it is held, even by another open database of the same process. Closing
+// the returned value releases the lock.
+type Locker interface {
+	Lock(name string) (io.Closer, error)
+}
+
+// Lock locks name+".lock" rather than the file itself, which is replaced when
+// it is compacted or repaired. The lock is advisory (flock on Unix, LockFileEx
+// on Windows) and is released by the operating system if the process dies.
+// The lock file is left in place.
+func (d DirStorage) Lock(name string) (io.Closer, error) {
+	f, err := os.OpenFile(filepath.Join(string(d), name+".lock"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	locked, err := lockFile(f)
+	if err == nil && !locked {
+		err = newError("database_locked", "name", name)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// lockPoll is how often a database waiting for a lock tries to take it.
+const lockPoll = 50 * time.Millisecond
+
+// WithLockTimeout makes opening a database wait up to d for the lock on its
+// file instead of failing right away if another process holds it.
+func WithLockTimeout(d time.Duration) DBOption { return func(db *csvDB) { db.lockWait = d } }
+
+// acquireLock locks the file of the database if the storage supports it, so
+// that two processes can't write to it at the same time.
+func (db *csvDB) acquireLock() error {
+	l, ok := db.st.(Locker)
+	if !ok {
+		return nil
+	}
+	deadline := time.Now().Add(db.lockWait)
+	for {
+		lock, err := l.Lock(db.name)
+		if err == nil {
+			db.lock = lock
+			return nil
+		}
+		if !errors.Is(err, ErrLocked) || !time.Now().Before(deadline) {
+			return err
+		}
+		time.Sleep(min(lockPoll, time.Until(deadline)))
+	}
+}
+
+func (db *csvDB) releaseLock() error {
+	if db.lock == nil {
+		return nil
+	}
+	err := db.lock.Close()
+	db.lock = nil
+	return err
+}
@@ -0,0 +1,8 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd || windows)
+
+package pennybase
+
+import "os"
+
+// lockFile doesn't lock anything on platforms without file locks.
+func lockFile(f *os.File) (bool, error) { return true, nil }
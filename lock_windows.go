@@ -0,0 +1,30 @@
+//go:build windows
+
+package pennybase
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var procLockFileEx = syscall.NewLazyDLL("kernel32.dll").NewProc("LockFileEx")
+
+// lockFile takes an exclusive lock on the first byte of f without blocking
+// and reports whether it got it.
+func lockFile(f *os.File) (bool, error) {
+	const (
+		lockfileFailImmediately = 0x1
+		lockfileExclusiveLock   = 0x2
+		errorLockViolation      = syscall.Errno(33)
+	)
+	var ol syscall.Overlapped
+	r, _, err := procLockFileEx.Call(f.Fd(), lockfileExclusiveLock|lockfileFailImmediately, 0, 1, 0, uintptr(unsafe.Pointer(&ol)))
+	if r != 0 {
+		return true, nil
+	}
+	if err == errorLockViolation {
+		return false, nil
+	}
+	return false, err
+}
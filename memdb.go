@@ -0,0 +1,196 @@
+package pennybase
+
+import (
+	"cmp"
+	"slices"
+	"strconv"
+	"sync"
+)
+
+// memDB is a database kept in memory with the semantics of the CSV databases:
+// records are versioned, updates must increment the version, and Iter yields
+// the live records in the order they were last written. It is meant for tests
+// and ephemeral demos.
+type memDB struct {
+	mu      sync.RWMutex
+	records map[string]memRecord
+	rows    int64
+	live    int
+}
+
+// memRecord is the latest version of a record and the number of the write
+// that stored it. For deleted records, deleted is the version of the deletion.
+type memRecord struct {
+	rec     Record
+	seq     int64
+	deleted int64
+}
+
+// NewMemDB returns an empty in-memory database. Like csvDB, it also reports
+// change sequences, tombstones and counts through the optional interfaces the
+// Store looks for.
+func NewMemDB() DB { return newMemDB() }
+
+func newMemDB() *memDB { return &memDB{records: map[string]memRecord{}} }
+
+func (db *memDB) Create(r Record) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if len(r) < 2 || r[0] == "" || r[1] != "1" {
+		return newError("invalid_record")
+	}
+	if v := db.version(r[0]); v != 0 {
+		return newError("version_conflict", "version", strconv.FormatInt(v, 10))
+	}
+	db.write(r)
+	return nil
+}
+
+func (db *memDB) Update(r Record) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if len(r) < 2 {
+		return newError("invalid_record")
+	}
+	v := db.version(r[0])
+	if v < 1 {
+		return newError("record_not_found")
+	}
+	if r[1] != strconv.FormatInt(v+1, 10) {
+		return newError("version_conflict", "version", strconv.FormatInt(v, 10))
+	}
+	db.write(r)
+	return nil
+}
+
+func (db *memDB) Delete(id string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.version(id) < 1 {
+		return newError("record_not_found")
+	}
+	db.write(Record{id, "0"})
+	return nil
+}
+
+func (db *memDB) Get(id string) (Record, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.version(id) < 1 {
+		return nil, newError("record_not_found")
+	}
+	return slices.Clone(db.records[id].rec), nil
+}
+
+// Iter yields the live records as of the start of the iteration.
+func (db *memDB) Iter() func(yield func(Record, error) bool) {
+	return func(yield func(Record, error) bool) {
+		db.mu.RLock()
+		live := []memRecord{}
+		for id, r := range db.records {
+			if db.version(id) >= 1 {
+				live = append(live, r)
+			}
+		}
+		db.mu.RUnlock()
+		slices.SortFunc(live, func(a, b memRecord) int { return cmp.Compare(a.seq, b.seq) })
+		for _, r := range live {
+			if !yield(slices.Clone(r.rec), nil) {
+				return
+			}
+		}
+	}
+}
+
+// Replicate writes a record copied from another database if it is newer than
+// the local version, like csvDB.Replicate. It makes batches work in memory.
+func (db *memDB) Replicate(r Record) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if len(r) < 2 || r[0] == "" {
+		return false, newError("invalid_record")
+	}
+	v, err := strconv.ParseInt(r[1], 10, 64)
+	if err != nil {
+		return false, err
+	}
+	if cur := db.version(r[0]); (v == 0 && cur < 1) || (v != 0 && v <= cur) {
+		return false, nil
+	}
+	db.write(r)
+	return true, nil
+}
+
+// Deleted returns the versions of the deletions of deleted records by id,
+// like csvDB.Deleted.
+func (db *memDB) Deleted() map[string]int64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	deleted := map[string]int64{}
+	for id, r := range db.records {
+		if r.deleted > 0 {
+			deleted[id] = r.deleted
+		}
+	}
+	return deleted
+}
+
+// Count returns the number of live records.
+func (db *memDB) Count() int {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.live
+}
+
+// Exists reports whether a record is live.
+func (db *memDB) Exists(id string) bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.version(id) >= 1
+}
+
+// Seq returns the number of writes, like csvDB.Seq.
+func (db *memDB) Seq() int64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.rows
+}
+
+func (db *memDB) Close() error { return nil }
+
+// version returns the version of the latest write of id, 0 if it was deleted
+// or never written. The caller must hold db.mu.
+func (db *memDB) version(id string) int64 {
+	r, ok := db.records[id]
+	if !ok {
+		return 0
+	}
+	v, _ := strconv.ParseInt(r.rec[1], 10, 64)
+	return v
+}
+
+func (db *memDB) write(r Record) {
+	prev := db.version(r[0])
+	if prev >= 1 {
+		db.live--
+	}
+	deleted := int64(0)
+	if r[1] != "0" {
+		db.live++
+	} else {
+		deleted = prev + 1
+	}
+	db.rows++
+	db.records[r[0]] = memRecord{slices.Clone(r), db.rows, deleted}
+}
+
+// MemBackend keeps every resource in a memDB, so that nothing but the schemas
+// is read from the storage. The records are lost when the store is closed.
+type MemBackend struct{}
+
+func (MemBackend) Open(resource string) (DB, error) { return NewMemDB(), nil }
+
+// WithMemDB makes the store keep resources in memory, see MemBackend. With
+// WithStorage(NewMemStorage()) nothing touches the disk, the schemas are
+// written to the storage first.
+func WithMemDB() StoreOption { return func(s *Store) { s.Backend = MemBackend{} } }
@@ -0,0 +1,67 @@
+package pennybase
+
+import (
+	"errors"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+var _ DB = (*memDB)(nil)
+
+func TestMemDB(t *testing.T) {
+	open := func(Storage, string, ...DBOption) (*memDB, error) { return newMemDB(), nil }
+	t.Run("BasicOperations", func(t *testing.T) { testDBBasicOperations(t, open) })
+	t.Run("EmptyIterator", func(t *testing.T) { testEmptyIterator(t, open) })
+	t.Run("IteratorWithDeletes", func(t *testing.T) { testIteratorWithDeletes(t, open) })
+	t.Run("Concurrent", func(t *testing.T) { testConcurrent(t, open) })
+
+	// Like csvDB, a deleted id can be created again and records are iterated
+	// in the order they were last written
+	db := newMemDB()
+	must0(t, db.Create(Record{"a", "1", "x"}))
+	must0(t, db.Create(Record{"b", "1", "y"}))
+	must0(t, db.Update(Record{"a", "2", "z"}))
+	if err := db.Update(Record{"a", "2", "z"}); !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("got %v for a stale update", err)
+	}
+	must0(t, db.Delete("b"))
+	if err := db.Delete("b"); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("got %v for a second delete", err)
+	}
+	must0(t, db.Create(Record{"b", "1", "again"}))
+	got := []Record{}
+	for rec, err := range db.Iter() {
+		got = append(got, must(rec, err).T(t))
+	}
+	if want := []Record{{"a", "2", "z"}, {"b", "1", "again"}}; !slices.EqualFunc(got, want, slices.Equal) || db.Seq() != 5 {
+		t.Errorf("got %v and seq %d", got, db.Seq())
+	}
+}
+
+func TestStoreMemDB(t *testing.T) {
+	st := NewMemStorage()
+	schemas := must(OpenCSVDB(st, "_schemas.csv")).T(t)
+	for i, row := range [][]string{
+		{"notes", "_id", "text", "", "", "^.+$"},
+		{"notes", "_v", "number", "1", "", ""},
+		{"notes", "title", "text", "", "", "^.+$"},
+	} {
+		must0(t, schemas.Create(append(Record{"s" + strconv.Itoa(i+1), "1"}, row...)))
+	}
+	must0(t, schemas.Close())
+	s := must(NewStore("", WithStorage(st), WithMemDB())).T(t)
+	defer s.Close()
+	id := must(s.Create("notes", Resource{"title": "hello"})).T(t)
+	must0(t, s.Update("notes", Resource{"_id": id, "title": "hi"}))
+	if r := must(s.Get("notes", id)).T(t); r["title"] != "hi" || r["_v"] != 2.0 {
+		t.Errorf("got %v", r)
+	}
+	must0(t, s.Batch(Write{Resource: "notes", Action: "delete", Data: Resource{"_id": id}}))
+	if _, err := s.Get("notes", id); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("got %v after a batch delete", err)
+	}
+	if names := must(st.List()).T(t); !slices.Equal(names, []string{"_schemas.csv"}) {
+		t.Errorf("got files %v", names)
+	}
+}
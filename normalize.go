@@ -0,0 +1,251 @@
+package pennybase
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Normalize applies the normalization options of a text field: "nfc", then
+// "collapse" or "trim", then "lower". It is used on stored values as well as
+// on lookup values, so that both compare equal.
+func (field FieldSchema) Normalize(s string) string {
+	if field.NFC {
+		s = composeNFC(s)
+	}
+	if field.Collapse {
+		s = strings.Join(strings.FieldsFunc(s, isSpace), " ")
+	} else if field.Trim {
+		s = strings.TrimFunc(s, isSpace)
+	}
+	if field.Lower {
+		s = strings.ToLower(s)
+	}
+	return s
+}
+
+// isSpace also treats zero-width spaces and byte order marks as whitespace,
+// as they are commonly pasted along with text and are invisible.
+func isSpace(r rune) bool {
+	return unicode.IsSpace(r) || r == '\u200b' || r == '\ufeff'
+}
+
+// slugify makes a URL-friendly slug: accents are removed from Latin letters,
+// letters and digits are lower-cased, and every other run of characters
+// becomes a single dash, e.g. "Crème Brûlée!" becomes "creme-brulee".
+func slugify(s string) string {
+	var sb strings.Builder
+	dash := false
+	for _, r := range composeNFC(s) {
+		if base := latinBase(r); base != 0 {
+			r = base
+		}
+		switch {
+		case unicode.Is(unicode.Mn, r): // combining marks left after composition
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if dash && sb.Len() > 0 {
+				sb.WriteByte('-')
+			}
+			dash = false
+			sb.WriteRune(unicode.ToLower(r))
+		default:
+			dash = true
+		}
+	}
+	return sb.String()
+}
+
+// latinBase returns the ASCII letter a composed character is based on, e.g.
+// 'u' for both 'ü' and 'ǖ', or 0 if there is none.
+func latinBase(r rune) rune {
+	for {
+		base, ok := nfcBases[r]
+		if !ok {
+			return 0
+		}
+		if base < 0x80 {
+			return base
+		}
+		r = base
+	}
+}
+
+// composeNFC converts decomposed text (a base character followed by
+// combining marks, as e.g. macOS file names are) to precomposed characters,
+// so that the NFC and NFD forms of a string become equal. Text that is
+// already composed is left as is. Unlike full NFC it doesn't reorder
+// combining marks, which covers the decomposed forms produced in practice.
+func composeNFC(s string) string {
+	ascii := true
+	for i := 0; i < len(s) && ascii; i++ {
+		ascii = s[i] < 0x80
+	}
+	if ascii {
+		return s
+	}
+	out := make([]rune, 0, len(s))
+	for _, r := range s {
+		if n := len(out); n > 0 {
+			if c, ok := composePair(out[n-1], r); ok {
+				out[n-1] = c
+				continue
+			}
+		}
+		out = append(out, r)
+	}
+	return string(out)
+}
+
+// Hangul syllables are composed algorithmically, see Unicode section 3.12.
+const (
+	hangulBase, hangulL, hangulV, hangulT    = 0xac00, 0x1100, 0x1161, 0x11a7
+	hangulLCount, hangulVCount, hangulTCount = 19, 21, 28
+)
+
+func composePair(a, b rune) (rune, bool) {
+	if a >= hangulL && a < hangulL+hangulLCount && b >= hangulV && b < hangulV+hangulVCount {
+		return hangulBase + ((a-hangulL)*hangulVCount+(b-hangulV))*hangulTCount, true
+	}
+	if s := a - hangulBase; s >= 0 && s < hangulLCount*hangulVCount*hangulTCount && s%hangulTCount == 0 &&
+		b > hangulT && b < hangulT+hangulTCount {
+		return a + b - hangulT, true
+	}
+	c, ok := nfcCompositions[[2]rune{a, b}]
+	return c, ok
+}
+
+var nfcCompositions = func() map[[2]rune]rune {
+	m := map[[2]rune]rune{}
+	for rs := []rune(nfcPairs); len(rs) >= 3; rs = rs[3:] {
+		m[[2]rune{rs[0], rs[1]}] = rs[2]
+	}
+	return m
+}()
+
+var nfcBases = func() map[rune]rune {
+	m := map[rune]rune{}
+	for rs := []rune(nfcPairs); len(rs) >= 3; rs = rs[3:] {
+		m[rs[2]] = rs[0]
+	}
+	return m
+}()
+
+// nfcPairs lists the canonical compositions in the Unicode BMP except Hangul,
+// as triples of a base character, a combining character and their composition
+// (Unicode 14.0.0, from UnicodeData.txt minus CompositionExclusions.txt).
+const nfcPairs = "" +
+	"A\u0300\u00c0A\u0301\u00c1A\u0302\u00c2A\u0303\u00c3A\u0308\u00c4A\u030a\u00c5C\u0327\u00c7E\u0300\u00c8" +
+	"E\u0301\u00c9E\u0302\u00caE\u0308\u00cbI\u0300\u00ccI\u0301\u00cdI\u0302\u00ceI\u0308\u00cfN\u0303\u00d1" +
+	"O\u0300\u00d2O\u0301\u00d3O\u0302\u00d4O\u0303\u00d5O\u0308\u00d6U\u0300\u00d9U\u0301\u00daU\u0302\u00db" +
+	"U\u0308\u00dcY\u0301\u00dda\u0300\u00e0a\u0301\u00e1a\u0302\u00e2a\u0303\u00e3a\u0308\u00e4a\u030a\u00e5" +
+	"c\u0327\u00e7e\u0300\u00e8e\u0301\u00e9e\u0302\u00eae\u0308\u00ebi\u0300\u00eci\u0301\u00edi\u0302\u00ee" +
+	"i\u0308\u00efn\u0303\u00f1o\u0300\u00f2o\u0301\u00f3o\u0302\u00f4o\u0303\u00f5o\u0308\u00f6u\u0300\u00f9" +
+	"u\u0301\u00fau\u0302\u00fbu\u0308\u00fcy\u0301\u00fdy\u0308\u00ffA\u0304\u0100a\u0304\u0101A\u0306\u0102" +
+	"a\u0306\u0103A\u0328\u0104a\u0328\u0105C\u0301\u0106c\u0301\u0107C\u0302\u0108c\u0302\u0109C\u0307\u010a" +
+	"c\u0307\u010bC\u030c\u010cc\u030c\u010dD\u030c\u010ed\u030c\u010fE\u0304\u0112e\u0304\u0113E\u0306\u0114" +
+	"e\u0306\u0115E\u0307\u0116e\u0307\u0117E\u0328\u0118e\u0328\u0119E\u030c\u011ae\u030c\u011bG\u0302\u011c" +
+	"g\u0302\u011dG\u0306\u011eg\u0306\u011fG\u0307\u0120g\u0307\u0121G\u0327\u0122g\u0327\u0123H\u0302\u0124" +
+	"h\u0302\u0125I\u0303\u0128i\u0303\u0129I\u0304\u012ai\u0304\u012bI\u0306\u012ci\u0306\u012dI\u0328\u012e" +
+	"i\u0328\u012fI\u0307\u0130J\u0302\u0134j\u0302\u0135K\u0327\u0136k\u0327\u0137L\u0301\u0139l\u0301\u013a" +
+	"L\u0327\u013bl\u0327\u013cL\u030c\u013dl\u030c\u013eN\u0301\u0143n\u0301\u0144N\u0327\u0145n\u0327\u0146" +
+	"N\u030c\u0147n\u030c\u0148O\u0304\u014co\u0304\u014dO\u0306\u014eo\u0306\u014fO\u030b\u0150o\u030b\u0151" +
+	"R\u0301\u0154r\u0301\u0155R\u0327\u0156r\u0327\u0157R\u030c\u0158r\u030c\u0159S\u0301\u015as\u0301\u015b" +
+	"S\u0302\u015cs\u0302\u015dS\u0327\u015es\u0327\u015fS\u030c\u0160s\u030c\u0161T\u0327\u0162t\u0327\u0163" +
+	"T\u030c\u0164t\u030c\u0165U\u0303\u0168u\u0303\u0169U\u0304\u016au\u0304\u016bU\u0306\u016cu\u0306\u016d" +
+	"U\u030a\u016eu\u030a\u016fU\u030b\u0170u\u030b\u0171U\u0328\u0172u\u0328\u0173W\u0302\u0174w\u0302\u0175" +
+	"Y\u0302\u0176y\u0302\u0177Y\u0308\u0178Z\u0301\u0179z\u0301\u017aZ\u0307\u017bz\u0307\u017cZ\u030c\u017d" +
+	"z\u030c\u017eO\u031b\u01a0o\u031b\u01a1U\u031b\u01afu\u031b\u01b0A\u030c\u01cda\u030c\u01ceI\u030c\u01cf" +
+	"i\u030c\u01d0O\u030c\u01d1o\u030c\u01d2U\u030c\u01d3u\u030c\u01d4\u00dc\u0304\u01d5\u00fc\u0304\u01d6\u00dc\u0301\u01d7" +
+	"\u00fc\u0301\u01d8\u00dc\u030c\u01d9\u00fc\u030c\u01da\u00dc\u0300\u01db\u00fc\u0300\u01dc\u00c4\u0304\u01de\u00e4\u0304\u01df\u0226\u0304\u01e0" +
+	"\u0227\u0304\u01e1\u00c6\u0304\u01e2\u00e6\u0304\u01e3G\u030c\u01e6g\u030c\u01e7K\u030c\u01e8k\u030c\u01e9O\u0328\u01ea" +
+	"o\u0328\u01eb\u01ea\u0304\u01ec\u01eb\u0304\u01ed\u01b7\u030c\u01ee\u0292\u030c\u01efj\u030c\u01f0G\u0301\u01f4g\u0301\u01f5" +
+	"N\u0300\u01f8n\u0300\u01f9\u00c5\u0301\u01fa\u00e5\u0301\u01fb\u00c6\u0301\u01fc\u00e6\u0301\u01fd\u00d8\u0301\u01fe\u00f8\u0301\u01ff" +
+	"A\u030f\u0200a\u030f\u0201A\u0311\u0202a\u0311\u0203E\u030f\u0204e\u030f\u0205E\u0311\u0206e\u0311\u0207" +
+	"I\u030f\u0208i\u030f\u0209I\u0311\u020ai\u0311\u020bO\u030f\u020co\u030f\u020dO\u0311\u020eo\u0311\u020f" +
+	"R\u030f\u0210r\u030f\u0211R\u0311\u0212r\u0311\u0213U\u030f\u0214u\u030f\u0215U\u0311\u0216u\u0311\u0217" +
+	"S\u0326\u0218s\u0326\u0219T\u0326\u021at\u0326\u021bH\u030c\u021eh\u030c\u021fA\u0307\u0226a\u0307\u0227" +
+	"E\u0327\u0228e\u0327\u0229\u00d6\u0304\u022a\u00f6\u0304\u022b\u00d5\u0304\u022c\u00f5\u0304\u022dO\u0307\u022eo\u0307\u022f" +
+	"\u022e\u0304\u0230\u022f\u0304\u0231Y\u0304\u0232y\u0304\u0233\u00a8\u0301\u0385\u0391\u0301\u0386\u0395\u0301\u0388\u0397\u0301\u0389" +
+	"\u0399\u0301\u038a\u039f\u0301\u038c\u03a5\u0301\u038e\u03a9\u0301\u038f\u03ca\u0301\u0390\u0399\u0308\u03aa\u03a5\u0308\u03ab\u03b1\u0301\u03ac" +
+	"\u03b5\u0301\u03ad\u03b7\u0301\u03ae\u03b9\u0301\u03af\u03cb\u0301\u03b0\u03b9\u0308\u03ca\u03c5\u0308\u03cb\u03bf\u0301\u03cc\u03c5\u0301\u03cd" +
+	"\u03c9\u0301\u03ce\u03d2\u0301\u03d3\u03d2\u0308\u03d4\u0415\u0300\u0400\u0415\u0308\u0401\u0413\u0301\u0403\u0406\u0308\u0407\u041a\u0301\u040c" +
+	"\u0418\u0300\u040d\u0423\u0306\u040e\u0418\u0306\u0419\u0438\u0306\u0439\u0435\u0300\u0450\u0435\u0308\u0451\u0433\u0301\u0453\u0456\u0308\u0457" +
+	"\u043a\u0301\u045c\u0438\u0300\u045d\u0443\u0306\u045e\u0474\u030f\u0476\u0475\u030f\u0477\u0416\u0306\u04c1\u0436\u0306\u04c2\u0410\u0306\u04d0" +
+	"\u0430\u0306\u04d1\u0410\u0308\u04d2\u0430\u0308\u04d3\u0415\u0306\u04d6\u0435\u0306\u04d7\u04d8\u0308\u04da\u04d9\u0308\u04db\u0416\u0308\u04dc" +
+	"\u0436\u0308\u04dd\u0417\u0308\u04de\u0437\u0308\u04df\u0418\u0304\u04e2\u0438\u0304\u04e3\u0418\u0308\u04e4\u0438\u0308\u04e5\u041e\u0308\u04e6" +
+	"\u043e\u0308\u04e7\u04e8\u0308\u04ea\u04e9\u0308\u04eb\u042d\u0308\u04ec\u044d\u0308\u04ed\u0423\u0304\u04ee\u0443\u0304\u04ef\u0423\u0308\u04f0" +
+	"\u0443\u0308\u04f1\u0423\u030b\u04f2\u0443\u030b\u04f3\u0427\u0308\u04f4\u0447\u0308\u04f5\u042b\u0308\u04f8\u044b\u0308\u04f9\u0627\u0653\u0622" +
+	"\u0627\u0654\u0623\u0648\u0654\u0624\u0627\u0655\u0625\u064a\u0654\u0626\u06d5\u0654\u06c0\u06c1\u0654\u06c2\u06d2\u0654\u06d3\u0928\u093c\u0929" +
+	"\u0930\u093c\u0931\u0933\u093c\u0934\u09c7\u09be\u09cb\u09c7\u09d7\u09cc\u0b47\u0b56\u0b48\u0b47\u0b3e\u0b4b\u0b47\u0b57\u0b4c\u0b92\u0bd7\u0b94" +
+	"\u0bc6\u0bbe\u0bca\u0bc7\u0bbe\u0bcb\u0bc6\u0bd7\u0bcc\u0c46\u0c56\u0c48\u0cbf\u0cd5\u0cc0\u0cc6\u0cd5\u0cc7\u0cc6\u0cd6\u0cc8\u0cc6\u0cc2\u0cca" +
+	"\u0cca\u0cd5\u0ccb\u0d46\u0d3e\u0d4a\u0d47\u0d3e\u0d4b\u0d46\u0d57\u0d4c\u0dd9\u0dca\u0dda\u0dd9\u0dcf\u0ddc\u0ddc\u0dca\u0ddd\u0dd9\u0ddf\u0dde" +
+	"\u1025\u102e\u1026\u1b05\u1b35\u1b06\u1b07\u1b35\u1b08\u1b09\u1b35\u1b0a\u1b0b\u1b35\u1b0c\u1b0d\u1b35\u1b0e\u1b11\u1b35\u1b12\u1b3a\u1b35\u1b3b" +
+	"\u1b3c\u1b35\u1b3d\u1b3e\u1b35\u1b40\u1b3f\u1b35\u1b41\u1b42\u1b35\u1b43A\u0325\u1e00a\u0325\u1e01B\u0307\u1e02b\u0307\u1e03" +
+	"B\u0323\u1e04b\u0323\u1e05B\u0331\u1e06b\u0331\u1e07\u00c7\u0301\u1e08\u00e7\u0301\u1e09D\u0307\u1e0ad\u0307\u1e0b" +
+	"D\u0323\u1e0cd\u0323\u1e0dD\u0331\u1e0ed\u0331\u1e0fD\u0327\u1e10d\u0327\u1e11D\u032d\u1e12d\u032d\u1e13" +
+	"\u0112\u0300\u1e14\u0113\u0300\u1e15\u0112\u0301\u1e16\u0113\u0301\u1e17E\u032d\u1e18e\u032d\u1e19E\u0330\u1e1ae\u0330\u1e1b" +
+	"\u0228\u0306\u1e1c\u0229\u0306\u1e1dF\u0307\u1e1ef\u0307\u1e1fG\u0304\u1e20g\u0304\u1e21H\u0307\u1e22h\u0307\u1e23" +
+	"H\u0323\u1e24h\u0323\u1e25H\u0308\u1e26h\u0308\u1e27H\u0327\u1e28h\u0327\u1e29H\u032e\u1e2ah\u032e\u1e2b" +
+	"I\u0330\u1e2ci\u0330\u1e2d\u00cf\u0301\u1e2e\u00ef\u0301\u1e2fK\u0301\u1e30k\u0301\u1e31K\u0323\u1e32k\u0323\u1e33" +
+	"K\u0331\u1e34k\u0331\u1e35L\u0323\u1e36l\u0323\u1e37\u1e36\u0304\u1e38\u1e37\u0304\u1e39L\u0331\u1e3al\u0331\u1e3b" +
+	"L\u032d\u1e3cl\u032d\u1e3dM\u0301\u1e3em\u0301\u1e3fM\u0307\u1e40m\u0307\u1e41M\u0323\u1e42m\u0323\u1e43" +
+	"N\u0307\u1e44n\u0307\u1e45N\u0323\u1e46n\u0323\u1e47N\u0331\u1e48n\u0331\u1e49N\u032d\u1e4an\u032d\u1e4b" +
+	"\u00d5\u0301\u1e4c\u00f5\u0301\u1e4d\u00d5\u0308\u1e4e\u00f5\u0308\u1e4f\u014c\u0300\u1e50\u014d\u0300\u1e51\u014c\u0301\u1e52\u014d\u0301\u1e53" +
+	"P\u0301\u1e54p\u0301\u1e55P\u0307\u1e56p\u0307\u1e57R\u0307\u1e58r\u0307\u1e59R\u0323\u1e5ar\u0323\u1e5b" +
+	"\u1e5a\u0304\u1e5c\u1e5b\u0304\u1e5dR\u0331\u1e5er\u0331\u1e5fS\u0307\u1e60s\u0307\u1e61S\u0323\u1e62s\u0323\u1e63" +
+	"\u015a\u0307\u1e64\u015b\u0307\u1e65\u0160\u0307\u1e66\u0161\u0307\u1e67\u1e62\u0307\u1e68\u1e63\u0307\u1e69T\u0307\u1e6at\u0307\u1e6b" +
+	"T\u0323\u1e6ct\u0323\u1e6dT\u0331\u1e6et\u0331\u1e6fT\u032d\u1e70t\u032d\u1e71U\u0324\u1e72u\u0324\u1e73" +
+	"U\u0330\u1e74u\u0330\u1e75U\u032d\u1e76u\u032d\u1e77\u0168\u0301\u1e78\u0169\u0301\u1e79\u016a\u0308\u1e7a\u016b\u0308\u1e7b" +
+	"V\u0303\u1e7cv\u0303\u1e7dV\u0323\u1e7ev\u0323\u1e7fW\u0300\u1e80w\u0300\u1e81W\u0301\u1e82w\u0301\u1e83" +
+	"W\u0308\u1e84w\u0308\u1e85W\u0307\u1e86w\u0307\u1e87W\u0323\u1e88w\u0323\u1e89X\u0307\u1e8ax\u0307\u1e8b" +
+	"X\u0308\u1e8cx\u0308\u1e8dY\u0307\u1e8ey\u0307\u1e8fZ\u0302\u1e90z\u0302\u1e91Z\u0323\u1e92z\u0323\u1e93" +
+	"Z\u0331\u1e94z\u0331\u1e95h\u0331\u1e96t\u0308\u1e97w\u030a\u1e98y\u030a\u1e99\u017f\u0307\u1e9bA\u0323\u1ea0" +
+	"a\u0323\u1ea1A\u0309\u1ea2a\u0309\u1ea3\u00c2\u0301\u1ea4\u00e2\u0301\u1ea5\u00c2\u0300\u1ea6\u00e2\u0300\u1ea7\u00c2\u0309\u1ea8" +
+	"\u00e2\u0309\u1ea9\u00c2\u0303\u1eaa\u00e2\u0303\u1eab\u1ea0\u0302\u1eac\u1ea1\u0302\u1ead\u0102\u0301\u1eae\u0103\u0301\u1eaf\u0102\u0300\u1eb0" +
+	"\u0103\u0300\u1eb1\u0102\u0309\u1eb2\u0103\u0309\u1eb3\u0102\u0303\u1eb4\u0103\u0303\u1eb5\u1ea0\u0306\u1eb6\u1ea1\u0306\u1eb7E\u0323\u1eb8" +
+	"e\u0323\u1eb9E\u0309\u1ebae\u0309\u1ebbE\u0303\u1ebce\u0303\u1ebd\u00ca\u0301\u1ebe\u00ea\u0301\u1ebf\u00ca\u0300\u1ec0" +
+	"\u00ea\u0300\u1ec1\u00ca\u0309\u1ec2\u00ea\u0309\u1ec3\u00ca\u0303\u1ec4\u00ea\u0303\u1ec5\u1eb8\u0302\u1ec6\u1eb9\u0302\u1ec7I\u0309\u1ec8" +
+	"i\u0309\u1ec9I\u0323\u1ecai\u0323\u1ecbO\u0323\u1ecco\u0323\u1ecdO\u0309\u1eceo\u0309\u1ecf\u00d4\u0301\u1ed0" +
+	"\u00f4\u0301\u1ed1\u00d4\u0300\u1ed2\u00f4\u0300\u1ed3\u00d4\u0309\u1ed4\u00f4\u0309\u1ed5\u00d4\u0303\u1ed6\u00f4\u0303\u1ed7\u1ecc\u0302\u1ed8" +
+	"\u1ecd\u0302\u1ed9\u01a0\u0301\u1eda\u01a1\u0301\u1edb\u01a0\u0300\u1edc\u01a1\u0300\u1edd\u01a0\u0309\u1ede\u01a1\u0309\u1edf\u01a0\u0303\u1ee0" +
+	"\u01a1\u0303\u1ee1\u01a0\u0323\u1ee2\u01a1\u0323\u1ee3U\u0323\u1ee4u\u0323\u1ee5U\u0309\u1ee6u\u0309\u1ee7\u01af\u0301\u1ee8" +
+	"\u01b0\u0301\u1ee9\u01af\u0300\u1eea\u01b0\u0300\u1eeb\u01af\u0309\u1eec\u01b0\u0309\u1eed\u01af\u0303\u1eee\u01b0\u0303\u1eef\u01af\u0323\u1ef0" +
+	"\u01b0\u0323\u1ef1Y\u0300\u1ef2y\u0300\u1ef3Y\u0323\u1ef4y\u0323\u1ef5Y\u0309\u1ef6y\u0309\u1ef7Y\u0303\u1ef8" +
+	"y\u0303\u1ef9\u03b1\u0313\u1f00\u03b1\u0314\u1f01\u1f00\u0300\u1f02\u1f01\u0300\u1f03\u1f00\u0301\u1f04\u1f01\u0301\u1f05\u1f00\u0342\u1f06" +
+	"\u1f01\u0342\u1f07\u0391\u0313\u1f08\u0391\u0314\u1f09\u1f08\u0300\u1f0a\u1f09\u0300\u1f0b\u1f08\u0301\u1f0c\u1f09\u0301\u1f0d\u1f08\u0342\u1f0e" +
+	"\u1f09\u0342\u1f0f\u03b5\u0313\u1f10\u03b5\u0314\u1f11\u1f10\u0300\u1f12\u1f11\u0300\u1f13\u1f10\u0301\u1f14\u1f11\u0301\u1f15\u0395\u0313\u1f18" +
+	"\u0395\u0314\u1f19\u1f18\u0300\u1f1a\u1f19\u0300\u1f1b\u1f18\u0301\u1f1c\u1f19\u0301\u1f1d\u03b7\u0313\u1f20\u03b7\u0314\u1f21\u1f20\u0300\u1f22" +
+	"\u1f21\u0300\u1f23\u1f20\u0301\u1f24\u1f21\u0301\u1f25\u1f20\u0342\u1f26\u1f21\u0342\u1f27\u0397\u0313\u1f28\u0397\u0314\u1f29\u1f28\u0300\u1f2a" +
+	"\u1f29\u0300\u1f2b\u1f28\u0301\u1f2c\u1f29\u0301\u1f2d\u1f28\u0342\u1f2e\u1f29\u0342\u1f2f\u03b9\u0313\u1f30\u03b9\u0314\u1f31\u1f30\u0300\u1f32" +
+	"\u1f31\u0300\u1f33\u1f30\u0301\u1f34\u1f31\u0301\u1f35\u1f30\u0342\u1f36\u1f31\u0342\u1f37\u0399\u0313\u1f38\u0399\u0314\u1f39\u1f38\u0300\u1f3a" +
+	"\u1f39\u0300\u1f3b\u1f38\u0301\u1f3c\u1f39\u0301\u1f3d\u1f38\u0342\u1f3e\u1f39\u0342\u1f3f\u03bf\u0313\u1f40\u03bf\u0314\u1f41\u1f40\u0300\u1f42" +
+	"\u1f41\u0300\u1f43\u1f40\u0301\u1f44\u1f41\u0301\u1f45\u039f\u0313\u1f48\u039f\u0314\u1f49\u1f48\u0300\u1f4a\u1f49\u0300\u1f4b\u1f48\u0301\u1f4c" +
+	"\u1f49\u0301\u1f4d\u03c5\u0313\u1f50\u03c5\u0314\u1f51\u1f50\u0300\u1f52\u1f51\u0300\u1f53\u1f50\u0301\u1f54\u1f51\u0301\u1f55\u1f50\u0342\u1f56" +
+	"\u1f51\u0342\u1f57\u03a5\u0314\u1f59\u1f59\u0300\u1f5b\u1f59\u0301\u1f5d\u1f59\u0342\u1f5f\u03c9\u0313\u1f60\u03c9\u0314\u1f61\u1f60\u0300\u1f62" +
+	"\u1f61\u0300\u1f63\u1f60\u0301\u1f64\u1f61\u0301\u1f65\u1f60\u0342\u1f66\u1f61\u0342\u1f67\u03a9\u0313\u1f68\u03a9\u0314\u1f69\u1f68\u0300\u1f6a" +
+	"\u1f69\u0300\u1f6b\u1f68\u0301\u1f6c\u1f69\u0301\u1f6d\u1f68\u0342\u1f6e\u1f69\u0342\u1f6f\u03b1\u0300\u1f70\u03b5\u0300\u1f72\u03b7\u0300\u1f74" +
+	"\u03b9\u0300\u1f76\u03bf\u0300\u1f78\u03c5\u0300\u1f7a\u03c9\u0300\u1f7c\u1f00\u0345\u1f80\u1f01\u0345\u1f81\u1f02\u0345\u1f82\u1f03\u0345\u1f83" +
+	"\u1f04\u0345\u1f84\u1f05\u0345\u1f85\u1f06\u0345\u1f86\u1f07\u0345\u1f87\u1f08\u0345\u1f88\u1f09\u0345\u1f89\u1f0a\u0345\u1f8a\u1f0b\u0345\u1f8b" +
+	"\u1f0c\u0345\u1f8c\u1f0d\u0345\u1f8d\u1f0e\u0345\u1f8e\u1f0f\u0345\u1f8f\u1f20\u0345\u1f90\u1f21\u0345\u1f91\u1f22\u0345\u1f92\u1f23\u0345\u1f93" +
+	"\u1f24\u0345\u1f94\u1f25\u0345\u1f95\u1f26\u0345\u1f96\u1f27\u0345\u1f97\u1f28\u0345\u1f98\u1f29\u0345\u1f99\u1f2a\u0345\u1f9a\u1f2b\u0345\u1f9b" +
+	"\u1f2c\u0345\u1f9c\u1f2d\u0345\u1f9d\u1f2e\u0345\u1f9e\u1f2f\u0345\u1f9f\u1f60\u0345\u1fa0\u1f61\u0345\u1fa1\u1f62\u0345\u1fa2\u1f63\u0345\u1fa3" +
+	"\u1f64\u0345\u1fa4\u1f65\u0345\u1fa5\u1f66\u0345\u1fa6\u1f67\u0345\u1fa7\u1f68\u0345\u1fa8\u1f69\u0345\u1fa9\u1f6a\u0345\u1faa\u1f6b\u0345\u1fab" +
+	"\u1f6c\u0345\u1fac\u1f6d\u0345\u1fad\u1f6e\u0345\u1fae\u1f6f\u0345\u1faf\u03b1\u0306\u1fb0\u03b1\u0304\u1fb1\u1f70\u0345\u1fb2\u03b1\u0345\u1fb3" +
+	"\u03ac\u0345\u1fb4\u03b1\u0342\u1fb6\u1fb6\u0345\u1fb7\u0391\u0306\u1fb8\u0391\u0304\u1fb9\u0391\u0300\u1fba\u0391\u0345\u1fbc\u00a8\u0342\u1fc1" +
+	"\u1f74\u0345\u1fc2\u03b7\u0345\u1fc3\u03ae\u0345\u1fc4\u03b7\u0342\u1fc6\u1fc6\u0345\u1fc7\u0395\u0300\u1fc8\u0397\u0300\u1fca\u0397\u0345\u1fcc" +
+	"\u1fbf\u0300\u1fcd\u1fbf\u0301\u1fce\u1fbf\u0342\u1fcf\u03b9\u0306\u1fd0\u03b9\u0304\u1fd1\u03ca\u0300\u1fd2\u03b9\u0342\u1fd6\u03ca\u0342\u1fd7" +
+	"\u0399\u0306\u1fd8\u0399\u0304\u1fd9\u0399\u0300\u1fda\u1ffe\u0300\u1fdd\u1ffe\u0301\u1fde\u1ffe\u0342\u1fdf\u03c5\u0306\u1fe0\u03c5\u0304\u1fe1" +
+	"\u03cb\u0300\u1fe2\u03c1\u0313\u1fe4\u03c1\u0314\u1fe5\u03c5\u0342\u1fe6\u03cb\u0342\u1fe7\u03a5\u0306\u1fe8\u03a5\u0304\u1fe9\u03a5\u0300\u1fea" +
+	"\u03a1\u0314\u1fec\u00a8\u0300\u1fed\u1f7c\u0345\u1ff2\u03c9\u0345\u1ff3\u03ce\u0345\u1ff4\u03c9\u0342\u1ff6\u1ff6\u0345\u1ff7\u039f\u0300\u1ff8" +
+	"\u03a9\u0300\u1ffa\u03a9\u0345\u1ffc\u2190\u0338\u219a\u2192\u0338\u219b\u2194\u0338\u21ae\u21d0\u0338\u21cd\u21d4\u0338\u21ce\u21d2\u0338\u21cf" +
+	"\u2203\u0338\u2204\u2208\u0338\u2209\u220b\u0338\u220c\u2223\u0338\u2224\u2225\u0338\u2226\u223c\u0338\u2241\u2243\u0338\u2244\u2245\u0338\u2247" +
+	"\u2248\u0338\u2249=\u0338\u2260\u2261\u0338\u2262\u224d\u0338\u226d<\u0338\u226e>\u0338\u226f\u2264\u0338\u2270\u2265\u0338\u2271" +
+	"\u2272\u0338\u2274\u2273\u0338\u2275\u2276\u0338\u2278\u2277\u0338\u2279\u227a\u0338\u2280\u227b\u0338\u2281\u2282\u0338\u2284\u2283\u0338\u2285" +
+	"\u2286\u0338\u2288\u2287\u0338\u2289\u22a2\u0338\u22ac\u22a8\u0338\u22ad\u22a9\u0338\u22ae\u22ab\u0338\u22af\u227c\u0338\u22e0\u227d\u0338\u22e1" +
+	"\u2291\u0338\u22e2\u2292\u0338\u22e3\u22b2\u0338\u22ea\u22b3\u0338\u22eb\u22b4\u0338\u22ec\u22b5\u0338\u22ed\u304b\u3099\u304c\u304d\u3099\u304e" +
+	"\u304f\u3099\u3050\u3051\u3099\u3052\u3053\u3099\u3054\u3055\u3099\u3056\u3057\u3099\u3058\u3059\u3099\u305a\u305b\u3099\u305c\u305d\u3099\u305e" +
+	"\u305f\u3099\u3060\u3061\u3099\u3062\u3064\u3099\u3065\u3066\u3099\u3067\u3068\u3099\u3069\u306f\u3099\u3070\u306f\u309a\u3071\u3072\u3099\u3073" +
+	"\u3072\u309a\u3074\u3075\u3099\u3076\u3075\u309a\u3077\u3078\u3099\u3079\u3078\u309a\u307a\u307b\u3099\u307c\u307b\u309a\u307d\u3046\u3099\u3094" +
+	"\u309d\u3099\u309e\u30ab\u3099\u30ac\u30ad\u3099\u30ae\u30af\u3099\u30b0\u30b1\u3099\u30b2\u30b3\u3099\u30b4\u30b5\u3099\u30b6\u30b7\u3099\u30b8" +
+	"\u30b9\u3099\u30ba\u30bb\u3099\u30bc\u30bd\u3099\u30be\u30bf\u3099\u30c0\u30c1\u3099\u30c2\u30c4\u3099\u30c5\u30c6\u3099\u30c7\u30c8\u3099\u30c9" +
+	"\u30cf\u3099\u30d0\u30cf\u309a\u30d1\u30d2\u3099\u30d3\u30d2\u309a\u30d4\u30d5\u3099\u30d6\u30d5\u309a\u30d7\u30d8\u3099\u30d9\u30d8\u309a\u30da" +
+	"\u30db\u3099\u30dc\u30db\u309a\u30dd\u30a6\u3099\u30f4\u30ef\u3099\u30f7\u30f0\u3099\u30f8\u30f1\u3099\u30f9\u30f2\u3099\u30fa\u30fd\u3099\u30fe"
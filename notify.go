@@ -0,0 +1,186 @@
+package pennybase
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"mime"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SMTPConfig describes the mail server used by a Mailer.
+type SMTPConfig struct {
+	Host     string
+	Port     int // defaults to 587
+	StartTLS bool
+	Username string // if set, authenticate with PLAIN auth
+	Password string
+	From     string
+}
+
+// Mailer renders emails from templates and delivers them in the background,
+// retrying failed deliveries so that requests never block on SMTP.
+type Mailer struct {
+	SMTP      SMTPConfig
+	Templates *template.Template
+	Retries   int           // delivery attempts after the first one, defaults to 3
+	Backoff   time.Duration // delay before the first retry, doubled on every next one, defaults to 1s
+	QueueSize int           // defaults to 100
+	Timeout   time.Duration // for connecting and for each delivery attempt as a whole, defaults to 30s
+
+	once  sync.Once
+	queue chan mail
+	wg    sync.WaitGroup
+}
+
+type mail struct {
+	to, subject, body, contentType string
+}
+
+func NewMailer(cfg SMTPConfig, tmpl *template.Template) *Mailer {
+	return &Mailer{SMTP: cfg, Templates: tmpl, Retries: 3, Backoff: time.Second, QueueSize: 100, Timeout: 30 * time.Second}
+}
+
+// NewMailer returns a Mailer that renders bodies with the server templates.
+func (s *Server) NewMailer(cfg SMTPConfig) *Mailer { return NewMailer(cfg, s.templates) }
+
+// Send renders the template with data and queues the email for delivery.
+// Only rendering errors and a full queue are reported, delivery errors are logged.
+func (m *Mailer) Send(to, subject, templateName string, data any) error {
+	if m.Templates == nil {
+		return errors.New("no templates")
+	}
+	if strings.ContainsAny(to+subject, "\r\n") {
+		return errors.New("invalid recipient or subject")
+	}
+	var body bytes.Buffer
+	if err := m.Templates.ExecuteTemplate(&body, templateName, data); err != nil {
+		return err
+	}
+	contentType := "text/plain; charset=utf-8"
+	if strings.HasSuffix(templateName, ".html") {
+		contentType = "text/html; charset=utf-8"
+	}
+	m.once.Do(m.start)
+	select {
+	case m.queue <- mail{to: to, subject: subject, body: body.String(), contentType: contentType}:
+		return nil
+	default:
+		return errors.New("mail queue is full")
+	}
+}
+
+// Close waits until the queued emails are delivered or given up.
+// Send must not be called after Close.
+func (m *Mailer) Close() {
+	m.once.Do(m.start)
+	close(m.queue)
+	m.wg.Wait()
+}
+
+// Notify mails every event published for the resource until ctx is cancelled.
+// The to function picks the recipient, events with an empty recipient are skipped.
+// Templates are rendered with the Event as data.
+func (m *Mailer) Notify(ctx context.Context, b *Broker, resource, subject, templateName string, to func(Event) string) {
+	events := make(chan Event, 16)
+	b.Subscribe(resource, events)
+	go func() {
+		defer b.Unsubscribe(resource, events)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case evt := <-events:
+				if addr := to(evt); addr != "" {
+					if err := m.Send(addr, subject, templateName, evt); err != nil {
+						log.Println("notify:", resource, evt.ID, err)
+					}
+				}
+			}
+		}
+	}()
+}
+
+func (m *Mailer) start() {
+	m.queue = make(chan mail, max(m.QueueSize, 1))
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		for msg := range m.queue {
+			backoff := m.Backoff
+			for attempt := 0; ; attempt++ {
+				err := m.deliver(msg)
+				if err == nil {
+					break
+				}
+				if attempt >= m.Retries {
+					log.Println("mail to", msg.to, "failed:", err)
+					break
+				}
+				time.Sleep(backoff)
+				backoff *= 2
+			}
+		}
+	}()
+}
+
+func (m *Mailer) deliver(msg mail) error {
+	port := m.SMTP.Port
+	if port == 0 {
+		port = 587
+	}
+	timeout := m.Timeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	// A server that doesn't answer must not stall the queue
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(m.SMTP.Host, strconv.Itoa(port)), timeout)
+	if err != nil {
+		return err
+	}
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		conn.Close()
+		return err
+	}
+	c, err := smtp.NewClient(conn, m.SMTP.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if m.SMTP.StartTLS {
+		if err := c.StartTLS(&tls.Config{ServerName: m.SMTP.Host}); err != nil {
+			return err
+		}
+	}
+	if m.SMTP.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", m.SMTP.Username, m.SMTP.Password, m.SMTP.Host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(m.SMTP.From); err != nil {
+		return err
+	}
+	if err := c.Rcpt(msg.to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "From: %s\r\nTo: %s\r\nSubject: %s\r\nMIME-Version: 1.0\r\nContent-Type: %s\r\n\r\n%s",
+		m.SMTP.From, msg.to, mime.QEncoding.Encode("utf-8", msg.subject), msg.contentType, msg.body)
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,166 @@
+package pennybase
+
+import (
+	"bufio"
+	"context"
+	"html/template"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSMTP accepts SMTP sessions and records the client commands of each one.
+// The first failures sessions are rejected at MAIL FROM with a transient error.
+type fakeSMTP struct {
+	ln       net.Listener
+	failures int
+	mu       sync.Mutex
+	sessions [][]string
+}
+
+func newFakeSMTP(t *testing.T, failures int) *fakeSMTP {
+	f := &fakeSMTP{ln: must(net.Listen("tcp", "127.0.0.1:0")).T(t), failures: failures}
+	t.Cleanup(func() { f.ln.Close() })
+	go func() {
+		for {
+			conn, err := f.ln.Accept()
+			if err != nil {
+				return
+			}
+			f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeSMTP) port() int { return f.ln.Addr().(*net.TCPAddr).Port }
+
+func (f *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	f.mu.Lock()
+	n := len(f.sessions)
+	f.sessions = append(f.sessions, nil)
+	f.mu.Unlock()
+	r := bufio.NewReader(conn)
+	reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+	reply("220 fake ESMTP")
+	data := false
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		f.mu.Lock()
+		f.sessions[n] = append(f.sessions[n], line)
+		f.mu.Unlock()
+		switch {
+		case data && line == ".":
+			data = false
+			reply("250 queued")
+		case data:
+		case strings.HasPrefix(line, "EHLO"):
+			reply("250-fake\r\n250 AUTH PLAIN")
+		case strings.HasPrefix(line, "AUTH"):
+			reply("235 ok")
+		case strings.HasPrefix(line, "MAIL") && n < f.failures:
+			reply("451 try again later")
+		case line == "DATA":
+			data = true
+			reply("354 go ahead")
+		case line == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func TestMailer(t *testing.T) {
+	srv := newFakeSMTP(t, 1)
+	tmpl := template.Must(template.New("updated.txt").Parse(`Book {{.ID}} is now "{{.Data.title}}".`))
+	m := NewMailer(SMTPConfig{Host: "127.0.0.1", Port: srv.port(), Username: "bot", Password: "secret", From: "bot@example.com"}, tmpl)
+	m.Backoff = time.Millisecond
+
+	b := &Broker{channels: map[string]map[chan Event]bool{}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m.Notify(ctx, b, "books", "Book updated", "updated.txt", func(e Event) string {
+		if owner, _ := e.Data["owner"].(string); owner != "" {
+			return owner + "@example.com"
+		}
+		return ""
+	})
+	b.Publish("books", Event{Action: "updated", ID: "b1", Data: Resource{"title": "Dune"}})
+	b.Publish("books", Event{Action: "updated", ID: "b1", Data: Resource{"title": "Dune", "owner": "alice"}})
+	// Wait until the event has reached the mailer queue before closing it
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		srv.mu.Lock()
+		n := len(srv.sessions)
+		srv.mu.Unlock()
+		if n > 1 || time.Now().After(deadline) {
+			break
+		}
+	}
+	m.Close()
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if len(srv.sessions) != 2 {
+		t.Fatalf("got %d sessions, want a failed one and a retry: %q", len(srv.sessions), srv.sessions)
+	}
+	want := []string{
+		"EHLO localhost",
+		"AUTH PLAIN AGJvdABzZWNyZXQ=",
+		"MAIL FROM:<bot@example.com>",
+		"RCPT TO:<alice@example.com>",
+		"DATA",
+		"From: bot@example.com",
+		"To: alice@example.com",
+		"Subject: Book updated",
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=utf-8",
+		"",
+		`Book b1 is now "Dune".`,
+		".",
+		"QUIT",
+	}
+	if got := srv.sessions[1]; !slices.Equal(got, want) {
+		t.Errorf("got conversation:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if err := m.Send("bob@example.com\r\nBcc: eve@example.com", "Hi", "updated.txt", nil); err == nil {
+		t.Error("expected header injection to be rejected")
+	}
+}
+
+func TestMailerTimeout(t *testing.T) {
+	// The server accepts connections but never answers
+	ln := must(net.Listen("tcp", "127.0.0.1:0")).T(t)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	m := NewMailer(SMTPConfig{Host: "127.0.0.1", Port: ln.Addr().(*net.TCPAddr).Port, From: "bot@example.com"}, template.Must(template.New("t.txt").Parse("hi")))
+	m.Retries, m.Timeout = 0, 50*time.Millisecond
+	must0(t, m.Send("alice@example.com", "Hi", "t.txt", nil))
+	closed := make(chan struct{})
+	go func() {
+		m.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close blocked on an unresponsive server")
+	}
+}
@@ -0,0 +1,82 @@
+package pennybase
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"slices"
+)
+
+// FieldValue is a field of an OrderedResource.
+type FieldValue struct {
+	Field string
+	Value any
+}
+
+// OrderedResource is a record with its fields in the order of the schema,
+// followed by the fields the schema doesn't know about (e.g. "_partial"),
+// sorted by name. It is encoded to JSON as an object with the keys in that
+// order, which makes the output deterministic. GraphQL responses use it to
+// keep the order of the selected fields.
+type OrderedResource []FieldValue
+
+func (o OrderedResource) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, f := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(f.Field)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(f.Value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// Ordered returns the fields of res in the order of the schema.
+func (s Schema) Ordered(res Resource) OrderedResource {
+	o := OrderedResource{}
+	known := map[string]bool{}
+	for _, field := range s {
+		if v, ok := res[field.Field]; ok {
+			o = append(o, FieldValue{field.Field, v})
+		}
+		known[field.Field] = true
+	}
+	for _, k := range slices.Sorted(maps.Keys(res)) {
+		if !known[k] {
+			o = append(o, FieldValue{k, res[k]})
+		}
+	}
+	return o
+}
+
+// GetOrdered is Get returning the fields in the order of the schema.
+func (s *Store) GetOrdered(resource, id string) (OrderedResource, error) {
+	res, err := s.get(context.Background(), resource, id)
+	if err != nil {
+		return nil, err
+	}
+	return s.Schemas[resource].Ordered(res), nil
+}
+
+// ordered returns res with its fields in the order of the schema if the
+// request asks for it with ?ordered=1, or else as it is.
+func (s *Server) ordered(r *http.Request, res Resource) any {
+	if r.FormValue("ordered") != "1" {
+		return res
+	}
+	return s.Store.Schemas[r.PathValue("resource")].Ordered(res)
+}
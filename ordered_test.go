@@ -0,0 +1,79 @@
+package pennybase
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// jsonKeys returns the keys of the JSON objects in data in order, one slice
+// per object.
+func jsonKeys(t *testing.T, data string) [][]string {
+	dec := json.NewDecoder(strings.NewReader(data))
+	var keys [][]string
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return keys
+		}
+		switch tok {
+		case json.Delim('{'):
+			if depth++; depth == 1 {
+				keys = append(keys, nil)
+			}
+		case json.Delim('}'):
+			depth--
+		default:
+			if s, ok := tok.(string); ok && depth == 1 {
+				keys[len(keys)-1] = append(keys[len(keys)-1], s)
+				var v json.RawMessage
+				must0(t, dec.Decode(&v))
+			}
+		}
+	}
+}
+
+func TestOrderedResource(t *testing.T) {
+	s := must(NewServer(testData(t, filepath.Join("testdata", "rest")), "", "")).T(t)
+	defer s.Store.Close()
+	want := []string{"_id", "_v", "title", "author", "year", "tags"}
+
+	o := must(s.Store.GetOrdered("books", "book1")).T(t)
+	if got := must(json.Marshal(o)).T(t); !slices.Equal(jsonKeys(t, string(got))[0], want) {
+		t.Errorf("got %s", got)
+	}
+	// Fields missing from the schema come last, sorted
+	fields := []string{}
+	for _, f := range s.Store.Schemas["books"].Ordered(Resource{"year": 1.0, "_partial": true, "title": "x", "_extra": []string{}}) {
+		fields = append(fields, f.Field)
+	}
+	if want := []string{"title", "year", "_extra", "_partial"}; !slices.Equal(fields, want) {
+		t.Errorf("got %v, want %v", fields, want)
+	}
+
+	for _, path := range []string{"/api/books/book1?ordered=1", "/api/books/?ordered=1&sort_by=year"} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		keys := jsonKeys(t, w.Body.String())
+		if w.Code != http.StatusOK || len(keys) == 0 {
+			t.Fatalf("%s: got status %d: %s", path, w.Code, w.Body)
+		}
+		for _, k := range keys {
+			if !slices.Equal(k, want) {
+				t.Errorf("%s: got keys %v, want %v", path, k, want)
+			}
+		}
+	}
+	// Without the parameter, the response holds the same fields
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/books/book1", nil))
+	keys := jsonKeys(t, w.Body.String())[0]
+	if slices.Sort(keys); !slices.Equal(keys, slices.Sorted(slices.Values(want))) {
+		t.Errorf("got keys %v", keys)
+	}
+}
@@ -1,19 +1,24 @@
 package pennybase
 
 import (
+	"cmp"
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base32"
+	"encoding/base64"
 	"encoding/csv"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"html/template"
 	"io"
 	"log"
+	"maps"
+	"math"
 	"net/http"
-	"os"
+	"net/url"
 	"path/filepath"
 	"regexp"
 	"slices"
@@ -22,6 +27,7 @@ import (
 	"strings"
 	"sync"
 	"time"
+	"unicode"
 )
 
 type Record []string
@@ -29,18 +35,41 @@ type Resource map[string]any
 type FieldType string
 
 const (
-	Number FieldType = "number"
-	Text   FieldType = "text"
-	List   FieldType = "list"
+	Number    FieldType = "number"
+	Text      FieldType = "text"
+	List      FieldType = "list"
+	DateTime  FieldType = "datetime" // time.Time in UTC, stored as RFC 3339, "" for the zero time
+	Reference FieldType = "ref"      // id of a record of the Target resource, or ""
+	Bool      FieldType = "bool"     // stored as "true" or "false", "" is false
 )
 
 type FieldSchema struct {
-	Resource string
-	Field    string
-	Type     FieldType
-	Min      float64
-	Max      float64
-	Regex    string
+	Resource    string
+	Field       string
+	Type        FieldType
+	Min         float64
+	Max         float64
+	Regex       string
+	DefaultUser bool   // set to the creating user's id ("user" option)
+	Required    bool   // must be set and not empty, zero numbers are fine ("required" option)
+	Default     string // value of the field when it is missing, parsed like its type ("default=<value>" option)
+	Trim        bool   // strip leading and trailing whitespace ("trim" option)
+	Collapse    bool   // trim and replace inner whitespace runs with a space ("collapse" option)
+	Lower       bool   // convert to lower case ("lower" option)
+	NFC         bool   // compose decomposed unicode characters ("nfc" option)
+	Set         bool   // deduplicate and sort list items ("set" option)
+	Slug        string // generate a unique slug from this field on create ("slug=<field>" option)
+	Indexed     bool   // keep an in-memory index of the values for lookups ("index" option)
+	Unique      bool   // no two live records share a non-empty value, implies Indexed ("unique" option)
+	Blob        bool   // holds a reference to a payload stored outside of the records ("blob" option)
+	Compressed  bool   // stored gzipped and base64-encoded ("compress" option)
+	Flatten     string // JSON keys listed instead of the whole value, separated by "|" ("flatten=<keys>" option)
+	Target      string // resource referenced by a ref field, given in the regex column
+	OnDelete    string // when the target is deleted: "cascade", "restrict" or "setnull" (option of the same name)
+	// Expires makes records expire TTL after the time in a datetime or number
+	// (unix seconds) field ("ttl=<duration>" option), see Store.StartSweeper
+	Expires bool
+	TTL     time.Duration
 }
 
 type Schema []FieldSchema
@@ -63,6 +92,155 @@ var HashPasswd = func(passwd, salt string) string {
 }
 var SessionKey = Salt()
 
+// Tracer starts spans around server and store operations. The returned end
+// function must be called exactly once with the operation result, which is
+// also the span status (nil means ok).
+//
+// Span names used by pennybase:
+//
+//	http <pattern>            - API handler, e.g. "http GET /api/{resource}/{id}"
+//	authenticate, authorize   - auth checks within a request
+//	hook, after_hook          - Server.Hook and Server.AfterHook execution
+//	store.<op>                - Store create/update/delete/get/list
+//	db.<op>                   - DB create/update/delete/get/iter
+//
+// Attributes, when known, are "resource", "action", "id" and "trigger".
+type Tracer interface {
+	StartSpan(ctx context.Context, name string, attrs ...Attr) (context.Context, func(err error))
+}
+
+type Attr struct{ Key, Value string }
+
+type nopTracer struct{}
+
+func (nopTracer) StartSpan(ctx context.Context, _ string, _ ...Attr) (context.Context, func(error)) {
+	return ctx, func(error) {}
+}
+
+// parseOptions sets field flags from the optional ninth column of the schema,
+// a comma-separated list of options. The "default=<value>" option takes the
+// rest of the list, so that list defaults may contain commas.
+func (field *FieldSchema) parseOptions(options string) error {
+	opts := strings.Split(options, ",")
+	for i, opt := range opts {
+		if def, ok := strings.CutPrefix(strings.TrimSpace(opt), "default="); ok {
+			field.Default = strings.Join(append([]string{def}, opts[i+1:]...), ",")
+			break
+		}
+		switch opt = strings.TrimSpace(opt); opt {
+		case "":
+		case "user":
+			field.DefaultUser = true
+		case "required":
+			field.Required = true
+		case "trim":
+			field.Trim = true
+		case "collapse":
+			field.Collapse = true
+		case "lower":
+			field.Lower = true
+		case "nfc":
+			field.NFC = true
+		case "set":
+			if field.Type != List {
+				return fmt.Errorf("set field %s.%s must be a list", field.Resource, field.Field)
+			}
+			field.Set = true
+		case "index":
+			if field.Type == List {
+				return fmt.Errorf("indexed field %s.%s can't be a list", field.Resource, field.Field)
+			}
+			field.Indexed = true
+		case "unique":
+			if field.Type == List {
+				return fmt.Errorf("unique field %s.%s can't be a list", field.Resource, field.Field)
+			}
+			field.Unique, field.Indexed = true, true
+		case "cascade", "restrict", "setnull":
+			if field.Type != Reference {
+				return fmt.Errorf("%s field %s.%s must be a ref", opt, field.Resource, field.Field)
+			}
+			field.OnDelete = opt
+		case "blob":
+			if field.Type != Text {
+				return fmt.Errorf("blob field %s.%s must be text", field.Resource, field.Field)
+			}
+			field.Blob = true
+		case "compress":
+			if field.Type != Text {
+				return fmt.Errorf("compressed field %s.%s must be text", field.Resource, field.Field)
+			}
+			field.Compressed = true
+		default:
+			if src, ok := strings.CutPrefix(opt, "slug="); ok && src != "" {
+				if field.Type != Text {
+					return fmt.Errorf("slug field %s.%s must be text", field.Resource, field.Field)
+				}
+				field.Slug = src
+				continue
+			}
+			if keys, ok := strings.CutPrefix(opt, "flatten="); ok && keys != "" {
+				if field.Type != Text || field.Blob {
+					return fmt.Errorf("flattened field %s.%s must be text", field.Resource, field.Field)
+				}
+				field.Flatten = keys
+				continue
+			}
+			if ttl, ok := strings.CutPrefix(opt, "ttl="); ok {
+				if field.Type != DateTime && field.Type != Number {
+					return fmt.Errorf("ttl field %s.%s must be a datetime or a number", field.Resource, field.Field)
+				}
+				d, err := time.ParseDuration(ttl)
+				if err != nil || d < 0 {
+					return fmt.Errorf("invalid ttl %q for field %s.%s", ttl, field.Resource, field.Field)
+				}
+				field.TTL, field.Expires = d, true
+				continue
+			}
+			return fmt.Errorf("unknown option %q for field %s.%s", opt, field.Resource, field.Field)
+		}
+	}
+	if field.Compressed && (field.Indexed || field.Slug != "" || field.Blob) {
+		return fmt.Errorf("compressed field %s.%s can't be indexed, a slug or a blob", field.Resource, field.Field)
+	}
+	if field.Default != "" {
+		if _, err := (Schema{*field}).Record(Resource{}); err != nil {
+			return fmt.Errorf("invalid default %q for field %s.%s: %w", field.Default, field.Resource, field.Field, err)
+		}
+	}
+	return nil
+}
+
+// defaultValue parses the default of the field: numbers as floats, lists
+// like stored lists, datetimes as RFC 3339 or unix seconds, bools with
+// strconv.ParseBool, and the rest as they are. It returns nil if the field has no default.
+func (field FieldSchema) defaultValue() (any, error) {
+	if field.Default == "" {
+		return nil, nil
+	}
+	switch field.Type {
+	case Number:
+		n, err := strconv.ParseFloat(strings.TrimSpace(field.Default), 64)
+		if err != nil {
+			return nil, newError("invalid_field", "field", field.Field)
+		}
+		return n, nil
+	case List:
+		return parseList(field.Default), nil
+	case DateTime:
+		if n, err := strconv.ParseFloat(field.Default, 64); err == nil {
+			return n, nil
+		}
+	case Bool:
+		b, err := strconv.ParseBool(strings.TrimSpace(field.Default))
+		if err != nil {
+			return nil, newError("invalid_field", "field", field.Field)
+		}
+		return b, nil
+	}
+	return field.Default, nil
+}
+
 func (field FieldSchema) Validate(v any) bool {
 	if v == nil {
 		return false
@@ -70,34 +248,121 @@ func (field FieldSchema) Validate(v any) bool {
 	switch field.Type {
 	case Number:
 		n, ok := v.(float64)
-		return ok && ((field.Min == 0 && field.Max == 0) || (n >= field.Min && (field.Max < field.Min || n <= field.Max)))
+		return ok && !math.IsNaN(n) && !math.IsInf(n, 0) && field.inRange(n)
 	case Text:
 		s, ok := v.(string)
-		return ok && (field.Regex == "" || regexp.MustCompile(field.Regex).MatchString(s))
+		return ok && field.matches(s) && (field.Flatten == "" || s == "" || json.Valid([]byte(s)))
+	case Reference:
+		_, ok := v.(string)
+		return ok
 	case List:
-		_, ok := v.([]string)
+		l, ok := v.([]string)
+		if !ok || !field.inRange(float64(len(l))) {
+			return false
+		}
+		return !slices.ContainsFunc(l, func(item string) bool { return !field.matches(item) })
+	case DateTime:
+		_, ok := v.(time.Time)
+		return ok
+	case Bool:
+		_, ok := v.(bool)
 		return ok
 	}
 	return false
 }
 
+// regexps caches the compiled regexes of fields by pattern, see matches.
+var regexps sync.Map
+
+// matches reports whether s matches the Regex of the field, if any. The
+// regex is compiled once. Invalid regexes match nothing, but schemas with
+// such regexes fail to load.
+func (field FieldSchema) matches(s string) bool {
+	if field.Regex == "" {
+		return true
+	}
+	re, ok := regexps.Load(field.Regex)
+	if !ok {
+		compiled, err := regexp.Compile(field.Regex)
+		if err != nil {
+			return false
+		}
+		re, _ = regexps.LoadOrStore(field.Regex, compiled)
+	}
+	return re.(*regexp.Regexp).MatchString(s)
+}
+
+// inRange checks n against Min and Max, which bound numbers and the number of
+// items of lists. Both zero means no bounds, and Max below Min means no upper
+// bound.
+func (field FieldSchema) inRange(n float64) bool {
+	return (field.Min == 0 && field.Max == 0) || (n >= field.Min && (field.Max < field.Min || n <= field.Max))
+}
+
+// Record converts a resource into its canonical stored form: numbers use
+// formatNumber, "\r\n" and "\r" line endings in text become "\n", and lists
+// are encoded with formatList, skipping empty items. Missing fields are stored
+// as their default or zero values ("0", "" and ""), so a missing field and an
+// empty one are the same, and required fields must be neither. Datetimes may be given as RFC
+// 3339 strings or unix timestamps in seconds and are stored in UTC, see
+// formatDateTime. Bools are stored as "true" or "false". Normalization options are applied before validation, and
+// text of compressed fields is encoded last, see compressText.
 func (s Schema) Record(res Resource) (Record, error) {
 	rec := Record{}
 	for _, field := range s {
 		v := res[field.Field]
 		if v == nil {
-			v = map[FieldType]any{Number: 0.0, Text: "", List: []string{}}[field.Type]
+			def, err := field.defaultValue()
+			if err != nil {
+				return nil, err
+			}
+			v = def
+		}
+		missing := v == nil
+		if missing {
+			v = map[FieldType]any{Number: 0.0, Text: "", List: []string{}, DateTime: time.Time{}, Reference: "", Bool: false}[field.Type]
+		}
+		switch x := v.(type) {
+		case string:
+			v = field.Normalize(newlines.Replace(x))
+		case []string:
+			list := make([]string, 0, len(x))
+			for _, item := range x {
+				if item = field.Normalize(newlines.Replace(item)); item != "" {
+					list = append(list, item)
+				}
+			}
+			if field.Set {
+				slices.Sort(list)
+				list = slices.Compact(list)
+			}
+			v = list
+		}
+		if field.Type == DateTime {
+			if t, ok := parseDateTime(v); ok {
+				v = t
+			}
+		}
+		if field.Required && (missing || isEmpty(v)) {
+			return nil, newError("required_field", "field", field.Field)
 		}
 		if !field.Validate(v) {
-			return nil, fmt.Errorf("invalid field \"%s\"", field.Field)
+			return nil, newError("invalid_field", "field", field.Field)
 		}
 		switch field.Type {
 		case Number:
-			rec = append(rec, fmt.Sprintf("%g", v))
-		case Text:
+			rec = append(rec, formatNumber(v.(float64)))
+		case Text, Reference:
+			if field.Compressed {
+				v = compressText(v.(string))
+			}
 			rec = append(rec, v.(string))
 		case List:
-			rec = append(rec, strings.Join(v.([]string), ","))
+			rec = append(rec, formatList(v.([]string)))
+		case DateTime:
+			rec = append(rec, formatDateTime(v.(time.Time)))
+		case Bool:
+			rec = append(rec, strconv.FormatBool(v.(bool)))
 		}
 	}
 	return rec, nil
@@ -116,14 +381,33 @@ func (s Schema) Resource(rec Record) (Resource, error) {
 				return nil, err
 			}
 			res[field.Field] = n
-		case Text:
-			res[field.Field] = rec[i]
+		case Text, Reference:
+			if !field.Compressed {
+				res[field.Field] = rec[i]
+				break
+			}
+			text, err := decompressText(rec[i])
+			if err != nil {
+				return nil, fmt.Errorf("invalid compressed %s: %w", field.Field, err)
+			}
+			res[field.Field] = text
 		case List:
+			res[field.Field] = parseList(rec[i])
+		case DateTime:
+			t, ok := parseDateTime(rec[i])
+			if !ok {
+				return nil, fmt.Errorf("invalid datetime %q", rec[i])
+			}
+			res[field.Field] = t
+		case Bool:
+			b := false // "" in rows written before the field was added
 			if rec[i] != "" {
-				res[field.Field] = strings.Split(rec[i], ",")
-			} else {
-				res[field.Field] = []string{}
+				var err error
+				if b, err = strconv.ParseBool(rec[i]); err != nil {
+					return nil, fmt.Errorf("invalid bool %q", rec[i])
+				}
 			}
+			res[field.Field] = b
 		default:
 			return nil, fmt.Errorf("unknown field type %s", field.Type)
 		}
@@ -131,63 +415,554 @@ func (s Schema) Resource(rec Record) (Resource, error) {
 	return res, nil
 }
 
+// isEmpty reports whether a normalized value is an empty string or list, or
+// the zero time.
+func isEmpty(v any) bool {
+	switch v := v.(type) {
+	case string:
+		return v == ""
+	case []string:
+		return len(v) == 0
+	case time.Time:
+		return v.IsZero()
+	}
+	return false
+}
+
+var newlines = strings.NewReplacer("\r\n", "\n", "\r", "\n")
+
+// formatList joins list items with commas, or, if an item contains a comma or
+// the result would look like a JSON array, encodes them as a JSON array of
+// strings, e.g. ["foo,bar","baz"]. Lists without such items are stored as
+// they always were.
+func formatList(list []string) string {
+	joined := strings.Join(list, ",")
+	if !strings.HasPrefix(joined, "[") && !slices.ContainsFunc(list, func(item string) bool { return strings.Contains(item, ",") }) {
+		return joined
+	}
+	data, _ := json.Marshal(list)
+	return string(data)
+}
+
+// parseList decodes a list encoded by formatList. Values that aren't a JSON
+// array of strings are split on commas, dropping empty items.
+func parseList(s string) []string {
+	var list []string
+	if strings.HasPrefix(s, "[") && json.Unmarshal([]byte(s), &list) == nil && list != nil {
+		return list
+	}
+	return strings.FieldsFunc(s, func(r rune) bool { return r == ',' })
+}
+
+// parseDateTime converts an RFC 3339 string, a unix timestamp in seconds or a
+// time.Time to UTC. An empty string is the zero time.
+func parseDateTime(v any) (time.Time, bool) {
+	switch v := v.(type) {
+	case time.Time:
+		return v.UTC(), true
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return time.Time{}, false
+		}
+		sec, frac := math.Modf(v)
+		return time.Unix(int64(sec), int64(math.Round(frac*1e9))).UTC(), true
+	case string:
+		if v == "" {
+			return time.Time{}, true
+		}
+		t, err := time.Parse(time.RFC3339Nano, v)
+		return t.UTC(), err == nil
+	}
+	return time.Time{}, false
+}
+
+// formatDateTime formats t in UTC as RFC 3339 with as many fractional digits
+// as needed, e.g. "2024-03-01T12:00:00Z" or "2024-03-01T12:00:00.5Z", so that
+// equal times are stored equally. The zero time is formatted as "".
+func formatDateTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// formatNumber formats n like JSON does: the shortest representation that
+// parses back to n, with an exponent only below 1e-6 or from 1e21 up.
+// Negative zero is formatted as "0".
+func formatNumber(n float64) string {
+	if n == 0 {
+		return "0"
+	}
+	if abs := math.Abs(n); abs < 1e-6 || abs >= 1e21 {
+		s := strconv.FormatFloat(n, 'e', -1, 64)
+		// Drop the leading zero of the exponent, e.g. 1e-07 becomes 1e-7
+		if n := len(s); n >= 4 && s[n-4] == 'e' && s[n-2] == '0' {
+			s = s[:n-2] + s[n-1:]
+		}
+		return s
+	}
+	return strconv.FormatFloat(n, 'f', -1, 64)
+}
+
+// csvDB is a database in an append-only file of CSV rows, or of JSON arrays
+// with the jsonl format (see OpenJSONLDB). Reads use ReadAt at the indexed
+// offsets and never move the write position of the file.
 type csvDB struct {
+	mu       sync.RWMutex // held for writing by writers, files are read without it
+	refs     fileRefs
+	compact  sync.Mutex // one compaction at a time
+	st       Storage
+	name     string
+	format   rowFormat
+	f        File
+	w        rowWriter
+	size     int64
+	index    map[string]int64
+	version  map[string]int64
+	deleted  map[string]int64 // versions of the deletions, see Deleted
+	rows     int64
+	live     int64 // live records
+	dropped  int64 // rows dropped by compactions, see compactedRows
+	persist  int   // appends between saves of the index file, 0 for none
+	unsaved  int
+	durable  Durability
+	dirty    bool // written since the last sync
+	repair   bool // see WithTailRepair
+	stop     chan struct{}
+	lock     io.Closer            // see acquireLock
+	lockWait time.Duration        // see WithLockTimeout
+	columns  map[int]*columnIndex // secondary indexes by column position
+	auto     AutoCompact          // see WithAutoCompact
+	bg       sync.WaitGroup       // background compactions
+	busy     bool                 // a background compaction is running
+	closing  bool                 // no more background compactions
+}
+
+// fileRefs counts the readers of the files of a database, which read them
+// without holding the database lock, so that a file replaced by a compaction
+// or closed with the database is closed only once its readers are done.
+type fileRefs struct {
 	mu      sync.Mutex
-	f       *os.File
-	w       *csv.Writer
-	index   map[string]int64
-	version map[string]int64
+	readers map[File]int
+	retired map[File]bool
+}
+
+// acquire registers a reader of f. It must be called while holding db.mu, so
+// that f can't be retired meanwhile.
+func (fr *fileRefs) acquire(f File) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	if fr.readers == nil {
+		fr.readers = map[File]int{}
+	}
+	fr.readers[f]++
+}
+
+// release unregisters a reader of f, and closes f if it was retired.
+func (fr *fileRefs) release(f File) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	if fr.readers[f]--; fr.readers[f] > 0 {
+		return
+	}
+	delete(fr.readers, f)
+	if fr.retired[f] {
+		delete(fr.retired, f)
+		f.Close()
+	}
+}
+
+// retire closes f, or marks it to be closed by its last reader.
+func (fr *fileRefs) retire(f File) error {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	if fr.readers[f] == 0 {
+		return f.Close()
+	}
+	if fr.retired == nil {
+		fr.retired = map[File]bool{}
+	}
+	fr.retired[f] = true
+	return nil
+}
+
+// columnIndex maps the values of a column in the live records to their ids.
+type columnIndex struct {
+	ids    map[string]map[string]bool // value -> ids
+	values map[string]string          // id -> value
+}
+
+func newColumnIndex() *columnIndex {
+	return &columnIndex{ids: map[string]map[string]bool{}, values: map[string]string{}}
+}
+
+// set indexes the value of a record, or removes it if deleted is true.
+func (ci *columnIndex) set(id, value string, deleted bool) {
+	if old, ok := ci.values[id]; ok {
+		if delete(ci.ids[old], id); len(ci.ids[old]) == 0 {
+			delete(ci.ids, old)
+		}
+		delete(ci.values, id)
+	}
+	if deleted {
+		return
+	}
+	if ci.ids[value] == nil {
+		ci.ids[value] = map[string]bool{}
+	}
+	ci.ids[value][id], ci.values[id] = true, value
+}
+
+func (db *csvDB) indexRecord(rec Record) {
+	for col, ci := range db.columns {
+		if col < len(rec) {
+			ci.set(rec[0], rec[col], rec[1] == "0")
+		} else {
+			ci.set(rec[0], "", rec[1] == "0")
+		}
+	}
+}
+
+// indexColumn adds a secondary index on the column at position col. It reads
+// the latest versions of the records only, unless the index has drifted.
+func (db *csvDB) indexColumn(col int) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.columns == nil {
+		db.columns = map[int]*columnIndex{}
+	}
+	ci := newColumnIndex()
+	db.columns[col] = ci
+	for id, v := range db.version {
+		if v < 1 {
+			continue
+		}
+		rec, err := db.read(id)
+		if err != nil || len(rec) < 2 {
+			return db.reindex()
+		}
+		if col < len(rec) {
+			ci.set(id, rec[col], false)
+		} else {
+			ci.set(id, "", false)
+		}
+	}
+	return nil
+}
+
+// lookup returns the sorted ids of the live records whose column at position
+// col holds the value. It reports false if the column is not indexed.
+func (db *csvDB) lookup(col int, value string) ([]string, bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	ci, ok := db.columns[col]
+	if !ok {
+		return nil, false
+	}
+	return slices.Sorted(maps.Keys(ci.ids[value])), true
+}
+
+func NewCSVDB(path string, opts ...DBOption) (*csvDB, error) {
+	return OpenCSVDB(DirStorage(filepath.Dir(path)), filepath.Base(path), opts...)
+}
+
+// OpenCSVDB opens (or creates) a CSV database named name in the given storage.
+func OpenCSVDB(st Storage, name string, opts ...DBOption) (*csvDB, error) {
+	return openDB(st, name, csvFormat, 0, opts...)
+}
+
+// DBOption sets an option of a database opened by OpenCSVDB or OpenJSONLDB.
+type DBOption func(*csvDB)
+
+// Durability says when writes are synced to stable storage, if the storage
+// supports it. A positive duration syncs at most that often from a background
+// goroutine, so that writes are lost at most that long after they returned.
+type Durability time.Duration
+
+const (
+	NoSync     Durability = 0  // leave it to the operating system (the default)
+	SyncAlways Durability = -1 // sync before every write returns
+)
+
+// WithSync sets the durability of the writes to a database.
+func WithSync(d Durability) DBOption { return func(db *csvDB) { db.setDurability(d) } }
+
+func (db *csvDB) setDurability(d Durability) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.stop != nil {
+		close(db.stop)
+		db.stop = nil
+	}
+	if db.durable = d; d > 0 {
+		db.stop = make(chan struct{})
+		go db.syncEvery(time.Duration(d), db.stop)
+	}
+}
+
+// syncEvery syncs the file periodically if it was written, until stop is
+// closed.
+func (db *csvDB) syncEvery(d time.Duration, stop chan struct{}) {
+	t := time.NewTicker(d)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		db.mu.Lock()
+		select {
+		case <-stop:
+			db.mu.Unlock()
+			return
+		default:
+		}
+		if db.dirty {
+			if err := db.syncFile(); err != nil {
+				log.Printf("csvdb: %s: %v", db.name, err)
+			}
+		}
+		db.mu.Unlock()
+	}
+}
+
+// rowReader and rowWriter read and write the rows of a database file, like
+// csv.Reader and csv.Writer do.
+type rowReader interface {
+	Read() ([]string, error)
+	InputOffset() int64 // offset of the next row
+}
+
+type rowWriter interface {
+	Write(row []string) error
+	Flush()
+	Error() error
+}
+
+// rowFormat encodes the rows of a database file.
+type rowFormat struct {
+	reader func(r io.Reader) rowReader
+	writer func(w io.Writer) rowWriter
+}
+
+var csvFormat = rowFormat{
+	reader: func(r io.Reader) rowReader {
+		cr := csv.NewReader(r)
+		cr.FieldsPerRecord = -1
+		return cr
+	},
+	writer: func(w io.Writer) rowWriter { return csv.NewWriter(w) },
 }
 
-func NewCSVDB(path string) (*csvDB, error) {
-	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+// openDB opens a database file. If persist is positive, the index is loaded
+// from the index file (see loadIndex) and saved to it on close and after every
+// persist appends.
+func openDB(st Storage, name string, format rowFormat, persist int, opts ...DBOption) (*csvDB, error) {
+	f, err := st.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	size, err := f.Size()
 	if err != nil {
 		return nil, err
 	}
-	db := &csvDB{f: f, w: csv.NewWriter(f), index: map[string]int64{}, version: map[string]int64{}}
-	r := csv.NewReader(f)
-	r.FieldsPerRecord = -1
+	db := &csvDB{st: st, name: name, format: format, f: f, size: size, persist: persist, index: map[string]int64{}, version: map[string]int64{}}
+	db.w = format.writer(writerFunc(func(p []byte) (int, error) {
+		n, err := db.f.Write(p)
+		db.size += int64(n)
+		return n, err
+	}))
+	for _, opt := range opts {
+		opt(db)
+	}
+	err = db.acquireLock()
+	if err == nil {
+		err = db.load()
+	}
+	if err != nil {
+		if db.stop != nil {
+			close(db.stop)
+		}
+		db.releaseLock()
+		db.f.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// load builds the index from the index file or by scanning the file.
+func (db *csvDB) load() error {
+	if db.persist > 0 {
+		err := db.loadIndex()
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, errStaleIndex) {
+			log.Printf("csvdb: %s: %v, scanning the file", db.name, err)
+		}
+	}
+	err := db.reindex()
+	if err != nil && db.repair {
+		if repaired, rerr := db.repairTail(); rerr != nil {
+			return errors.Join(err, rerr)
+		} else if repaired {
+			return db.reindex()
+		}
+	}
+	return err
+}
+
+// reindex scans the file to find the offset and the version of the latest
+// record of every id.
+func (db *csvDB) reindex() error {
+	for col := range db.columns {
+		db.columns[col] = newColumnIndex()
+	}
+	db.dropped = 0
+	return db.scan(0, map[string]int64{}, map[string]int64{}, map[string]int64{}, 0)
+}
+
+// scan adds the rows from the offset to the end of the file to the index.
+func (db *csvDB) scan(from int64, index, version, deleted map[string]int64, rows int64) error {
+	live := int64(0)
+	for _, v := range version {
+		if v >= 1 {
+			live++
+		}
+	}
+	r := db.format.reader(io.NewSectionReader(db.f, from, db.size-from))
 	for {
-		pos := r.InputOffset()
+		pos := from + r.InputOffset()
 		rec, err := r.Read()
 		if errors.Is(err, io.EOF) {
 			break
 		}
 		if err != nil {
-			return nil, err
+			return err
 		}
-		if len(rec) > 0 {
-			db.index[rec[0]] = pos
-			db.version[rec[0]], _ = strconv.ParseInt(rec[1], 10, 64)
+		if n, ok := compactedRows(rec); ok {
+			rows += n
+			db.dropped = n
+		} else if len(rec) > 0 {
+			prev := version[rec[0]]
+			if prev >= 1 {
+				live--
+			}
+			index[rec[0]] = pos
+			version[rec[0]], _ = strconv.ParseInt(rec[1], 10, 64)
+			if version[rec[0]] >= 1 {
+				live++
+				delete(deleted, rec[0])
+			} else {
+				deleted[rec[0]] = prev + 1
+			}
+			rows++
+			db.indexRecord(rec)
 		}
 	}
-	return db, nil
+	db.index, db.version, db.deleted, db.rows, db.live = index, version, deleted, rows, live
+	return nil
 }
 
 func (db *csvDB) Close() error {
+	db.mu.Lock()
+	db.closing = true
+	db.mu.Unlock()
+	db.bg.Wait()
 	db.mu.Lock()
 	defer db.mu.Unlock()
+	defer db.releaseLock()
 	db.w.Flush()
-	return db.f.Close()
+	if db.stop != nil { // see syncEvery
+		close(db.stop)
+		db.stop = nil
+	}
+	if db.dirty {
+		if err := db.syncFile(); err != nil {
+			db.refs.retire(db.f)
+			return err
+		}
+	}
+	if db.persist > 0 {
+		if err := db.saveIndex(); err != nil {
+			db.refs.retire(db.f)
+			return err
+		}
+	}
+	return db.refs.retire(db.f)
 }
 
 func (db *csvDB) append(r Record) error {
-	pos, _ := db.f.Seek(0, io.SeekEnd)
+	pos := db.size
 	err := db.w.Write(r)
 	if err != nil {
 		return err
 	}
-	db.w.Flush()
+	if db.w.Flush(); db.w.Error() != nil {
+		return db.w.Error()
+	}
+	if db.durable == SyncAlways {
+		if err := db.syncFile(); err != nil {
+			return err
+		}
+	} else if db.durable > 0 {
+		db.dirty = true
+	}
+	prev := db.version[r[0]]
+	if prev >= 1 {
+		db.live--
+	}
 	db.index[r[0]] = pos
 	db.version[r[0]], err = strconv.ParseInt(r[1], 10, 64)
+	if db.version[r[0]] >= 1 {
+		db.live++
+		delete(db.deleted, r[0])
+	} else {
+		db.deleted[r[0]] = prev + 1
+	}
+	db.rows++
+	db.indexRecord(r)
+	if db.unsaved++; db.persist > 0 && db.unsaved >= db.persist {
+		if err := db.saveIndex(); err != nil {
+			log.Printf("csvdb: %s: saving the index: %v", db.name, err)
+		}
+	}
+	db.autoCompact()
 	return err
 }
 
+// Seq returns the number of records ever written to the file, which is also
+// the number of changes, as every create, update and delete appends a record.
+func (db *csvDB) Seq() int64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.rows
+}
+
+// sync flushes the file to stable storage, if the storage supports it.
+func (db *csvDB) sync() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.syncFile()
+}
+
+func (db *csvDB) syncFile() error {
+	db.dirty = false
+	if f, ok := db.f.(interface{ Sync() error }); ok {
+		return f.Sync()
+	}
+	return nil
+}
+
 func (db *csvDB) Create(r Record) error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	if r[0] == "" || r[1] != "1" || db.version[r[0]] != 0 {
-		return errors.New("invalid record")
+	if len(r) < 2 || r[0] == "" || r[1] != "1" {
+		return newError("invalid_record")
+	}
+	if v := db.version[r[0]]; v != 0 {
+		return newError("version_conflict", "version", strconv.FormatInt(v, 10))
 	}
 	return db.append(r)
 }
@@ -195,8 +970,14 @@ func (db *csvDB) Create(r Record) error {
 func (db *csvDB) Update(r Record) error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	if len(r) == 0 || r[1] != strconv.FormatInt(db.version[r[0]]+1, 10) {
-		return errors.New("invalid record version")
+	if len(r) < 2 {
+		return newError("invalid_record")
+	}
+	if db.version[r[0]] < 1 {
+		return newError("record_not_found")
+	}
+	if r[1] != strconv.FormatInt(db.version[r[0]]+1, 10) {
+		return newError("version_conflict", "version", strconv.FormatInt(db.version[r[0]], 10))
 	}
 	return db.append(r)
 }
@@ -205,115 +986,393 @@ func (db *csvDB) Delete(id string) error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 	if db.version[id] < 1 {
-		return errors.New("record not found")
+		return newError("record_not_found")
 	}
 	return db.append(Record{id, "0"})
 }
 
+// Get reads the record without holding the lock, so that slow reads don't
+// block writers.
 func (db *csvDB) Get(id string) (Record, error) {
+	db.mu.RLock()
+	f, offset, size, live := db.f, db.index[id], db.size, db.version[id] >= 1
+	if live {
+		db.refs.acquire(f)
+	}
+	db.mu.RUnlock()
+	if !live {
+		return nil, newError("record_not_found")
+	}
+	rec, err := db.readAt(f, id, offset, size)
+	db.refs.release(f)
+	if err == nil {
+		return rec, nil
+	}
 	db.mu.Lock()
 	defer db.mu.Unlock()
+	// The index drifted from the file, rebuild it once and retry
+	log.Printf("csvdb: %s: %v, rebuilding the index", id, err)
+	if err := db.reindex(); err != nil {
+		return nil, err
+	}
 	if db.version[id] < 1 {
-		return nil, errors.New("record not found")
+		return nil, newError("record_not_found")
 	}
+	return db.read(id)
+}
+
+// read returns the record at the indexed offset of id.
+func (db *csvDB) read(id string) (Record, error) {
 	offset, ok := db.index[id]
 	if !ok {
 		return nil, nil
 	}
-	if _, err := db.f.Seek(offset, io.SeekStart); err != nil {
-		return nil, err
-	}
-	r := csv.NewReader(db.f)
+	return db.readAt(db.f, id, offset, db.size)
+}
+
+// readAt returns the record of id at the offset of f, which holds size bytes.
+func (db *csvDB) readAt(f File, id string, offset, size int64) (Record, error) {
+	r := db.format.reader(io.NewSectionReader(f, offset, size-offset))
 	rec, err := r.Read()
 	if err != nil {
 		return nil, err
 	}
 	if len(rec) > 0 && rec[0] != id {
-		log.Println(rec)
 		return nil, errors.New("corrupted index")
 	}
 	return rec, nil
 }
 
+// Iter yields the live records as of the start of the iteration. The file is
+// read without holding the lock, so that long iterations don't block writers.
 func (db *csvDB) Iter() func(yield func(Record, error) bool) {
 	return func(yield func(Record, error) bool) {
-		db.mu.Lock()
-		defer db.mu.Unlock()
-		if _, err := db.f.Seek(0, io.SeekStart); err != nil {
-			yield(nil, err)
-			return
-		}
-		r := csv.NewReader(db.f)
-		r.FieldsPerRecord = -1
+		for row, err := range db.IterFrom(0) {
+			if !yield(row.Record, err) {
+				return
+			}
+		}
+	}
+}
+
+// IterFrom is Iter starting at a byte offset of the file, either 0 or the
+// Next offset of a row yielded before, so that a scan can be resumed. Records
+// are checked against the versions at the time IterFrom is called: records
+// updated after the scan began show up again with their new version, in the
+// order they were written. A compaction invalidates the offsets, see
+// Generation.
+func (db *csvDB) IterFrom(offset int64) func(yield func(Row, error) bool) {
+	return func(yield func(Row, error) bool) {
+		db.mu.RLock()
+		f, size, versions := db.f, db.size, maps.Clone(db.version)
+		db.refs.acquire(f)
+		db.mu.RUnlock()
+		defer db.refs.release(f)
+		if offset < 0 || offset > size {
+			yield(Row{}, fmt.Errorf("offset %d is outside of %s", offset, db.name))
+			return
+		}
+		r := db.format.reader(io.NewSectionReader(f, offset, size-offset))
 		for {
 			rec, err := r.Read()
 			if errors.Is(err, io.EOF) {
 				break
 			}
 			if err != nil {
-				yield(nil, err)
+				yield(Row{}, err)
 				return
 			}
-			if len(rec) < 2 {
-				continue
+			if len(rec) < 2 || rec[0] == "" {
+				continue // compaction marker
 			}
 			id, version := rec[0], rec[1]
-			if version == "0" || version != strconv.FormatInt(db.version[id], 10) {
+			if version == "0" || version != strconv.FormatInt(versions[id], 10) {
 				continue // deleted items or outdated versions
 			}
-			if !yield(rec, nil) {
+			if !yield(Row{rec, offset + r.InputOffset()}, nil) {
 				return
 			}
 		}
 	}
 }
 
-func SignSession(username string) string {
-	data := fmt.Sprintf("%s:%d", username, time.Now().Unix())
-	sum := sha256.Sum256([]byte(SessionKey + data))
+// Count returns the number of live records.
+func (db *csvDB) Count() int {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return int(db.live)
+}
+
+// Exists reports whether a record is live.
+func (db *csvDB) Exists(id string) bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.version[id] >= 1
+}
+
+// Generation changes whenever a compaction rewrites the file, which moves
+// the rows and invalidates the offsets of IterFrom.
+func (db *csvDB) Generation() int64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.dropped
+}
+
+// Replicate appends a record copied from another database if it is newer than
+// the local version. Tombstones (version 0) delete live records. It reports
+// whether the record was written.
+func (db *csvDB) Replicate(r Record) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if len(r) < 2 || r[0] == "" {
+		return false, newError("invalid_record")
+	}
+	v, err := strconv.ParseInt(r[1], 10, 64)
+	if err != nil {
+		return false, err
+	}
+	if cur := db.version[r[0]]; (v == 0 && cur < 1) || (v != 0 && v <= cur) {
+		return false, nil
+	}
+	return true, db.append(r)
+}
+
+// Deleted returns the versions of the deletions of deleted records by id. A
+// deletion counts as the version after the last one of the record.
+func (db *csvDB) Deleted() map[string]int64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return maps.Clone(db.deleted)
+}
+
+func SignSession(username string) string { return signSession(SessionKey, username) }
+
+func VerifySession(session string) (string, bool) {
+	return verifySession(SessionKey, session, 24*time.Hour)
+}
+
+func signSession(key, username string) string {
+	return signData(key, fmt.Sprintf("%s:%d", username, time.Now().Unix()))
+}
+
+// signImpersonation signs a session of username opened by the impersonator,
+// which is appended after the timestamp in base64, so that it can't be told
+// from the username whatever characters either of them contains.
+func signImpersonation(key, username, impersonator string) string {
+	enc := base64.RawURLEncoding.EncodeToString([]byte(impersonator))
+	return signData(key, fmt.Sprintf("%s:%d.%s", username, time.Now().Unix(), enc))
+}
+
+func signData(key, data string) string {
+	sum := sha256.Sum256([]byte(key + data))
 	sig := base32.StdEncoding.EncodeToString(sum[:])[:16]
 	return fmt.Sprintf("%s.%s", data, sig)
 }
 
-func VerifySession(session string) (string, bool) {
-	parts := strings.Split(session, ".")
-	if len(parts) != 2 {
-		return "", false
-	}
-	data, sig := parts[0], parts[1]
-	sum := sha256.Sum256([]byte(SessionKey + data))
+func verifySession(key, session string, ttl time.Duration) (string, bool) {
+	username, _, ok := parseSession(key, session, ttl)
+	return username, ok
+}
+
+// parseSession verifies a session and returns its user and, for impersonation
+// sessions, the user who opened it. The session is "username:timestamp", or
+// "username:timestamp.impersonator" with the impersonator in base64, followed
+// by a dot and the signature. It is split from the end, as the fields after
+// the username can't contain colons or dots. Sessions signed in the future or
+// older than ttl are rejected.
+func parseSession(key, session string, ttl time.Duration) (username, impersonator string, ok bool) {
+	i := strings.LastIndexByte(session, '.')
+	if i < 0 {
+		return "", "", false
+	}
+	data, sig := session[:i], session[i+1:]
+	sum := sha256.Sum256([]byte(key + data))
 	expectedSig := base32.StdEncoding.EncodeToString(sum[:])[:16]
 	if sig != expectedSig {
-		return "", false
-	}
-	if parts = strings.Split(data, ":"); len(parts) == 2 {
-		if ts, err := strconv.ParseInt(parts[1], 10, 64); err == nil {
-			if time.Now().Unix()-ts < 86400 { // 24 hours
-				return parts[0], true
-			}
+		return "", "", false
+	}
+	i = strings.LastIndexByte(data, ':')
+	if i < 0 {
+		return "", "", false
+	}
+	username, tail := data[:i], data[i+1:]
+	tail, enc, impersonated := strings.Cut(tail, ".")
+	if impersonated {
+		b, err := base64.RawURLEncoding.DecodeString(enc)
+		if err != nil || len(b) == 0 {
+			return "", "", false
 		}
+		impersonator = string(b)
+	}
+	ts, err := strconv.ParseInt(tail, 10, 64)
+	if err != nil {
+		return "", "", false
+	}
+	if age := time.Since(time.Unix(ts, 0)); age < 0 || age >= ttl {
+		return "", "", false
 	}
-	return "", false
+	return username, impersonator, true
+}
+
+// sessionConfig describes how session cookies are named, signed and expired.
+type sessionConfig struct {
+	cookie, key string
+	ttl         time.Duration
 }
 
 type Store struct {
-	Dir       string
-	Schemas   map[string]Schema
-	Resources map[string]DB
+	Dir         string
+	Schemas     map[string]Schema
+	Resources   map[string]DB
+	Storage     Storage
+	Backend     Backend // opens resource databases, CSVBackend by default
+	Tracer      Tracer
+	MaxChanges  int // number of recent changes kept for followers
+	indexEvery  int // see WithIndexFiles
+	durability  Durability
+	repair      bool // see WithTailRepair
+	compaction  AutoCompact
+	lockTimeout time.Duration // see WithStoreLockTimeout
+	changes     changeLog
+	schemaDB    *csvDB            // _schemas.csv, closed by Close
+	engines     map[string]string // resource -> engine, see open
+	schemaMu    sync.RWMutex      // see ReloadSchemas
+	listCache   *listCache        // see WithListCache
+	// MirrorStrict makes writes fail if they can't be mirrored, otherwise
+	// mirroring errors are only logged.
+	MirrorStrict bool
+	mirror       map[string]*csvDB
+	intents      *csvDB // opened by the first batch that needs it
+	intentsOnce  sync.Once
+	intentsErr   error
+	slugMu       sync.Mutex
+	refsMu       sync.Mutex
+	blobMu       sync.RWMutex         // see putBlob
+	refs         map[string]*refIndex // "resource.field" -> index, see RelatedCount
+	// Warnings lists problems found when the store was opened that don't
+	// prevent it from working, e.g. an *IntentWarning.
+	Warnings []error
+	// Lenient makes records that don't match the schema length readable, e.g.
+	// after a schema change was rolled back: short records are padded with
+	// empty values and marked "_partial", the unknown columns of long records
+	// are kept in "_extra" and written back by updates. Otherwise records
+	// shorter than the schema are an error.
+	Lenient bool
+	// stopSweep stops the sweeper started by StartSweeper and waits for it.
+	stopSweep func()
+	closeMu   sync.Mutex
+	closed    bool           // see enter
+	inflight  sync.WaitGroup // operations that Close waits for
+}
+
+type StoreOption func(*Store)
+
+// WithStorage makes the store keep its files in st instead of the data directory.
+func WithStorage(st Storage) StoreOption { return func(s *Store) { s.Storage = st } }
+
+// WithBackend makes the store open the databases of resources with b instead
+// of keeping them in CSV files. Schemas are still read from _schemas.csv.
+func WithBackend(b Backend) StoreOption { return func(s *Store) { s.Backend = b } }
+
+// WithIndexFiles keeps the index of every resource file in an index file next
+// to it, saved when the store is closed and after every n writes, so that the
+// files don't have to be scanned when the store is opened. Only the rows
+// written after the index was saved are scanned. Stale or corrupted index
+// files are ignored. It applies to CSVBackend and the jsonl engine.
+func WithIndexFiles(n int) StoreOption { return func(s *Store) { s.indexEvery = n } }
+
+// WithDurability sets when the writes to resource files are synced to stable
+// storage, see Durability. By default it is left to the operating system.
+func WithDurability(d Durability) StoreOption { return func(s *Store) { s.durability = d } }
+
+// WithRepair sets whether the store repairs resource files whose last row was
+// left half-written by a crash instead of failing to open, see WithTailRepair.
+func WithRepair(repair bool) StoreOption { return func(s *Store) { s.repair = repair } }
+
+// WithCompaction sets when the resource files are compacted in the background,
+// DefaultAutoCompact by default. The zero AutoCompact disables it.
+func WithCompaction(ac AutoCompact) StoreOption { return func(s *Store) { s.compaction = ac } }
+
+// WithStoreLockTimeout makes the store wait up to d for the lock on each of
+// its files if another process holds it, see WithLockTimeout. By default
+// opening a store fails right away.
+func WithStoreLockTimeout(d time.Duration) StoreOption {
+	return func(s *Store) { s.lockTimeout = d }
 }
 
-func NewStore(dir string) (*Store, error) {
-	s := &Store{Dir: dir, Schemas: map[string]Schema{}, Resources: map[string]DB{}}
-	schemaDB, err := NewCSVDB(s.Dir + "/_schemas.csv")
+// Backend opens the database of a resource.
+type Backend interface {
+	Open(resource string) (DB, error)
+}
+
+// BackendFunc is a function used as a Backend, e.g. to open some resources
+// with another backend:
+//
+//	csv := pennybase.CSVBackend{Storage: pennybase.DirStorage(dir)}
+//	pennybase.WithBackend(pennybase.BackendFunc(func(resource string) (pennybase.DB, error) {
+//		if resource == "sessions" {
+//			return pennybase.NewMemDB(), nil
+//		}
+//		return csv.Open(resource)
+//	}))
+type BackendFunc func(resource string) (DB, error)
+
+func (f BackendFunc) Open(resource string) (DB, error) { return f(resource) }
+
+// CSVBackend is the default backend, it keeps every resource in a CSV file
+// named after it.
+type CSVBackend struct {
+	Storage     Storage
+	IndexEvery  int           // writes between saves of index files, 0 for none, see WithIndexFiles
+	Repair      bool          // see WithTailRepair
+	AutoCompact AutoCompact   // see WithAutoCompact
+	LockTimeout time.Duration // see WithLockTimeout
+}
+
+func (b CSVBackend) Open(resource string) (DB, error) {
+	opts := []DBOption{WithAutoCompact(b.AutoCompact), WithLockTimeout(b.LockTimeout)}
+	if b.Repair {
+		opts = append(opts, WithTailRepair())
+	}
+	db, err := openDB(b.Storage, resource+".csv", csvFormat, b.IndexEvery, opts...)
 	if err != nil {
 		return nil, err
 	}
-	for rec, err := range schemaDB.Iter() {
+	return db, nil
+}
+
+// open opens the database of a resource with the storage engine named in the
+// schema: "csv" (the default) uses the Backend, "jsonl" opens a JSONL file in
+// the Storage.
+func (s *Store) open(resource, engine string) (db DB, err error) {
+	switch engine {
+	case "", "csv":
+		db, err = s.Backend.Open(resource)
+	case "jsonl":
+		opts := []DBOption{WithAutoCompact(s.compaction), WithLockTimeout(s.lockTimeout)}
+		if s.repair {
+			opts = append(opts, WithTailRepair())
+		}
+		db, err = openDB(s.Storage, resource+".jsonl", jsonlFormat, s.indexEvery, opts...)
+	default:
+		return nil, fmt.Errorf("unknown engine %q of %s", engine, resource)
+	}
+	if db, ok := db.(*csvDB); ok && s.durability != NoSync {
+		db.setDurability(s.durability)
+	}
+	return db, err
+}
+
+// readSchemas reads the field schemas of every resource and their engines
+// from the schema database.
+func readSchemas(db DB) (map[string]Schema, map[string]string, error) {
+	schemas, engines := map[string]Schema{}, map[string]string{}
+	for rec, err := range db.Iter() {
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
-		if len(rec) != 8 {
-			return nil, fmt.Errorf("invalid schema record: %v", rec)
+		if len(rec) < 8 {
+			return nil, nil, fmt.Errorf("invalid schema record: %v", rec)
 		}
 		schema := FieldSchema{
 			Resource: rec[2],
@@ -321,88 +1380,583 @@ func NewStore(dir string) (*Store, error) {
 			Type:     FieldType(rec[4]),
 			Regex:    rec[7],
 		}
+		if schema.Type == Reference {
+			schema.Target, schema.Regex = schema.Regex, ""
+		}
+		if _, err := regexp.Compile(schema.Regex); err != nil {
+			return nil, nil, fmt.Errorf("invalid regex of field %s.%s: %w", schema.Resource, schema.Field, err)
+		}
 		schema.Min, _ = strconv.ParseFloat(rec[5], 64)
 		schema.Max, _ = strconv.ParseFloat(rec[6], 64)
-		s.Schemas[schema.Resource] = append(s.Schemas[schema.Resource], schema)
-		if _, ok := s.Resources[schema.Resource]; !ok {
-			db, err := NewCSVDB(s.Dir + "/" + schema.Resource + ".csv")
-			if err != nil {
-				return nil, err
+		if len(rec) > 8 {
+			if err := schema.parseOptions(rec[8]); err != nil {
+				return nil, nil, err
+			}
+		}
+		if schema.Field == "_expires" && schema.Type == Number {
+			schema.Expires = true // expires at the time in the field, see expiresAt
+		}
+		if slices.ContainsFunc(schemas[schema.Resource], func(f FieldSchema) bool { return f.Field == schema.Field }) {
+			return nil, nil, fmt.Errorf("schema %s defines field %s.%s more than once", rec[0], schema.Resource, schema.Field)
+		}
+		if len(rec) > 9 && rec[9] != "" {
+			if engine, ok := engines[schema.Resource]; ok && engine != rec[9] {
+				return nil, nil, fmt.Errorf("schema %s sets engine %q of %s, which is already %q", rec[0], rec[9], schema.Resource, engine)
+			}
+			engines[schema.Resource] = rec[9]
+		}
+		schemas[schema.Resource] = append(schemas[schema.Resource], schema)
+	}
+	return schemas, engines, nil
+}
+
+// checkTargets checks that ref fields reference known resources.
+func checkTargets(schemas map[string]Schema) error {
+	for resource, schema := range schemas {
+		for _, field := range schema {
+			if _, ok := schemas[field.Target]; field.Type == Reference && !ok {
+				return fmt.Errorf("field %s.%s references unknown resource %q", resource, field.Field, field.Target)
+			}
+		}
+	}
+	return nil
+}
+
+// indexColumns builds the indexes of the fields of a resource with the
+// "index" option, if its database is a CSV one.
+func (s *Store) indexColumns(resource string) error {
+	db, ok := s.Resources[resource].(*csvDB)
+	if !ok {
+		return nil
+	}
+	for i, field := range s.Schemas[resource] {
+		if field.Indexed {
+			if err := db.indexColumn(i); err != nil {
+				return err
 			}
-			s.Resources[schema.Resource] = db
 		}
 	}
+	return nil
+}
+
+func NewStore(dir string, opts ...StoreOption) (*Store, error) {
+	s := &Store{Dir: dir, Schemas: map[string]Schema{}, Resources: map[string]DB{}, Storage: DirStorage(dir), Tracer: nopTracer{}, MaxChanges: 10000, compaction: DefaultAutoCompact}
+	s.changes.epoch = rand.Text()
+	s.changes.resources, s.changes.modified = map[string]int64{}, map[string]time.Time{}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.Backend == nil {
+		s.Backend = CSVBackend{Storage: s.Storage, IndexEvery: s.indexEvery, Repair: s.repair, AutoCompact: s.compaction, LockTimeout: s.lockTimeout}
+	}
+	schemaDB, err := OpenCSVDB(s.Storage, "_schemas.csv", WithLockTimeout(s.lockTimeout))
+	if err != nil {
+		return nil, err
+	}
+	s.Schemas, s.engines, err = readSchemas(schemaDB)
+	if err == nil {
+		err = checkTargets(s.Schemas)
+	}
+	if err != nil {
+		schemaDB.Close()
+		return nil, err
+	}
+	s.schemaDB = schemaDB
+	for resource := range s.Schemas {
+		db, err := s.open(resource, s.engines[resource])
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.Resources[resource] = db
+		if db, ok := db.(interface{ Seq() int64 }); ok {
+			s.changes.resources[resource] = db.Seq()
+		}
+		if err := s.indexColumns(resource); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	if err := s.recoverIntents(); err != nil {
+		s.Close()
+		return nil, err
+	}
 	return s, nil
 }
 
+// Create adds a new record and returns its id. Errors match ErrResourceNotFound
+// if the resource doesn't exist and ErrInvalidField if a field fails
+// validation.
 func (s *Store) Create(resource string, r Resource) (string, error) {
+	return s.create(context.Background(), resource, r, nil)
+}
+
+// create adds a new record. Fields with the "user" option are set to the id
+// of the given user, if any, so that clients can't spoof record ownership.
+func (s *Store) create(ctx context.Context, resource string, r Resource, user Resource) (string, error) {
+	s.preset(resource, r, user)
+	newID := s.normalizeID(resource, ID())
+	if slices.ContainsFunc(s.Schemas[resource], func(f FieldSchema) bool { return f.Slug != "" || f.Unique }) {
+		// Slugs and unique values must stay unique until the record is written
+		s.slugMu.Lock()
+		defer s.slugMu.Unlock()
+		if err := s.setSlugs(resource, newID, r); err != nil {
+			return "", err
+		}
+	}
+	if err := s.insert(ctx, resource, newID, r); err != nil {
+		return "", err
+	}
+	return newID, nil
+}
+
+// preset sets the fields of a new record that clients can't choose: the
+// "user" fields and blobs.
+func (s *Store) preset(resource string, r Resource, user Resource) {
+	if id, ok := user["_id"].(string); ok {
+		for _, field := range s.Schemas[resource] {
+			if field.DefaultUser && field.Type == List {
+				r[field.Field] = []string{id}
+			} else if field.DefaultUser {
+				r[field.Field] = id
+			}
+		}
+	}
+	for _, field := range s.Schemas[resource] {
+		if field.Blob {
+			delete(r, field.Field) // set by PutBlob
+		}
+	}
+}
+
+func (s *Store) insert(ctx context.Context, resource, id string, r Resource) (err error) {
+	ctx, end := s.span(ctx, "store.create", Attr{"resource", resource}, Attr{"id", id})
+	defer func() { end(err) }()
+	done, err := s.enter()
+	if err != nil {
+		return err
+	}
+	defer done()
 	db, ok := s.Resources[resource]
 	if !ok {
-		return "", fmt.Errorf("resource %s not found", resource)
+		return newError("resource_not_found", "resource", resource)
 	}
-	newID := ID()
-	r["_id"] = newID
+	r["_id"] = id
 	r["_v"] = 1.0
 	rec, err := s.Schemas[resource].Record(r)
 	if err != nil {
-		return "", err
+		return err
 	}
-	if err := db.Create(rec); err != nil {
-		return "", err
+	if err := s.checkRefs(ctx, resource, r, nil); err != nil {
+		return err
 	}
-	return newID, nil
+	if err := s.checkUnique(resource, rec, nil); err != nil {
+		return err
+	}
+	_, endDB := s.span(ctx, "db.create", Attr{"resource", resource}, Attr{"id", id})
+	err = db.Create(rec)
+	if endDB(err); err != nil {
+		return err
+	}
+	return s.committed(resource, rec)
+}
+
+// checkUnique returns an error matching ErrDuplicate if a unique field of the
+// record holds the same non-empty value as another live record. Indexed
+// resources are looked up, others are scanned once per unique field. If seen
+// is not nil, the values are also checked against and added to it, e.g. for
+// the other records of a batch. Callers hold slugMu, so that no other record
+// takes the values before the record is written.
+func (s *Store) checkUnique(resource string, rec Record, seen map[string]string) error {
+	for i, field := range s.Schemas[resource] {
+		if !field.Unique || i >= len(rec) || rec[i] == "" {
+			continue
+		}
+		taken := func(id string) error {
+			if id == rec[0] {
+				return nil
+			}
+			return newError("duplicate_value", "field", field.Field, "value", rec[i])
+		}
+		if seen != nil {
+			key := resource + "\x00" + field.Field + "\x00" + rec[i]
+			if err := taken(cmp.Or(seen[key], rec[0])); err != nil {
+				return err
+			}
+			seen[key] = rec[0]
+		}
+		ids, indexed := s.lookup(resource, i, rec[i])
+		if !indexed {
+			for r, err := range s.Resources[resource].Iter() {
+				if err != nil {
+					return err
+				}
+				if i < len(r) && r[i] == rec[i] {
+					ids = append(ids, r[0])
+				}
+			}
+		}
+		for _, id := range ids {
+			if err := taken(id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
+// setSlugs fills the slug fields of a new record from their source fields,
+// appending "-2", "-3" and so on to slugs that are already taken. If the
+// source field is empty, the slug is made from the record id.
+func (s *Store) setSlugs(resource, id string, r Resource) error {
+	for i, field := range s.Schemas[resource] {
+		if field.Slug == "" {
+			continue
+		}
+		src, _ := r[field.Slug].(string)
+		base := slugify(src)
+		if base == "" {
+			base = slugify(id)
+		}
+		taken := func(slug string) bool {
+			ids, _ := s.lookup(resource, i, slug)
+			return len(ids) > 0
+		}
+		if _, indexed := s.lookup(resource, i, ""); !indexed {
+			slugs := map[string]bool{}
+			for rec, err := range s.Resources[resource].Iter() {
+				if err != nil {
+					return err
+				}
+				if i < len(rec) {
+					slugs[rec[i]] = true
+				}
+			}
+			taken = func(slug string) bool { return slugs[slug] }
+		}
+		slug := base
+		for n := 2; taken(slug); n++ {
+			slug = fmt.Sprintf("%s-%d", base, n)
+		}
+		r[field.Field] = slug
+	}
+	return nil
+}
+
+// CreateUser adds a user, storing a salted hash of the password.
+func (s *Store) CreateUser(username, password string, roles []string) error {
+	return s.createUser(context.Background(), username, password, roles)
+}
+
+func (s *Store) createUser(ctx context.Context, username, password string, roles []string) error {
+	if username == "" || password == "" {
+		return errors.New("username and password are required")
+	}
+	// Colons separate the username from the timestamp in sessions
+	if strings.ContainsFunc(username, func(r rune) bool { return r == ':' || unicode.IsControl(r) }) {
+		return newError("invalid_field", "field", "username")
+	}
+	salt := Salt()
+	return s.insert(ctx, "_users", username, Resource{"salt": salt, "password": HashPasswd(password, salt), "roles": roles})
+}
+
+// Update writes a new version of a record. Fields missing from r keep their
+// values. If r has a "_v", it must be the current version of the record, or
+// else the update fails with ErrVersionConflict, whose "version" parameter is
+// the current version. This lets clients detect concurrent updates.
 func (s *Store) Update(resource string, r Resource) error {
+	return s.update(context.Background(), resource, r)
+}
+
+func (s *Store) update(ctx context.Context, resource string, r Resource) (err error) {
+	ctx, end := s.span(ctx, "store.update", Attr{"resource", resource}, Attr{"id", fmt.Sprint(r["_id"])})
+	defer func() { end(err) }()
+	done, err := s.enter()
+	if err != nil {
+		return err
+	}
+	defer done()
 	db, ok := s.Resources[resource]
 	if !ok {
-		return fmt.Errorf("resource %s not found", resource)
+		return newError("resource_not_found", "resource", resource)
 	}
-	orig, err := s.Get(resource, r["_id"].(string))
+	if slices.ContainsFunc(s.Schemas[resource], func(f FieldSchema) bool { return f.Unique }) {
+		s.slugMu.Lock()
+		defer s.slugMu.Unlock()
+	}
+	orig, err := s.get(ctx, resource, r["_id"].(string))
 	if err != nil {
-		return fmt.Errorf("record not found: %w", err)
+		return err
+	}
+	if v, ok := r["_v"].(float64); ok && v != orig["_v"] {
+		return newError("version_conflict", "version", formatNumber(orig["_v"].(float64)))
 	}
 	for _, field := range s.Schemas[resource] {
-		if _, ok := r[field.Field]; !ok {
+		if _, ok := r[field.Field]; !ok || field.Slug != "" || field.Blob {
 			r[field.Field] = orig[field.Field]
 		}
 	}
 	r["_v"] = orig["_v"].(float64) + 1
-	rec, err := s.Schemas[resource].Record(r)
+	rec, err := s.record(resource, r, orig)
 	if err != nil {
 		return err
 	}
-	return db.Update(rec)
+	if err := s.checkRefs(ctx, resource, r, orig); err != nil {
+		return err
+	}
+	if err := s.checkUnique(resource, rec, nil); err != nil {
+		return err
+	}
+	_, endDB := s.span(ctx, "db.update", Attr{"resource", resource}, Attr{"id", rec[0]})
+	err = db.Update(rec)
+	if endDB(err); err != nil {
+		return err
+	}
+	return s.committed(resource, rec)
 }
 
+// Touch writes a new version of a record with unchanged fields, e.g. to make
+// clients and followers refetch data computed from it. See also Server.Touch.
+func (s *Store) Touch(resource, id string) error {
+	return s.update(context.Background(), resource, Resource{"_id": id})
+}
+
+// Delete deletes a record. Records referring to it with a ref field are
+// deleted as well ("cascade" option), prevent the deletion with an error
+// matching ErrReferenced ("restrict") or get the field cleared ("setnull"),
+// all as a single operation (see Batch).
 func (s *Store) Delete(resource, id string) error {
+	_, err := s.delete(context.Background(), resource, id)
+	return err
+}
+
+// delete deletes a record and returns the writes its deletion cascaded to.
+func (s *Store) delete(ctx context.Context, resource, id string) (cascaded []Write, err error) {
+	id = s.normalizeID(resource, id)
+	ctx, end := s.span(ctx, "store.delete", Attr{"resource", resource}, Attr{"id", id})
+	defer func() { end(err) }()
+	done, err := s.enter()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
 	db, ok := s.Resources[resource]
 	if !ok {
-		return fmt.Errorf("resource %s not found", resource)
+		return nil, newError("resource_not_found", "resource", resource)
+	}
+	if cascaded, err = s.cascade(ctx, resource, id); err != nil {
+		return nil, err
+	} else if len(cascaded) > 0 {
+		return cascaded, s.deleteCascaded(ctx, resource, id, cascaded)
+	}
+	_, endDB := s.span(ctx, "db.delete", Attr{"resource", resource}, Attr{"id", id})
+	err = db.Delete(id)
+	if endDB(err); err != nil {
+		return nil, err
+	}
+	s.removeBlobs(resource, id)
+	return nil, s.committed(resource, Record{id, "0"})
+}
+
+// checkRefs checks that the references of a new or updated record point to
+// existing records. References unchanged since orig are not checked again, so
+// that records referring to deleted ones can still be updated.
+func (s *Store) checkRefs(ctx context.Context, resource string, r, orig Resource) error {
+	for _, field := range s.Schemas[resource] {
+		id, _ := r[field.Field].(string)
+		if field.Type != Reference || id == "" || id == orig[field.Field] {
+			continue
+		}
+		if ref, err := s.get(ctx, field.Target, id); err != nil || ref == nil {
+			return newError("reference_not_found", "resource", field.Target, "id", id)
+		}
 	}
-	return db.Delete(id)
+	return nil
 }
 
+// resource converts a stored record. In lenient mode, records shorter than the
+// schema are padded with empty values and marked with "_partial", and the
+// columns of longer records unknown to the schema are kept in "_extra".
+func (s *Store) resource(resource string, rec Record) (Resource, error) {
+	schema := s.Schemas[resource]
+	if !s.Lenient || len(rec) < 2 || len(rec) == len(schema) {
+		return schema.Resource(rec)
+	}
+	var extra []string
+	if len(rec) > len(schema) {
+		rec, extra = rec[:len(schema)], rec[len(schema):]
+	} else {
+		rec = slices.Clone(rec)
+		for _, field := range schema[len(rec):] {
+			rec = append(rec, map[FieldType]string{Number: "0"}[field.Type])
+		}
+	}
+	res, err := schema.Resource(rec)
+	if err != nil {
+		return nil, err
+	}
+	if extra != nil {
+		res["_extra"] = slices.Clone(extra)
+	} else {
+		res["_partial"] = true
+	}
+	return res, nil
+}
+
+// record converts an updated resource, keeping the "_extra" columns of the
+// original record that the schema doesn't know about.
+func (s *Store) record(resource string, r, orig Resource) (Record, error) {
+	rec, err := s.Schemas[resource].Record(r)
+	if extra, ok := orig["_extra"].([]string); ok && err == nil && s.Lenient {
+		rec = append(rec, extra...)
+	}
+	return rec, err
+}
+
+// Get returns a record by id, or an error matching ErrRecordNotFound if there
+// is none.
 func (s *Store) Get(resource, id string) (Resource, error) {
+	return s.get(context.Background(), resource, id)
+}
+
+// GetBy returns the record whose field holds the value, e.g. a user by a
+// unique username or an article by its slug. The value is normalized like the
+// field. It returns nil if no record matches, and an error if several do.
+func (s *Store) GetBy(resource, field, value string) (Resource, error) {
+	return s.getBy(context.Background(), resource, field, value)
+}
+
+func (s *Store) getBy(ctx context.Context, resource, field, value string) (res Resource, err error) {
+	ctx, end := s.span(ctx, "store.get_by", Attr{"resource", resource}, Attr{"field", field})
+	defer func() { end(err) }()
+	done, err := s.enter()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
 	db, ok := s.Resources[resource]
 	if !ok {
-		return nil, fmt.Errorf("resource %s not found", resource)
+		return nil, newError("resource_not_found", "resource", resource)
+	}
+	i := slices.IndexFunc(s.Schemas[resource], func(f FieldSchema) bool { return f.Field == field && f.Type != List })
+	if i < 0 {
+		return nil, newError("invalid_field", "field", field)
+	}
+	value = s.Schemas[resource][i].Normalize(value)
+	if t, ok := parseDateTime(value); ok && s.Schemas[resource][i].Type == DateTime {
+		value = formatDateTime(t)
+	}
+	if ids, ok := s.lookup(resource, i, value); ok {
+		switch len(ids) {
+		case 0:
+			return nil, nil
+		case 1:
+			if res, err = s.get(ctx, resource, ids[0]); errors.Is(err, ErrRecordNotFound) {
+				return nil, nil // expired
+			}
+			return res, err
+		default:
+			return nil, fmt.Errorf("%s is not unique in %s: %s", field, resource, value)
+		}
 	}
-	rec, err := db.Get(id)
+	var found Record
+	for rec, err := range db.Iter() {
+		if err != nil {
+			return nil, err
+		}
+		if i >= len(rec) {
+			continue
+		}
+		cell := rec[i]
+		if s.Schemas[resource][i].Compressed {
+			cell, _ = decompressText(cell)
+		}
+		if cell == value {
+			if found != nil {
+				return nil, fmt.Errorf("%s is not unique in %s: %s", field, resource, value)
+			}
+			found = rec
+		}
+	}
+	if found == nil {
+		return nil, nil
+	}
+	if res, err = s.resource(resource, found); err == nil && s.expired(resource, res, time.Now()) {
+		return nil, nil
+	}
+	return res, err
+}
+
+// lookup returns the ids of the records whose field at position i holds the
+// value. It reports false if the field is not indexed.
+func (s *Store) lookup(resource string, i int, value string) ([]string, bool) {
+	if db, ok := s.Resources[resource].(*csvDB); ok {
+		return db.lookup(i, value)
+	}
+	return nil, false
+}
+
+// normalizeID applies the normalization options of the _id field to a
+// looked up id, the same way they are applied to stored ids.
+func (s *Store) normalizeID(resource, id string) string {
+	if schema := s.Schemas[resource]; len(schema) > 0 {
+		return schema[0].Normalize(id)
+	}
+	return id
+}
+
+func (s *Store) get(ctx context.Context, resource, id string) (res Resource, err error) {
+	id = s.normalizeID(resource, id)
+	ctx, end := s.span(ctx, "store.get", Attr{"resource", resource}, Attr{"id", id})
+	defer func() { end(err) }()
+	done, err := s.enter()
 	if err != nil {
 		return nil, err
 	}
+	defer done()
+	db, ok := s.Resources[resource]
+	if !ok {
+		return nil, newError("resource_not_found", "resource", resource)
+	}
+	_, endDB := s.span(ctx, "db.get", Attr{"resource", resource}, Attr{"id", id})
+	rec, err := db.Get(id)
+	if endDB(err); err != nil {
+		return nil, err
+	}
 	if len(rec) < 2 {
-		return nil, nil // record not found
+		return nil, newError("record_not_found")
 	}
-	return s.Schemas[resource].Resource(rec)
+	if res, err = s.resource(resource, rec); err == nil && s.expired(resource, res, time.Now()) {
+		return nil, newError("record_not_found")
+	}
+	return res, err
 }
 
+// List returns the live records of a resource, sorted by the field sortBy if
+// it is not empty, or in descending order if it starts with "-", e.g.
+// "-year". Records without the field come last either way.
 func (s *Store) List(resource, sortBy string) ([]Resource, error) {
+	return s.list(context.Background(), resource, sortBy)
+}
+
+func (s *Store) list(ctx context.Context, resource, sortBy string) (_ []Resource, err error) {
+	ctx, end := s.span(ctx, "store.list", Attr{"resource", resource})
+	defer func() { end(err) }()
+	done, err := s.enter()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
 	db, ok := s.Resources[resource]
 	if !ok {
-		return nil, fmt.Errorf("resource %s not found", resource)
+		return nil, newError("resource_not_found", "resource", resource)
+	}
+	seq := s.ChangeSeq(resource)
+	if res, ok := s.listCache.get(resource, sortBy, seq); ok {
+		return s.unexpired(resource, res), nil
 	}
+	_, endDB := s.span(ctx, "db.iter", Attr{"resource", resource})
+	defer func() { endDB(err) }()
 	res := []Resource{}
 	for rec, err := range db.Iter() {
 		if err != nil {
@@ -411,71 +1965,267 @@ func (s *Store) List(resource, sortBy string) ([]Resource, error) {
 		if len(rec) < 2 {
 			continue
 		}
-		r, err := s.Schemas[resource].Resource(rec)
+		r, err := s.resource(resource, rec)
 		if err != nil {
 			return res, err
 		}
 		res = append(res, r)
 	}
-	if sortBy != "" {
-		sort.Slice(res, func(i, j int) bool {
-			if res[i][sortBy] == nil {
+	sortResources(res, sortBy)
+	s.listCache.put(s.Schemas[resource], resource, sortBy, seq, res)
+	return s.unexpired(resource, res), nil
+}
+
+// sortResources sorts by a field, see Store.List.
+func sortResources(res []Resource, sortBy string) {
+	field, desc := strings.CutPrefix(sortBy, "-")
+	if field == "" {
+		return
+	}
+	sort.Slice(res, func(i, j int) bool {
+		a, b := res[i][field], res[j][field]
+		if a == nil {
+			return false
+		}
+		if b == nil {
+			return true
+		}
+		if desc {
+			a, b = b, a
+		}
+		switch a.(type) {
+		case string:
+			return a.(string) < b.(string)
+		case float64:
+			return a.(float64) < b.(float64)
+		case time.Time:
+			return a.(time.Time).Before(b.(time.Time))
+		case bool:
+			return !a.(bool) && b.(bool)
+		default:
+			return false
+		}
+	})
+}
+
+// ListWhere is like List, but returns only the records whose fields equal the
+// values in the filter, e.g. {"author": "Alan Donovan", "year": "2015"}. The
+// values are parsed and normalized like the fields, so numbers and datetimes
+// are compared by value, and list fields match if they contain the value.
+func (s *Store) ListWhere(resource, sortBy string, filter map[string]string) ([]Resource, error) {
+	return s.listWhere(context.Background(), resource, sortBy, filter)
+}
+
+func (s *Store) listWhere(ctx context.Context, resource, sortBy string, filter map[string]string) ([]Resource, error) {
+	want := map[string]any{}
+	for _, field := range s.Schemas[resource] {
+		v, ok := filter[field.Field]
+		if !ok {
+			continue
+		}
+		switch field.Type {
+		case Number:
+			n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil {
+				return nil, newError("invalid_field", "field", field.Field)
+			}
+			want[field.Field] = n
+		case DateTime:
+			t, ok := parseDateTime(strings.TrimSpace(v))
+			if !ok {
+				return nil, newError("invalid_field", "field", field.Field)
+			}
+			want[field.Field] = t
+		case Bool:
+			b, err := strconv.ParseBool(strings.TrimSpace(v))
+			if err != nil {
+				return nil, newError("invalid_field", "field", field.Field)
+			}
+			want[field.Field] = b
+		default:
+			want[field.Field] = field.Normalize(v)
+		}
+	}
+	for name := range filter {
+		if _, ok := want[name]; !ok {
+			return nil, newError("invalid_field", "field", name)
+		}
+	}
+	res, err := s.list(ctx, resource, sortBy)
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(res, func(r Resource) bool { return !matches(r, want) }), nil
+}
+
+// matches reports whether the fields of a record equal the filter values, or
+// contain them for lists.
+func matches(r Resource, filter map[string]any) bool {
+	for k, want := range filter {
+		switch v := r[k].(type) {
+		case []string:
+			if !slices.Contains(v, want.(string)) {
 				return false
 			}
-			if res[j][sortBy] == nil {
-				return true
+		case time.Time:
+			if !v.Equal(want.(time.Time)) {
+				return false
 			}
-			switch res[i][sortBy].(type) {
-			case string:
-				return res[i][sortBy].(string) < res[j][sortBy].(string)
-			case float64:
-				return res[i][sortBy].(float64) < res[j][sortBy].(float64)
-			default:
+		default:
+			if v != want {
 				return false
 			}
-		})
+		}
+	}
+	return true
+}
+
+// ListPage is like List, but returns at most limit records (all if limit is
+// 0) starting at offset, and the number of all records. An offset past the end
+// returns no records.
+func (s *Store) ListPage(resource, sortBy string, offset, limit int) ([]Resource, int, error) {
+	res, err := s.list(context.Background(), resource, sortBy)
+	if err != nil {
+		return nil, 0, err
+	}
+	return page(res, offset, limit), len(res), nil
+}
+
+// page returns the records from offset, at most limit of them unless limit is 0.
+func page(res []Resource, offset, limit int) []Resource {
+	res = res[min(offset, len(res)):]
+	if limit > 0 && limit < len(res) {
+		res = res[:limit]
+	}
+	return res
+}
+
+// ListSince returns records whose version is greater than sinceV, followed by
+// tombstones ({"_id": id, "_v": 0, "_deleted": true}) for records deleted
+// since, if the resource DB can report them. A deletion counts as the version
+// after the last one of the record.
+func (s *Store) ListSince(resource string, sinceV float64) ([]Resource, error) {
+	all, err := s.List(resource, "")
+	if err != nil {
+		return nil, err
+	}
+	res := []Resource{}
+	for _, r := range all {
+		if r["_v"].(float64) > sinceV {
+			res = append(res, r)
+		}
+	}
+	if db, ok := s.Resources[resource].(interface{ Deleted() map[string]int64 }); ok {
+		deleted := db.Deleted()
+		for _, id := range slices.Sorted(maps.Keys(deleted)) {
+			if float64(deleted[id]) > sinceV {
+				res = append(res, Resource{"_id": id, "_v": 0.0, "_deleted": true})
+			}
+		}
+	}
+	return res, nil
+}
+
+func (s *Store) span(ctx context.Context, name string, attrs ...Attr) (context.Context, func(error)) {
+	if s.Tracer == nil {
+		return ctx, func(error) {}
 	}
-	return res, nil
+	return s.Tracer.StartSpan(ctx, name, attrs...)
+}
+
+// enter starts an operation that Close waits for, or fails with ErrClosed if
+// the store is closing. The returned function ends the operation.
+func (s *Store) enter() (func(), error) {
+	s.closeMu.Lock()
+	defer s.closeMu.Unlock()
+	if s.closed {
+		return nil, newError("store_closed")
+	}
+	s.inflight.Add(1)
+	return s.inflight.Done, nil
 }
 
+// Close waits for the operations in progress and closes the databases. Any
+// operation started afterwards fails with ErrClosed.
 func (s *Store) Close() error {
+	if s.stopSweep != nil {
+		s.stopSweep()
+	}
+	s.closeMu.Lock()
+	s.closed = true
+	s.closeMu.Unlock()
+	s.inflight.Wait()
 	for _, db := range s.Resources {
 		if err := db.Close(); err != nil {
 			return err
 		}
 	}
+	for _, db := range s.mirror {
+		if err := db.Close(); err != nil {
+			return err
+		}
+	}
+	if s.schemaDB != nil {
+		if err := s.schemaDB.Close(); err != nil {
+			return err
+		}
+	}
+	if s.intents != nil {
+		return s.intents.Close()
+	}
 	return nil
 }
 
+// Authenticate returns the user of a request signed in with a "session"
+// cookie or with basic auth. See Server.Authenticate for other session settings.
 func (s *Store) Authenticate(r *http.Request) (Resource, error) {
-	if cookie, err := r.Cookie("session"); err == nil {
-		if username, ok := VerifySession(cookie.Value); ok {
-			u, err := s.Get("_users", username)
+	return s.authenticate(r.Context(), r, sessionConfig{"session", SessionKey, 24 * time.Hour})
+}
+
+func (s *Store) authenticate(ctx context.Context, r *http.Request, sess sessionConfig) (u Resource, err error) {
+	ctx, end := s.span(ctx, "authenticate")
+	defer func() { end(err) }()
+	if cookie, err := r.Cookie(sess.cookie); err == nil {
+		if username, impersonator, ok := parseSession(sess.key, cookie.Value, sess.ttl); ok {
+			u, err := s.get(ctx, "_users", username)
 			if err != nil {
 				return nil, fmt.Errorf("users error: %w", err)
 			}
+			if impersonator != "" {
+				u["_impersonator"] = impersonator
+			}
 			return u, nil
 		}
 	}
 	if username, password, ok := r.BasicAuth(); ok {
-		return s.AuthenticateBasic(username, password)
+		return s.authenticateBasic(ctx, username, password)
 	}
-	return nil, errors.New("unauthenticated")
+	return nil, newError("unauthenticated")
 }
 
 func (s *Store) AuthenticateBasic(username, password string) (Resource, error) {
-	u, err := s.Get("_users", username)
+	return s.authenticateBasic(context.Background(), username, password)
+}
+
+func (s *Store) authenticateBasic(ctx context.Context, username, password string) (Resource, error) {
+	u, err := s.get(ctx, "_users", username)
 	if err != nil {
 		return nil, fmt.Errorf("users error: %w", err)
 	}
 	if u["password"] != HashPasswd(password, u["salt"].(string)) {
-		return nil, errors.New("unauthenticated")
+		return nil, newError("unauthenticated")
 	}
 	return u, nil
 }
 
 func (s *Store) Authorize(resource, id, action string, user Resource) error {
-	permissions, err := s.List("_permissions", "")
+	return s.authorize(context.Background(), resource, id, action, user)
+}
+
+func (s *Store) authorize(ctx context.Context, resource, id, action string, user Resource) (err error) {
+	ctx, end := s.span(ctx, "authorize", Attr{"resource", resource}, Attr{"action", action}, Attr{"id", id})
+	defer func() { end(err) }()
+	permissions, err := s.list(ctx, "_permissions", "")
 	if err != nil {
 		return fmt.Errorf("permissions error: %w", err)
 	}
@@ -487,39 +2237,116 @@ func (s *Store) Authorize(resource, id, action string, user Resource) error {
 			return nil
 		}
 		if user == nil {
-			return errors.New("unauthenticated")
+			return newError("unauthenticated")
 		}
 		// Any role? Or user has the role?
 		if p["role"] == "*" || slices.Contains(user["roles"].([]string), p["role"].(string)) {
 			return nil
 		}
 		if id != "" {
-			res, err := s.Get(resource, id)
-			if err != nil {
+			res, err := s.get(ctx, resource, id)
+			if errors.Is(err, ErrRecordNotFound) {
+				continue // no owner to match, other permissions may apply
+			} else if err != nil {
 				return err
 			}
+			fields := []string{p["field"].(string)}
+			if p["role"] == "@owner" && fields[0] == "" {
+				fields = s.ownerFields(resource)
+			}
 			username := user["_id"].(string)
-			if user, ok := res[p["field"].(string)]; ok && user == username {
-				return nil // user name matches requested resource field (string)
-			} else if users, ok := res[p["field"].(string)].([]string); ok && slices.Contains(users, username) {
-				return nil // user name is in the requested resource field (list)
+			for _, field := range fields {
+				if user, ok := res[field]; ok && user == username {
+					return nil // user name matches requested resource field (string)
+				} else if users, ok := res[field].([]string); ok && slices.Contains(users, username) {
+					return nil // user name is in the requested resource field (list)
+				}
 			}
 		}
 	}
-	return errors.New("unauthorized")
+	return newError("unauthorized")
+}
+
+// ownerFields returns the fields of the resource holding the id of the user
+// who created the record, i.e. fields with the "user" option.
+func (s *Store) ownerFields(resource string) []string {
+	fields := []string{}
+	for _, f := range s.Schemas[resource] {
+		if f.DefaultUser {
+			fields = append(fields, f.Field)
+		}
+	}
+	return fields
+}
+
+// AddPermission appends a permission rule, taking effect immediately. The
+// action must be "create", "read", "update", "delete" or "*", and the field,
+// if set, must be defined in the resource schema. The "@owner" role requires
+// a field or a resource field with the "user" option.
+func (s *Store) AddPermission(resource, action, field, role string) error {
+	done, err := s.enter()
+	if err != nil {
+		return err
+	}
+	defer done()
+	schema, ok := s.Schemas[resource]
+	if !ok {
+		return fmt.Errorf("unknown resource %q", resource)
+	}
+	if !slices.Contains([]string{"create", "read", "update", "delete", "*"}, action) {
+		return fmt.Errorf("unknown action %q", action)
+	}
+	if field != "" && !slices.ContainsFunc(schema, func(f FieldSchema) bool { return f.Field == field }) {
+		return fmt.Errorf("unknown field %q in %s", field, resource)
+	}
+	if role == "@owner" && field == "" && len(s.ownerFields(resource)) == 0 {
+		return fmt.Errorf("resource %s has no owner field", resource)
+	}
+	_, err = s.Create("_permissions", Resource{"resource": resource, "action": action, "field": field, "role": role})
+	return err
+}
+
+// AccessibleResources returns the sorted names of resources the user may read
+// at all, either publicly or via one of their roles. Rules granting access by
+// an owner field are not considered, as they depend on a specific record.
+func (s *Store) AccessibleResources(user Resource) []string {
+	return s.accessibleResources(context.Background(), user, s.authorize)
+}
+
+func (s *Store) accessibleResources(ctx context.Context, user Resource, authorize func(ctx context.Context, resource, id, action string, user Resource) error) []string {
+	names := []string{}
+	for _, resource := range slices.Sorted(maps.Keys(s.Schemas)) {
+		if authorize(ctx, resource, "", "read", user) == nil {
+			names = append(names, resource)
+		}
+	}
+	return names
 }
 
 type Event struct {
 	Action string   `json:"action"`
 	ID     string   `json:"id"`
 	Data   Resource `json:"data"`
+	Seq    int64    `json:"seq"` // Store.ChangeSeq of the resource after the change
 }
 
+// Broker delivers events to the subscribers of a resource. Publish only
+// queues an event, and a goroutine per resource, started by the first
+// subscription, sends it to the subscribers, so that writes don't wait for
+// them. Events are dropped if the queue is full, and for subscribers whose
+// channel stays full for longer than slowSubscriber.
 type Broker struct {
 	channels map[string]map[chan Event]bool // resource -> channels
+	queues   map[string]chan Event          // resource -> published events
+	closed   bool
 	mu       sync.RWMutex
 }
 
+const (
+	publishQueue   = 1024 // events queued per resource
+	slowSubscriber = 100 * time.Millisecond
+)
+
 func (b *Broker) Subscribe(resource string, ch chan Event) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
@@ -527,6 +2354,14 @@ func (b *Broker) Subscribe(resource string, ch chan Event) {
 		b.channels[resource] = make(map[chan Event]bool)
 	}
 	b.channels[resource][ch] = true
+	if b.queues[resource] == nil && !b.closed {
+		if b.queues == nil {
+			b.queues = map[string]chan Event{}
+		}
+		q := make(chan Event, publishQueue)
+		b.queues[resource] = q
+		go b.fanOut(resource, q)
+	}
 }
 
 func (b *Broker) Unsubscribe(resource string, ch chan Event) {
@@ -540,58 +2375,200 @@ func (b *Broker) Unsubscribe(resource string, ch chan Event) {
 func (b *Broker) Publish(resource string, evt Event) {
 	b.mu.RLock()
 	defer b.mu.RUnlock()
-	if subs := b.channels[resource]; subs != nil {
-		for ch := range subs {
+	select {
+	case b.queues[resource] <- evt: // nil without subscribers, never ready
+	default:
+	}
+}
+
+// fanOut sends the events of a resource to its subscribers until the queue
+// is closed.
+func (b *Broker) fanOut(resource string, q chan Event) {
+	for evt := range q {
+		b.mu.RLock()
+		subs := slices.Collect(maps.Keys(b.channels[resource]))
+		b.mu.RUnlock()
+		var slow []chan Event
+		for _, ch := range subs {
 			select {
 			case ch <- evt:
 			default:
+				slow = append(slow, ch)
+			}
+		}
+		if len(slow) == 0 {
+			continue
+		}
+		timeout := time.NewTimer(slowSubscriber)
+	wait:
+		for _, ch := range slow {
+			select {
+			case ch <- evt:
+			case <-timeout.C:
+				break wait
 			}
 		}
+		timeout.Stop()
+	}
+}
+
+// Close stops delivering events. Events already queued are still delivered.
+func (b *Broker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, q := range b.queues {
+		close(q)
 	}
+	b.queues, b.closed = nil, true
 }
 
 type Hook func(trigger, resource string, user, r Resource) error
 
 func nopHook(trigger, resource string, user, r Resource) error { return nil }
 
+// Config holds the settings of a Server. It is embedded in the Server, so the
+// settings can also be changed later, before the server starts serving.
+type Config struct {
+	ReadOnly      bool           // refuse writes, e.g. on a follower
+	GraphQL       bool           // enable POST /api/graphql
+	GraphQLDepth  int            // maximum nesting of GraphQL queries, 0 for no limit
+	Strict        bool           // reject request bodies with fields not in the schema
+	KnownOnly     bool           // answer 404 for resources without a schema before authorization
+	AdminRole     string         // role required for system (underscore) resources
+	MaxListItems  int            // cap on records in list responses (0 for none), see X-Truncated
+	MaxBodySize   int64          // maximum request body size in bytes, 0 for no limit
+	SessionCookie string         // "session" by default, apps sharing a domain need distinct names
+	SessionKey    string         // signs session cookies, defaults to the SessionKey variable
+	SessionTTL    time.Duration  // session lifetime, 24 hours by default
+	IDPattern     *regexp.Regexp // record ids accepted in URLs, nil to accept any
+	SecureCookie  bool           // send session cookies over https only
+	SupportRole   string         // role admins need to impersonate users, empty to disable
+	SweepInterval time.Duration  // how often expired records are deleted, 0 to never
+	IndexFiles    int            // writes between saves of index files, 0 for none, see WithIndexFiles
+	Durability    Durability     // when writes are synced to disk, see WithDurability
+	Repair        bool           // truncate half-written last rows of resource files, see WithRepair
+	HasPassword   bool           // add "has_password" to users sent to clients, see Server.view
+}
+
+// DefaultConfig returns the settings used by NewServer.
+func DefaultConfig() Config {
+	return Config{AdminRole: "admin", SupportRole: "support", GraphQLDepth: 10, MaxListItems: 10000, SessionCookie: "session", SessionTTL: 24 * time.Hour, IDPattern: DefaultIDPattern, SweepInterval: time.Minute}
+}
+
+// ResourcePattern matches the resource names accepted in URLs.
+var ResourcePattern = regexp.MustCompile(`^_?[A-Za-z0-9][A-Za-z0-9_-]*$`)
+
+// DefaultIDPattern matches the record ids accepted in URLs by default: the
+// generated ids, slugs, user names and e-mail addresses.
+var DefaultIDPattern = regexp.MustCompile(`^[A-Za-z0-9_.@+~-]{1,256}$`)
+
 type Server struct {
-	Store  *Store
-	Broker *Broker
-	Mux    *http.ServeMux
-	Hook   Hook
+	Config
+	Store     *Store
+	Broker    *Broker
+	Mux       *http.ServeMux
+	Hook      Hook
+	AfterHook Hook                  // called like Hook once the write succeeded, see afterHook
+	Preload   map[string][]string   // template name -> asset URLs to preload
+	Feeds     map[string]FeedConfig // resource -> Atom feed configuration
+	Catalogs  map[string]Catalog    // language -> error messages, see WriteError
+	templates *template.Template
+	scheduler *scheduler
+	quotas    *quotas
+	// impersonations is the audit trail, see Server.Impersonations
+	impersonations impersonationLog
 }
 
 func NewServer(dataDir, tmplDir, staticDir string) (*Server, error) {
-	store, err := NewStore(dataDir)
+	return NewServerWithConfig(DefaultConfig(), dataDir, tmplDir, staticDir)
+}
+
+// NewServerWithConfig is like NewServer, with the given settings instead of
+// DefaultConfig.
+func NewServerWithConfig(cfg Config, dataDir, tmplDir, staticDir string) (*Server, error) {
+	store, err := NewStore(dataDir, WithIndexFiles(cfg.IndexFiles), WithDurability(cfg.Durability), WithRepair(cfg.Repair))
 	if err != nil {
 		return nil, err
 	}
-	s := &Server{Store: store, Broker: &Broker{channels: map[string]map[chan Event]bool{}}, Mux: http.NewServeMux(), Hook: nopHook}
-	auth := func(next http.HandlerFunc) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			resource := r.PathValue("resource")
-			action := map[string]string{"GET": "read", "POST": "create", "PUT": "update", "DELETE": "delete"}[r.Method]
-			user, _ := s.Store.Authenticate(r)
-			if resource != "" && action != "" {
-				if err := s.Store.Authorize(resource, r.PathValue("id"), action, user); err != nil {
-					http.Error(w, err.Error(), http.StatusUnauthorized)
-					return
-				}
-			}
-			next(w, r.WithContext(context.WithValue(r.Context(), "user", user)))
-		})
+	s := &Server{Config: cfg, Store: store, Broker: &Broker{channels: map[string]map[chan Event]bool{}}, Mux: http.NewServeMux(), Hook: nopHook, AfterHook: nopHook, Catalogs: map[string]Catalog{"en": English}, scheduler: newScheduler(realClock{}), quotas: newQuotas(realClock{})}
+	if _, ok := store.Resources["_quotas"]; ok {
+		if err := s.quotas.load(store.Storage); err != nil {
+			store.Close()
+			return nil, err
+		}
+		if err := s.Schedule("@every 1m", "quotas", func(ctx context.Context) error { return s.quotas.save(store.Storage) }); err != nil {
+			store.Close()
+			return nil, err
+		}
 	}
-	s.Mux.Handle("GET /api/{resource}/", auth(s.handleList))
-	s.Mux.Handle("POST /api/{resource}/", auth(s.handleCreate))
-	s.Mux.Handle("GET /api/{resource}/{id}", auth(s.handleGet))
+	store.StartSweeper(cfg.SweepInterval, func(resource string, res Resource) {
+		s.Broker.Publish(resource, Event{Action: "deleted", ID: res["_id"].(string), Data: s.view(resource, res), Seq: store.ChangeSeq(resource)})
+	})
+	auth := func(next http.HandlerFunc) http.Handler { return s.auth("", next) }
+	// Lists and creates work with and without the trailing slash
+	for _, path := range []string{"/api/{resource}/", "/api/{resource}"} {
+		s.Mux.Handle("GET "+path, auth(s.handleList))
+		s.Mux.Handle("POST "+path, auth(s.handleCreate))
+	}
+	s.Mux.Handle("POST /api/{resource}/_batch", auth(s.handleBatch))
+	// GET /api/events/{resource} is dispatched by hand, so that it doesn't
+	// conflict with per-resource routes like GET /api/{resource}/_feed.atom
+	get := auth(s.handleGet)
+	s.Mux.Handle("GET /api/{resource}/{id}", s.validatePath(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("resource") == "events" {
+			r.SetPathValue("resource", r.PathValue("id"))
+			s.handleEvents(w, r)
+			return
+		}
+		get.ServeHTTP(w, r)
+	})))
+	// The record is looked up before authorization, so that owners can read
+	// it. Missing records are reported only to users who may read any record.
+	notFound := auth(http.NotFound)
+	s.Mux.Handle("GET /api/{resource}/by/{field}/{value}", s.validatePath(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res, err := s.Store.getBy(r.Context(), r.PathValue("resource"), r.PathValue("field"), r.PathValue("value"))
+		if err != nil && !errors.Is(err, ErrResourceNotFound) {
+			s.WriteError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		if res == nil {
+			notFound.ServeHTTP(w, r)
+			return
+		}
+		r.SetPathValue("id", res["_id"].(string))
+		get.ServeHTTP(w, r)
+	})))
+	s.Mux.Handle("GET /api/{resource}/_feed.atom", s.validatePath(http.HandlerFunc(s.handleFeed)))
+	s.Mux.Handle("GET /api/{resource}/stream", auth(s.handleStream))
+	s.Mux.Handle("GET /api/{resource}/_export", s.auth("export", s.handleExport))
+	s.Mux.Handle("POST /api/{resource}/_import", s.auth("import", s.handleImport))
+	s.Mux.Handle("GET /api/{resource}/count", auth(s.handleCount))
+	s.Mux.Handle("GET /api/{resource}/{id}/_history", auth(s.handleHistory))
+	s.Mux.Handle("GET /partials/{resource}/", auth(s.handlePartial))
+	s.Mux.Handle("GET /partials/{resource}/{id}", auth(s.handlePartial))
 	s.Mux.Handle("PUT /api/{resource}/{id}", auth(s.handleUpdate))
 	s.Mux.Handle("DELETE /api/{resource}/{id}", auth(s.handleDelete))
-	s.Mux.HandleFunc("GET /api/events/{resource}", s.handleEvents)
+	s.Mux.Handle("GET /blobs/{resource}/{id}/{field}", auth(s.handleBlob))
+	s.Mux.Handle("PUT /blobs/{resource}/{id}/{field}", auth(s.handleBlob))
+	s.Mux.Handle("GET /api/_changes", auth(s.requireRead("_changes", s.handleChanges)))
+	s.Mux.Handle("GET /api/_snapshot", auth(s.requireRead("_changes", s.handleSnapshot)))
+	s.Mux.Handle("POST /api/graphql", auth(s.handleGraphQL))
+	s.Mux.Handle("GET /api/_info", auth(s.requireRead("_info", s.handleInfo)))
+	s.Mux.Handle("GET /api/_audit", auth(s.handleAudit))
+	s.Mux.Handle("GET /api/me/resources", auth(s.handleMyResources))
 	s.Mux.HandleFunc("POST /api/login", s.handleLogin)
 	s.Mux.HandleFunc("POST /api/logout", s.handleLogout)
+	s.Mux.Handle("POST /api/admin/impersonate/{username}", auth(s.handleImpersonate))
+	s.Mux.HandleFunc("DELETE /api/admin/impersonate", s.handleEndImpersonation)
+	s.Mux.Handle("GET /api/admin/impersonations", auth(s.handleImpersonations))
+	s.Mux.Handle("POST /api/admin/users/{username}/roles", auth(s.handleSetRoles))
 	if tmplDir != "" {
 		if tmpl, err := template.ParseGlob(filepath.Join(tmplDir, "*")); err == nil {
+			s.templates = tmpl
 			for _, t := range tmpl.Templates() {
+				if strings.HasPrefix(t.Name(), "_") {
+					continue // partials are rendered via /partials/
+				}
 				if t.Name() == "index.html" {
 					s.Mux.Handle("GET /", s.handleTemplate(t, "index.html"))
 				}
@@ -608,130 +2585,676 @@ func NewServer(dataDir, tmplDir, staticDir string) (*Server, error) {
 	return s, nil
 }
 
-func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) { s.Mux.ServeHTTP(w, r) }
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.MaxBodySize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, s.MaxBodySize)
+	}
+	// Event streams last long and would hold off Store.ReloadSchemas
+	if !strings.HasPrefix(r.URL.Path, "/api/events/") {
+		s.Store.schemaMu.RLock()
+		defer s.Store.schemaMu.RUnlock()
+	}
+	s.Mux.ServeHTTP(w, r)
+}
 
-func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
-	res, err := s.Store.List(r.PathValue("resource"), r.FormValue("sort_by"))
+// authorize checks permissions like Store.Authorize, additionally requiring the
+// admin role for system resources such as _users and _permissions, so that a
+// loose permission row can't be used to grant oneself privileges.
+func (s *Server) authorize(ctx context.Context, resource, id, action string, user Resource) error {
+	if err := s.Store.authorize(ctx, resource, id, action, user); err != nil {
+		return err
+	}
+	if strings.HasPrefix(resource, "_") && !hasRole(user, s.AdminRole) {
+		return newError("admin_required")
+	}
+	return nil
+}
+
+func hasRole(user Resource, role string) bool {
+	roles, _ := user["roles"].([]string)
+	return role != "" && slices.Contains(roles, role)
+}
+
+// validatePath rejects requests whose {resource} or {id} path values are
+// malformed with 400 Bad Request, before they reach the store.
+func (s *Server) validatePath(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if resource := r.PathValue("resource"); resource != "" && !ResourcePattern.MatchString(resource) {
+			s.WriteError(w, r, http.StatusBadRequest, newError("invalid_path", "param", "resource"))
+			return
+		}
+		if id := r.PathValue("id"); id != "" && s.IDPattern != nil && !s.IDPattern.MatchString(id) {
+			s.WriteError(w, r, http.StatusBadRequest, newError("invalid_path", "param", "id"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// auth authenticates the request and checks that the user may perform the
+// action on the {resource} and {id} of the route. An empty action is derived
+// from the request method. With KnownOnly, resources without a schema are
+// answered with 404 first, including those of HandleAPI endpoints.
+func (s *Server) auth(action string, next http.HandlerFunc) http.Handler {
+	return s.validatePath(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resource, action := r.PathValue("resource"), action
+		if action == "" {
+			action = map[string]string{"GET": "read", "POST": "create", "PUT": "update", "DELETE": "delete"}[r.Method]
+		}
+		ctx, end := s.Store.span(r.Context(), "http "+r.Pattern, Attr{"resource", resource}, Attr{"action", action}, Attr{"id", r.PathValue("id")})
+		var err error
+		defer func() { end(err) }()
+		if _, ok := s.Store.Schemas[resource]; s.KnownOnly && resource != "" && !ok {
+			err = newError("resource_not_found", "resource", resource)
+			s.WriteError(w, r, http.StatusNotFound, err)
+			return
+		}
+		if s.ReadOnly && resource != "" && r.Method != http.MethodGet {
+			err = newError("read_only")
+			s.WriteError(w, r, http.StatusMethodNotAllowed, err)
+			return
+		}
+		user, _ := s.Store.authenticate(ctx, r, s.session())
+		if err = s.logImpersonation(r, user); err != nil {
+			s.WriteError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		if resource != "" && action != "" {
+			if err = s.authorize(ctx, resource, r.PathValue("id"), action, user); err != nil {
+				status := http.StatusUnauthorized
+				if errors.Is(err, ErrClosed) {
+					status = http.StatusServiceUnavailable
+				}
+				s.WriteError(w, r, status, err)
+				return
+			}
+			if r.Method != http.MethodGet {
+				var ok bool
+				if w, ok = s.checkQuota(w, r.WithContext(ctx), resource, action, user); !ok {
+					return
+				}
+			}
+		}
+		next(w, r.WithContext(context.WithValue(ctx, "user", user)))
+	}))
+}
+
+// HandleAPI registers a custom endpoint behind the standard authentication
+// and authorization: the user must be allowed to perform the action on the
+// resource and the {id} (if any) of the pattern. The resource is the {resource}
+// wildcard, or else the path segment following /api/, e.g.
+//
+//	s.HandleAPI("POST /api/orders/{id}/checkout", "checkout", h)
+//
+// Permission rows for the action (or "*") are enforced like for built-in CRUD.
+// Use CurrentUser to get the authenticated user inside the handler.
+func (s *Server) HandleAPI(pattern, action string, h http.HandlerFunc) {
+	handler := s.auth(action, h)
+	if !strings.Contains(pattern, "{resource}") {
+		_, path, _ := strings.Cut(pattern, "/api/")
+		resource, _, _ := strings.Cut(path, "/")
+		next := handler
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.SetPathValue("resource", resource)
+			next.ServeHTTP(w, r)
+		})
+	}
+	s.Mux.Handle(pattern, handler)
+}
+
+// CurrentUser returns the user authenticated by the API middleware, or nil.
+func CurrentUser(r *http.Request) Resource {
+	user, _ := r.Context().Value("user").(Resource)
+	return user
+}
+
+// WriteJSON writes v as a JSON response with the given status code.
+func WriteJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// WriteError writes err as a plain-text error response. Use Server.WriteError
+// to translate coded errors and honor clients accepting JSON.
+func WriteError(w http.ResponseWriter, status int, err error) {
+	http.Error(w, err.Error(), status)
+}
+
+// Touch is Store.Touch that also sends an "updated" event to the subscribers
+// of the resource.
+func (s *Server) Touch(resource, id string) error {
+	if err := s.Store.Touch(resource, id); err != nil {
+		return err
+	}
+	res, err := s.Store.Get(resource, id)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+	s.Broker.Publish(resource, Event{Action: "updated", ID: res["_id"].(string), Data: s.view(resource, res), Seq: s.Store.ChangeSeq(resource)})
+	return nil
+}
+
+// Publish sends an event about the record to the subscribers of the resource
+// and tells HTMX clients that the resource has changed.
+func (s *Server) Publish(w http.ResponseWriter, resource, action string, res Resource) {
+	id, _ := res["_id"].(string)
+	s.Broker.Publish(resource, Event{Action: action, ID: id, Data: s.view(resource, res), Seq: s.Store.ChangeSeq(resource)})
+	w.Header().Set("HX-Trigger", fmt.Sprintf("%s-changed", resource))
+}
+
+// requireRead guards handlers that have no {resource} in their route.
+func (s *Server) requireRead(resource string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := s.authorize(r.Context(), resource, "", "read", CurrentUser(r)); err != nil {
+			s.WriteError(w, r, http.StatusUnauthorized, err)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (s *Server) hook(ctx context.Context, trigger, resource string, res Resource) (err error) {
+	_, end := s.Store.span(ctx, "hook", Attr{"trigger", trigger}, Attr{"resource", resource})
+	defer func() { end(err) }()
+	return s.Hook(trigger, resource, ctx.Value("user").(Resource), res)
+}
+
+// afterHook calls AfterHook with the record as stored (a deleted record as it
+// was), after the event has been published. Its error is only logged, since
+// the write can't be undone.
+func (s *Server) afterHook(ctx context.Context, trigger, resource string, res Resource) {
+	_, end := s.Store.span(ctx, "after_hook", Attr{"trigger", trigger}, Attr{"resource", resource})
+	err := s.AfterHook(trigger, resource, ctx.Value("user").(Resource), res)
+	if end(err); err != nil {
+		log.Printf("after hook: %s %s/%v: %v", trigger, resource, res["_id"], err)
+	}
+}
+
+func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
+	if s.notModified(w, r, r.PathValue("resource")) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	res, ok := s.query(w, r)
+	if !ok || !s.expandCounts(w, r, res...) {
+		return
+	}
+	schema := s.Store.Schemas[r.PathValue("resource")]
+	out := make([]any, len(res))
+	for i := range res {
+		out[i] = s.ordered(r, schema.flatten(res[i]))
+	}
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+// handleStream writes all records of a resource as newline-delimited JSON,
+// see Store.Stream.
+func (s *Server) handleStream(w http.ResponseWriter, r *http.Request) {
+	resource := r.PathValue("resource")
+	if _, ok := s.Store.Resources[resource]; !ok {
+		s.WriteError(w, r, http.StatusNotFound, newError("resource_not_found", "resource", resource))
 		return
 	}
-	_ = json.NewEncoder(w).Encode(res)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	if err := s.Store.stream(r.Context(), resource, w, func(res Resource) Resource { return s.view(resource, res) }); err != nil {
+		log.Printf("stream %s: %v", resource, err) // the status is already sent
+	}
+}
+
+// notModified sets the ETag and Last-Modified headers of a list response,
+// derived from the resource change counter, and reports whether the client
+// copy is still fresh. The ETag also depends on the query parameters.
+func (s *Server) notModified(w http.ResponseWriter, r *http.Request, resource string) bool {
+	h := fnv.New32a()
+	h.Write([]byte(r.URL.RawQuery))
+	// Related counts change with the counted resources
+	for _, spec := range countSpecs(r) {
+		counted, _, _ := strings.Cut(spec, ".")
+		fmt.Fprint(h, s.Store.ChangeSeq(counted))
+	}
+	etag := fmt.Sprintf(`"%d-%x"`, s.Store.ChangeSeq(resource), h.Sum32())
+	w.Header().Set("ETag", etag)
+	modified := s.Store.lastModified(resource)
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		return strings.Contains(match, etag)
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	return err == nil && !modified.IsZero() && !modified.Truncate(time.Second).After(since)
+}
+
+// query lists the records of the requested resource, applying the "since",
+// "sort_by", "order", "offset" and "limit" query parameters, filters by the
+// query parameters named after fields (see Store.ListWhere) and the
+// MaxListItems cap. The number of records before paging is sent in the
+// X-Total-Count header. On failure it writes the error response.
+func (s *Server) query(w http.ResponseWriter, r *http.Request) ([]Resource, bool) {
+	var res []Resource
+	var err error
+	if since := r.FormValue("since"); since != "" {
+		v, perr := strconv.ParseFloat(since, 64)
+		if perr != nil {
+			s.WriteError(w, r, http.StatusBadRequest, newError("invalid_since"))
+			return nil, false
+		}
+		res, err = s.Store.ListSince(r.PathValue("resource"), v)
+	} else {
+		sortBy := r.FormValue("sort_by")
+		if r.FormValue("order") == "desc" && !strings.HasPrefix(sortBy, "-") {
+			sortBy = "-" + sortBy
+		}
+		res, err = s.Store.listWhere(r.Context(), r.PathValue("resource"), sortBy, s.filter(r))
+	}
+	if errors.Is(err, ErrInvalidField) {
+		s.WriteError(w, r, http.StatusBadRequest, err)
+		return nil, false
+	} else if err != nil {
+		s.WriteError(w, r, http.StatusInternalServerError, err)
+		return nil, false
+	}
+	offset, limit := 0, 0
+	for name, p := range map[string]*int{"offset": &offset, "limit": &limit} {
+		if v := r.FormValue(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				s.WriteError(w, r, http.StatusBadRequest, newError("invalid_page"))
+				return nil, false
+			}
+			*p = n
+		}
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(len(res)))
+	size := limit
+	if s.MaxListItems > 0 && (size == 0 || size > s.MaxListItems) {
+		size = s.MaxListItems
+	}
+	if links := pageLinks(r.URL, offset, size, len(res)); links != "" {
+		w.Header().Set("Link", links)
+	}
+	res = page(res, offset, limit)
+	if s.MaxListItems > 0 && len(res) > s.MaxListItems {
+		res = res[:s.MaxListItems]
+		w.Header().Set("X-Truncated", "true")
+	}
+	for i := range res {
+		res[i] = s.view(r.PathValue("resource"), res[i])
+	}
+	return res, true
+}
+
+// pageLinks returns a Link header value (RFC 8288) with the "first", "prev",
+// "next" and "last" pages of a list of total records, given the offset and
+// the page size, or "" if the list isn't paged. The links are the request
+// path and query with other offset and limit parameters.
+func pageLinks(u *url.URL, offset, size, total int) string {
+	if size <= 0 {
+		return ""
+	}
+	link := func(rel string, offset int) string {
+		q := u.Query()
+		q.Set("offset", strconv.Itoa(offset))
+		q.Set("limit", strconv.Itoa(size))
+		return fmt.Sprintf(`<%s?%s>; rel="%s"`, u.Path, q.Encode(), rel)
+	}
+	links := []string{link("first", 0)}
+	if offset > 0 {
+		links = append(links, link("prev", max(offset-size, 0)))
+	}
+	if offset+size < total {
+		links = append(links, link("next", offset+size))
+	}
+	return strings.Join(append(links, link("last", max(total-1, 0)/size*size)), ", ")
+}
+
+// filter returns the query parameters named after fields of the resource, see
+// Store.ListWhere.
+func (s *Server) filter(r *http.Request) map[string]string {
+	filter, q := map[string]string{}, r.URL.Query()
+	for _, field := range s.Store.Schemas[r.PathValue("resource")] {
+		if q.Has(field.Field) {
+			filter[field.Field] = q.Get(field.Field)
+		}
+	}
+	return filter
+}
+
+// view returns a record as sent to clients. The password hashes and salts of
+// users are removed, and with HasPassword a "has_password" flag tells whether
+// a user has a password at all, e.g. for accounts signed in otherwise.
+func (s *Server) view(resource string, res Resource) Resource {
+	if resource != "_users" || res == nil {
+		return res
+	}
+	res = maps.Clone(res)
+	if s.HasPassword {
+		res["has_password"] = res["password"] != nil && res["password"] != ""
+	}
+	delete(res, "password")
+	delete(res, "salt")
+	return res
 }
 
 func (s *Server) handleCreate(w http.ResponseWriter, r *http.Request) {
 	var res Resource
 	if err := json.NewDecoder(r.Body).Decode(&res); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		s.WriteError(w, r, http.StatusBadRequest, err)
 		return
 	}
 	resource := r.PathValue("resource")
-	if err := s.Hook("create", resource, r.Context().Value("user").(Resource), res); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if !s.checkFields(w, r, resource, res) {
+		return
+	}
+	if err := s.hook(r.Context(), "create", resource, res); err != nil {
+		s.WriteError(w, r, http.StatusInternalServerError, err)
 		return
 	}
-	id, err := s.Store.Create(resource, res)
+	var id string
+	var err error
+	if resource == "_users" {
+		// Users are created with a hashed password, never with a raw one
+		username, _ := res["username"].(string)
+		password, _ := res["password"].(string)
+		roles := []string{}
+		if list, ok := res["roles"].([]any); ok {
+			for _, role := range list {
+				roles = append(roles, fmt.Sprint(role))
+			}
+		}
+		id, err = username, s.Store.createUser(r.Context(), username, password, roles)
+		res = Resource{"_id": username, "_v": 1.0, "roles": roles, "_tmp_id": res["_tmp_id"]}
+	} else {
+		id, err = s.Store.create(r.Context(), resource, res, CurrentUser(r))
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		s.WriteError(w, r, errorStatus(err), err)
 		return
 	}
-	s.Broker.Publish(resource, Event{Action: "created", ID: res["_id"].(string), Data: res})
+	// Offline clients send a temporary id and swap it for the assigned one
+	tmpID, _ := res["_tmp_id"].(string)
+	if tmpID == "" {
+		delete(res, "_tmp_id")
+	}
+	s.Publish(w, resource, "created", res)
+	s.afterHook(r.Context(), "create", resource, res)
 	w.Header().Set("Location", fmt.Sprintf("/api/%s/%s", resource, id))
-	w.Header().Set("HX-Trigger", fmt.Sprintf("%s-changed", resource))
+	if tmpID != "" {
+		WriteJSON(w, http.StatusCreated, map[string]string{"_id": id, "_tmp_id": tmpID})
+		return
+	}
 	w.WriteHeader(http.StatusCreated)
 }
 
+// errorStatus returns the response status for an error reading or writing a
+// record.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrResourceNotFound), errors.Is(err, ErrRecordNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrVersionConflict), errors.Is(err, ErrReferenced), errors.Is(err, ErrDuplicate):
+		return http.StatusConflict
+	case errors.Is(err, ErrInvalidField), errors.Is(err, ErrRequiredField), errors.Is(err, ErrReferenceNotFound):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, ErrInvalidRecord):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrClosed):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
 func (s *Server) handleGet(w http.ResponseWriter, r *http.Request) {
-	res, err := s.Store.Get(r.PathValue("resource"), r.PathValue("id"))
+	res, err := s.Store.get(r.Context(), r.PathValue("resource"), r.PathValue("id"))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		s.WriteError(w, r, errorStatus(err), err)
 		return
 	}
-	if res == nil {
-		http.NotFound(w, r)
+	if !s.expandCounts(w, r, res) {
 		return
 	}
-	_ = json.NewEncoder(w).Encode(res)
+	_ = json.NewEncoder(w).Encode(s.ordered(r, s.view(r.PathValue("resource"), res)))
 }
 
 func (s *Server) handleUpdate(w http.ResponseWriter, r *http.Request) {
 	res := Resource{}
 	if err := json.NewDecoder(r.Body).Decode(&res); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		s.WriteError(w, r, http.StatusBadRequest, err)
 		return
 	}
 	resource := r.PathValue("resource")
+	if !s.checkFields(w, r, resource, res) {
+		return
+	}
 	res["_id"] = r.PathValue("id")
-	if err := s.Hook("update", resource, r.Context().Value("user").(Resource), res); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if password, ok := res["password"].(string); ok && resource == "_users" {
+		res["salt"] = Salt()
+		res["password"] = HashPasswd(password, res["salt"].(string))
+	}
+	if err := s.hook(r.Context(), "update", resource, res); err != nil {
+		s.WriteError(w, r, http.StatusInternalServerError, err)
 		return
 	}
-	if err := s.Store.Update(resource, res); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := s.Store.update(r.Context(), resource, res); err != nil {
+		var current Resource
+		if errors.Is(err, ErrVersionConflict) {
+			current, _ = s.Store.get(r.Context(), resource, r.PathValue("id"))
+		}
+		s.writeError(w, r, errorStatus(err), err, s.view(resource, current))
 		return
 	}
-	s.Broker.Publish(resource, Event{Action: "updated", ID: res["_id"].(string), Data: res})
-	w.Header().Set("HX-Trigger", fmt.Sprintf("%s-changed", resource))
+	s.Publish(w, resource, "updated", res)
+	s.afterHook(r.Context(), "update", resource, res)
 	w.WriteHeader(http.StatusOK)
 }
 
+// checkFields responds with 400 if the server is strict and the body has keys
+// that are not in the resource schema.
+func (s *Server) checkFields(w http.ResponseWriter, r *http.Request, resource string, res Resource) bool {
+	if err := s.unknownFields(resource, res); err != nil {
+		s.WriteError(w, r, http.StatusBadRequest, err)
+		return false
+	}
+	return true
+}
+
+// unknownFields returns an error listing the fields of res missing from the
+// schema, in strict mode.
+func (s *Server) unknownFields(resource string, res Resource) error {
+	if !s.Strict {
+		return nil
+	}
+	known := map[string]bool{"_id": true, "_v": true, "_partial": true, "_extra": true, "_tmp_id": true}
+	for _, f := range s.Store.Schemas[resource] {
+		known[f.Field] = true
+	}
+	if resource == "_users" {
+		known["username"] = true // users are created by username
+	}
+	unknown := []string{}
+	for k := range res {
+		if !known[k] {
+			unknown = append(unknown, k)
+		}
+	}
+	if len(unknown) > 0 {
+		slices.Sort(unknown)
+		return newError("unknown_fields", "fields", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
 func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
-	res, _ := s.Store.Get(r.PathValue("resource"), r.PathValue("id"))
-	if err := s.Hook("delete", r.PathValue("resource"), r.Context().Value("user").(Resource), res); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	res, err := s.Store.get(r.Context(), r.PathValue("resource"), r.PathValue("id"))
+	if err != nil {
+		s.WriteError(w, r, errorStatus(err), err)
+		return
+	}
+	if err := s.hook(r.Context(), "delete", r.PathValue("resource"), res); err != nil {
+		s.WriteError(w, r, http.StatusInternalServerError, err)
 		return
 	}
-	if err := s.Store.Delete(r.PathValue("resource"), r.PathValue("id")); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	cascaded, err := s.Store.delete(r.Context(), r.PathValue("resource"), r.PathValue("id"))
+	if err != nil {
+		s.WriteError(w, r, errorStatus(err), err)
 		return
 	}
-	s.Broker.Publish(r.PathValue("resource"), Event{Action: "deleted", Data: res})
-	w.Header().Set("HX-Trigger", fmt.Sprintf("%s-changed", r.PathValue("resource")))
+	for _, c := range cascaded {
+		s.Publish(w, c.Resource, c.Action+"d", c.Data)
+	}
+	s.Publish(w, r.PathValue("resource"), "deleted", res)
+	s.afterHook(r.Context(), "delete", r.PathValue("resource"), res)
 	w.WriteHeader(http.StatusOK)
 }
 
+// Authenticate returns the user of a request signed in with a session cookie
+// (see the Session* settings) or with basic auth.
+func (s *Server) Authenticate(r *http.Request) (Resource, error) {
+	return s.Store.authenticate(r.Context(), r, s.session())
+}
+
+func (s *Server) session() sessionConfig {
+	return sessionConfig{cmp.Or(s.SessionCookie, "session"), cmp.Or(s.SessionKey, SessionKey), cmp.Or(s.SessionTTL, 24*time.Hour)}
+}
+
 func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 	username, password := r.FormValue("username"), r.FormValue("password")
 	if _, err := s.Store.AuthenticateBasic(username, password); err != nil {
-		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		s.WriteError(w, r, http.StatusUnauthorized, newError("invalid_credentials"))
 		return
 	}
+	s.setSession(w, signSession(s.session().key, username))
+	target := r.FormValue("redirect")
+	if target == "" {
+		target = r.FormValue("next")
+	}
+	w.Header().Set("HX-Redirect", localPath(target))
+	w.WriteHeader(http.StatusOK)
+}
+
+// localPath returns the target if it is a path on this server, e.g.
+// "/books?page=2", and "/" otherwise, so that redirects can't lead to other
+// sites. Absolute URLs and network-path references ("//host", and "/\host"
+// which browsers read alike) are rejected, and so are control characters,
+// which browsers strip.
+func localPath(target string) string {
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || strings.HasPrefix(target, "/\\") {
+		return "/"
+	}
+	if strings.ContainsFunc(target, unicode.IsControl) {
+		return "/"
+	}
+	if u, err := url.Parse(target); err != nil || u.Scheme != "" || u.Host != "" {
+		return "/"
+	}
+	return target
+}
+
+func (s *Server) setSession(w http.ResponseWriter, value string) {
+	sess := s.session()
 	http.SetCookie(w, &http.Cookie{
-		Name:     "session",
-		Value:    SignSession(username),
+		Name:     sess.cookie,
+		Value:    value,
 		Path:     "/",
 		HttpOnly: true,
+		Secure:   s.SecureCookie,
 		SameSite: http.SameSiteStrictMode,
-		MaxAge:   86400, // 24 hours
+		MaxAge:   int(sess.ttl.Seconds()),
 	})
-	w.Header().Set("HX-Redirect", "/")
-	w.WriteHeader(http.StatusOK)
 }
 
 func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
-	http.SetCookie(w, &http.Cookie{Name: "session", Value: "", Path: "/", HttpOnly: true, MaxAge: -1})
+	http.SetCookie(w, &http.Cookie{Name: s.session().cookie, Value: "", Path: "/", HttpOnly: true, Secure: s.SecureCookie, MaxAge: -1})
 	w.Header().Set("HX-Redirect", "/")
 	w.WriteHeader(http.StatusOK)
 }
 
+func (s *Server) handleMyResources(w http.ResponseWriter, r *http.Request) {
+	user := CurrentUser(r)
+	_ = json.NewEncoder(w).Encode(s.Store.accessibleResources(r.Context(), user, s.authorize))
+}
+
 func (s *Server) handleTemplate(tmpl *template.Template, name string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		user, _ := s.Store.Authenticate(r)
-		data := map[string]any{
-			"Store":   s.Store,
-			"Request": r,
-			"User":    user,
-			"ID":      r.URL.Query().Get("_id"),
-			"Authorize": func(resource, id, action string) bool {
-				return s.Store.Authorize(resource, id, action, user) == nil
-			},
-		}
-		if err := tmpl.ExecuteTemplate(w, name, data); err != nil {
+		for _, asset := range s.Preload[name] {
+			w.Header().Add("Link", preloadLink(asset))
+		}
+		user, _ := s.Authenticate(r)
+		if err := tmpl.ExecuteTemplate(w, name, s.templateData(r, user)); err != nil {
 			log.Println("Error executing template:", name, err)
 		}
 	}
 }
 
+func (s *Server) templateData(r *http.Request, user Resource) map[string]any {
+	return map[string]any{
+		"Store":   s.Store,
+		"Request": r,
+		"User":    user,
+		"ID":      r.URL.Query().Get("_id"),
+		"Authorize": func(resource, id, action string) bool {
+			return s.authorize(r.Context(), resource, id, action, user) == nil
+		},
+		// {{call .RelatedCount "books" "author" .Record._id}}
+		"RelatedCount": func(resource, field, id string) (int, error) {
+			if err := s.authorize(r.Context(), resource, "", "read", user); err != nil {
+				return 0, err
+			}
+			return s.Store.RelatedCount(resource, field, id)
+		},
+	}
+}
+
+// handlePartial renders a single record with the "_{resource}.html" template,
+// or a list of records with "_{resource}_list.html", as .Record or .Records.
+func (s *Server) handlePartial(w http.ResponseWriter, r *http.Request) {
+	resource, id := r.PathValue("resource"), r.PathValue("id")
+	name := "_" + resource + "_list.html"
+	if id != "" {
+		name = "_" + resource + ".html"
+	}
+	if s.templates == nil || s.templates.Lookup(name) == nil {
+		http.NotFound(w, r)
+		return
+	}
+	data := s.templateData(r, CurrentUser(r))
+	if id != "" {
+		res, err := s.Store.get(r.Context(), resource, id)
+		if err != nil || res == nil {
+			http.NotFound(w, r)
+			return
+		}
+		data["Record"] = s.view(resource, res)
+	} else {
+		res, ok := s.query(w, r)
+		if !ok {
+			return
+		}
+		data["Records"] = res
+	}
+	if err := s.templates.ExecuteTemplate(w, name, data); err != nil {
+		log.Println("Error executing template:", name, err)
+	}
+}
+
+func preloadLink(asset string) string {
+	link := fmt.Sprintf("<%s>; rel=preload", asset)
+	switch strings.ToLower(filepath.Ext(strings.SplitN(asset, "?", 2)[0])) {
+	case ".css":
+		link += "; as=style"
+	case ".js", ".mjs":
+		link += "; as=script"
+	case ".woff", ".woff2", ".ttf", ".otf":
+		link += "; as=font; crossorigin"
+	case ".png", ".jpg", ".jpeg", ".gif", ".svg", ".webp", ".avif", ".ico":
+		link += "; as=image"
+	default:
+		link += "; as=fetch; crossorigin"
+	}
+	return link
+}
+
 func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
 	flusher, ok := w.(http.Flusher)
 	if !ok {
@@ -742,20 +3265,44 @@ func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
 	resource := r.PathValue("resource")
-	user, err := s.Store.Authenticate(r)
+	user, err := s.Authenticate(r)
 	if err != nil {
-		http.Error(w, "unauthenticated", http.StatusUnauthorized)
+		s.WriteError(w, r, http.StatusUnauthorized, newError("unauthenticated"))
 		return
 	}
 	events := make(chan Event, 10)
 	s.Broker.Subscribe(resource, events)
 	defer s.Broker.Unsubscribe(resource, events)
+	send := func(e Event) {
+		// Deleted records can't be checked for ownership, but system
+		// resources still require the admin role
+		err := s.authorize(r.Context(), resource, e.ID, "read", user)
+		if err == nil || e.Action == "deleted" && !errors.Is(err, &Error{Code: "admin_required"}) {
+			data, _ := json.Marshal(e.Data)
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Seq, e.Action, data)
+		}
+	}
+	// Reconnecting clients get the changes they missed, or a "reset" event if
+	// those are no longer retained and the client has to reload the resource
+	var last int64
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		last, _ = strconv.ParseInt(id, 10, 64)
+		changes, ok := s.Store.resourceChanges(resource, last)
+		if !ok {
+			last = s.Store.ChangeSeq(resource)
+			fmt.Fprintf(w, "id: %d\nevent: reset\ndata: {}\n\n", last)
+		}
+		for _, c := range changes {
+			send(s.changeEvent(resource, c))
+			last = c.ResourceSeq
+		}
+	}
+	flusher.Flush()
 	for {
 		select {
 		case e := <-events:
-			if e.Action == "delete" || s.Store.Authorize(resource, e.ID, "read", user) == nil {
-				data, _ := json.Marshal(e.Data)
-				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Action, data)
+			if e.Seq > last {
+				send(e)
 				flusher.Flush()
 			}
 		case <-r.Context().Done():
@@ -763,3 +3310,18 @@ func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 }
+
+// changeEvent converts a logged change to the event published for it.
+func (s *Server) changeEvent(resource string, c Change) Event {
+	e := Event{Action: "updated", ID: c.Record[0], Seq: c.ResourceSeq}
+	switch c.Record[1] {
+	case "0":
+		e.Action, e.Data = "deleted", Resource{"_id": c.Record[0]}
+		return e
+	case "1":
+		e.Action = "created"
+	}
+	res, _ := s.Store.resource(resource, c.Record)
+	e.Data = s.view(resource, res)
+	return e
+}
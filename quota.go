@@ -0,0 +1,256 @@
+package pennybase
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// quotaRule is a row of the _quotas resource: at most limit writes of the
+// action on the resource within the sliding window, counted per user if the
+// scope is "user" and for all matching users together otherwise.
+type quotaRule struct {
+	id, resource, action, role string
+	perUser                    bool
+	window                     time.Duration
+	limit                      int
+}
+
+// quotaWindow holds the times of the counted writes, oldest first.
+type quotaWindow struct {
+	Window time.Duration `json:"window"`
+	Times  []time.Time   `json:"times"`
+}
+
+// quotas tracks writes in memory. The windows are saved to the storage
+// periodically and on Close, so that restarts don't reset daily quotas.
+type quotas struct {
+	clock    clock
+	mu       sync.Mutex
+	windows  map[string]*quotaWindow // quota id + "/" + user id (or "" for total quotas)
+	rejected map[string]int64        // quota id -> number of rejected writes
+}
+
+const quotaStateFile = "_quotas.json"
+
+func newQuotas(c clock) *quotas {
+	return &quotas{clock: c, windows: map[string]*quotaWindow{}, rejected: map[string]int64{}}
+}
+
+// allow checks the rules matching the write and, if none of them is
+// exceeded, counts the write against all of them and returns a function that
+// takes it back, or nil if no rule matched. Otherwise it returns the exceeded
+// rule and when a write will be allowed again.
+func (q *quotas) allow(rules []quotaRule, resource, action string, user Resource) (string, time.Time, func(), bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := q.clock.Now()
+	userID, _ := user["_id"].(string)
+	matched := []*quotaWindow{}
+	for _, rule := range rules {
+		if rule.resource != resource || (rule.action != "*" && rule.action != action) ||
+			(rule.role != "" && rule.role != "*" && !hasRole(user, rule.role)) {
+			continue
+		}
+		key := rule.id + "/"
+		if rule.perUser {
+			key += userID
+		}
+		w := q.windows[key]
+		if w == nil {
+			w = &quotaWindow{}
+			q.windows[key] = w
+		}
+		w.Window = rule.window
+		w.prune(now)
+		if len(w.Times) >= rule.limit {
+			q.rejected[rule.id]++
+			if len(w.Times) == 0 {
+				return rule.id, now.Add(rule.window), nil, false
+			}
+			return rule.id, w.Times[len(w.Times)-rule.limit].Add(rule.window), nil, false
+		}
+		matched = append(matched, w)
+	}
+	if len(matched) == 0 {
+		return "", time.Time{}, nil, true
+	}
+	for _, w := range matched {
+		w.Times = append(w.Times, now)
+	}
+	refund := func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		for _, w := range matched {
+			if i := slices.IndexFunc(w.Times, now.Equal); i >= 0 {
+				w.Times = slices.Delete(w.Times, i, i+1)
+			}
+		}
+	}
+	return "", time.Time{}, refund, true
+}
+
+func (w *quotaWindow) prune(now time.Time) {
+	i := 0
+	for i < len(w.Times) && !w.Times[i].After(now.Add(-w.Window)) {
+		i++
+	}
+	w.Times = w.Times[i:]
+}
+
+func (q *quotas) rejections() map[string]int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	m := map[string]int64{}
+	for id, n := range q.rejected {
+		m[id] = n
+	}
+	return m
+}
+
+// save writes the unexpired windows to a temporary file and renames it over
+// the state file.
+func (q *quotas) save(st Storage) error {
+	q.mu.Lock()
+	now := q.clock.Now()
+	for key, w := range q.windows {
+		if w.prune(now); len(w.Times) == 0 {
+			delete(q.windows, key)
+		}
+	}
+	data, err := json.Marshal(q.windows)
+	q.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := quotaStateFile + ".tmp"
+	_ = st.Remove(tmp)
+	f, err := st.Open(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if f, ok := f.(interface{ Sync() error }); ok {
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return st.Rename(tmp, quotaStateFile)
+}
+
+func (q *quotas) load(st Storage) error {
+	names, err := st.List()
+	if err != nil || !slices.Contains(names, quotaStateFile) {
+		return err
+	}
+	f, err := st.Open(quotaStateFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	size, err := f.Size()
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(io.NewSectionReader(f, 0, size))
+	if err != nil {
+		return err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return json.Unmarshal(data, &q.windows)
+}
+
+// quotaRules reads the _quotas resource, skipping invalid rows.
+func (s *Server) quotaRules(ctx context.Context) ([]quotaRule, error) {
+	if _, ok := s.Store.Resources["_quotas"]; !ok {
+		return nil, nil
+	}
+	rows, err := s.Store.list(ctx, "_quotas", "")
+	if err != nil {
+		return nil, err
+	}
+	rules := []quotaRule{}
+	for _, row := range rows {
+		rule := quotaRule{}
+		rule.id, _ = row["_id"].(string)
+		rule.resource, _ = row["resource"].(string)
+		rule.action, _ = row["action"].(string)
+		rule.role, _ = row["role"].(string)
+		scope, _ := row["scope"].(string)
+		rule.perUser = scope == "user"
+		window, _ := row["window"].(string)
+		limit, _ := row["limit"].(float64)
+		rule.limit = int(limit)
+		if rule.window, err = time.ParseDuration(window); err != nil || rule.window <= 0 || rule.limit < 0 {
+			log.Printf("quotas: invalid row %s: window %q, limit %v", rule.id, window, limit)
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// checkQuota counts a write against the _quotas rules. Users with the admin
+// role are not limited. If a quota is exceeded, it writes 429 Too Many
+// Requests with the reset time and reports false. Otherwise it returns the
+// writer for the handler, which takes the write back if the handler responds
+// with an error, so that failed writes don't use up the quota.
+func (s *Server) checkQuota(w http.ResponseWriter, r *http.Request, resource, action string, user Resource) (http.ResponseWriter, bool) {
+	if hasRole(user, s.AdminRole) {
+		return w, true
+	}
+	rules, err := s.quotaRules(r.Context())
+	if err != nil {
+		s.WriteError(w, r, http.StatusInternalServerError, err)
+		return w, false
+	}
+	id, reset, refund, ok := s.quotas.allow(rules, resource, action, user)
+	if !ok {
+		wait := reset.Sub(s.quotas.clock.Now()).Seconds()
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(max(wait, 1)))))
+		s.WriteError(w, r, http.StatusTooManyRequests, newError("quota_exceeded", "quota", id, "reset", reset.UTC().Format(time.RFC3339)))
+		return w, false
+	}
+	if refund == nil {
+		return w, true
+	}
+	return &quotaWriter{ResponseWriter: w, refund: refund}, true
+}
+
+// quotaWriter calls refund if the response status is an error.
+type quotaWriter struct {
+	http.ResponseWriter
+	refund func()
+	wrote  bool
+}
+
+func (w *quotaWriter) WriteHeader(code int) {
+	if !w.wrote && code >= http.StatusBadRequest {
+		w.refund()
+	}
+	w.wrote = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *quotaWriter) Write(p []byte) (int, error) {
+	if !w.wrote {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *quotaWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
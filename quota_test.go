@@ -0,0 +1,166 @@
+package pennybase
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const quotaSchemas = `q1,1,_quotas,_id,text,,,^.+$
+q2,1,_quotas,_v,number,1,,
+q3,1,_quotas,resource,text,,,^.+$
+q4,1,_quotas,action,text,,,^.+$
+q5,1,_quotas,role,text,,,
+q6,1,_quotas,scope,text,,,
+q7,1,_quotas,window,text,,,^.+$
+q8,1,_quotas,limit,number,0,,
+`
+
+func quotaServer(t *testing.T, dir string, c clock) *Server {
+	t.Helper()
+	s := must(NewServer(dir, "", "")).T(t)
+	s.quotas.clock = c
+	return s
+}
+
+func TestServerQuotas(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "rest"))
+	f := must(os.OpenFile(filepath.Join(dir, "_schemas.csv"), os.O_APPEND|os.O_WRONLY, 0o644)).T(t)
+	must(f.WriteString(quotaSchemas)).T(t)
+	must0(t, f.Close())
+	must0(t, os.WriteFile(filepath.Join(dir, "_quotas.csv"), []byte("daily,1,books,create,,user,24h,2\n"), 0o644))
+
+	start := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	c := newFakeClock(start)
+	s := quotaServer(t, dir, c)
+
+	create := func(user string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/books/", strings.NewReader(`{"title":"Book","author":"Me","year":2000}`))
+		req.SetBasicAuth(user, map[string]string{"admin": "admin123", "user1": "user1pass"}[user])
+		req.Header.Set("Accept", "application/json")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w
+	}
+	for i := range 2 {
+		if w := create("user1"); w.Code != http.StatusCreated {
+			t.Fatalf("create %d: got %d %s", i, w.Code, w.Body)
+		}
+		c.Advance(time.Hour)
+	}
+	w := create("user1")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("got %d, want 429", w.Code)
+	}
+	var resp errorResponse
+	must0(t, json.NewDecoder(w.Body).Decode(&resp))
+	wantReset := start.Add(24 * time.Hour).Format(time.RFC3339)
+	if resp.Error.Code != "quota_exceeded" || resp.Error.Params["quota"] != "daily" || resp.Error.Params["reset"] != wantReset {
+		t.Errorf("got %+v", resp.Error)
+	}
+	if got := w.Header().Get("Retry-After"); got != "79200" {
+		t.Errorf("got Retry-After %q", got)
+	}
+	// Admins are not limited
+	for range 3 {
+		if w := create("admin"); w.Code != http.StatusCreated {
+			t.Errorf("admin: got %d %s", w.Code, w.Body)
+		}
+	}
+	if got := s.quotas.rejections()["daily"]; got != 1 {
+		t.Errorf("got %d rejections", got)
+	}
+
+	// The windows survive a restart
+	must0(t, s.Close())
+	s = quotaServer(t, dir, c)
+	defer s.Close()
+	if w := create("user1"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("after restart: got %d", w.Code)
+	}
+	// The oldest write leaves the window first
+	c.Advance(22 * time.Hour)
+	if w := create("user1"); w.Code != http.StatusCreated {
+		t.Errorf("after reset: got %d %s", w.Code, w.Body)
+	}
+	if w := create("user1"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("after one slot freed: got %d", w.Code)
+	}
+}
+
+func TestServerQuotaFailedWrites(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "rest"))
+	f := must(os.OpenFile(filepath.Join(dir, "_schemas.csv"), os.O_APPEND|os.O_WRONLY, 0o644)).T(t)
+	must(f.WriteString(quotaSchemas)).T(t)
+	must0(t, f.Close())
+	must0(t, os.WriteFile(filepath.Join(dir, "_quotas.csv"), []byte("daily,1,books,create,,user,24h,2\n"), 0o644))
+	s := quotaServer(t, dir, newFakeClock(time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)))
+	defer s.Close()
+
+	create := func(year int) int {
+		body := fmt.Sprintf(`{"title":"Book","author":"Me","year":%d}`, year)
+		req := httptest.NewRequest("POST", "/api/books/", strings.NewReader(body))
+		req.SetBasicAuth("user1", "user1pass")
+		req.Header.Set("Accept", "application/json")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w.Code
+	}
+	// Invalid writes don't use up the quota
+	for range 3 {
+		if code := create(1800); code != http.StatusUnprocessableEntity {
+			t.Fatalf("invalid create: got %d", code)
+		}
+	}
+	for i := range 2 {
+		if code := create(2000); code != http.StatusCreated {
+			t.Fatalf("create %d: got %d", i, code)
+		}
+	}
+	if code := create(2000); code != http.StatusTooManyRequests {
+		t.Errorf("got %d, want 429", code)
+	}
+}
+
+func TestQuotaRules(t *testing.T) {
+	c := newFakeClock(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	q := newQuotas(c)
+	rules := []quotaRule{
+		{id: "total", resource: "books", action: "*", window: time.Minute, limit: 3},
+		{id: "editors", resource: "books", action: "update", role: "editor", perUser: true, window: time.Minute, limit: 1},
+	}
+	alice := Resource{"_id": "alice", "roles": []string{"editor"}}
+	bob := Resource{"_id": "bob", "roles": []string{"editor"}}
+	carol := Resource{"_id": "carol"}
+	for _, tt := range []struct {
+		user      Resource
+		action    string
+		wantQuota string
+	}{
+		{alice, "update", ""},
+		{alice, "update", "editors"},
+		{bob, "update", ""}, // alice's rejected write was not counted against "total"
+		{carol, "update", ""},
+		{carol, "delete", "total"},
+		{carol, "read", ""}, // other resources and actions are not counted
+	} {
+		resource := "books"
+		if tt.action == "read" {
+			resource = "authors"
+		}
+		id, _, _, ok := q.allow(rules, resource, tt.action, tt.user)
+		if ok != (tt.wantQuota == "") || id != tt.wantQuota {
+			t.Errorf("%v %s: got %q %v, want %q", tt.user["_id"], tt.action, id, ok, tt.wantQuota)
+		}
+	}
+	c.Advance(time.Minute)
+	if _, _, _, ok := q.allow(rules, "books", "update", alice); !ok {
+		t.Error("window did not slide")
+	}
+}
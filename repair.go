@@ -0,0 +1,196 @@
+package pennybase
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// WithTailRepair makes opening a database tolerate a last row that can't be
+// parsed, e.g. half-written before a crash: the file is copied to a ".bak"
+// file, truncated before that row, and a warning is logged. Rows that can't
+// be parsed anywhere else are still an error.
+func WithTailRepair() DBOption { return func(db *csvDB) { db.repair = true } }
+
+// badTail returns the offset of the last row of the file if it is the only
+// one that can't be parsed.
+func (db *csvDB) badTail() (int64, bool) {
+	r := db.format.reader(io.NewSectionReader(db.f, 0, db.size))
+	for {
+		pos := r.InputOffset()
+		_, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			return 0, false
+		}
+		if err != nil {
+			_, err = r.Read()
+			return pos, errors.Is(err, io.EOF)
+		}
+	}
+}
+
+// repairTail truncates the file before its last row if it can't be parsed,
+// after copying it to a ".bak" file. The file is rewritten and renamed, since
+// storages can only append to files.
+func (db *csvDB) repairTail() (bool, error) {
+	pos, ok := db.badTail()
+	if !ok {
+		return false, nil
+	}
+	if err := db.copyTo(db.name+".bak", db.size); err != nil {
+		return false, err
+	}
+	tmp := db.name + ".repair"
+	if err := db.copyTo(tmp, pos); err != nil {
+		_ = db.st.Remove(tmp)
+		return false, err
+	}
+	if err := db.st.Rename(tmp, db.name); err != nil {
+		_ = db.st.Remove(tmp)
+		return false, err
+	}
+	f, err := db.st.Open(db.name)
+	if err != nil {
+		return false, err
+	}
+	db.f.Close()
+	log.Printf("csvdb: %s: dropped %d bytes of a partial last row, the original is in %s.bak", db.name, db.size-pos, db.name)
+	db.f, db.size = f, pos
+	return true, nil
+}
+
+// copyTo writes the first n bytes of the file to a new file.
+func (db *csvDB) copyTo(name string, n int64) error {
+	_ = db.st.Remove(name)
+	f, err := db.st.Open(name)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, io.NewSectionReader(db.f, 0, n)); err != nil {
+		f.Close()
+		return err
+	}
+	if s, ok := f.(interface{ Sync() error }); ok {
+		if err := s.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// VersionRepairer is implemented by databases that can fix the version
+// counters of their records, see Store.RepairVersions.
+type VersionRepairer interface {
+	RepairVersions() ([]Record, error)
+}
+
+// RepairVersions scans the file for records whose latest row doesn't have the
+// highest version of the record, e.g. "2.0" written by hand or a lower number
+// than an earlier row, which makes them fail to update. A copy of the latest
+// row is appended with the version after the highest one, and the appended
+// rows are returned. Versions that don't increase (other than after a
+// delete) are logged.
+func (db *csvDB) RepairVersions() ([]Record, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	type history struct {
+		last      Record
+		prev, max int64
+	}
+	ids, order := map[string]*history{}, []string{}
+	r := db.format.reader(io.NewSectionReader(db.f, 0, db.size))
+	for {
+		rec, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := compactedRows(rec); ok || len(rec) < 2 {
+			continue
+		}
+		h, ok := ids[rec[0]]
+		if !ok {
+			h = &history{}
+			ids[rec[0]], order = h, append(order, rec[0])
+		}
+		h.last = rec
+		if rec[1] == "0" {
+			h.prev, h.max = 0, 0
+			continue
+		}
+		v, ok := parseVersion(rec[1])
+		if !ok {
+			log.Printf("csvdb: %s: %s has an invalid version %q", db.name, rec[0], rec[1])
+			continue
+		}
+		if v <= h.prev {
+			log.Printf("csvdb: %s: %s has version %d after %d", db.name, rec[0], v, h.prev)
+		}
+		h.prev, h.max = v, max(h.max, v)
+	}
+	var fixed []Record
+	for _, id := range order {
+		h := ids[id]
+		if h.last[1] == "0" || h.last[1] == strconv.FormatInt(h.max, 10) {
+			continue
+		}
+		rec := slices.Clone(h.last)
+		rec[1] = strconv.FormatInt(h.max+1, 10)
+		if err := db.append(rec); err != nil {
+			return fixed, err
+		}
+		fixed = append(fixed, rec)
+	}
+	return fixed, nil
+}
+
+// parseVersion parses a version leniently, accepting e.g. " 2" or "2.0".
+func parseVersion(s string) (int64, bool) {
+	f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || f < 1 || f != math.Trunc(f) || f > math.MaxInt64/2 {
+		return 0, false
+	}
+	return int64(f), true
+}
+
+// RepairVersions fixes the records of a resource that can't be updated
+// because of a broken version, see csvDB.RepairVersions. The repaired
+// records are logged as changes like any other write.
+func (s *Store) RepairVersions(resource string) error {
+	return s.repairVersions(context.Background(), resource)
+}
+
+func (s *Store) repairVersions(ctx context.Context, resource string) (err error) {
+	_, end := s.span(ctx, "store.repair_versions", Attr{"resource", resource})
+	defer func() { end(err) }()
+	done, err := s.enter()
+	if err != nil {
+		return err
+	}
+	defer done()
+	db, ok := s.Resources[resource]
+	if !ok {
+		return newError("resource_not_found", "resource", resource)
+	}
+	vr, ok := db.(VersionRepairer)
+	if !ok {
+		return fmt.Errorf("resource %s does not support version repair", resource)
+	}
+	fixed, err := vr.RepairVersions()
+	for _, rec := range fixed {
+		log.Printf("store: %s/%s: version repaired to %s", resource, rec[0], rec[1])
+		if cerr := s.committed(resource, rec); cerr != nil {
+			return errors.Join(err, cerr)
+		}
+	}
+	return err
+}
@@ -0,0 +1,388 @@
+package pennybase
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Change is a single record write, numbered sequentially within a store epoch.
+// Deletes are recorded as tombstones: {id, "0"}.
+type Change struct {
+	Seq         int64  `json:"seq"`
+	Resource    string `json:"resource"`
+	ResourceSeq int64  `json:"resource_seq"` // see Store.ChangeSeq
+	Record      Record `json:"record"`
+}
+
+// Snapshot is a consistent starting point for a follower: all live records
+// (including _schemas) as of change Seq.
+type Snapshot struct {
+	Epoch   string              `json:"epoch"`
+	Seq     int64               `json:"seq"`
+	Records map[string][]Record `json:"records"`
+}
+
+// changeLog keeps the most recent changes in memory. The epoch changes on
+// every restart, so followers can tell that sequence numbers were reset.
+// Per-resource sequence numbers are not reset, see Store.ChangeSeq.
+type changeLog struct {
+	mu        sync.Mutex
+	epoch     string
+	seq       int64
+	buf       []Change
+	resources map[string]int64     // resource -> change counter
+	modified  map[string]time.Time // resource -> time of the last change since startup
+}
+
+func (s *Store) logChange(resource string, rec Record) {
+	s.changes.mu.Lock()
+	defer s.changes.mu.Unlock()
+	s.changes.seq++
+	s.changes.resources[resource]++
+	s.changes.modified[resource] = time.Now()
+	s.changes.buf = append(s.changes.buf, Change{Seq: s.changes.seq, Resource: resource, ResourceSeq: s.changes.resources[resource], Record: rec})
+	if n := len(s.changes.buf) - s.MaxChanges; n > 0 {
+		s.changes.buf = s.changes.buf[n:]
+	}
+}
+
+// ChangeSeq returns the change counter of the resource, which is incremented
+// by every create, update and delete. It is derived from the number of records
+// in the resource file, so it survives restarts and never goes back, and is
+// used for list ETags and SSE event IDs.
+func (s *Store) ChangeSeq(resource string) int64 {
+	s.changes.mu.Lock()
+	defer s.changes.mu.Unlock()
+	return s.changes.resources[resource]
+}
+
+// lastModified returns the time of the last change of the resource, or zero
+// if it hasn't changed since the store was opened.
+func (s *Store) lastModified(resource string) time.Time {
+	s.changes.mu.Lock()
+	defer s.changes.mu.Unlock()
+	return s.changes.modified[resource]
+}
+
+// resourceChanges returns the retained changes of the resource with a change
+// counter above since, or ok=false if some of them are no longer retained.
+func (s *Store) resourceChanges(resource string, since int64) (changes []Change, ok bool) {
+	s.changes.mu.Lock()
+	defer s.changes.mu.Unlock()
+	next := since + 1
+	for _, c := range s.changes.buf {
+		if c.Resource == resource && c.ResourceSeq > since {
+			if c.ResourceSeq != next {
+				return nil, false
+			}
+			changes, next = append(changes, c), next+1
+		}
+	}
+	return changes, since <= s.changes.resources[resource] && next == s.changes.resources[resource]+1
+}
+
+// Changes returns the changes after sequence number since, together with the
+// store epoch and the latest sequence number. It returns ok=false if some of
+// the requested changes are no longer retained.
+func (s *Store) Changes(since int64) (epoch string, seq int64, changes []Change, ok bool) {
+	s.changes.mu.Lock()
+	defer s.changes.mu.Unlock()
+	epoch, seq = s.changes.epoch, s.changes.seq
+	if since > seq || (since < seq && (len(s.changes.buf) == 0 || s.changes.buf[0].Seq > since+1)) {
+		return epoch, seq, nil, false
+	}
+	i, _ := slices.BinarySearchFunc(s.changes.buf, since+1, func(c Change, seq int64) int { return int(c.Seq - seq) })
+	return epoch, seq, slices.Clone(s.changes.buf[i:]), true
+}
+
+// Snapshot returns all live records of all resources. Writes that happen while
+// the snapshot is taken may or may not be included, but they are always
+// available as changes after Snapshot.Seq.
+func (s *Store) Snapshot() (*Snapshot, error) {
+	done, err := s.enter()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	s.changes.mu.Lock()
+	snap := &Snapshot{Epoch: s.changes.epoch, Seq: s.changes.seq, Records: map[string][]Record{}}
+	s.changes.mu.Unlock()
+	dbs := map[string]DB{"_schemas": s.schemaDB}
+	for name, db := range s.Resources {
+		dbs[name] = db
+	}
+	for name, db := range dbs {
+		snap.Records[name] = []Record{}
+		for rec, err := range db.Iter() {
+			if err != nil {
+				return nil, err
+			}
+			snap.Records[name] = append(snap.Records[name], rec)
+		}
+	}
+	return snap, nil
+}
+
+// Apply writes a record replicated from another store, preserving its version.
+// Records older than the local version are ignored.
+func (s *Store) Apply(resource string, rec Record) error {
+	_, err := s.replicate(resource, rec)
+	return err
+}
+
+// replicate is Apply that also reports whether the record was written.
+func (s *Store) replicate(resource string, rec Record) (bool, error) {
+	done, err := s.enter()
+	if err != nil {
+		return false, err
+	}
+	defer done()
+	db, ok := s.Resources[resource]
+	if !ok {
+		return false, newError("resource_not_found", "resource", resource)
+	}
+	r, ok := db.(interface{ Replicate(Record) (bool, error) })
+	if !ok {
+		return false, fmt.Errorf("resource %s does not support replication", resource)
+	}
+	applied, err := r.Replicate(rec)
+	if err != nil || !applied {
+		return false, err
+	}
+	return true, s.committed(resource, rec)
+}
+
+// committed is called after every successful write.
+func (s *Store) committed(resource string, rec Record) error {
+	s.logChange(resource, rec)
+	s.indexRefs(resource, rec)
+	if db, ok := s.mirror[resource]; ok {
+		if _, err := db.Replicate(rec); err != nil {
+			if s.MirrorStrict {
+				return fmt.Errorf("mirror: %w", err)
+			}
+			log.Printf("mirror: %s/%s: %v", resource, rec[0], err)
+		}
+	}
+	return nil
+}
+
+// EnableMirror keeps a warm copy of all resources (and schemas) in dir. Existing
+// live records are copied first, then every write is appended to the mirror
+// as well. It must be called before the store is used concurrently.
+func (s *Store) EnableMirror(dir string) error {
+	snap, err := s.Snapshot()
+	if err != nil {
+		return err
+	}
+	mirror := map[string]*csvDB{}
+	for resource, recs := range snap.Records {
+		db, err := OpenCSVDB(DirStorage(dir), resource+".csv")
+		if err != nil {
+			return err
+		}
+		mirror[resource] = db
+		for _, rec := range recs {
+			if _, err := db.Replicate(rec); err != nil {
+				return err
+			}
+		}
+	}
+	if err := mirror["_schemas"].Close(); err != nil {
+		return err
+	}
+	delete(mirror, "_schemas")
+	s.mirror = mirror
+	return nil
+}
+
+type changesResponse struct {
+	Epoch   string   `json:"epoch"`
+	Seq     int64    `json:"seq"`
+	Changes []Change `json:"changes"`
+}
+
+func (s *Server) handleChanges(w http.ResponseWriter, r *http.Request) {
+	since, _ := strconv.ParseInt(r.FormValue("since"), 10, 64)
+	epoch, seq, changes, ok := s.Store.Changes(since)
+	if !ok || (r.FormValue("epoch") != "" && r.FormValue("epoch") != epoch) {
+		http.Error(w, "changes are no longer available, bootstrap from /api/_snapshot", http.StatusGone)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(changesResponse{Epoch: epoch, Seq: seq, Changes: changes})
+}
+
+func (s *Server) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	snap, err := s.Store.Snapshot()
+	if err != nil {
+		s.WriteError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(snap)
+}
+
+// Follower mirrors a primary pennybase server into a local Store by polling
+// its /api/_changes endpoint. The follower's user must have the primary's
+// admin role and be granted "read" on the "_changes" resource.
+type Follower struct {
+	Store    *Store
+	Source   string // primary base URL, e.g. http://primary:8080
+	User     string
+	Password string
+	Client   *http.Client
+	Interval time.Duration
+
+	epoch string
+	seq   int64
+}
+
+var errGap = errors.New("replication gap")
+
+// InitDir writes the primary's schemas into dir unless it already has some,
+// so that a Store can be opened there before following.
+func (f *Follower) InitDir(dir string) error {
+	snap, err := f.snapshot()
+	if err != nil {
+		return err
+	}
+	db, err := OpenCSVDB(DirStorage(dir), "_schemas.csv")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if len(db.index) > 0 {
+		return nil
+	}
+	for _, rec := range snap.Records["_schemas"] {
+		if _, err := db.Replicate(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Bootstrap replaces local data with a snapshot of the primary.
+func (f *Follower) Bootstrap() error {
+	snap, err := f.snapshot()
+	if err != nil {
+		return err
+	}
+	for resource, db := range f.Store.Resources {
+		recs, ok := snap.Records[resource]
+		if !ok {
+			log.Printf("follower: resource %s is missing on the primary", resource)
+			continue
+		}
+		ids := map[string]bool{}
+		for _, rec := range recs {
+			ids[rec[0]] = true
+			if err := f.Store.Apply(resource, rec); err != nil {
+				return err
+			}
+		}
+		stale := []string{}
+		for rec, err := range db.Iter() {
+			if err != nil {
+				return err
+			}
+			if !ids[rec[0]] {
+				stale = append(stale, rec[0])
+			}
+		}
+		for _, id := range stale {
+			if err := f.Store.Apply(resource, Record{id, "0"}); err != nil {
+				return err
+			}
+		}
+	}
+	f.epoch, f.seq = snap.Epoch, snap.Seq
+	return nil
+}
+
+// Sync applies the changes made on the primary since the last call,
+// bootstrapping again if the changes can't be replayed without gaps.
+func (f *Follower) Sync() error {
+	if f.epoch == "" {
+		return f.Bootstrap()
+	}
+	var resp changesResponse
+	q := url.Values{"since": {strconv.FormatInt(f.seq, 10)}, "epoch": {f.epoch}}
+	if err := f.get("/api/_changes?"+q.Encode(), &resp); errors.Is(err, errGap) {
+		log.Println("follower: gap detected, bootstrapping")
+		return f.Bootstrap()
+	} else if err != nil {
+		return err
+	}
+	for _, c := range resp.Changes {
+		if c.Seq != f.seq+1 {
+			log.Println("follower: gap detected, bootstrapping")
+			return f.Bootstrap()
+		}
+		if err := f.Store.Apply(c.Resource, c.Record); err != nil {
+			return err
+		}
+		f.seq = c.Seq
+	}
+	return nil
+}
+
+// Run keeps the store in sync until the context is cancelled.
+func (f *Follower) Run(ctx context.Context) error {
+	interval := f.Interval
+	if interval == 0 {
+		interval = time.Second
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		if err := f.Sync(); err != nil {
+			log.Println("follower:", err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+func (f *Follower) snapshot() (*Snapshot, error) {
+	snap := &Snapshot{}
+	return snap, f.get("/api/_snapshot", snap)
+}
+
+func (f *Follower) get(path string, v any) error {
+	req, err := http.NewRequest(http.MethodGet, f.Source+path, nil)
+	if err != nil {
+		return err
+	}
+	if f.User != "" {
+		req.SetBasicAuth(f.User, f.Password)
+	}
+	client := f.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return json.NewDecoder(resp.Body).Decode(v)
+	case http.StatusGone:
+		return errGap
+	default:
+		return fmt.Errorf("%s: %s", path, resp.Status)
+	}
+}
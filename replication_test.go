@@ -0,0 +1,159 @@
+package pennybase
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func replicationPrimary(t *testing.T) *Server {
+	t.Helper()
+	dir := testData(t, filepath.Join("testdata", "rest"))
+	f := must(os.OpenFile(filepath.Join(dir, "_permissions.csv"), os.O_APPEND|os.O_WRONLY, 0)).T(t)
+	must(f.WriteString("p9,1,_changes,read,,admin\n")).T(t)
+	must0(t, f.Close())
+	s := must(NewServer(dir, "", "")).T(t)
+	t.Cleanup(func() { s.Store.Close() })
+	return s
+}
+
+func assertConverged(t *testing.T, primary, follower *Store) {
+	t.Helper()
+	for _, resource := range []string{"books", "_users", "_permissions"} {
+		want := must(primary.List(resource, "_id")).T(t)
+		got := must(follower.List(resource, "_id")).T(t)
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s: follower has %v, primary has %v", resource, got, want)
+		}
+	}
+}
+
+func TestFollower(t *testing.T) {
+	primary := replicationPrimary(t)
+	ts := httptest.NewServer(primary)
+	defer ts.Close()
+
+	dir := t.TempDir()
+	f := &Follower{Source: ts.URL, User: "admin", Password: "admin123"}
+	must0(t, f.InitDir(dir))
+	replica := must(NewServer(dir, "", "")).T(t)
+	defer replica.Store.Close()
+	replica.ReadOnly = true
+	f.Store = replica.Store
+
+	must0(t, f.Sync())
+	assertConverged(t, primary.Store, replica.Store)
+
+	// A burst of writes is replayed from the change log
+	for i := range 20 {
+		id := must(primary.Store.Create("books", Resource{"title": fmt.Sprint("Book ", i), "author": "Author", "year": 2000.0})).T(t)
+		if i%2 == 0 {
+			must0(t, primary.Store.Update("books", Resource{"_id": id, "title": fmt.Sprint("Updated ", i)}))
+		}
+		if i%5 == 0 {
+			must0(t, primary.Store.Delete("books", id))
+		}
+	}
+	must0(t, primary.Store.Delete("books", "book1"))
+	must0(t, f.Sync())
+	assertConverged(t, primary.Store, replica.Store)
+	if b := must(replica.Store.Get("books", "book2")).T(t); b["_v"] != 1.0 {
+		t.Errorf("versions not preserved: %v", b)
+	}
+
+	// A gap in the change log makes the follower bootstrap again
+	primary.Store.MaxChanges = 2
+	for i := range 5 {
+		must(primary.Store.Create("books", Resource{"title": fmt.Sprint("Late ", i), "author": "Author", "year": 2001.0})).T(t)
+	}
+	must0(t, primary.Store.Delete("books", "book2"))
+	must0(t, f.Sync())
+	assertConverged(t, primary.Store, replica.Store)
+
+	// Followers refuse writes
+	req := httptest.NewRequest(http.MethodPost, "/api/books/", nil)
+	req.SetBasicAuth("admin", "admin123")
+	w := httptest.NewRecorder()
+	replica.ServeHTTP(w, req)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("got status %d for a write to the follower", w.Code)
+	}
+}
+
+func TestChangesAuthorization(t *testing.T) {
+	primary := replicationPrimary(t)
+	for _, path := range []string{"/api/_changes", "/api/_snapshot"} {
+		for _, user := range [][2]string{{"", ""}, {"user1", "user1pass"}} {
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+			if user[0] != "" {
+				req.SetBasicAuth(user[0], user[1])
+			}
+			w := httptest.NewRecorder()
+			primary.ServeHTTP(w, req)
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("%s as %q: got status %d", path, user[0], w.Code)
+			}
+		}
+	}
+}
+
+func TestStoreChanges(t *testing.T) {
+	store := must(NewStore(testData(t, "testdata/basic"))).T(t)
+	defer store.Close()
+	store.MaxChanges = 3
+	for i := range 5 {
+		must(store.Create("books", Resource{"title": "T", "author": "A", "isbn": "123-0123456789", "publication_year": float64(i)})).T(t)
+	}
+	if _, seq, changes, ok := store.Changes(2); !ok || seq != 5 || len(changes) != 3 || changes[0].Seq != 3 {
+		t.Errorf("got seq=%d, changes=%v, ok=%v", seq, changes, ok)
+	}
+	if _, _, changes, ok := store.Changes(5); !ok || len(changes) != 0 {
+		t.Errorf("got changes=%v, ok=%v for an up to date follower", changes, ok)
+	}
+	for _, since := range []int64{0, 1, 6} {
+		if _, _, _, ok := store.Changes(since); ok {
+			t.Errorf("since=%d: expected a gap", since)
+		}
+	}
+	snap := must(store.Snapshot()).T(t)
+	if snap.Seq != 5 || len(snap.Records["books"]) != 5 || len(snap.Records["_schemas"]) != 7 {
+		t.Errorf("unexpected snapshot: %+v", snap)
+	}
+	if !slices.Equal(snap.Records["_schemas"][0], Record{"s1", "1", "books", "_id", "text", "", "", "^.+$"}) {
+		t.Errorf("unexpected schema record: %v", snap.Records["_schemas"][0])
+	}
+}
+
+func TestStoreMirror(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "rest"))
+	mirrorDir := t.TempDir()
+	store := must(NewStore(dir)).T(t)
+	must0(t, store.EnableMirror(mirrorDir))
+	for i := range 10 {
+		id := must(store.Create("books", Resource{"title": fmt.Sprint("Book ", i), "author": "Author", "year": 2000.0})).T(t)
+		if i%3 == 0 {
+			must0(t, store.Update("books", Resource{"_id": id, "year": 2001.0}))
+		}
+		if i%4 == 0 {
+			must0(t, store.Delete("books", id))
+		}
+	}
+	must0(t, store.Delete("books", "book1"))
+	must0(t, store.Close())
+
+	primary := must(NewStore(dir)).T(t)
+	defer primary.Close()
+	mirror := must(NewStore(mirrorDir)).T(t)
+	defer mirror.Close()
+	for _, resource := range []string{"books", "_users", "_permissions"} {
+		want := must(primary.List(resource, "_id")).T(t)
+		got := must(mirror.List(resource, "_id")).T(t)
+		if len(got) != len(want) || fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s: mirror has %d records, primary has %d", resource, len(got), len(want))
+		}
+	}
+}
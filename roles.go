@@ -0,0 +1,100 @@
+package pennybase
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// SetRoles replaces the roles of a user, leaving the other fields (e.g. the
+// password hash) untouched.
+func (s *Store) SetRoles(username string, roles []string) error {
+	return s.setRoles(context.Background(), username, roles)
+}
+
+func (s *Store) setRoles(ctx context.Context, username string, roles []string) error {
+	if roles == nil {
+		roles = []string{}
+	}
+	return s.update(ctx, "_users", Resource{"_id": username, "roles": roles})
+}
+
+// knownRoles returns the roles named in permission rows, held by users, or
+// configured as AdminRole or SupportRole.
+func (s *Server) knownRoles(ctx context.Context) (map[string]bool, error) {
+	known := map[string]bool{s.AdminRole: true, s.SupportRole: true}
+	permissions, err := s.Store.list(ctx, "_permissions", "")
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range permissions {
+		known[p["role"].(string)] = true
+	}
+	users, err := s.Store.list(ctx, "_users", "")
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range users {
+		roles, _ := u["roles"].([]string)
+		for _, role := range roles {
+			known[role] = true
+		}
+	}
+	for _, special := range []string{"", "*", "@owner"} {
+		delete(known, special)
+	}
+	return known, nil
+}
+
+// handleSetRoles replaces the roles of a user with the "roles" list of the
+// request body, e.g. {"roles": ["editor"]}. It requires the admin role. Roles
+// must be known (see knownRoles), and admins can't remove the admin role
+// from themselves, so that they don't lock themselves out.
+func (s *Server) handleSetRoles(w http.ResponseWriter, r *http.Request) {
+	admin := CurrentUser(r)
+	if !hasRole(admin, s.AdminRole) {
+		s.WriteError(w, r, http.StatusUnauthorized, newError("admin_required"))
+		return
+	}
+	if s.ReadOnly {
+		s.WriteError(w, r, http.StatusMethodNotAllowed, newError("read_only"))
+		return
+	}
+	var body struct {
+		Roles []string `json:"roles"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		s.WriteError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	known, err := s.knownRoles(r.Context())
+	if err != nil {
+		s.WriteError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	for _, role := range body.Roles {
+		if !known[role] {
+			s.WriteError(w, r, http.StatusUnprocessableEntity, newError("unknown_role", "role", role, "roles", strings.Join(slices.Sorted(maps.Keys(known)), ", ")))
+			return
+		}
+	}
+	username := r.PathValue("username")
+	if username == admin["_id"] && !slices.Contains(body.Roles, s.AdminRole) {
+		s.WriteError(w, r, http.StatusConflict, newError("admin_lockout", "role", s.AdminRole))
+		return
+	}
+	if err := s.Store.setRoles(r.Context(), username, body.Roles); err != nil {
+		s.WriteError(w, r, errorStatus(err), err)
+		return
+	}
+	user, err := s.Store.get(r.Context(), "_users", username)
+	if err != nil {
+		s.WriteError(w, r, errorStatus(err), err)
+		return
+	}
+	s.Publish(w, "_users", "updated", user)
+	WriteJSON(w, http.StatusOK, s.view("_users", user))
+}
@@ -0,0 +1,69 @@
+package pennybase
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestServerSetRoles(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "rest"))
+	perms := filepath.Join(dir, "_permissions.csv")
+	must0(t, os.WriteFile(perms, append(must(os.ReadFile(perms)).T(t), "p5,1,books,update,,editor\n"...), 0644))
+	s := must(NewServer(dir, "", "")).T(t)
+	defer s.Close()
+	must0(t, s.Store.CreateUser("root", "rootpass", []string{"admin"}))
+
+	setRoles := func(user, password, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/admin/users/"+target+"/roles", strings.NewReader(body))
+		req.SetBasicAuth(user, password)
+		req.Header.Set("Accept", "application/json")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w
+	}
+	for _, tt := range []struct {
+		name, user, password, target, body string
+		wantStatus                         int
+		wantCode                           string
+	}{
+		{"not an admin", "user1", "user1pass", "user1", `{"roles":["admin"]}`, http.StatusUnauthorized, "admin_required"},
+		{"unknown role", "admin", "admin123", "user1", `{"roles":["superuser"]}`, http.StatusUnprocessableEntity, "unknown_role"},
+		{"unknown user", "admin", "admin123", "nobody", `{"roles":["editor"]}`, http.StatusNotFound, "record_not_found"},
+		{"self-lockout", "admin", "admin123", "admin", `{"roles":["editor"]}`, http.StatusConflict, "admin_lockout"},
+		{"self-lockout with no roles", "admin", "admin123", "admin", `{"roles":[]}`, http.StatusConflict, "admin_lockout"},
+		{"invalid body", "admin", "admin123", "user1", `["editor"]`, http.StatusBadRequest, ""},
+	} {
+		w := setRoles(tt.user, tt.password, tt.target, tt.body)
+		var got errorResponse
+		_ = json.NewDecoder(w.Body).Decode(&got)
+		if w.Code != tt.wantStatus || got.Error.Code != tt.wantCode {
+			t.Errorf("%s: got %d %q, want %d %q", tt.name, w.Code, got.Error.Code, tt.wantStatus, tt.wantCode)
+		}
+	}
+	if u := must(s.Store.Get("_users", "admin")).T(t); !slices.Equal(u["roles"].([]string), []string{"admin"}) {
+		t.Errorf("got admin roles %v after refused changes", u["roles"])
+	}
+
+	// Granting a role keeps the password and doesn't send it back
+	w := setRoles("admin", "admin123", "user1", `{"roles":["editor"]}`)
+	var got Resource
+	must0(t, json.NewDecoder(w.Body).Decode(&got))
+	if w.Code != http.StatusOK || got["_id"] != "user1" || got["password"] != nil || got["salt"] != nil {
+		t.Errorf("got %d %v", w.Code, got)
+	}
+	if u := must(s.Store.Get("_users", "user1")).T(t); !slices.Equal(u["roles"].([]string), []string{"editor"}) || u["_v"] != 2.0 {
+		t.Errorf("got user %v", u)
+	}
+	must(s.Store.AuthenticateBasic("user1", "user1pass")).T(t)
+
+	// Another admin can take the admin role away
+	if w := setRoles("root", "rootpass", "admin", `{"roles":["editor","support"]}`); w.Code != http.StatusOK {
+		t.Errorf("got %d %s", w.Code, w.Body)
+	}
+}
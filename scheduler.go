@@ -0,0 +1,331 @@
+package pennybase
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// schedule computes the next run time strictly after t.
+type schedule interface {
+	next(t time.Time) time.Time
+}
+
+// every runs a job at a fixed interval.
+type every time.Duration
+
+func (e every) next(t time.Time) time.Time { return t.Add(time.Duration(e)) }
+
+// cronSpec is a parsed "minute hour day-of-month month day-of-week" spec,
+// each field stored as a bit set of the allowed values.
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+	anyDom, anyDow                bool
+}
+
+// parseSchedule parses a cron-like spec. It accepts five cron fields (each a
+// "*", a number, a range "a-b" or a list of those, optionally with a "/step"),
+// as well as "@hourly", "@daily", "@weekly" and "@every <duration>".
+func parseSchedule(spec string) (schedule, error) {
+	switch spec = strings.TrimSpace(spec); spec {
+	case "@hourly":
+		spec = "0 * * * *"
+	case "@daily", "@midnight":
+		spec = "0 0 * * *"
+	case "@weekly":
+		spec = "0 0 * * 0"
+	}
+	if d, ok := strings.CutPrefix(spec, "@every "); ok {
+		interval, err := time.ParseDuration(strings.TrimSpace(d))
+		if err != nil {
+			return nil, err
+		}
+		if interval < time.Second {
+			return nil, errors.New("interval must be at least 1s")
+		}
+		return every(interval), nil
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid schedule %q: expected 5 fields", spec)
+	}
+	c := &cronSpec{anyDom: fields[2] == "*", anyDow: fields[4] == "*"}
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6}}
+	sets := [5]*uint64{&c.minute, &c.hour, &c.dom, &c.month, &c.dow}
+	for i, f := range fields {
+		set, err := parseCronField(f, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %w", spec, err)
+		}
+		*sets[i] = set
+	}
+	return c, nil
+}
+
+func parseCronField(f string, lo, hi int) (uint64, error) {
+	var set uint64
+	for part := range strings.SplitSeq(f, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepStr)
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step %q", stepStr)
+			}
+			step = n
+		}
+		from, to := lo, hi
+		if rng != "*" {
+			a, b, isRange := strings.Cut(rng, "-")
+			var err error
+			if from, err = strconv.Atoi(a); err != nil {
+				return 0, fmt.Errorf("invalid value %q", a)
+			}
+			to = from
+			if isRange {
+				if to, err = strconv.Atoi(b); err != nil {
+					return 0, fmt.Errorf("invalid value %q", b)
+				}
+			} else if hasStep {
+				to = hi
+			}
+		}
+		if from < lo || to > hi || from > to {
+			return 0, fmt.Errorf("value %q out of range %d-%d", part, lo, hi)
+		}
+		for v := from; v <= to; v += step {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+func (c *cronSpec) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// Every valid spec matches at least once within a few years
+	for limit := t.AddDate(5, 0, 0); t.Before(limit); {
+		if c.month&(1<<t.Month()) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		} else if !c.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		} else if c.hour&(1<<t.Hour()) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		} else if c.minute&(1<<t.Minute()) == 0 {
+			t = t.Add(time.Minute)
+		} else {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// matchDay follows cron: if both day fields are restricted, either may match.
+func (c *cronSpec) matchDay(t time.Time) bool {
+	dom, dow := c.dom&(1<<t.Day()) != 0, c.dow&(1<<t.Weekday()) != 0
+	if !c.anyDom && !c.anyDow {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+// clock abstracts time for the scheduler, so that tests can use a fake one.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// JobStatus describes a scheduled job and the outcome of its last run.
+type JobStatus struct {
+	Name      string    `json:"name"`
+	Spec      string    `json:"spec"`
+	Next      time.Time `json:"next"`
+	LastRun   time.Time `json:"last_run,omitzero"`
+	LastError string    `json:"last_error,omitempty"`
+	Duration  float64   `json:"duration"` // of the last run, in seconds
+	Runs      int       `json:"runs"`
+	Skipped   int       `json:"skipped"` // runs skipped because the previous one was still running
+	Running   bool      `json:"running"`
+}
+
+type job struct {
+	JobStatus
+	sched schedule
+	fn    func(ctx context.Context) error
+}
+
+// scheduler runs jobs on their schedules from a single timer goroutine. Each
+// job runs in its own goroutine, and a job never overlaps with itself.
+type scheduler struct {
+	clock  clock
+	mu     sync.Mutex
+	jobs   []*job
+	wake   chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+	once   sync.Once
+	loop   sync.WaitGroup // the timer goroutine
+	wg     sync.WaitGroup // running jobs
+}
+
+func newScheduler(c clock) *scheduler {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &scheduler{clock: c, wake: make(chan struct{}, 1), ctx: ctx, cancel: cancel}
+}
+
+func (sc *scheduler) add(spec, name string, fn func(ctx context.Context) error) error {
+	sched, err := parseSchedule(spec)
+	if err != nil {
+		return err
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.ctx.Err() != nil {
+		return errors.New("scheduler is stopped")
+	}
+	if slices.ContainsFunc(sc.jobs, func(j *job) bool { return j.Name == name }) {
+		return fmt.Errorf("job %q already scheduled", name)
+	}
+	next := sched.next(sc.clock.Now())
+	if next.IsZero() {
+		return fmt.Errorf("schedule %q never matches", spec)
+	}
+	sc.jobs = append(sc.jobs, &job{JobStatus: JobStatus{Name: name, Spec: spec, Next: next}, sched: sched, fn: fn})
+	started := false
+	sc.once.Do(func() {
+		started = true
+		sc.loop.Add(1)
+		go sc.run()
+	})
+	if !started {
+		select {
+		case sc.wake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (sc *scheduler) run() {
+	defer sc.loop.Done()
+	for {
+		sc.mu.Lock()
+		now, next := sc.clock.Now(), time.Time{}
+		for _, j := range sc.jobs {
+			if !j.Next.After(now) {
+				j.Next = j.sched.next(now)
+				if j.Running {
+					j.Skipped++
+				} else {
+					j.Running = true
+					sc.wg.Add(1)
+					go sc.exec(j)
+				}
+			}
+			if next.IsZero() || j.Next.Before(next) {
+				next = j.Next
+			}
+		}
+		sc.mu.Unlock()
+		select {
+		case <-sc.ctx.Done():
+			return
+		case <-sc.wake:
+		case <-sc.clock.After(next.Sub(now)):
+		}
+	}
+}
+
+func (sc *scheduler) exec(j *job) {
+	defer sc.wg.Done()
+	start := sc.clock.Now()
+	err := j.fn(sc.ctx)
+	if err != nil {
+		log.Println("job", j.Name, "failed:", err)
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	j.Running, j.Runs, j.LastRun = false, j.Runs+1, start
+	j.Duration = sc.clock.Now().Sub(start).Seconds()
+	j.LastError = ""
+	if err != nil {
+		j.LastError = err.Error()
+	}
+}
+
+func (sc *scheduler) status() []JobStatus {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	jobs := []JobStatus{}
+	for _, j := range sc.jobs {
+		jobs = append(jobs, j.JobStatus)
+	}
+	return jobs
+}
+
+// stop cancels the context of the running jobs and waits for them to return.
+func (sc *scheduler) stop() {
+	sc.mu.Lock()
+	sc.cancel()
+	sc.mu.Unlock()
+	sc.loop.Wait()
+	sc.wg.Wait()
+}
+
+// Schedule runs fn periodically until the server is closed. The spec is
+// either five cron fields ("minute hour day-of-month month day-of-week", in
+// local time), "@hourly", "@daily", "@weekly" or "@every <duration>". A run is
+// skipped if the previous run of the same job has not finished yet.
+func (s *Server) Schedule(spec, name string, fn func(ctx context.Context) error) error {
+	return s.scheduler.add(spec, name, fn)
+}
+
+// Jobs returns the status of the scheduled jobs.
+func (s *Server) Jobs() []JobStatus { return s.scheduler.status() }
+
+// Close stops the scheduler, waiting for the running jobs, saves the quota
+// windows and closes the store.
+func (s *Server) Close() error {
+	s.scheduler.stop()
+	s.Broker.Close()
+	if db := s.impersonations.db; db != nil {
+		if err := db.Close(); err != nil {
+			s.Store.Close()
+			return err
+		}
+	}
+	if _, ok := s.Store.Resources["_quotas"]; ok {
+		if err := s.quotas.save(s.Store.Storage); err != nil {
+			s.Store.Close()
+			return err
+		}
+	}
+	return s.Store.Close()
+}
+
+type infoResponse struct {
+	Jobs      []JobStatus      `json:"jobs"`
+	Resources map[string]int64 `json:"resources"` // resource -> Store.ChangeSeq
+	// quota id -> writes rejected since the server started
+	QuotaRejections map[string]int64 `json:"quota_rejections"`
+}
+
+func (s *Server) handleInfo(w http.ResponseWriter, r *http.Request) {
+	info := infoResponse{Jobs: s.Jobs(), Resources: map[string]int64{}, QuotaRejections: s.quotas.rejections()}
+	for resource := range s.Store.Resources {
+		info.Resources[resource] = s.Store.ChangeSeq(resource)
+	}
+	_ = json.NewEncoder(w).Encode(info)
+}
@@ -0,0 +1,212 @@
+package pennybase
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	start := time.Date(2026, time.January, 30, 22, 59, 30, 0, time.UTC) // Friday
+	tests := []struct {
+		spec string
+		want []string // subsequent run times
+	}{
+		{"@every 90s", []string{"2026-01-30 23:01:00", "2026-01-30 23:02:30"}},
+		{"* * * * *", []string{"2026-01-30 23:00:00", "2026-01-30 23:01:00"}},
+		{"*/20 * * * *", []string{"2026-01-30 23:00:00", "2026-01-30 23:20:00", "2026-01-30 23:40:00"}},
+		{"@hourly", []string{"2026-01-30 23:00:00", "2026-01-31 00:00:00"}},
+		{"30 3 * * *", []string{"2026-01-31 03:30:00", "2026-02-01 03:30:00"}},
+		{"0 9-17/4 * * *", []string{"2026-01-31 09:00:00", "2026-01-31 13:00:00", "2026-01-31 17:00:00", "2026-02-01 09:00:00"}},
+		{"15 0 1,15 * *", []string{"2026-02-01 00:15:00", "2026-02-15 00:15:00"}},
+		{"0 0 * * 1", []string{"2026-02-02 00:00:00", "2026-02-09 00:00:00"}},
+		{"0 0 13 * 5", []string{"2026-02-06 00:00:00", "2026-02-13 00:00:00"}}, // day of month or Friday
+		{"0 12 29 2 *", []string{"2028-02-29 12:00:00"}},
+	}
+	for _, tt := range tests {
+		sched := must(parseSchedule(tt.spec)).T(t)
+		at := start
+		for _, want := range tt.want {
+			at = sched.next(at)
+			if got := at.Format(time.DateTime); got != want {
+				t.Errorf("%q: got %s, want %s", tt.spec, got, want)
+				break
+			}
+		}
+	}
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "5-1 * * * *", "*/0 * * * *", "x * * * *", "@every 10ms", "@every soon", "@yearly"} {
+		if _, err := parseSchedule(spec); err == nil {
+			t.Errorf("%q: expected an error", spec)
+		}
+	}
+}
+
+// fakeClock only moves when advanced. Every call to After is reported on the
+// ch channel, so that tests can wait for the scheduler to go back to sleep.
+type fakeClock struct {
+	ch      chan time.Duration
+	now     chan time.Time // holds the current time, doubles as a mutex
+	waiters []fakeTimer
+}
+
+type fakeTimer struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	c := &fakeClock{ch: make(chan time.Duration, 100), now: make(chan time.Time, 1)}
+	c.now <- now
+	return c
+}
+
+func (c *fakeClock) Now() time.Time {
+	now := <-c.now
+	c.now <- now
+	return now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	now := <-c.now
+	ch := make(chan time.Time, 1)
+	c.waiters = append(c.waiters, fakeTimer{now.Add(d), ch})
+	c.now <- now
+	c.ch <- d
+	return ch
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	now := (<-c.now).Add(d)
+	waiters := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(now) {
+			waiters = append(waiters, w)
+		} else {
+			w.ch <- now
+		}
+	}
+	c.waiters = waiters
+	c.now <- now
+}
+
+// armed waits until the scheduler sleeps again and returns the sleep duration.
+func (c *fakeClock) armed(t *testing.T) time.Duration {
+	t.Helper()
+	select {
+	case d := <-c.ch:
+		return d
+	case <-time.After(time.Second):
+		t.Fatal("scheduler did not go to sleep")
+		return 0
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	clock := newFakeClock(time.Date(2026, time.March, 1, 12, 0, 30, 0, time.UTC))
+	sc := newScheduler(clock)
+	ticks := make(chan time.Time, 10)
+	must0(t, sc.add("* * * * *", "tick", func(ctx context.Context) error {
+		ticks <- clock.Now()
+		return nil
+	}))
+	if d := clock.armed(t); d != 30*time.Second {
+		t.Fatalf("got sleep %v, want 30s", d)
+	}
+	clock.Advance(30 * time.Second)
+	if d := clock.armed(t); d != time.Minute {
+		t.Fatalf("got sleep %v, want 1m", d)
+	}
+	if got := <-ticks; got.Format(time.TimeOnly) != "12:01:00" {
+		t.Errorf("got run at %v", got)
+	}
+
+	// A slow job is not started again while it is still running
+	release := make(chan struct{})
+	must0(t, sc.add("@every 20s", "slow", func(ctx context.Context) error {
+		<-release
+		return errors.New("boom")
+	}))
+	if d := clock.armed(t); d != 20*time.Second {
+		t.Fatalf("got sleep %v, want 20s", d)
+	}
+	clock.Advance(20 * time.Second)
+	clock.armed(t)
+	clock.Advance(20 * time.Second)
+	clock.armed(t)
+	jobs := sc.status()
+	if jobs[1].Name != "slow" || !jobs[1].Running || jobs[1].Skipped != 1 || jobs[1].Runs != 0 {
+		t.Errorf("got %+v", jobs[1])
+	}
+	if err := sc.add("@every 1m", "slow", nil); err == nil {
+		t.Error("expected an error for a duplicate job")
+	}
+	close(release)
+	sc.stop()
+	jobs = sc.status()
+	if jobs[1].Running || jobs[1].Runs != 1 || jobs[1].LastError != "boom" {
+		t.Errorf("got %+v", jobs[1])
+	}
+	if jobs[0].Runs != 1 || jobs[0].LastError != "" {
+		t.Errorf("got %+v", jobs[0])
+	}
+}
+
+func TestSchedulerStop(t *testing.T) {
+	clock := newFakeClock(time.Date(2026, time.March, 1, 12, 0, 0, 0, time.UTC))
+	sc := newScheduler(clock)
+	started := make(chan struct{})
+	must0(t, sc.add("@every 1m", "wait", func(ctx context.Context) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	}))
+	clock.armed(t)
+	clock.Advance(time.Minute)
+	<-started
+	sc.stop() // returns only after the job saw the cancellation
+	if jobs := sc.status(); jobs[0].Runs != 1 || jobs[0].LastError != context.Canceled.Error() {
+		t.Errorf("got %+v", jobs[0])
+	}
+	if err := sc.add("@every 1m", "late", func(ctx context.Context) error { return nil }); err == nil {
+		t.Error("expected an error after stop")
+	}
+}
+
+func TestServerJobs(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "menu"))
+	s := must(NewServer(dir, "", "")).T(t)
+	defer s.Close()
+	must0(t, s.Store.insert(context.Background(), "_permissions", "p6", Resource{"resource": "_info", "action": "read", "role": "admin"}))
+	must0(t, s.Schedule("@daily", "compact", func(ctx context.Context) error { return nil }))
+	if err := s.Schedule("0 0 31 2 *", "never", func(ctx context.Context) error { return nil }); err == nil {
+		t.Error("expected an error for a schedule that never matches")
+	}
+
+	for _, tt := range []struct {
+		user, password string
+		wantStatus     int
+	}{
+		{"viewer", "viewerpass", http.StatusUnauthorized},
+		{"admin", "admin123", http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/api/_info", nil)
+		req.SetBasicAuth(tt.user, tt.password)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		if w.Code != tt.wantStatus {
+			t.Fatalf("%s: got status %d, want %d", tt.user, w.Code, tt.wantStatus)
+		}
+		if w.Code == http.StatusOK {
+			var info infoResponse
+			must0(t, json.NewDecoder(w.Body).Decode(&info))
+			if len(info.Jobs) != 1 || info.Jobs[0].Name != "compact" || info.Jobs[0].Next.IsZero() {
+				t.Errorf("got %+v", info)
+			}
+		}
+	}
+}
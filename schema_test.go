@@ -1,11 +1,15 @@
 package pennybase
 
 import (
+	"errors"
 	"fmt"
 	"math"
 	"reflect"
+	"regexp"
 	"slices"
+	"strings"
 	"testing"
+	"time"
 )
 
 const testID = "test0001"
@@ -68,6 +72,12 @@ func TestFieldSchema(t *testing.T) {
 			value:    "Uppercase",
 			expected: false,
 		},
+		{
+			name:     "text with invalid regex",
+			field:    FieldSchema{Type: Text, Regex: "^(.+$"},
+			value:    "anything",
+			expected: false,
+		},
 		{
 			name:     "empty text with regex",
 			field:    FieldSchema{Type: Text, Regex: "^.*$"},
@@ -88,12 +98,73 @@ func TestFieldSchema(t *testing.T) {
 			value:    []string{},
 			expected: true,
 		},
+		{
+			name:     "list within item bounds",
+			field:    FieldSchema{Type: List, Min: 1, Max: 5},
+			value:    []string{"a", "b", "c", "d", "e"},
+			expected: true,
+		},
+		{
+			name:     "list with too many items",
+			field:    FieldSchema{Type: List, Min: 1, Max: 5},
+			value:    []string{"a", "b", "c", "d", "e", "f"},
+			expected: false,
+		},
+		{
+			name:     "empty list with min items",
+			field:    FieldSchema{Type: List, Min: 1},
+			value:    []string{},
+			expected: false,
+		},
+		{
+			name:     "list with max items only",
+			field:    FieldSchema{Type: List, Max: 2},
+			value:    []string{},
+			expected: true,
+		},
+		{
+			name:     "list items match regex",
+			field:    FieldSchema{Type: List, Regex: "^[a-z0-9-]+$"},
+			value:    []string{"go", "web-dev", "2024"},
+			expected: true,
+		},
+		{
+			name:     "list item doesn't match regex",
+			field:    FieldSchema{Type: List, Regex: "^[a-z0-9-]+$"},
+			value:    []string{"go", "Web Dev", "2024"},
+			expected: false,
+		},
+		{
+			name:     "empty list with regex",
+			field:    FieldSchema{Type: List, Regex: "^[a-z0-9-]+$"},
+			value:    []string{},
+			expected: true,
+		},
 		{
 			name:     "invalid list type",
 			field:    FieldSchema{Type: List},
 			value:    "not a list",
 			expected: false,
 		},
+		// Bool validation
+		{
+			name:     "bool ignores min, max and regex",
+			field:    FieldSchema{Type: Bool, Min: 5, Max: 10, Regex: "^x$"},
+			value:    false,
+			expected: true,
+		},
+		{
+			name:     "bool as string",
+			field:    FieldSchema{Type: Bool},
+			value:    "true",
+			expected: false,
+		},
+		{
+			name:     "bool as number",
+			field:    FieldSchema{Type: Bool},
+			value:    1.0,
+			expected: false,
+		},
 	}
 
 	for _, tt := range tests {
@@ -105,6 +176,26 @@ func TestFieldSchema(t *testing.T) {
 	}
 }
 
+// BenchmarkValidate compares validating with the cached regex to compiling it
+// every time, as it used to be.
+func BenchmarkValidate(b *testing.B) {
+	field := FieldSchema{Type: Text, Regex: `^[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[a-z]{2,}$`}
+	b.Run("cached", func(b *testing.B) {
+		for range b.N {
+			if !field.Validate("ann@example.com") {
+				b.Fatal("expected a match")
+			}
+		}
+	})
+	b.Run("compiled", func(b *testing.B) {
+		for range b.N {
+			if !regexp.MustCompile(field.Regex).MatchString("ann@example.com") {
+				b.Fatal("expected a match")
+			}
+		}
+	})
+}
+
 func TestSchemaRecordConversion(t *testing.T) {
 	testSchema := Schema{
 		{Field: "_id", Type: Text, Regex: "^[A-Za-z0-9]+$"},
@@ -323,3 +414,427 @@ func TestSchema_EdgeCases(t *testing.T) {
 		}
 	})
 }
+
+func TestFieldNormalize(t *testing.T) {
+	tests := []struct {
+		name    string
+		options string
+		in      string
+		want    string
+	}{
+		{"no options", "", "  Mixed \t Case\n", "  Mixed \t Case\n"},
+		{"trim", "trim", "\u200b \tTitle  with  spaces\n\ufeff", "Title  with  spaces"},
+		{"collapse", "collapse", " a\tb\n\nc   d ", "a b c d"},
+		{"lower", "lower", "\u00c0LICE", "\u00e0lice"},
+		{"nfc composed", "nfc", "caf\u00e9", "caf\u00e9"},
+		{"nfc decomposed", "nfc", "cafe\u0301", "caf\u00e9"},
+		{"nfc multiple marks", "nfc", "A\u030astro\u0308m u\u0308\u0304", "\u00c5str\u00f6m \u01d6"},
+		{"nfc hangul", "nfc", "\u1112\u1161\u11ab\u1100\u1173\u11af", "\ud55c\uae00"},
+		{"nfc mark without base", "nfc", "\u0301a", "\u0301a"},
+		{"all", "nfc, trim, lower", " JOSE\u0301 ", "jos\u00e9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			field := FieldSchema{Resource: "r", Field: "f", Type: Text}
+			must0(t, field.parseOptions(tt.options))
+			if got := field.Normalize(tt.in); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+	if err := (&FieldSchema{}).parseOptions("trim,upper"); err == nil {
+		t.Error("expected an error for an unknown option")
+	}
+}
+
+func TestSlugify(t *testing.T) {
+	for in, want := range map[string]string{
+		"My Title":                             "my-title",
+		"  --Hello,   World!-- ":               "hello-world",
+		"Go 1.24 released":                     "go-1-24-released",
+		"Cr\u00e8me Br\u00fbl\u00e9e":          "creme-brulee",
+		"Cre\u0300me":                          "creme",
+		"\u01d6ber":                            "uber",
+		"\u041f\u0440\u0438\u0432\u0435\u0442": "\u043f\u0440\u0438\u0432\u0435\u0442",
+		"\u30ac\u30a4\u30c9":                   "\u30ac\u30a4\u30c9",
+		"!!!":                                  "",
+	} {
+		if got := slugify(in); got != want {
+			t.Errorf("slugify(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestSchemaRecordNormalization(t *testing.T) {
+	schema := Schema{
+		{Field: "_id", Type: Text, Trim: true},
+		{Field: "name", Type: Text, Regex: "^[a-z\u00e9]+$", Trim: true, Lower: true, NFC: true},
+		{Field: "raw", Type: Text, Regex: "^[a-z]+$"},
+		{Field: "tags", Type: List, Collapse: true},
+	}
+	// Normalization happens before validation, so the regex sees the canonical form
+	rec := must(schema.Record(Resource{"_id": " id1\n", "name": " RENE\u0301\t", "raw": "abc", "tags": []string{" new  york ", "la"}})).T(t)
+	if want := (Record{"id1", "ren\u00e9", "abc", "new york,la"}); !slices.Equal(rec, want) {
+		t.Errorf("got %q, want %q", rec, want)
+	}
+	if _, err := schema.Record(Resource{"_id": "id1", "name": "rene", "raw": " abc"}); err == nil {
+		t.Error("expected fields without options not to be normalized")
+	}
+}
+
+func TestSchemaRequired(t *testing.T) {
+	schema := Schema{
+		{Field: "_id", Type: Text},
+		{Field: "_v", Type: Number},
+		{Field: "title", Type: Text, Required: true, Trim: true},
+		{Field: "stock", Type: Number, Required: true},
+		{Field: "tags", Type: List, Required: true},
+		{Field: "due", Type: DateTime, Required: true},
+		{Field: "note", Type: Text},
+	}
+	valid := func() Resource {
+		return Resource{"_id": "id1", "_v": 1.0, "title": "Dune", "stock": 0.0, "tags": []string{"sf"}, "due": "2024-03-01T12:00:00Z"}
+	}
+	rec := must(schema.Record(valid())).T(t)
+	if want := (Record{"id1", "1", "Dune", "0", "sf", "2024-03-01T12:00:00Z", ""}); !slices.Equal(rec, want) {
+		t.Errorf("got %q, want %q", rec, want)
+	}
+	for _, tt := range []struct {
+		field string
+		value any // nil removes the field
+	}{
+		{"title", nil},
+		{"title", ""},
+		{"title", "  "},
+		{"stock", nil},
+		{"tags", nil},
+		{"tags", []string{"", ""}},
+		{"due", nil},
+		{"due", ""},
+	} {
+		res := valid()
+		if res[tt.field] = tt.value; tt.value == nil {
+			delete(res, tt.field)
+		}
+		_, err := schema.Record(res)
+		if !errors.Is(err, ErrRequiredField) || err.Error() != `field "`+tt.field+`" is required` {
+			t.Errorf("%s = %q: got %v", tt.field, tt.value, err)
+		}
+	}
+	field := FieldSchema{Resource: "books", Field: "title", Type: Text}
+	if must0(t, field.parseOptions("trim, required")); !field.Required {
+		t.Error("expected the required option to be parsed")
+	}
+}
+
+func TestSchemaDefault(t *testing.T) {
+	schema := Schema{
+		{Field: "_id", Type: Text},
+		{Field: "_v", Type: Number},
+		{Field: "status", Type: Text, Default: "draft", Required: true},
+		{Field: "stock", Type: Number, Default: "10"},
+		{Field: "tags", Type: List, Default: "new,sale"},
+		{Field: "due", Type: DateTime, Default: "1700000000"},
+		{Field: "note", Type: Text},
+	}
+	for _, tt := range []struct {
+		res  Resource
+		want Record
+	}{
+		{Resource{}, Record{"", "0", "draft", "10", "new,sale", "2023-11-14T22:13:20Z", ""}},
+		{Resource{"status": "published", "stock": 0.0, "tags": []string{}}, Record{"", "0", "published", "0", "", "2023-11-14T22:13:20Z", ""}},
+	} {
+		if rec := must(schema.Record(tt.res)).T(t); !slices.Equal(rec, tt.want) {
+			t.Errorf("%v: got %q, want %q", tt.res, rec, tt.want)
+		}
+	}
+	for _, tt := range []struct {
+		field FieldSchema
+		opts  string
+		def   string
+		ok    bool
+	}{
+		{FieldSchema{Type: Text}, "required, default=draft", "draft", true},
+		{FieldSchema{Type: List}, "set,default=a,b, c", "a,b, c", true},
+		{FieldSchema{Type: Text, Regex: "^[a-z]+$"}, "default=Draft", "", false},
+		{FieldSchema{Type: Text, Regex: "^[a-z]+$"}, "lower,default=Draft", "Draft", true},
+		{FieldSchema{Type: Number, Min: 1, Max: 5}, "default=7", "", false},
+		{FieldSchema{Type: Number}, "default=many", "", false},
+		{FieldSchema{Type: DateTime}, "default=yesterday", "", false},
+		{FieldSchema{Type: Bool}, "default=true", "true", true},
+		{FieldSchema{Type: Bool}, "default=yes", "", false},
+	} {
+		field := tt.field
+		field.Resource, field.Field = "posts", "f"
+		if err := field.parseOptions(tt.opts); (err == nil) != tt.ok || (tt.ok && field.Default != tt.def) {
+			t.Errorf("%s: got default %q, %v", tt.opts, field.Default, err)
+		}
+	}
+}
+
+func TestSchemaCompressed(t *testing.T) {
+	schema := Schema{
+		{Field: "_id", Type: Text},
+		{Field: "_v", Type: Number},
+		{Field: "body", Type: Text, Compressed: true},
+	}
+	long := strings.Repeat("All work and no play makes Jack a dull boy.\n", 1000)
+	for _, tt := range []struct {
+		text       string
+		compressed bool
+	}{
+		{long, true},
+		{"short", false},
+		{"", false},
+		{"gz:not compressed", true},
+	} {
+		rec := must(schema.Record(Resource{"_id": "id1", "_v": 1.0, "body": tt.text})).T(t)
+		if got := strings.HasPrefix(rec[2], compressedPrefix); got != tt.compressed {
+			t.Errorf("%.20q: compressed = %v, want %v", tt.text, got, tt.compressed)
+		}
+		if tt.compressed && len(tt.text) > 100 && len(rec[2]) >= len(tt.text)/10 {
+			t.Errorf("%.20q: stored %d bytes for %d", tt.text, len(rec[2]), len(tt.text))
+		}
+		res := must(schema.Resource(rec)).T(t)
+		if res["body"] != tt.text {
+			t.Errorf("%.20q: got %.20q back", tt.text, res["body"])
+		}
+	}
+	// Cells written before the field was compressed are read as they are.
+	res := must(schema.Resource(Record{"id1", "1", "plain text"})).T(t)
+	if res["body"] != "plain text" {
+		t.Errorf("got %q", res["body"])
+	}
+	if _, err := schema.Resource(Record{"id1", "1", "gz:!!!"}); err == nil {
+		t.Error("expected an error for a corrupt compressed cell")
+	}
+	for _, opts := range []string{"compress,index", "slug=title,compress", "compress,blob"} {
+		field := FieldSchema{Resource: "posts", Field: "body", Type: Text}
+		if err := field.parseOptions(opts); err == nil {
+			t.Errorf("%s: expected an error", opts)
+		}
+	}
+	field := FieldSchema{Resource: "posts", Field: "views", Type: Number}
+	if err := field.parseOptions("compress"); err == nil {
+		t.Error("expected an error for a compressed number")
+	}
+}
+
+func TestSchemaRecordSet(t *testing.T) {
+	schema := Schema{{Field: "_id", Type: Text}, {Field: "tags", Type: List, Set: true, Trim: true}}
+	for _, tt := range []struct {
+		tags []string
+		want string
+	}{
+		{[]string{"b", "a", "a"}, "a,b"},
+		{[]string{" a", "b", "a "}, "a,b"},
+		{[]string{}, ""},
+	} {
+		rec := must(schema.Record(Resource{"_id": "id1", "tags": tt.tags})).T(t)
+		if rec[1] != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.tags, rec[1], tt.want)
+		}
+	}
+	res := must(schema.Resource(must(schema.Record(Resource{"_id": "id1", "tags": []string{"b", "a", "a"}})).T(t))).T(t)
+	if got := res["tags"].([]string); !slices.Equal(got, []string{"a", "b"}) {
+		t.Errorf("got %q, want [a b]", got)
+	}
+	field := FieldSchema{Resource: "books", Field: "title", Type: Text}
+	if err := field.parseOptions("set"); err == nil {
+		t.Error("expected set option to require a list")
+	}
+}
+
+func TestSchemaListRoundTrip(t *testing.T) {
+	schema := Schema{{Field: "_id", Type: Text}, {Field: "tags", Type: List}}
+	for _, tt := range []struct {
+		tags []string
+		want string
+	}{
+		{[]string{"a", "b"}, "a,b"},
+		{[]string{"foo,bar", "baz"}, `["foo,bar","baz"]`},
+		{[]string{`say "hi"`, "'quoted'"}, `say "hi",'quoted'`},
+		{[]string{"two\nlines", "x"}, "two\nlines,x"},
+		{[]string{"[draft]"}, `["[draft]"]`},
+		{[]string{`["a","b"]`}, `["[\"a\",\"b\"]"]`},
+		{[]string{",", `"`, "\n,\n"}, `[",","\"","\n,\n"]`},
+	} {
+		rec := must(schema.Record(Resource{"_id": "id1", "tags": tt.tags})).T(t)
+		if rec[1] != tt.want {
+			t.Errorf("%q: stored as %q, want %q", tt.tags, rec[1], tt.want)
+		}
+		res := must(schema.Resource(rec)).T(t)
+		if got := res["tags"].([]string); !slices.Equal(got, tt.tags) {
+			t.Errorf("%q: got %q after a round trip", tt.tags, got)
+		}
+	}
+	// Lists written before items could hold commas read as they always did
+	for stored, want := range map[string][]string{"a,b": {"a", "b"}, ",a,,b,": {"a", "b"}, "[a,b]": {"[a", "b]"}, "": {}} {
+		res := must(schema.Resource(Record{"id1", stored})).T(t)
+		if got := res["tags"].([]string); !slices.Equal(got, want) {
+			t.Errorf("%q: got %q, want %q", stored, got, want)
+		}
+	}
+}
+
+func TestSchemaListBounds(t *testing.T) {
+	schema := Schema{{Field: "_id", Type: Text}, {Field: "tags", Type: List, Min: 1, Max: 3}}
+	for _, tt := range []struct {
+		tags  any
+		valid bool
+	}{
+		{[]string{"a"}, true},
+		{[]string{"a", "b", "c"}, true},
+		{[]string{"a", "b", "c", "d"}, false},
+		{[]string{}, false},
+		{[]string{"", ""}, false}, // empty items are dropped before counting
+		{nil, false},
+	} {
+		rec, err := schema.Record(Resource{"_id": "id1", "tags": tt.tags})
+		if !tt.valid {
+			if !errors.Is(err, ErrInvalidField) {
+				t.Errorf("%q: got %v", tt.tags, err)
+			}
+			continue
+		}
+		res := must(schema.Resource(must(rec, err).T(t))).T(t)
+		if got := res["tags"].([]string); !slices.Equal(got, tt.tags.([]string)) {
+			t.Errorf("%q: got %q after a round trip", tt.tags, got)
+		}
+		if again := must(schema.Record(res)).T(t); !slices.Equal(again, rec) {
+			t.Errorf("%q: got %q, want %q", tt.tags, again, rec)
+		}
+	}
+}
+
+func TestSchemaDuplicateFields(t *testing.T) {
+	mem := NewMemStorage()
+	f := must(mem.Open("_schemas.csv")).T(t)
+	must(f.Write([]byte("s1,1,books,_id,text,,,^.+$\ns2,1,books,_v,number,1,,\ns3,1,books,title,text,,,\ns4,1,authors,title,text,,,\ns5,1,books,title,number,,,\n"))).T(t)
+	must0(t, f.Close())
+	_, err := NewStore("", WithStorage(mem))
+	if err == nil || !strings.Contains(err.Error(), "s5") || !strings.Contains(err.Error(), "books.title") {
+		t.Errorf("got %v, want an error naming s5 and books.title", err)
+	}
+}
+
+func TestSchemaDateTime(t *testing.T) {
+	schema := Schema{{Field: "_id", Type: Text}, {Field: "_v", Type: Number}, {Field: "at", Type: DateTime}}
+	for _, tt := range []struct {
+		in   any
+		want string
+	}{
+		{"2024-03-01T12:00:00Z", "2024-03-01T12:00:00Z"},
+		{"2024-03-01T14:00:00.500+02:00", "2024-03-01T12:00:00.5Z"},
+		{1709294400.0, "2024-03-01T12:00:00Z"},
+		{1709294400.25, "2024-03-01T12:00:00.25Z"},
+		{0.0, "1970-01-01T00:00:00Z"},
+		{time.Date(2024, 3, 1, 13, 0, 0, 0, time.FixedZone("CET", 3600)), "2024-03-01T12:00:00Z"},
+		{nil, ""},
+		{"", ""},
+		{time.Time{}, ""},
+		{"2024-03-01", "error"},
+		{"yesterday", "error"},
+		{math.NaN(), "error"},
+		{true, "error"},
+	} {
+		rec, err := schema.Record(Resource{"_id": "a", "_v": 1.0, "at": tt.in})
+		if err != nil {
+			if tt.want != "error" {
+				t.Errorf("%v: %v", tt.in, err)
+			}
+			continue
+		}
+		if rec[2] != tt.want {
+			t.Errorf("%v: stored %q, want %q", tt.in, rec[2], tt.want)
+			continue
+		}
+		res := must(schema.Resource(rec)).T(t)
+		if at, ok := res["at"].(time.Time); !ok || formatDateTime(at) != tt.want || at.Location() != time.UTC {
+			t.Errorf("%v: got %#v", tt.in, res["at"])
+		}
+	}
+	if _, err := schema.Resource(Record{"a", "1", "not a time"}); err == nil {
+		t.Error("expected an error for an invalid stored datetime")
+	}
+
+	// Sorting is chronological, fractional seconds included
+	mem := NewMemStorage()
+	f := must(mem.Open("_schemas.csv")).T(t)
+	must(f.Write([]byte("e1,1,events,_id,text,,,\ne2,1,events,_v,number,1,,\ne3,1,events,at,datetime,,,\n"))).T(t)
+	must0(t, f.Close())
+	s := must(NewStore("", WithStorage(mem))).T(t)
+	defer s.Close()
+	for id, at := range map[string]string{"b": "2024-03-01T12:00:00Z", "a": "2024-03-01T12:00:00.5Z", "c": "2024-03-01T11:00:00-02:00", "d": ""} {
+		must0(t, s.Resources["events"].Create(Record{id, "1", at}))
+	}
+	ids := []string{}
+	for _, e := range must(s.List("events", "at")).T(t) {
+		ids = append(ids, e["_id"].(string))
+	}
+	if !slices.Equal(ids, []string{"d", "b", "a", "c"}) {
+		t.Errorf("got %v", ids)
+	}
+}
+
+func TestSchemaBool(t *testing.T) {
+	schema := Schema{{Field: "_id", Type: Text}, {Field: "_v", Type: Number}, {Field: "done", Type: Bool, Regex: "^$"}}
+	for _, tt := range []struct {
+		in   any
+		want string
+	}{
+		{true, "true"},
+		{false, "false"},
+		{nil, "false"},
+		{"true", "error"},
+		{1.0, "error"},
+	} {
+		rec, err := schema.Record(Resource{"_id": "a", "_v": 1.0, "done": tt.in})
+		if err != nil {
+			if tt.want != "error" {
+				t.Errorf("%v: %v", tt.in, err)
+			}
+			continue
+		}
+		if rec[2] != tt.want {
+			t.Errorf("%v: stored %q, want %q", tt.in, rec[2], tt.want)
+			continue
+		}
+		if res := must(schema.Resource(rec)).T(t); res["done"] != (tt.want == "true") {
+			t.Errorf("%v: got %#v", tt.in, res["done"])
+		}
+	}
+	if res := must(schema.Resource(Record{"a", "1", ""})).T(t); res["done"] != false {
+		t.Errorf("empty stored bool: got %#v", res["done"])
+	}
+	if _, err := schema.Resource(Record{"a", "1", "maybe"}); err == nil {
+		t.Error("expected an error for an invalid stored bool")
+	}
+	if rec := must(schema.Canonical(Record{"a", "1", " TRUE "})).T(t); rec[2] != "true" {
+		t.Errorf("canonical: got %q", rec)
+	}
+
+	// Filters parse the value, false sorts first
+	mem := NewMemStorage()
+	f := must(mem.Open("_schemas.csv")).T(t)
+	must(f.Write([]byte("t1,1,tasks,_id,text,,,\nt2,1,tasks,_v,number,1,,\nt3,1,tasks,done,bool,,,\n"))).T(t)
+	must0(t, f.Close())
+	s := must(NewStore("", WithStorage(mem))).T(t)
+	defer s.Close()
+	for id, done := range map[string]string{"a": "true", "b": "false", "c": ""} {
+		must0(t, s.Resources["tasks"].Create(Record{id, "1", done}))
+	}
+	ids := []string{}
+	for _, r := range must(s.List("tasks", "-done")).T(t) {
+		ids = append(ids, r["_id"].(string))
+	}
+	if ids[0] != "a" {
+		t.Errorf("sorted by -done: got %v", ids)
+	}
+	if res := must(s.ListWhere("tasks", "_id", map[string]string{"done": "false"})).T(t); len(res) != 2 || res[0]["_id"] != "b" || res[1]["_id"] != "c" {
+		t.Errorf("done=false: got %v", res)
+	}
+	if _, err := s.ListWhere("tasks", "", map[string]string{"done": "maybe"}); !errors.Is(err, ErrInvalidField) {
+		t.Errorf("done=maybe: got %v", err)
+	}
+}
@@ -0,0 +1,120 @@
+package pennybase
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// ReloadSchemas reads _schemas.csv again and applies the changes without
+// restarting: the databases of new resources are opened, those of removed
+// resources are closed, and changed fields are indexed again. The schemas are
+// swapped while no request is being served by a Server (except for event
+// streams), so that requests see either the old or the new schemas. Go code
+// using the store directly must not call it concurrently. As after a restart,
+// records written before fields were added are only readable if the store is
+// Lenient. If the schemas can't be read or a database can't be opened,
+// nothing changes.
+func (s *Store) ReloadSchemas() error {
+	done, err := s.enter()
+	if err != nil {
+		return err
+	}
+	defer done()
+	s.schemaMu.Lock()
+	defer s.schemaMu.Unlock()
+	if err := s.schemaDB.reopen(); err != nil {
+		return err
+	}
+	schemas, engines, err := readSchemas(s.schemaDB)
+	if err == nil {
+		err = checkTargets(schemas)
+	}
+	for resource := range schemas {
+		if _, ok := s.Resources[resource]; ok && err == nil && engines[resource] != s.engines[resource] {
+			err = fmt.Errorf("engine of %s can't change from %q to %q", resource, s.engines[resource], engines[resource])
+		}
+	}
+	opened := map[string]DB{}
+	for resource := range schemas {
+		if _, ok := s.Resources[resource]; ok || err != nil {
+			continue
+		}
+		var db DB
+		if db, err = s.open(resource, engines[resource]); err == nil {
+			opened[resource] = db
+		}
+	}
+	if err != nil {
+		for _, db := range opened {
+			db.Close()
+		}
+		return err
+	}
+
+	var errs []error
+	resources := map[string]DB{}
+	for resource, db := range s.Resources {
+		if _, ok := schemas[resource]; ok {
+			resources[resource] = db
+		} else {
+			errs = append(errs, db.Close())
+		}
+	}
+	for resource, db := range opened {
+		resources[resource] = db
+		if db, ok := db.(interface{ Seq() int64 }); ok {
+			s.changes.mu.Lock()
+			s.changes.resources[resource] = max(s.changes.resources[resource], db.Seq())
+			s.changes.mu.Unlock()
+		}
+	}
+	old := s.Schemas
+	s.Schemas, s.Resources, s.engines = schemas, resources, engines
+	for resource, schema := range schemas {
+		if slices.Equal(schema, old[resource]) {
+			continue
+		}
+		if db, ok := resources[resource].(*csvDB); ok {
+			db.mu.Lock()
+			db.columns = nil
+			db.mu.Unlock()
+		}
+		errs = append(errs, s.indexColumns(resource))
+		s.listCache.drop(resource)
+		s.refsMu.Lock()
+		for key := range s.refs {
+			if strings.HasPrefix(key, resource+".") {
+				delete(s.refs, key)
+			}
+		}
+		s.refsMu.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+// reopen opens the file again and scans it, to see the changes made by other
+// programs, even if they replaced the file. The database keeps its lock.
+func (db *csvDB) reopen() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	f, err := db.st.Open(db.name)
+	if err != nil {
+		return err
+	}
+	size, err := f.Size()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	old, oldSize := db.f, db.size
+	db.f, db.size = f, size
+	if err := db.reindex(); err != nil {
+		db.f, db.size = old, oldSize
+		f.Close()
+		return err
+	}
+	db.refs.retire(old)
+	return nil
+}
@@ -0,0 +1,157 @@
+package pennybase
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// File is a random-access readable, append-only writable file.
+type File interface {
+	io.ReaderAt
+	io.Writer // appends to the end of the file
+	Size() (int64, error)
+	Close() error
+}
+
+// Storage is a flat namespace of files, e.g. a local directory or an object store bucket.
+type Storage interface {
+	Open(name string) (File, error) // opens or creates a file
+	Rename(oldname, newname string) error
+	Remove(name string) error
+	List() ([]string, error)
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+// DirStorage keeps files in a local directory. It is the default storage.
+type DirStorage string
+
+type osFile struct{ *os.File }
+
+func (f osFile) Size() (int64, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+func (d DirStorage) Open(name string) (File, error) {
+	f, err := os.OpenFile(filepath.Join(string(d), name), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return osFile{f}, nil
+}
+
+func (d DirStorage) Rename(oldname, newname string) error {
+	return os.Rename(filepath.Join(string(d), oldname), filepath.Join(string(d), newname))
+}
+
+func (d DirStorage) Remove(name string) error { return os.Remove(filepath.Join(string(d), name)) }
+
+func (d DirStorage) List() ([]string, error) {
+	entries, err := os.ReadDir(string(d))
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, e := range entries {
+		if !e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+// MemStorage keeps files in memory. It is meant for tests and ephemeral demos.
+type MemStorage struct {
+	mu    sync.Mutex
+	files map[string]*memFile
+}
+
+type memFile struct {
+	mu   sync.RWMutex
+	data []byte
+}
+
+func NewMemStorage() *MemStorage { return &MemStorage{files: map[string]*memFile{}} }
+
+func (m *MemStorage) Open(name string) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if strings.ContainsAny(name, "/\\") {
+		return nil, os.ErrInvalid
+	}
+	if m.files[name] == nil {
+		m.files[name] = &memFile{}
+	}
+	return m.files[name], nil
+}
+
+func (m *MemStorage) Rename(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.files[oldname]
+	if !ok {
+		return os.ErrNotExist
+	}
+	delete(m.files, oldname)
+	m.files[newname] = f
+	return nil
+}
+
+func (m *MemStorage) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.files[name]; !ok {
+		return os.ErrNotExist
+	}
+	delete(m.files, name)
+	return nil
+}
+
+func (m *MemStorage) List() ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := []string{}
+	for name := range m.files {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if off >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.data = append(f.data, p...)
+	return len(p), nil
+}
+
+func (f *memFile) Size() (int64, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return int64(len(f.data)), nil
+}
+
+func (f *memFile) Close() error { return nil }
@@ -0,0 +1,94 @@
+package pennybase
+
+import (
+	"io"
+	"slices"
+	"testing"
+)
+
+func TestStorage(t *testing.T) {
+	for name, st := range map[string]Storage{
+		"dir": DirStorage(t.TempDir()),
+		"mem": NewMemStorage(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			f := must(st.Open("a.csv")).T(t)
+			must(f.Write([]byte("hello "))).T(t)
+			must(f.Write([]byte("world"))).T(t)
+			if size := must(f.Size()).T(t); size != 11 {
+				t.Errorf("got size %d, want 11", size)
+			}
+			if b := must(io.ReadAll(io.NewSectionReader(f, 6, 5))).T(t); string(b) != "world" {
+				t.Errorf("got %q, want %q", b, "world")
+			}
+			must0(t, f.Close())
+
+			must0(t, st.Rename("a.csv", "b.csv"))
+			if names := must(st.List()).T(t); !slices.Equal(names, []string{"b.csv"}) {
+				t.Errorf("got files %v after rename", names)
+			}
+			f = must(st.Open("b.csv")).T(t)
+			if size := must(f.Size()).T(t); size != 11 {
+				t.Errorf("got size %d after rename, want 11", size)
+			}
+			must0(t, f.Close())
+
+			must0(t, st.Remove("b.csv"))
+			if names := must(st.List()).T(t); len(names) != 0 {
+				t.Errorf("got files %v after remove", names)
+			}
+			if err := st.Remove("b.csv"); err == nil {
+				t.Error("expected error removing missing file")
+			}
+		})
+	}
+}
+
+func TestCSVDBMemStorage(t *testing.T) {
+	st := NewMemStorage()
+	db := must(OpenCSVDB(st, "test.csv")).T(t)
+	must0(t, db.Create(Record{"a", "1", "foo"}))
+	must0(t, db.Create(Record{"b", "1", "bar"}))
+	must0(t, db.Update(Record{"a", "2", "baz"}))
+	must0(t, db.Delete("b"))
+	must0(t, db.Close())
+
+	// Reopen and check that the index is rebuilt from the stored data
+	db = must(OpenCSVDB(st, "test.csv")).T(t)
+	defer db.Close()
+	if rec := must(db.Get("a")).T(t); !slices.Equal(rec, Record{"a", "2", "baz"}) {
+		t.Errorf("got %v after reopen", rec)
+	}
+	if _, err := db.Get("b"); err == nil {
+		t.Error("expected deleted record to stay deleted after reopen")
+	}
+	recs := []Record{}
+	for rec, err := range db.Iter() {
+		must0(t, err)
+		recs = append(recs, rec)
+	}
+	if len(recs) != 1 {
+		t.Errorf("got records %v, want one", recs)
+	}
+}
+
+func TestStoreMemStorage(t *testing.T) {
+	st := NewMemStorage()
+	f := must(st.Open("_schemas.csv")).T(t)
+	must(f.Write([]byte("s1,1,notes,_id,text,,,^.+$\ns2,1,notes,_v,number,1,,\ns3,1,notes,text,text,,,^.+$\n"))).T(t)
+
+	store := must(NewStore("", WithStorage(st))).T(t)
+	defer store.Close()
+	id := must(store.Create("notes", Resource{"text": "hello"})).T(t)
+	must0(t, store.Update("notes", Resource{"_id": id, "text": "bye"}))
+	if r := must(store.Get("notes", id)).T(t); r["text"] != "bye" || r["_v"] != 2.0 {
+		t.Errorf("got %v after update", r)
+	}
+	must0(t, store.Delete("notes", id))
+	if notes := must(store.List("notes", "")).T(t); len(notes) != 0 {
+		t.Errorf("got %v after delete", notes)
+	}
+	if names := must(st.List()).T(t); !slices.Equal(names, []string{"_schemas.csv", "notes.csv"}) {
+		t.Errorf("got files %v", names)
+	}
+}
@@ -1,8 +1,24 @@
 package pennybase
 
 import (
+	"cmp"
+	"context"
 	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestStoreCRUD(t *testing.T) {
@@ -170,3 +186,898 @@ func TestStoreCRUD(t *testing.T) {
 		})
 	}
 }
+
+func TestSortResources(t *testing.T) {
+	res := []Resource{
+		{"_id": "a", "title": "Solaris", "year": 1961.0},
+		{"_id": "b"},
+		{"_id": "c", "title": "Dune", "year": 1965.0},
+		{"_id": "d", "title": "Ubik", "year": 1969.0},
+	}
+	for _, tt := range []struct {
+		sortBy string
+		want   string
+	}{
+		{"", "abcd"},
+		{"title", "cadb"},
+		{"-title", "dacb"},
+		{"year", "acdb"},
+		{"-year", "dcab"},
+		{"-", "abcd"},
+	} {
+		sorted := slices.Clone(res)
+		sortResources(sorted, tt.sortBy)
+		got := ""
+		for _, r := range sorted {
+			got += r["_id"].(string)
+		}
+		if got != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.sortBy, got, tt.want)
+		}
+	}
+}
+
+func TestStoreListSince(t *testing.T) {
+	originalID := ID
+	defer func() { ID = originalID }()
+	for _, tt := range []struct {
+		name   string
+		opts   []StoreOption
+		reopen bool
+	}{
+		{"csv", nil, false},
+		{"index files", []StoreOption{WithIndexFiles(1)}, true},
+		{"mem", []StoreOption{WithMemDB()}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := testData(t, "testdata/basic")
+			store := must(NewStore(dir, tt.opts...)).T(t)
+			defer func() { store.Close() }()
+			for _, id := range []string{"a", "b", "c", "d"} {
+				ID = func() string { return id }
+				must(store.Create("books", Resource{"title": "Book " + id, "author": "Author", "isbn": "123-0123456789"})).T(t)
+			}
+			// Client has synced everything up to version 1.
+			must0(t, store.Update("books", Resource{"_id": "a", "title": "Book A2"}))
+			must0(t, store.Update("books", Resource{"_id": "c", "title": "Book C2"}))
+			must0(t, store.Delete("books", "d")) // deletion version 2
+			must0(t, store.Update("books", Resource{"_id": "b", "title": "Book B2"}))
+			must0(t, store.Update("books", Resource{"_id": "b", "title": "Book B3"}))
+			must0(t, store.Delete("books", "b")) // deletion version 4
+			if tt.reopen {
+				must0(t, store.Close())
+				store = must(NewStore(dir, tt.opts...)).T(t)
+			}
+
+			for _, tc := range []struct {
+				since float64
+				want  map[string]float64
+			}{
+				{1, map[string]float64{"a": 2, "c": 2, "b": 0, "d": 0}},
+				{2, map[string]float64{"b": 0}}, // d was deleted before
+				{4, map[string]float64{}},
+			} {
+				res := must(store.ListSince("books", tc.since)).T(t)
+				got := map[string]float64{}
+				for _, r := range res {
+					got[r["_id"].(string)] = r["_v"].(float64)
+					if r["_v"] == 0.0 && r["_deleted"] != true {
+						t.Errorf("since %v: expected tombstone for deleted record, got %v", tc.since, r)
+					}
+				}
+				if !maps.Equal(got, tc.want) {
+					t.Errorf("since %v: got changes %v, want %v", tc.since, got, tc.want)
+				}
+			}
+		})
+	}
+}
+
+func TestStoreNormalizedLookup(t *testing.T) {
+	dir := t.TempDir()
+	must0(t, os.WriteFile(filepath.Join(dir, "_schemas.csv"), []byte(
+		"s1,1,tags,_id,text,,,^[a-z-]+$,\"trim,lower\"\n"+
+			"s2,1,tags,_v,number,1,,\n"+
+			"s3,1,tags,label,text,,,,collapse\n"), 0644))
+	store := must(NewStore(dir)).T(t)
+	defer store.Close()
+
+	originalID := ID
+	defer func() { ID = originalID }()
+	ID = func() string { return " Go-Lang\t" }
+	id := must(store.Create("tags", Resource{"label": "  The  Go\nlanguage "})).T(t)
+	tag := must(store.Get("tags", id)).T(t)
+	if tag == nil || tag["_id"] != "go-lang" || tag["label"] != "The Go language" {
+		t.Fatalf("got %v", tag)
+	}
+	must0(t, store.Delete("tags", "GO-LANG "))
+	if tag, err := store.Get("tags", "go-lang"); err == nil {
+		t.Errorf("expected the tag to be deleted, got %v", tag)
+	}
+}
+
+func TestStoreSlugs(t *testing.T) {
+	dir := t.TempDir()
+	must0(t, os.WriteFile(filepath.Join(dir, "_schemas.csv"), []byte(
+		"s1,1,articles,_id,text,,,^.+$\n"+
+			"s2,1,articles,_v,number,1,,\n"+
+			"s3,1,articles,title,text,,,\n"+
+			"s4,1,articles,slug,text,,,^[a-z0-9-]+$,slug=title\n"), 0644))
+	store := must(NewStore(dir)).T(t)
+	defer store.Close()
+
+	var ids []string
+	for _, tt := range []struct{ title, slug, want string }{
+		{"My Title", "", "my-title"},
+		{"  my title!", "custom", "my-title-2"}, // clients can't set the slug
+		{"My Title", "", "my-title-3"},
+		{"Cr\u00e8me Bru\u0302le\u0301e", "", "creme-brulee"},
+	} {
+		id := must(store.Create("articles", Resource{"title": tt.title, "slug": tt.slug})).T(t)
+		if a := must(store.Get("articles", id)).T(t); a["slug"] != tt.want {
+			t.Errorf("%q: got slug %q, want %q", tt.title, a["slug"], tt.want)
+		}
+		ids = append(ids, id)
+	}
+	// Slugs don't change on update, and freed slugs are reused
+	must0(t, store.Update("articles", Resource{"_id": ids[0], "title": "Other", "slug": "other"}))
+	if a := must(store.Get("articles", ids[0])).T(t); a["slug"] != "my-title" {
+		t.Errorf("got slug %q after update", a["slug"])
+	}
+	must0(t, store.Delete("articles", ids[0]))
+	id := must(store.Create("articles", Resource{"title": "My title"})).T(t)
+	if a := must(store.Get("articles", id)).T(t); a["slug"] != "my-title" {
+		t.Errorf("got slug %q, want the freed my-title", a["slug"])
+	}
+}
+
+func TestStoreChangeSeq(t *testing.T) {
+	dir := testData(t, "testdata/graphql")
+	store := must(NewStore(dir)).T(t)
+	initial := store.ChangeSeq("books")
+	if initial != 4 {
+		t.Fatalf("got %d, want the counter to be derived from the 4 existing records", initial)
+	}
+	id := must(store.Create("books", Resource{"title": "Title", "author": "a1"})).T(t)
+	must0(t, store.Update("books", Resource{"_id": id, "title": "New Title", "author": "a1"}))
+	must0(t, store.Delete("books", id))
+	if err := store.Update("books", Resource{"_id": id, "_v": 1.0}); err == nil {
+		t.Fatal("expected a failed update")
+	}
+	if got := store.ChangeSeq("books"); got != initial+3 {
+		t.Errorf("got %d, want %d after three changes", got, initial+3)
+	}
+	must0(t, store.Close())
+
+	// The counter is derived from the file, so it is the same after a restart
+	store = must(NewStore(dir)).T(t)
+	defer store.Close()
+	if got := store.ChangeSeq("books"); got != initial+3 {
+		t.Errorf("got %d after restart, want %d", got, initial+3)
+	}
+}
+
+func TestStoreLenient(t *testing.T) {
+	const v1 = "s1,1,notes,_id,text,,,^.+$\ns2,1,notes,_v,number,1,,\ns3,1,notes,title,text,,,\n"
+	const v2 = v1 + "s4,1,notes,stars,number,,,\ns5,1,notes,tags,list,,,\n"
+	mem := NewMemStorage()
+	open := func(schemas string, lenient bool) *Store {
+		t.Helper()
+		_ = mem.Remove("_schemas.csv")
+		f := must(mem.Open("_schemas.csv")).T(t)
+		must(f.Write([]byte(schemas))).T(t)
+		must0(t, f.Close())
+		s := must(NewStore("", WithStorage(mem))).T(t)
+		s.Lenient = lenient
+		return s
+	}
+
+	// Roll forward: records written with v1 are short for v2
+	s := open(v1, false)
+	must0(t, s.insert(t.Context(), "notes", "n1", Resource{"title": "Old"}))
+	must0(t, s.Close())
+	s = open(v2, false)
+	if _, err := s.Get("notes", "n1"); err == nil {
+		t.Error("expected an error for a short record in strict mode")
+	}
+	must0(t, s.Close())
+	s = open(v2, true)
+	n := must(s.Get("notes", "n1")).T(t)
+	if n["title"] != "Old" || n["stars"] != 0.0 || len(n["tags"].([]string)) != 0 || n["_partial"] != true {
+		t.Errorf("got %v", n)
+	}
+	must0(t, s.Update("notes", Resource{"_id": "n1", "stars": 5.0, "tags": []string{"a", "b"}}))
+	if n := must(s.Get("notes", "n1")).T(t); n["_partial"] != nil || n["stars"] != 5.0 {
+		t.Errorf("got %v after update", n)
+	}
+	must0(t, s.Close())
+
+	// Roll back: records written with v2 are long for v1
+	s = open(v1, true)
+	n = must(s.Get("notes", "n1")).T(t)
+	if !slices.Equal(n["_extra"].([]string), []string{"5", "a,b"}) {
+		t.Errorf("got %v", n)
+	}
+	if list := must(s.List("notes", "")).T(t); len(list) != 1 || list[0]["_extra"] == nil {
+		t.Errorf("got %v", list)
+	}
+	must0(t, s.Update("notes", Resource{"_id": "n1", "title": "New"}))
+	must0(t, s.Close())
+
+	// ...and forward again, without losing the columns v1 didn't know
+	s = open(v2, false)
+	defer s.Close()
+	n = must(s.Get("notes", "n1")).T(t)
+	if n["title"] != "New" || n["stars"] != 5.0 || !slices.Equal(n["tags"].([]string), []string{"a", "b"}) || n["_v"] != 3.0 {
+		t.Errorf("got %v after rolling forward again", n)
+	}
+}
+
+func TestStoreTouch(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "rest"))
+	s := must(NewServer(dir, "", "")).T(t)
+	defer s.Close()
+	events := make(chan Event, 1)
+	s.Broker.Subscribe("books", events)
+	defer s.Broker.Unsubscribe("books", events)
+
+	orig := must(s.Store.Get("books", "book1")).T(t)
+	seq := s.Store.ChangeSeq("books")
+	must0(t, s.Store.Touch("books", "book1"))
+	must0(t, s.Touch("books", "book1"))
+	touched := must(s.Store.Get("books", "book1")).T(t)
+	if touched["_v"] != orig["_v"].(float64)+2 || s.Store.ChangeSeq("books") != seq+2 {
+		t.Errorf("got version %v, change seq %d", touched["_v"], s.Store.ChangeSeq("books"))
+	}
+	delete(orig, "_v")
+	delete(touched, "_v")
+	if !reflect.DeepEqual(orig, touched) {
+		t.Errorf("got %v, want %v", touched, orig)
+	}
+	select {
+	case evt := <-events:
+		if evt.Action != "updated" || evt.ID != "book1" || evt.Seq != seq+2 {
+			t.Errorf("got event %+v", evt)
+		}
+	case <-time.After(time.Second): // delivered asynchronously
+		t.Error("no event was published")
+	}
+	if err := s.Store.Touch("books", "missing"); err == nil {
+		t.Error("expected an error for a missing record")
+	}
+}
+
+func TestStoreCreateErrors(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "rest"))
+	// A permission left behind by a removed resource
+	f := must(os.OpenFile(filepath.Join(dir, "_permissions.csv"), os.O_APPEND|os.O_WRONLY, 0644)).T(t)
+	must(f.WriteString("p5,1,movies,create,,*\n")).T(t)
+	must0(t, f.Close())
+	s := must(NewServer(dir, "", "")).T(t)
+	defer s.Close()
+
+	_, missing := s.Store.Create("movies", Resource{"title": "Solaris"})
+	_, invalid := s.Store.Create("books", Resource{"title": "Solaris", "author": "Stanislaw Lem", "year": 3000.0})
+	if !errors.Is(missing, ErrResourceNotFound) || errors.Is(missing, ErrInvalidField) {
+		t.Errorf("missing resource: got %v", missing)
+	}
+	if !errors.Is(invalid, ErrInvalidField) || errors.Is(invalid, ErrResourceNotFound) {
+		t.Errorf("invalid body: got %v", invalid)
+	}
+
+	for _, tt := range []struct {
+		path, body string
+		wantStatus int
+	}{
+		{"/api/movies/", `{"title":"Solaris"}`, http.StatusNotFound},
+		{"/api/books/", `{"title":"Solaris","author":"Stanislaw Lem","year":3000}`, http.StatusUnprocessableEntity},
+		{"/api/books/", `{"title":"Solaris","author":"Stanislaw Lem","year":1961}`, http.StatusCreated},
+	} {
+		req := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body))
+		req.SetBasicAuth("admin", "admin123")
+		w := httptest.NewRecorder()
+		if s.ServeHTTP(w, req); w.Code != tt.wantStatus {
+			t.Errorf("%s %s: got status %d, want %d", tt.path, tt.body, w.Code, tt.wantStatus)
+		}
+	}
+}
+
+func TestStoreNotFoundErrors(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "rest"))
+	f := must(os.OpenFile(filepath.Join(dir, "_permissions.csv"), os.O_APPEND|os.O_WRONLY, 0644)).T(t)
+	must(f.WriteString("p5,1,books,update,,admin\n")).T(t)
+	must0(t, f.Close())
+	s := must(NewServer(dir, "", "")).T(t)
+	defer s.Close()
+
+	if _, err := s.Store.Get("books", "book9"); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("get: got %v", err)
+	}
+	if err := s.Store.Update("books", Resource{"_id": "book9", "title": "x"}); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("update: got %v", err)
+	}
+	if err := s.Store.Delete("books", "book9"); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("delete: got %v", err)
+	}
+	db := s.Store.Resources["books"]
+	rec := must(db.Get("book1")).T(t)
+	if err := db.Update(rec); !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("stale update: got %v", err)
+	}
+	if err := db.Update(Record{"book9", "2"}); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("update of a missing record: got %v", err)
+	}
+
+	for _, tt := range []struct {
+		method, body string
+		wantStatus   int
+	}{
+		{http.MethodGet, "", http.StatusNotFound},
+		{http.MethodPut, `{"title":"x"}`, http.StatusNotFound},
+		{http.MethodDelete, "", http.StatusNotFound},
+	} {
+		req := httptest.NewRequest(tt.method, "/api/books/book9", strings.NewReader(tt.body))
+		req.SetBasicAuth("admin", "admin123")
+		w := httptest.NewRecorder()
+		if s.ServeHTTP(w, req); w.Code != tt.wantStatus {
+			t.Errorf("%s: got status %d, want %d", tt.method, w.Code, tt.wantStatus)
+		}
+	}
+}
+
+func TestStoreCompact(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "rest"))
+	s := must(NewStore(dir)).T(t)
+	defer s.Close()
+	must0(t, s.Update("books", Resource{"_id": "book1", "title": "Go"}))
+	must0(t, s.Delete("books", "book2"))
+	want, seq := must(s.List("books", "")).T(t), s.ChangeSeq("books")
+	must0(t, s.Compact("books"))
+	if got := must(s.List("books", "")).T(t); !reflect.DeepEqual(got, want) || s.ChangeSeq("books") != seq {
+		t.Errorf("got %v, seq %d, want %v, seq %d", got, s.ChangeSeq("books"), want, seq)
+	}
+	if data := string(must(os.ReadFile(filepath.Join(dir, "books.csv"))).T(t)); strings.Contains(data, "book2") {
+		t.Errorf("deleted record kept: %s", data)
+	}
+	if err := s.Compact("movies"); !errors.Is(err, ErrResourceNotFound) {
+		t.Errorf("got %v for a missing resource", err)
+	}
+}
+
+func indexedStore(t testing.TB, options string) *Store {
+	t.Helper()
+	mem := NewMemStorage()
+	f := must(mem.Open("_schemas.csv")).T(t)
+	must(f.Write([]byte("m1,1,members,_id,text,,,^.+$\nm2,1,members,_v,number,1,,\nm3,1,members,username,text,,,," + options + "\nm4,1,members,team,text,,,\n"))).T(t)
+	must0(t, f.Close())
+	return must(NewStore("", WithStorage(mem))).T(t)
+}
+
+func TestStoreIndexedField(t *testing.T) {
+	s := indexedStore(t, `"index,lower"`)
+	for id, name := range map[string]string{"u1": "alice", "u2": "bob", "u3": "carol"} {
+		must0(t, s.insert(t.Context(), "members", id, Resource{"username": name, "team": "red"}))
+	}
+	must0(t, s.Update("members", Resource{"_id": "u1", "username": "Alicia"}))
+	must0(t, s.Update("members", Resource{"_id": "u2", "team": "blue"}))
+	must0(t, s.Delete("members", "u3"))
+
+	check := func(step string) {
+		t.Helper()
+		if _, ok := s.lookup("members", 2, "alice"); !ok {
+			t.Fatalf("%s: username is not indexed", step)
+		}
+		for name, want := range map[string]any{"alice": nil, "ALICIA": "u1", "bob": "u2", "carol": nil} {
+			m := must(s.GetBy("members", "username", name)).T(t)
+			if got := m["_id"]; (want == nil && m != nil) || (want != nil && got != want) {
+				t.Errorf("%s: %s is %v, want %v", step, name, m, want)
+			}
+		}
+	}
+	check("updated")
+	must0(t, s.Close())
+	s = must(NewStore("", WithStorage(s.Storage))).T(t)
+	defer s.Close()
+	check("reopened")
+
+	// Duplicates are reported as with a scan
+	must0(t, s.insert(t.Context(), "members", "u4", Resource{"username": "bob", "team": "red"}))
+	if _, err := s.GetBy("members", "username", "bob"); err == nil {
+		t.Error("expected an error for a duplicate value")
+	}
+	if _, err := s.GetBy("members", "team", "red"); err == nil {
+		t.Error("expected an error for a duplicate value in a scanned field")
+	}
+}
+
+func BenchmarkGetBy(b *testing.B) {
+	for _, options := range []string{"", "index"} {
+		for _, n := range []int{100, 10000} {
+			b.Run(fmt.Sprintf("%s/%d", cmp.Or(options, "scan"), n), func(b *testing.B) {
+				s := indexedStore(b, options)
+				defer s.Close()
+				for i := range n {
+					must0(b, s.insert(context.Background(), "members", strconv.Itoa(i), Resource{"username": "user" + strconv.Itoa(i)}))
+				}
+				b.ResetTimer()
+				for i := range b.N {
+					if _, err := s.GetBy("members", "username", "user"+strconv.Itoa(i%n)); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// mapDB is a minimal in-memory DB keeping only the latest versions.
+type mapDB struct {
+	mu      sync.Mutex
+	records map[string]Record
+}
+
+type mapBackend map[string]*mapDB
+
+func (b mapBackend) Open(resource string) (DB, error) {
+	db := &mapDB{records: map[string]Record{}}
+	b[resource] = db
+	return db, nil
+}
+
+func (db *mapDB) Create(r Record) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.records[r[0]]; ok || r[1] != "1" {
+		return errors.New("invalid record")
+	}
+	db.records[r[0]] = slices.Clone(r)
+	return nil
+}
+
+func (db *mapDB) Update(r Record) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	old, ok := db.records[r[0]]
+	if !ok {
+		return ErrRecordNotFound
+	}
+	if v, _ := strconv.Atoi(old[1]); r[1] != strconv.Itoa(v+1) {
+		return ErrVersionConflict
+	}
+	db.records[r[0]] = slices.Clone(r)
+	return nil
+}
+
+func (db *mapDB) Get(id string) (Record, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if r, ok := db.records[id]; ok {
+		return slices.Clone(r), nil
+	}
+	return nil, ErrRecordNotFound
+}
+
+func (db *mapDB) Delete(id string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.records[id]; !ok {
+		return ErrRecordNotFound
+	}
+	delete(db.records, id)
+	return nil
+}
+
+func (db *mapDB) Iter() func(yield func(Record, error) bool) {
+	return func(yield func(Record, error) bool) {
+		db.mu.Lock()
+		recs := slices.Collect(maps.Values(db.records))
+		db.mu.Unlock()
+		for _, r := range recs {
+			if !yield(r, nil) {
+				return
+			}
+		}
+	}
+}
+
+func (db *mapDB) Close() error { return nil }
+
+func TestStoreBackend(t *testing.T) {
+	mem := NewMemStorage()
+	f := must(mem.Open("_schemas.csv")).T(t)
+	must(f.Write([]byte("s1,1,todo,_id,text,,,^.+$\ns2,1,todo,_v,number,1,,\ns3,1,todo,title,text,,,^.+$\ns4,1,todo,done,number,0,1,\n"))).T(t)
+	must0(t, f.Close())
+	backend := mapBackend{}
+	s := must(NewStore("", WithStorage(mem), WithBackend(backend))).T(t)
+	defer s.Close()
+
+	id := must(s.Create("todo", Resource{"title": "Write tests"})).T(t)
+	must(s.Create("todo", Resource{"title": "Ship"})).T(t)
+	if _, err := s.Create("todo", Resource{"title": ""}); err == nil {
+		t.Error("expected a validation error")
+	}
+	must0(t, s.Update("todo", Resource{"_id": id, "done": 1.0}))
+	if todo := must(s.Get("todo", id)).T(t); todo["title"] != "Write tests" || todo["done"] != 1.0 || todo["_v"] != 2.0 {
+		t.Errorf("got %v", todo)
+	}
+	if list := must(s.List("todo", "title")).T(t); len(list) != 2 || list[0]["title"] != "Ship" {
+		t.Errorf("got %v", list)
+	}
+	must0(t, s.Delete("todo", id))
+	if _, err := s.Get("todo", id); err == nil {
+		t.Error("expected an error after delete")
+	}
+	// Nothing was written to CSV files
+	if len(backend["todo"].records) != 1 || slices.Contains(must(mem.List()).T(t), "todo.csv") {
+		t.Errorf("got records %v, files %v", backend["todo"].records, must(mem.List()).T(t))
+	}
+}
+
+func TestStoreBackendFunc(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "rest"))
+	csv, opened := CSVBackend{Storage: DirStorage(dir)}, []string{}
+	s := must(NewStore(dir, WithBackend(BackendFunc(func(resource string) (DB, error) {
+		opened = append(opened, resource)
+		if resource == "books" {
+			return NewMemDB(), nil
+		}
+		return csv.Open(resource)
+	})))).T(t)
+	defer s.Close()
+	if _, ok := s.Resources["books"].(*memDB); !ok || !slices.Contains(opened, "_users") {
+		t.Fatalf("got %T for books after opening %v", s.Resources["books"], opened)
+	}
+	if n := must(s.Count("books")).T(t); n != 0 {
+		t.Errorf("got %d books in memory", n)
+	}
+	if u := must(s.Get("_users", "admin")).T(t); u["_id"] != "admin" {
+		t.Errorf("got user %v from the CSV file", u)
+	}
+}
+
+// countingDB counts the iterations over the records of a DB.
+type countingDB struct {
+	DB
+	iters *atomic.Int32
+}
+
+func (db countingDB) Iter() func(yield func(Record, error) bool) {
+	db.iters.Add(1)
+	return db.DB.Iter()
+}
+
+func TestStoreListCache(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "rest"))
+	csv, iters := CSVBackend{Storage: DirStorage(dir)}, &atomic.Int32{}
+	s := must(NewStore(dir, WithListCache(), WithBackend(BackendFunc(func(resource string) (DB, error) {
+		db, err := csv.Open(resource)
+		return countingDB{db, iters}, err
+	})))).T(t)
+	defer s.Close()
+	list := func(sortBy string) []Resource {
+		t.Helper()
+		iters.Store(0)
+		return must(s.List("books", sortBy)).T(t)
+	}
+	first := list("-title")
+	if n := iters.Load(); n != 1 || len(first) != 2 {
+		t.Fatalf("got %d books with %d scans", len(first), n)
+	}
+	first[0]["title"] = "Changed by the caller"
+	if second := list("-title"); iters.Load() != 0 || second[0]["title"] == "Changed by the caller" {
+		t.Errorf("got %v with %d scans", second, iters.Load())
+	}
+	if where := must(s.ListWhere("books", "-title", map[string]string{"_id": "book1"})).T(t); len(where) != 1 || iters.Load() != 0 {
+		t.Errorf("got %v with %d scans", where, iters.Load())
+	}
+	if list(""); iters.Load() != 1 {
+		t.Errorf("got %d scans for another order", iters.Load())
+	}
+	list("nosuchfield")
+	if list("nosuchfield"); iters.Load() != 1 {
+		t.Errorf("got %d scans when sorting by an unknown field", iters.Load())
+	}
+	id := must(s.Create("books", Resource{"title": "Zzz", "author": "Someone", "year": 2020.0})).T(t)
+	if books := list("-title"); iters.Load() != 1 || len(books) != 3 || books[0]["_id"] != id {
+		t.Errorf("got %v with %d scans after a create", books, iters.Load())
+	}
+	must0(t, s.Delete("books", id))
+	if books := list("-title"); iters.Load() != 1 || len(books) != 2 {
+		t.Errorf("got %v with %d scans after a delete", books, iters.Load())
+	}
+}
+
+func TestStoreListFrom(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "rest"))
+	s := must(NewStore(dir)).T(t)
+	defer s.Close()
+	for i := range 5 {
+		must(s.Create("books", Resource{"title": fmt.Sprint("Book ", i), "author": "Me", "year": 2000.0})).T(t)
+	}
+	all := must(s.List("books", "")).T(t)
+	var got []Resource
+	cursor, pages := "", 0
+	for {
+		page, next, err := s.ListFrom("books", cursor, 3)
+		if must0(t, err); len(page) > 3 {
+			t.Fatalf("got %d records", len(page))
+		}
+		got, cursor, pages = append(got, page...), next, pages+1
+		if cursor == "" {
+			break
+		}
+	}
+	if pages != 3 || !reflect.DeepEqual(got, all) {
+		t.Errorf("got %d pages: %v, want %v", pages, got, all)
+	}
+	if page, next, err := s.ListFrom("books", "", 0); err != nil || len(page) != 7 || next != "" {
+		t.Errorf("got %d records and cursor %q without a limit", len(page), next)
+	}
+
+	// Compaction expires cursors
+	_, cursor, _ = s.ListFrom("books", "", 2)
+	must0(t, s.Update("books", Resource{"_id": "book1", "year": 2016.0}))
+	must0(t, s.Compact("books"))
+	for _, c := range []string{cursor, "nonsense", "0.-1"} {
+		if _, _, err := s.ListFrom("books", c, 2); !errors.Is(err, &Error{Code: "invalid_cursor"}) {
+			t.Errorf("%q: got %v", c, err)
+		}
+	}
+}
+
+func TestStoreUnique(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		opts []StoreOption
+	}{
+		{"indexed", nil},
+		{"scanned", []StoreOption{WithMemDB()}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mem := NewMemStorage()
+			f := must(mem.Open("_schemas.csv")).T(t)
+			must(f.Write([]byte("s1,1,members,_id,text,,,^.+$\ns2,1,members,_v,number,1,,\ns3,1,members,email,text,,,,\"trim,lower,unique\"\ns4,1,members,name,text,,,\n"))).T(t)
+			must0(t, f.Close())
+			s := must(NewStore("", append(tt.opts, WithStorage(mem))...)).T(t)
+			defer s.Close()
+			alice := must(s.Create("members", Resource{"email": "alice@example.com"})).T(t)
+			bob := must(s.Create("members", Resource{"email": "bob@example.com"})).T(t)
+			must(s.Create("members", Resource{"name": "no email"})).T(t)
+			must(s.Create("members", Resource{"name": "no email either"})).T(t)
+			for _, err := range []error{
+				must(s.Create("members", Resource{"email": " Alice@Example.com"})).Err,
+				s.Update("members", Resource{"_id": bob, "email": "alice@example.com"}),
+				must(s.CreateBatch("members", []Resource{{"email": "carol@example.com"}, {"email": "carol@example.com"}})).Err,
+				s.Batch(Write{Resource: "members", Action: "create", Data: Resource{"_id": "m1", "email": "bob@example.com"}}),
+			} {
+				if !errors.Is(err, ErrDuplicate) {
+					t.Errorf("got %v", err)
+				}
+			}
+			// Keeping its own value is fine, and deleting a record frees it
+			must0(t, s.Update("members", Resource{"_id": alice, "name": "Alice"}))
+			must0(t, s.Delete("members", alice))
+			must0(t, s.Update("members", Resource{"_id": bob, "email": "alice@example.com"}))
+			must(s.Create("members", Resource{"email": "bob@example.com"})).T(t)
+			if n := must(s.Count("members")).T(t); n != 4 {
+				t.Errorf("got %d members", n)
+			}
+		})
+	}
+}
+
+func TestStoreReloadSchemas(t *testing.T) {
+	mem := NewMemStorage()
+	appendSchemas := func(rows string) {
+		t.Helper()
+		f := must(mem.Open("_schemas.csv")).T(t)
+		must(f.Write([]byte(rows))).T(t)
+		must0(t, f.Close())
+	}
+	appendSchemas("s1,1,notes,_id,text,,,^.+$\ns2,1,notes,_v,number,1,,\ns3,1,notes,body,text,,,\n")
+	s := must(NewStore("", WithStorage(mem))).T(t)
+	defer s.Close()
+	id := must(s.Create("notes", Resource{"body": "hello"})).T(t)
+
+	// New resources and fields, older records are padded
+	s.Lenient = true
+	appendSchemas("s4,1,tags,_id,text,,,^.+$\ns5,1,tags,_v,number,1,,\ns6,1,tags,name,text,,,,index\ns7,1,notes,tag,ref,,,tags\n")
+	must0(t, s.ReloadSchemas())
+	tag := must(s.Create("tags", Resource{"name": "go"})).T(t)
+	if r := must(s.GetBy("tags", "name", "go")).T(t); r["_id"] != tag {
+		t.Errorf("got %v", r)
+	}
+	if _, ok := s.Resources["tags"].(*csvDB).lookup(2, "go"); !ok {
+		t.Error("expected the new field to be indexed")
+	}
+	must0(t, s.Update("notes", Resource{"_id": id, "tag": tag}))
+	if r := must(s.Get("notes", id)).T(t); r["body"] != "hello" || r["tag"] != tag {
+		t.Errorf("got %v", r)
+	}
+	if _, err := s.Create("notes", Resource{"body": "x", "tag": "nosuchtag"}); !errors.Is(err, ErrReferenceNotFound) {
+		t.Errorf("got %v for a missing tag", err)
+	}
+
+	// Invalid schemas change nothing
+	for _, rows := range []string{
+		"s8,1,notes,tag,text,,,\n",
+		"s8,1,notes,author,ref,,,authors\n",
+		"s8,1,notes,_id,text,,,,,jsonl\n",
+	} {
+		before := must(mem.Open("_schemas.csv")).T(t)
+		size := must(before.Size()).T(t)
+		must0(t, before.Close())
+		appendSchemas(rows)
+		if err := s.ReloadSchemas(); err == nil {
+			t.Errorf("%q: expected an error", rows)
+		}
+		if len(s.Schemas["notes"]) != 4 || len(s.Resources) != 2 {
+			t.Errorf("%q: got schemas %v", rows, s.Schemas)
+		}
+		data := make([]byte, size)
+		f := must(mem.Open("_schemas.csv")).T(t)
+		must(f.ReadAt(data, 0)).T(t)
+		must0(t, f.Close())
+		must0(t, mem.Remove("_schemas.csv"))
+		appendSchemas(string(data))
+	}
+
+	// Removed resources are closed
+	data := make([]byte, 1024)
+	f := must(mem.Open("_schemas.csv")).T(t)
+	n, _ := f.ReadAt(data, 0)
+	must0(t, f.Close())
+	must0(t, mem.Remove("_schemas.csv"))
+	var kept []string
+	for _, row := range strings.SplitAfter(string(data[:n]), "\n") {
+		if !strings.Contains(row, ",tags,") && !strings.Contains(row, ",tag,") {
+			kept = append(kept, row)
+		}
+	}
+	appendSchemas(strings.Join(kept, ""))
+	must0(t, s.ReloadSchemas())
+	if _, ok := s.Resources["tags"]; ok || len(s.Schemas["notes"]) != 3 {
+		t.Errorf("got schemas %v", s.Schemas)
+	}
+	if r := must(s.Get("notes", id)).T(t); r["body"] != "hello" {
+		t.Errorf("got %v", r)
+	}
+}
+
+func TestStoreJSONLEngine(t *testing.T) {
+	mem := NewMemStorage()
+	f := must(mem.Open("_schemas.csv")).T(t)
+	must(f.Write([]byte("s1,1,notes,_id,text,,,^.+$,,jsonl\ns2,1,notes,_v,number,1,,\ns3,1,notes,body,text,,,\n"))).T(t)
+	must0(t, f.Close())
+	s := must(NewStore("", WithStorage(mem))).T(t)
+	id := must(s.Create("notes", Resource{"body": "two\nlines, \"quoted\""})).T(t)
+	must0(t, s.Close())
+
+	f = must(mem.Open("notes.jsonl")).T(t)
+	data := make([]byte, must(f.Size()).T(t))
+	must(f.ReadAt(data, 0)).T(t)
+	must0(t, f.Close())
+	if want := `["` + id + `","1","two\nlines, \"quoted\""]` + "\n"; string(data) != want {
+		t.Errorf("got %q, want %q", data, want)
+	}
+	if slices.Contains(must(mem.List()).T(t), "notes.csv") {
+		t.Error("got a CSV file")
+	}
+	s = must(NewStore("", WithStorage(mem))).T(t)
+	if note := must(s.Get("notes", id)).T(t); note["body"] != "two\nlines, \"quoted\"" {
+		t.Errorf("got %v after reopening", note)
+	}
+	must0(t, s.Close())
+
+	f = must(mem.Open("_schemas.csv")).T(t)
+	must(f.Write([]byte("s4,1,notes,title,text,,,,,csv\n"))).T(t)
+	must0(t, f.Close())
+	if _, err := NewStore("", WithStorage(mem)); err == nil {
+		t.Error("expected an error for conflicting engines")
+	}
+}
+
+func TestStoreRepairVersions(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "rest"))
+	f := must(os.OpenFile(filepath.Join(dir, "books.csv"), os.O_APPEND|os.O_WRONLY, 0644)).T(t)
+	// book1 gets a version that isn't an integer, book2 goes back to 2 after 3
+	must(f.WriteString("\nbook1,2.0,The Go Programming Language,Brian Kernighan,2016,\n" +
+		"book2,3,1984,George Orwell,1949,\nbook2,2,1984,George Orwell,1950,\n")).T(t)
+	must0(t, f.Close())
+	s := must(NewStore(dir)).T(t)
+	defer s.Close()
+
+	if err := s.Update("books", Resource{"_id": "book1", "_v": 2.0, "year": 2017.0}); err == nil {
+		t.Fatal("expected the update of book1 to fail")
+	}
+	must0(t, s.RepairVersions("books"))
+	for _, tt := range []struct {
+		id      string
+		v, year float64
+	}{
+		{"book1", 3, 2016},
+		{"book2", 4, 1950},
+	} {
+		r := must(s.Get("books", tt.id)).T(t)
+		if r["_v"] != tt.v || r["year"] != tt.year {
+			t.Errorf("%s: got %v", tt.id, r)
+		}
+		must0(t, s.Update("books", Resource{"_id": tt.id, "_v": tt.v, "year": 2020.0}))
+		if r := must(s.Get("books", tt.id)).T(t); r["_v"] != tt.v+1 {
+			t.Errorf("%s: got %v after the update", tt.id, r)
+		}
+	}
+
+	// Nothing is left to repair
+	seq := s.ChangeSeq("books")
+	must0(t, s.RepairVersions("books"))
+	if got := s.ChangeSeq("books"); got != seq {
+		t.Errorf("got seq %d, want %d", got, seq)
+	}
+	if err := s.RepairVersions("nope"); !errors.Is(err, ErrResourceNotFound) {
+		t.Errorf("got %v", err)
+	}
+}
+
+// blockingWriter blocks the first write until unblock is closed.
+type blockingWriter struct {
+	started, unblock chan struct{}
+	once             sync.Once
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	w.once.Do(func() {
+		close(w.started)
+		<-w.unblock
+	})
+	return len(p), nil
+}
+
+func TestStoreClose(t *testing.T) {
+	s := must(NewServer(testData(t, filepath.Join("testdata", "rest")), "", "")).T(t)
+	w := &blockingWriter{started: make(chan struct{}), unblock: make(chan struct{})}
+	streamed := make(chan error)
+	go func() { streamed <- s.Store.Stream("books", w) }()
+	<-w.started
+
+	closed := make(chan error)
+	go func() { closed <- s.Store.Close() }()
+	select {
+	case <-closed:
+		t.Fatal("Close did not wait for the stream")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, err := s.Store.Get("books", "book1"); !errors.Is(err, ErrClosed) {
+		t.Errorf("Get while closing: got %v, want ErrClosed", err)
+	}
+	close(w.unblock)
+	must0(t, <-streamed)
+	must0(t, <-closed)
+
+	if _, err := s.Store.List("books", ""); !errors.Is(err, ErrClosed) {
+		t.Errorf("List after Close: got %v, want ErrClosed", err)
+	}
+	if _, err := s.Store.Create("books", Resource{"title": "Dune"}); !errors.Is(err, ErrClosed) {
+		t.Errorf("Create after Close: got %v, want ErrClosed", err)
+	}
+	for name, call := range map[string]func() error{
+		"ExportCSV":     func() error { return s.Store.ExportCSV("books", io.Discard) },
+		"ImportCSV":     func() error { return s.Store.ImportCSV("books", strings.NewReader("_id,_v\n")) },
+		"Export":        func() error { return s.Store.Export("books", io.Discard) },
+		"Import":        func() error { return s.Store.Import("books", strings.NewReader(`{"title":"Dune"}`), false) },
+		"AddPermission": func() error { return s.Store.AddPermission("books", "read", "", "") },
+		"Apply":         func() error { return s.Store.Apply("books", Record{"book1", "9"}) },
+		"ReloadSchemas": s.Store.ReloadSchemas,
+	} {
+		if err := call(); !errors.Is(err, ErrClosed) {
+			t.Errorf("%s after Close: got %v, want ErrClosed", name, err)
+		}
+	}
+	for _, path := range []string{"/api/books/", "/api/books/book1"} {
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, path, nil))
+		if resp.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s: got status %d, want 503", path, resp.Code)
+		}
+	}
+}
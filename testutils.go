@@ -10,7 +10,7 @@ type mustResult[T any] struct {
 	Err error
 }
 
-func (m mustResult[T]) T(t *testing.T) T {
+func (m mustResult[T]) T(t testing.TB) T {
 	t.Helper()
 	must0(t, m.Err)
 	return m.Val
@@ -18,7 +18,7 @@ func (m mustResult[T]) T(t *testing.T) T {
 
 func must[T any](v T, err error) mustResult[T] { return mustResult[T]{v, err} }
 
-func must0(t *testing.T, err error) {
+func must0(t testing.TB, err error) {
 	t.Helper()
 	if err != nil {
 		t.Fatalf("Expected no error, got: %v", err)
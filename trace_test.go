@@ -0,0 +1,123 @@
+package pennybase
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+)
+
+type span struct {
+	Name   string
+	Parent int // index of the parent span, -1 for roots
+	Attrs  []Attr
+	Ended  bool
+	Err    error
+}
+
+type spanKey struct{}
+
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []span
+}
+
+func (t *recordingTracer) StartSpan(ctx context.Context, name string, attrs ...Attr) (context.Context, func(error)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	parent, ok := ctx.Value(spanKey{}).(int)
+	if !ok {
+		parent = -1
+	}
+	i := len(t.spans)
+	t.spans = append(t.spans, span{Name: name, Parent: parent, Attrs: attrs})
+	return context.WithValue(ctx, spanKey{}, i), func(err error) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.spans[i].Ended, t.spans[i].Err = true, err
+	}
+}
+
+// path returns the names of the span and all its ancestors, innermost first.
+func (t *recordingTracer) path(i int) []string {
+	names := []string{}
+	for ; i >= 0; i = t.spans[i].Parent {
+		names = append(names, t.spans[i].Name)
+	}
+	return names
+}
+
+// find returns the index of the last span with the given name.
+func (t *recordingTracer) find(name string) int {
+	for i := len(t.spans) - 1; i >= 0; i-- {
+		if t.spans[i].Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestTracerCRUD(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "rest"))
+	f := must(os.OpenFile(filepath.Join(dir, "_permissions.csv"), os.O_APPEND|os.O_WRONLY, 0)).T(t)
+	must(f.WriteString("p9,1,books,*,,admin\n")).T(t)
+	must0(t, f.Close())
+	s := must(NewServer(dir, "", "")).T(t)
+	defer s.Store.Close()
+
+	originalID := ID
+	defer func() { ID = originalID }()
+	ID = func() string { return "traced" }
+
+	steps := []struct {
+		method, path, body, pattern, op string
+	}{
+		{http.MethodPost, "/api/books/", `{"title":"Traced","author":"Tracer","year":2020}`, "POST /api/{resource}/", "create"},
+		{http.MethodGet, "/api/books/traced", "", "GET /api/{resource}/{id}", "get"},
+		{http.MethodPut, "/api/books/traced", `{"title":"Traced again"}`, "PUT /api/{resource}/{id}", "update"},
+		{http.MethodDelete, "/api/books/traced", "", "DELETE /api/{resource}/{id}", "delete"},
+	}
+	for _, step := range steps {
+		tr := &recordingTracer{}
+		s.Store.Tracer = tr
+		req := httptest.NewRequest(step.method, step.path, bytes.NewBufferString(step.body))
+		req.SetBasicAuth("admin", "admin123")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		if w.Code >= 300 {
+			t.Fatalf("%s %s: status %d: %s", step.method, step.path, w.Code, w.Body)
+		}
+
+		root := "http " + step.pattern
+		if i := tr.find(root); i < 0 || tr.spans[i].Parent != -1 {
+			t.Fatalf("%s: missing root span %q", step.op, root)
+		}
+		want := []string{"db." + step.op, "store." + step.op, root}
+		if got := tr.path(tr.find("db." + step.op)); !slices.Equal(got, want) {
+			t.Errorf("%s: got span path %v, want %v", step.op, got, want)
+		}
+		for _, name := range []string{"authenticate", "authorize"} {
+			if got := tr.path(tr.find(name)); !slices.Equal(got, []string{name, root}) {
+				t.Errorf("%s: got span path %v for %s", step.op, got, name)
+			}
+		}
+		if step.op != "get" {
+			if got := tr.path(tr.find("hook")); !slices.Equal(got, []string{"hook", root}) {
+				t.Errorf("%s: got span path %v for hook", step.op, got)
+			}
+		}
+		if attrs := tr.spans[tr.find("db."+step.op)].Attrs; !slices.Contains(attrs, Attr{"resource", "books"}) {
+			t.Errorf("%s: got db span attributes %v", step.op, attrs)
+		}
+		for _, sp := range tr.spans {
+			if !sp.Ended {
+				t.Errorf("%s: span %q was not ended", step.op, sp.Name)
+			}
+		}
+	}
+}
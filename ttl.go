@@ -0,0 +1,150 @@
+package pennybase
+
+import (
+	"context"
+	"errors"
+	"log"
+	"maps"
+	"slices"
+	"time"
+)
+
+// expiresAt returns when a record expires: the earliest time in one of its
+// fields with the "ttl" option, plus the TTL. Records with a zero or empty
+// time never expire.
+func expiresAt(schema Schema, r Resource) (time.Time, bool) {
+	var at time.Time
+	for _, f := range schema {
+		if !f.Expires || r[f.Field] == 0.0 {
+			continue
+		}
+		t, _ := parseDateTime(r[f.Field])
+		if t.IsZero() {
+			continue
+		}
+		if t = t.Add(f.TTL); at.IsZero() || t.Before(at) {
+			at = t
+		}
+	}
+	return at, !at.IsZero()
+}
+
+// expiring reports whether the records of a resource can expire.
+func expiring(schema Schema) bool {
+	return slices.ContainsFunc(schema, func(f FieldSchema) bool { return f.Expires })
+}
+
+// expired reports whether a record of the resource has expired at now.
+// Expired records are hidden from reads until the sweeper deletes them.
+func (s *Store) expired(resource string, r Resource, now time.Time) bool {
+	at, ok := expiresAt(s.Schemas[resource], r)
+	return ok && !at.After(now)
+}
+
+// unexpired returns the records of a list that haven't expired, leaving the
+// list as it is, since it may be cached.
+func (s *Store) unexpired(resource string, res []Resource) []Resource {
+	if !expiring(s.Schemas[resource]) {
+		return res
+	}
+	now := time.Now()
+	return slices.DeleteFunc(slices.Clone(res), func(r Resource) bool { return s.expired(resource, r, now) })
+}
+
+// stored reads a record without hiding it if it has expired.
+func (s *Store) stored(resource, id string) (Resource, error) {
+	rec, err := s.Resources[resource].Get(id)
+	if err != nil {
+		return nil, err
+	}
+	return s.resource(resource, rec)
+}
+
+// sweep deletes the records expired at now and passes them to expired. Each
+// record is read again right before it is deleted, so that records updated in
+// the meantime are kept if they no longer expire. Expired records are hidden
+// from Get and List, so they are read from the database directly.
+func (s *Store) sweep(ctx context.Context, now time.Time, expired func(resource string, r Resource)) (err error) {
+	ctx, end := s.span(ctx, "store.sweep")
+	defer func() { end(err) }()
+	done, err := s.enter()
+	if err != nil {
+		return err
+	}
+	defer done()
+	var errs []error
+	for resource, schema := range s.Schemas {
+		if !expiring(schema) {
+			continue
+		}
+		var ids []string
+		for rec, err := range s.Resources[resource].Iter() {
+			if err != nil {
+				errs = append(errs, err)
+				break
+			}
+			r, err := s.resource(resource, rec)
+			if err != nil {
+				errs = append(errs, err)
+				break
+			}
+			if s.expired(resource, r, now) {
+				ids = append(ids, rec[0])
+			}
+		}
+		for _, id := range ids {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			r, err := s.stored(resource, id)
+			if err != nil || !s.expired(resource, r, now) {
+				continue // deleted or updated meanwhile
+			}
+			if _, err := s.delete(ctx, resource, id); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			if expired != nil {
+				expired(resource, r)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// StartSweeper deletes expired records (see the "ttl" field option) every
+// interval in the background until the store is closed, and passes every
+// deleted record to expired, which may be nil. It does nothing if no field has
+// a TTL or if the interval is not positive. Errors are logged.
+func (s *Store) StartSweeper(interval time.Duration, expired func(resource string, r Resource)) {
+	if interval <= 0 || s.stopSweep != nil {
+		return
+	}
+	if !slices.ContainsFunc(slices.Collect(maps.Values(s.Schemas)), expiring) {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	s.stopSweep = func() {
+		cancel()
+		<-done
+	}
+	go func() {
+		defer close(done)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-t.C:
+				s.schemaMu.RLock()
+				err := s.sweep(ctx, now, expired)
+				s.schemaMu.RUnlock()
+				if err != nil && ctx.Err() == nil {
+					log.Println("sweeper:", err)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,138 @@
+package pennybase
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestExpiresAt(t *testing.T) {
+	schema := Schema{{Field: "created", Type: DateTime, Expires: true, TTL: time.Hour}, {Field: "until", Type: Number, Expires: true}}
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		r    Resource
+		want time.Time
+	}{
+		{Resource{"created": now, "until": 0.0}, now.Add(time.Hour)},
+		{Resource{"created": now, "until": float64(now.Unix())}, now},
+		{Resource{"created": time.Time{}, "until": float64(now.Unix() + 60)}, now.Add(time.Minute)},
+		{Resource{"created": time.Time{}, "until": 0.0}, time.Time{}},
+	} {
+		if at, ok := expiresAt(schema, tt.r); !at.Equal(tt.want) || ok == tt.want.IsZero() {
+			t.Errorf("%v: got %v, %v, want %v", tt.r, at, ok, tt.want)
+		}
+	}
+}
+
+func TestSweeper(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "rest"))
+	f := must(os.OpenFile(filepath.Join(dir, "_schemas.csv"), os.O_APPEND|os.O_WRONLY, 0644)).T(t)
+	must(f.WriteString("t1,1,tokens,_id,text,,,^.+$\nt2,1,tokens,_v,number,1,,\nt3,1,tokens,created,datetime,,,,ttl=50ms\n")).T(t)
+	must0(t, f.Close())
+	cfg := DefaultConfig()
+	cfg.SweepInterval = 10 * time.Millisecond
+	s := must(NewServerWithConfig(cfg, dir, "", "")).T(t)
+	defer s.Close()
+	events := make(chan Event, 10)
+	s.Broker.Subscribe("tokens", events)
+
+	short := must(s.Store.Create("tokens", Resource{"created": time.Now()})).T(t)
+	kept := must(s.Store.Create("tokens", Resource{"created": time.Now().Add(time.Hour)})).T(t)
+	never := must(s.Store.Create("tokens", Resource{})).T(t)
+	select {
+	case evt := <-events:
+		if evt.Action != "deleted" || evt.ID != short {
+			t.Errorf("got event %+v", evt)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the record did not expire")
+	}
+	if _, err := s.Store.Get("tokens", short); err == nil {
+		t.Error("expired record not deleted")
+	}
+	for _, id := range []string{kept, never} {
+		must(s.Store.Get("tokens", id)).T(t)
+	}
+
+	// Closing stops the sweeper
+	must0(t, s.Close())
+	select {
+	case evt := <-events:
+		t.Errorf("got event %+v after closing", evt)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestStoreExpires(t *testing.T) {
+	dir := testData(t, filepath.Join("testdata", "rest"))
+	f := must(os.OpenFile(filepath.Join(dir, "_schemas.csv"), os.O_APPEND|os.O_WRONLY, 0644)).T(t)
+	must(f.WriteString("i1,1,invites,_id,text,,,^.+$\ni2,1,invites,_v,number,1,,\ni3,1,invites,email,text,,,,index\ni4,1,invites,_expires,number,,,\n")).T(t)
+	must0(t, f.Close())
+	cfg := DefaultConfig()
+	cfg.SweepInterval = 0
+	s := must(NewServerWithConfig(cfg, dir, "", "")).T(t)
+	defer s.Close()
+	now := time.Now()
+	past := must(s.Store.Create("invites", Resource{"email": "old@example.com", "_expires": float64(now.Add(-time.Minute).Unix())})).T(t)
+	soon := must(s.Store.Create("invites", Resource{"email": "soon@example.com", "_expires": float64(now.Add(time.Hour).Unix())})).T(t)
+	never := must(s.Store.Create("invites", Resource{"email": "never@example.com"})).T(t)
+
+	// Expired records are hidden before they are deleted
+	if _, err := s.Store.Get("invites", past); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("got %v for an expired record", err)
+	}
+	if r := must(s.Store.GetBy("invites", "email", "old@example.com")).T(t); r != nil {
+		t.Errorf("got %v by email", r)
+	}
+	page, _, err := s.Store.ListFrom("invites", "", 0)
+	must0(t, err)
+	slices.Reverse(page) // never was created last
+	for name, list := range map[string][]Resource{
+		"List":     must(s.Store.List("invites", "email")).T(t),
+		"ListFrom": page,
+	} {
+		if len(list) != 2 || list[0]["_id"] != never || list[1]["_id"] != soon {
+			t.Errorf("%s: got %v", name, list)
+		}
+	}
+	if n := must(s.Store.Count("invites")).T(t); n != 2 {
+		t.Errorf("got count %d", n)
+	}
+	if ok := must(s.Store.Exists("invites", past)).T(t); ok {
+		t.Error("expired record exists")
+	}
+	var buf bytes.Buffer
+	tmpl := template.Must(template.New("t").Parse(`{{range .Store.List "invites" "email"}}{{.email}} {{end}}`))
+	must0(t, tmpl.Execute(&buf, s.templateData(httptest.NewRequest(http.MethodGet, "/", nil), nil)))
+	if buf.String() != "never@example.com soon@example.com " {
+		t.Errorf("got %q from the template", buf.String())
+	}
+
+	// Updates push the expiry forward
+	later := float64(now.Add(3 * time.Hour).Unix())
+	must0(t, s.Store.Update("invites", Resource{"_id": soon, "_expires": later}))
+	if r := must(s.Store.Get("invites", soon)).T(t); r["_expires"] != later {
+		t.Errorf("got %v", r)
+	}
+
+	// The sweeper deletes them for good
+	var swept []string
+	must0(t, s.Store.sweep(context.Background(), now.Add(2*time.Hour), func(resource string, r Resource) {
+		swept = append(swept, r["_id"].(string))
+	}))
+	if len(swept) != 1 || swept[0] != past {
+		t.Errorf("got %v swept", swept)
+	}
+	if _, err := s.Store.Resources["invites"].Get(past); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("got %v, want the record deleted", err)
+	}
+	must(s.Store.Get("invites", soon)).T(t)
+}